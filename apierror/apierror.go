@@ -0,0 +1,199 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gotwarden/logging"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+var logger = logging.For("apierror")
+
+// RegisterValidator keys the validation errors of gin's validator by the names of the Bitwarden models
+// (masterPasswordHash -> MasterPasswordHash)
+func RegisterValidator() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(fieldName)
+	}
+}
+
+func fieldName(f reflect.StructField) string {
+	name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Error is an error sent back to the clients with its HTTP status
+type Error struct {
+	Status int
+	// Message is the error displayed by the clients
+	Message string
+	// ValidationErrors are the messages by field of the request
+	ValidationErrors map[string][]string
+	// OAuth is the OAuth error code of the identity endpoints (invalid_grant...)
+	OAuth string
+	// Extra fields of the identity response (ie the two factor providers)
+	Extra map[string]interface{}
+	// Err is the cause (logged, never sent to the clients)
+	Err error
+}
+
+// Model is the ErrorModel of Bitwarden
+type Model struct {
+	Message               string
+	ValidationErrors      map[string][]string
+	ExceptionMessage      *string
+	ExceptionStackTrace   *string
+	InnerExceptionMessage *string
+	Object                string
+}
+
+// invalidModel is the message of Bitwarden for the validation errors
+const invalidModel = "The model state is invalid."
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Model provides the body sent back by the API endpoints
+func (e *Error) Model() Model {
+	return Model{
+		Message:          e.Message,
+		ValidationErrors: e.ValidationErrors,
+		Object:           "error",
+	}
+}
+
+// Validation is an invalid field of the request (400)
+func Validation(field, msg string) *Error {
+	return &Error{
+		Status:           http.StatusBadRequest,
+		Message:          msg,
+		ValidationErrors: map[string][]string{field: {msg}},
+	}
+}
+
+// BadRequest is an invalid request (400)
+func BadRequest(msg string) *Error {
+	return &Error{Status: http.StatusBadRequest, Message: msg}
+}
+
+// Unauthorized asks for an authentication (401)
+func Unauthorized(msg string) *Error {
+	return &Error{Status: http.StatusUnauthorized, Message: msg}
+}
+
+// Forbidden is an action not allowed to the user on a resource he can see (403)
+func Forbidden(msg string) *Error {
+	return &Error{Status: http.StatusForbidden, Message: msg}
+}
+
+// NotFound is a resource which doesn't exist or the user cannot see (404)
+func NotFound(resource string) *Error {
+	return &Error{Status: http.StatusNotFound, Message: resource + " doesn't exist"}
+}
+
+// Conflict is a resource which already exists or is in an incompatible state (409)
+func Conflict(msg string) *Error {
+	return &Error{Status: http.StatusConflict, Message: msg}
+}
+
+// Internal is a failure of the server, the cause is only logged (500)
+func Internal(msg string, err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Message: msg, Err: err}
+}
+
+// Upstream is a failure of a service used by the server (ie SMTP) (502)
+func Upstream(msg string, err error) *Error {
+	return &Error{Status: http.StatusBadGateway, Message: msg, Err: err}
+}
+
+// Identity is an OAuth error of the identity endpoints (400)
+func Identity(code, description string) *Error {
+	return &Error{Status: http.StatusBadRequest, Message: description, OAuth: code}
+}
+
+// Binding converts the errors of the request binding into validation errors by field
+func Binding(err error) *Error {
+	var verrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &verrs):
+		e := &Error{Status: http.StatusBadRequest, Message: invalidModel, ValidationErrors: map[string][]string{}, Err: err}
+		for _, fe := range verrs {
+			e.ValidationErrors[fe.Field()] = append(e.ValidationErrors[fe.Field()], fieldMessage(fe))
+		}
+		return e
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field != "" {
+			field = strings.ToUpper(field[:1]) + field[1:]
+		}
+		e := Validation(field, fmt.Sprintf("The %s field has an invalid value.", field))
+		e.Err = err
+		return e
+	default:
+		return &Error{Status: http.StatusBadRequest, Message: "The request is invalid.", Err: err}
+	}
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("The %s field is required.", fe.Field())
+	case "email":
+		return fmt.Sprintf("The %s field is not a valid e-mail address.", fe.Field())
+	default:
+		return fmt.Sprintf("The %s field is invalid.", fe.Field())
+	}
+}
+
+// From converts any error (an unexpected one is an internal error)
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Internal("An error has occurred.", err)
+}
+
+// Abort sends the error to the client (ErrorModel, or OAuth error for the identity endpoints) and stops the handlers
+func Abort(c *gin.Context, err error) {
+	e := From(err)
+	if e.Status >= http.StatusInternalServerError {
+		logging.WithRequest(logger, c).WithError(e).Error("Request failed")
+	}
+	c.Error(e)
+
+	if e.OAuth == "" {
+		c.AbortWithStatusJSON(e.Status, e.Model())
+		return
+	}
+
+	body := gin.H{
+		"error":             e.OAuth,
+		"error_description": e.Message,
+		"ErrorModel":        gin.H{"Message": e.Message, "Object": "error"},
+	}
+	for k, v := range e.Extra {
+		body[k] = v
+	}
+	c.AbortWithStatusJSON(e.Status, body)
+}
@@ -0,0 +1,280 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gotwarden/logging"
+	"gotwarden/metrics"
+	"gotwarden/models"
+	"gotwarden/util"
+	"gotwarden/version"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logging.For("backup")
+
+// Names of the files into the archives
+const (
+	manifestFile = "manifest.json"
+	sqliteFile   = "gotwarden.db"
+	postgresFile = "gotwarden.pgdump"
+)
+
+// The archives are named by their date, so that they sort from the oldest
+const (
+	archivePrefix = "gotwarden-"
+	archiveSuffix = ".tar.gz"
+	// encryptedSuffix is added to the encrypted archives
+	encryptedSuffix = ".enc"
+	timeFormat      = "20060102T150405.000Z"
+)
+
+// Manifest describes the content of an archive
+type Manifest struct {
+	Release       string
+	Commit        string
+	CreatedAt     time.Time
+	DbType        string
+	SchemaVersion int
+	// AttachmentBytes is the size of the attachments (stored into the database)
+	AttachmentBytes int64
+	// Files are the SHA-256 of the files of the archive
+	Files map[string]string
+}
+
+// Create archives a consistent snapshot of the database, attachments included, into the directory of the config,
+// encrypted if a passphrase is configured, then removes the archives beyond the number kept
+func Create(ctx context.Context, db *models.DB, dbConf util.DbConfig, conf util.BackupConfig) (string, error) {
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return "", err
+	}
+	work, err := ioutil.TempDir(conf.Dir, ".snapshot-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+
+	manifest := Manifest{
+		Release:   version.Release,
+		Commit:    version.Commit,
+		CreatedAt: time.Now().UTC(),
+		DbType:    dbConf.GetType(),
+		Files:     map[string]string{},
+	}
+	if manifest.SchemaVersion, err = db.GetSchemaVersion(ctx); err != nil {
+		return "", err
+	}
+	storage, err := db.GetStorageByUser(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, size := range storage {
+		manifest.AttachmentBytes += size
+	}
+
+	name, err := snapshot(ctx, db, dbConf, work)
+	if err != nil {
+		return "", fmt.Errorf("snapshot failed: %w", err)
+	}
+	if manifest.Files[name], err = checksum(filepath.Join(work, name)); err != nil {
+		return "", err
+	}
+
+	archive := filepath.Join(conf.Dir, archivePrefix+manifest.CreatedAt.Format(timeFormat)+archiveSuffix)
+	if conf.Passphrase != "" {
+		archive += encryptedSuffix
+	}
+	// The archive only gets its name once complete
+	tmp := archive + ".tmp"
+	if err := writeArchive(tmp, work, manifest, conf.Passphrase); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, archive); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := Rotate(conf.Dir, conf.Keep); err != nil {
+		logger.WithError(err).Error("Cannot remove the oldest backups")
+	}
+	return archive, nil
+}
+
+// snapshot dumps the database into the directory and gives the name of the file
+func snapshot(ctx context.Context, db *models.DB, conf util.DbConfig, dir string) (string, error) {
+	switch c := conf.(type) {
+	case util.SqliteConfig:
+		return sqliteFile, db.Snapshot(ctx, filepath.Join(dir, sqliteFile))
+	case util.PostgresConfig:
+		return postgresFile, pgDump(ctx, c, filepath.Join(dir, postgresFile))
+	}
+	return "", fmt.Errorf("the %s database cannot be backed up", conf.GetType())
+}
+
+// writeArchive writes the manifest then its files (from the directory) into a tar.gz, encrypted with the passphrase
+func writeArchive(path, dir string, manifest Manifest, passphrase string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var enc *encrypter
+	if passphrase != "" {
+		if enc, err = newEncrypter(f, passphrase); err != nil {
+			return err
+		}
+		w = enc
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: manifestFile, Mode: 0600, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(manifest.Files))
+	for name := range manifest.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := addFile(tw, filepath.Join(dir, name), name, manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addFile(tw *tar.Writer, path, name string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// checksum gives the SHA-256 of the file
+func checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isArchive tells if the file is an archive written by Create
+func isArchive(name string) bool {
+	return strings.HasPrefix(name, archivePrefix) &&
+		(strings.HasSuffix(name, archiveSuffix) || strings.HasSuffix(name, archiveSuffix+encryptedSuffix))
+}
+
+// List gives the archives of the directory, from the oldest
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && isArchive(e.Name()) {
+			archives = append(archives, e.Name())
+		}
+	}
+	sort.Strings(archives)
+	return archives, nil
+}
+
+// Rotate removes the oldest archives of the directory beyond keep (0 keeps them all)
+func Rotate(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	archives, err := List(dir)
+	if err != nil || len(archives) <= keep {
+		return err
+	}
+	for _, name := range archives[:len(archives)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		logger.WithField("file", name).Info("Old backup removed")
+	}
+	return nil
+}
+
+// Schedule backs up the database at every interval of the config until the context is done
+func Schedule(ctx context.Context, db *models.DB, dbConf util.DbConfig, conf util.BackupConfig) {
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			archive, err := Create(ctx, db, dbConf, conf)
+			if err != nil {
+				metrics.Backups.WithLabelValues("failure").Inc()
+				logger.WithError(err).Error("Scheduled backup failed")
+				continue
+			}
+			metrics.Backups.WithLabelValues("success").Inc()
+			metrics.BackupLastSuccess.SetToCurrentTime()
+			logger.WithFields(logrus.Fields{"file": archive, "duration_ms": time.Since(start).Milliseconds()}).Info("Backup done")
+		}
+	}
+}
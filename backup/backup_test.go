@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gotwarden/models"
+	"gotwarden/util"
+)
+
+func TestCrypt(t *testing.T) {
+	// A full last chunk, a short one and an empty stream
+	for _, size := range []int{0, 10, chunkSize, 2*chunkSize + 100} {
+		data := bytes.Repeat([]byte("gotwarden"), size/9+1)[:size]
+		var sealed bytes.Buffer
+		enc, err := newEncrypter(&sealed, "passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := enc.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		open := func(b []byte, passphrase string) ([]byte, error) {
+			dec, err := newDecrypter(bytes.NewReader(b), passphrase)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(dec)
+		}
+		if plain, err := open(sealed.Bytes(), "passphrase"); err != nil || !bytes.Equal(plain, data) {
+			t.Errorf("%d bytes: the data are not decrypted (%v)", size, err)
+		}
+		if _, err := open(sealed.Bytes(), "wrong"); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("%d bytes: the wrong passphrase is not detected: %v", size, err)
+		}
+		// The last chunk removed, ie the archive truncated on a chunk boundary
+		if size >= chunkSize {
+			truncated := sealed.Bytes()[:len(magic)+saltSize+prefixSize+chunkSize+16]
+			if _, err := open(truncated, "passphrase"); !errors.Is(err, ErrPassphrase) {
+				t.Errorf("%d bytes: the truncation is not detected: %v", size, err)
+			}
+		}
+	}
+}
+
+func TestCreateRestore(t *testing.T) {
+	for _, passphrase := range []string{"", "a backup passphrase"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "gotwarden.db")
+		db, err := models.NewDB("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		u := models.NewUser("Alice", "alice@example.com", "hash", "", "key", 0, 100000)
+		if err := db.AddUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+
+		dbConf := util.SqliteConfig{DbFilePath: path}
+		conf := util.BackupConfig{Dir: filepath.Join(dir, "backups"), Keep: 2, Passphrase: passphrase}
+		archive, err := Create(ctx, db, dbConf, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(archive, encryptedSuffix) != (passphrase != "") {
+			t.Errorf("unexpected archive %s", archive)
+		}
+		if err := db.DeleteUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		db.Db.Close()
+
+		if passphrase != "" {
+			if _, err := Check(ctx, archive, "", dir); !errors.Is(err, ErrPassphraseRequired) {
+				t.Errorf("the archive is checked without passphrase: %v", err)
+			}
+			if _, err := Check(ctx, archive, "wrong", dir); !errors.Is(err, ErrPassphrase) {
+				t.Errorf("the archive is checked with a wrong passphrase: %v", err)
+			}
+		}
+		checked, err := Check(ctx, archive, passphrase, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checked.Manifest.SchemaVersion != models.SchemaVersion() || checked.Manifest.DbType != "sqlite3" {
+			t.Errorf("unexpected manifest %+v", checked.Manifest)
+		}
+		if err := checked.Restore(ctx, dbConf); err != nil {
+			t.Fatal(err)
+		}
+		checked.Close()
+
+		restored, err := models.NewDB("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := restored.GetUser(ctx, u.UUID); err != nil {
+			t.Errorf("the user is not restored: %v", err)
+		}
+		restored.Db.Close()
+		if aside, _ := filepath.Glob(path + ".pre-restore-*"); len(aside) != 1 {
+			t.Errorf("the previous database is not kept aside: %v", aside)
+		}
+	}
+}
+
+func TestCheckAltered(t *testing.T) {
+	dir := t.TempDir()
+	db, err := models.NewDB("sqlite3", filepath.Join(dir, "gotwarden.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Db.Close()
+	ctx := context.Background()
+	conf := util.BackupConfig{Dir: dir, Passphrase: "passphrase"}
+	archive, err := Create(ctx, db, util.SqliteConfig{DbFilePath: filepath.Join(dir, "gotwarden.db")}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-20] ^= 1
+	if err := ioutil.WriteFile(archive, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Check(ctx, archive, "passphrase", dir); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("the altered archive is accepted: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".restore-*")); len(leftovers) != 0 {
+		t.Errorf("the extracted files are not removed: %v", leftovers)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"gotwarden-20220101T000000.000Z.tar.gz",
+		"gotwarden-20220102T000000.000Z.tar.gz.enc",
+		"gotwarden-20220103T000000.000Z.tar.gz",
+		"gotwarden-20220104T000000.000Z.tar.gz.tmp",
+		"other.tar.gz",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Rotate(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed := os.IsNotExist(err); removed != (i == 0) {
+			t.Errorf("%s: removed %t", name, removed)
+		}
+	}
+}
+
+// pgRestoreScript is the output of pg_restore --data-only --table=schema_version --file=- for a dump at version 3
+const pgRestoreScript = `--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+
+--
+-- Data for Name: schema_version; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.schema_version (version) FROM stdin;
+1
+3
+2
+\.
+
+
+--
+-- PostgreSQL database dump complete
+--
+`
+
+func TestPgSchemaVersion(t *testing.T) {
+	if version, err := pgSchemaVersion([]byte(pgRestoreScript)); err != nil || version != 3 {
+		t.Errorf("expected the version 3, got %d (%v)", version, err)
+	}
+	if _, err := pgSchemaVersion([]byte("--\n-- PostgreSQL database dump complete\n--\n")); err == nil {
+		t.Error("a dump without schema_version is accepted")
+	}
+	if _, err := pgSchemaVersion([]byte("COPY public.schema_version (version) FROM stdin;\nversion\n\\.\n")); err == nil {
+		t.Error("an invalid version is accepted")
+	}
+}
+
+func TestCheckPostgresVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake pg_restore is a shell script")
+	}
+
+	// pg_restore is replaced by a script reading the dump as its own output
+	bin := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\ncase \"$1\" in --list) ;; *) cat \"$last\" ;; esac\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "pg_restore"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		version int
+		valid   bool
+	}{{3, true}, {2, false}} {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, postgresFile), []byte(pgRestoreScript), 0600); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := checksum(filepath.Join(dir, postgresFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := Manifest{DbType: (util.PostgresConfig{}).GetType(), SchemaVersion: c.version, Files: map[string]string{postgresFile: sum}}
+		archive := filepath.Join(dir, "backup.tar.gz")
+		if err := writeArchive(archive, dir, manifest, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		checked, err := Check(ctx, archive, "", dir)
+		if c.valid && err != nil {
+			t.Errorf("version %d: the dump is refused: %v", c.version, err)
+		}
+		if !c.valid && (err == nil || !strings.Contains(err.Error(), "schema version 3 instead of 2")) {
+			t.Errorf("version %d: the dump of another version is accepted: %v", c.version, err)
+		}
+		if checked != nil {
+			checked.Close()
+		}
+	}
+}
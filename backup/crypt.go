@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The encrypted archives are cut into chunks sealed with AES-256-GCM, the key is derived from the
+// passphrase with scrypt. The nonce of a chunk is a random prefix, its counter and a flag set on the
+// last one, so the chunks cannot be reordered, removed nor the archive truncated.
+//
+//	magic (8) | salt (16) | nonce prefix (7) | chunks of 64 KiB + tag (16), the last one shorter
+
+var magic = []byte("GWBACKUP")
+
+const (
+	saltSize   = 16
+	prefixSize = 7
+	chunkSize  = 64 * 1024
+)
+
+// ErrPassphrase is returned when the archive cannot be decrypted with the passphrase
+var ErrPassphrase = errors.New("wrong passphrase or altered archive")
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, prefixSize+5)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], counter)
+	if last {
+		n[prefixSize+4] = 1
+	}
+	return n
+}
+
+// encrypter seals the data written into chunks, Close writes the last one
+type encrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newEncrypter(w io.Writer, passphrase string) (*encrypter, error) {
+	header := make([]byte, len(magic)+saltSize+prefixSize)
+	copy(header, magic)
+	if _, err := rand.Read(header[len(magic):]); err != nil {
+		return nil, err
+	}
+	salt, prefix := header[len(magic):len(magic)+saltSize], header[len(magic)+saltSize:]
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encrypter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *encrypter) seal(data []byte, last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("the archive is too large to be encrypted")
+	}
+	_, err := e.w.Write(e.aead.Seal(nil, nonce(e.prefix, e.counter, last), data, nil))
+	e.counter++
+	return err
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf, p = e.buf[:len(e.buf)+n], p[n:]
+		// A full chunk is never the last one, so the last one is always shorter
+		if len(e.buf) == chunkSize {
+			if err := e.seal(e.buf, false); err != nil {
+				return 0, err
+			}
+			e.buf = e.buf[:0]
+		}
+	}
+	return written, nil
+}
+
+// Close seals the last chunk (empty if the data fills the chunks)
+func (e *encrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+// decrypter opens the chunks read, a missing last chunk is reported as ErrPassphrase
+type decrypter struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func newDecrypter(r io.Reader, passphrase string) (*decrypter, error) {
+	header := make([]byte, len(magic)+saltSize+prefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(magic)], magic) {
+		return nil, errors.New("not an encrypted gotwarden backup")
+	}
+	aead, err := newAEAD(passphrase, header[len(magic):len(magic)+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{r: r, aead: aead, prefix: header[len(magic)+saltSize:], chunk: make([]byte, chunkSize+aead.Overhead())}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, ErrPassphrase
+			}
+			return 0, err
+		}
+		last := n < len(d.chunk)
+		if d.plain, err = d.aead.Open(d.chunk[:0], nonce(d.prefix, d.counter, last), d.chunk[:n], nil); err != nil {
+			return 0, ErrPassphrase
+		}
+		d.counter++
+		d.done = last
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// encrypted tells if the archive is encrypted (by its magic)
+func encrypted(r *bufio.Reader) bool {
+	header, err := r.Peek(len(magic))
+	return err == nil && bytes.Equal(header, magic)
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"gotwarden/util"
+)
+
+// The PostgreSQL databases are dumped and restored with the client tools, which must be in the PATH
+
+// pgEnv gives the connection to the tools by the environment, so that the password is not in the arguments
+func pgEnv(conf util.PostgresConfig) []string {
+	return append(os.Environ(),
+		"PGHOST="+conf.Host,
+		"PGPORT="+conf.Port,
+		"PGUSER="+conf.User,
+		"PGPASSWORD="+conf.Password,
+		"PGDATABASE="+conf.Name,
+	)
+}
+
+func pgRun(ctx context.Context, conf util.PostgresConfig, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = pgEnv(conf)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return out, nil
+}
+
+// pgDump dumps the database into the file, in the custom format of pg_restore
+func pgDump(ctx context.Context, conf util.PostgresConfig, path string) error {
+	_, err := pgRun(ctx, conf, "pg_dump", "--format=custom", "--no-owner", "--no-privileges", "--file="+path)
+	return err
+}
+
+// pgCheck checks that pg_restore can read the dump and provides its schema version, read from the data of the
+// schema_version table without any database
+func pgCheck(ctx context.Context, path string) (int, error) {
+	if _, err := pgRun(ctx, util.PostgresConfig{}, "pg_restore", "--list", path); err != nil {
+		return 0, err
+	}
+	out, err := pgRun(ctx, util.PostgresConfig{}, "pg_restore", "--data-only", "--table=schema_version", "--file=-", path)
+	if err != nil {
+		return 0, err
+	}
+	return pgSchemaVersion(out)
+}
+
+// pgSchemaVersion reads the highest version of the COPY block of the table schema_version in the SQL script
+// written by pg_restore
+func pgSchemaVersion(script []byte) (int, error) {
+	version := 0
+	found, inCopy := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(script))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case !inCopy:
+			inCopy = strings.HasPrefix(line, "COPY ") && strings.Contains(line, "schema_version ")
+			found = found || inCopy
+		case line == `\.`:
+			inCopy = false
+		default:
+			v, err := strconv.Atoi(strings.TrimSpace(line))
+			if err != nil {
+				return 0, fmt.Errorf("invalid schema version %q in the dump", line)
+			}
+			if v > version {
+				version = v
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errors.New("the dump has no schema_version table")
+	}
+	return version, nil
+}
+
+// pgRestore replaces the content of the database by the dump, in a single transaction
+func pgRestore(ctx context.Context, conf util.PostgresConfig, path string) error {
+	_, err := pgRun(ctx, conf, "pg_restore", "--clean", "--if-exists", "--no-owner", "--no-privileges",
+		"--single-transaction", "--exit-on-error", "--dbname="+conf.Name, path)
+	return err
+}
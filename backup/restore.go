@@ -0,0 +1,218 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gotwarden/models"
+	"gotwarden/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrPassphraseRequired is returned when an encrypted archive is checked without passphrase
+var ErrPassphraseRequired = errors.New("the archive is encrypted, WARDEN_BACKUP_PASSPHRASE is required")
+
+// Checked is an archive extracted and verified, ready to be restored
+type Checked struct {
+	Manifest Manifest
+	dir      string
+	file     string
+}
+
+// Check extracts the archive into a temporary directory of workDir and verifies it: the checksums of its
+// files, the schema version (not newer than this server) and the integrity of the database
+func Check(ctx context.Context, archive, passphrase, workDir string) (*Checked, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir, err := ioutil.TempDir(workDir, ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	checked := &Checked{dir: dir}
+	if err := checked.extract(bufio.NewReader(f), passphrase); err != nil {
+		checked.Close()
+		return nil, err
+	}
+	if err := checked.verify(ctx); err != nil {
+		checked.Close()
+		return nil, err
+	}
+	return checked, nil
+}
+
+func (c *Checked) extract(r *bufio.Reader, passphrase string) error {
+	var in io.Reader = r
+	if encrypted(r) {
+		if passphrase == "" {
+			return ErrPassphraseRequired
+		}
+		d, err := newDecrypter(r, passphrase)
+		if err != nil {
+			return err
+		}
+		in = d
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		if errors.Is(err, ErrPassphrase) {
+			return err
+		}
+		return fmt.Errorf("not a gotwarden backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != manifestFile {
+		return errors.New("not a gotwarden backup: the manifest is missing")
+	}
+	if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&c.Manifest); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum, ok := c.Manifest.Files[hdr.Name]
+		if !ok || (hdr.Name != sqliteFile && hdr.Name != postgresFile) || c.file != "" {
+			return fmt.Errorf("unexpected file %q in the archive", hdr.Name)
+		}
+		if err := extractFile(tr, filepath.Join(c.dir, hdr.Name), sum); err != nil {
+			return err
+		}
+		c.file = hdr.Name
+	}
+	if c.file == "" {
+		return errors.New("the archive has no database")
+	}
+	// Reads the end of the stream, so that the last chunk of the encrypted archives is authenticated
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func extractFile(r io.Reader, path, sum string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return fmt.Errorf("the checksum of %s does not match", filepath.Base(path))
+	}
+	return f.Close()
+}
+
+func (c *Checked) verify(ctx context.Context) error {
+	if c.Manifest.SchemaVersion > models.SchemaVersion() {
+		return fmt.Errorf("the backup has the schema version %d, newer than this server (%d)", c.Manifest.SchemaVersion, models.SchemaVersion())
+	}
+	path := filepath.Join(c.dir, c.file)
+	switch c.file {
+	case sqliteFile:
+		if c.Manifest.DbType != (util.SqliteConfig{}).GetType() {
+			return fmt.Errorf("the manifest does not match the database (%s)", c.Manifest.DbType)
+		}
+		version, err := models.CheckSnapshot(ctx, path)
+		if err != nil {
+			return err
+		}
+		return c.checkVersion(version)
+	case postgresFile:
+		if c.Manifest.DbType != (util.PostgresConfig{}).GetType() {
+			return fmt.Errorf("the manifest does not match the database (%s)", c.Manifest.DbType)
+		}
+		version, err := pgCheck(ctx, path)
+		if err != nil {
+			return err
+		}
+		return c.checkVersion(version)
+	}
+	return nil
+}
+
+// checkVersion compares the schema version of the database extracted with the one of the manifest
+func (c *Checked) checkVersion(version int) error {
+	if version != c.Manifest.SchemaVersion {
+		return fmt.Errorf("the database has the schema version %d instead of %d", version, c.Manifest.SchemaVersion)
+	}
+	return nil
+}
+
+// Restore replaces the configured database by the backup, the server must be stopped.
+// A SQLite database replaced is kept aside with the suffix .pre-restore-<date>
+func (c *Checked) Restore(ctx context.Context, conf util.DbConfig) error {
+	if conf.GetType() != c.Manifest.DbType {
+		return fmt.Errorf("a %s backup cannot be restored into a %s database", c.Manifest.DbType, conf.GetType())
+	}
+	path := filepath.Join(c.dir, c.file)
+	switch conf := conf.(type) {
+	case util.SqliteConfig:
+		return restoreSqlite(path, conf.DbFilePath)
+	case util.PostgresConfig:
+		return pgRestore(ctx, conf, path)
+	}
+	return fmt.Errorf("the %s database cannot be restored", conf.GetType())
+}
+
+// restoreSqlite moves the current database (and its journals) aside then the snapshot in its place
+func restoreSqlite(snapshot, path string) error {
+	suffix := ".pre-restore-" + time.Now().UTC().Format(timeFormat)
+	var moved []string
+	rollback := func() {
+		for _, p := range moved {
+			if err := os.Rename(p+suffix, p); err != nil {
+				logger.WithError(err).WithField("file", p).Error("Cannot put the database back")
+			}
+		}
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm", path + "-journal"} {
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.Rename(p, p+suffix); err != nil {
+			rollback()
+			return err
+		}
+		moved = append(moved, p)
+	}
+	if err := os.Rename(snapshot, path); err != nil {
+		rollback()
+		return err
+	}
+	if len(moved) > 0 {
+		logger.WithFields(logrus.Fields{"file": path + suffix}).Info("Previous database kept aside")
+	}
+	return nil
+}
+
+// Close removes the extracted files
+func (c *Checked) Close() error {
+	return os.RemoveAll(c.dir)
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gotwarden/backup"
+	"gotwarden/handlers"
+	"gotwarden/importer"
+	"gotwarden/models"
+	"gotwarden/util"
+	"gotwarden/version"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var userCommands = map[string]command{
+	"list":    {"List the users with their devices and storage use", userList},
+	"disable": {"Disable a user and log out its devices", userAction("disable", "disabled")},
+	"enable":  {"Enable a disabled user", userAction("enable", "enabled")},
+	"delete":  {"Delete a user and its vault", userAction("delete", "deleted")},
+	"invite":  {"Invite an email to register (sent if SMTP is configured)", userInvite},
+}
+
+var deviceCommands = map[string]command{
+	"list":   {"List the devices", deviceList},
+	"revoke": {"Revoke the refresh token of a device", deviceRevoke},
+}
+
+var configCommands = map[string]command{
+	"check": {"Validate the configuration and print the effective settings", configCheck},
+}
+
+var dbCommands = map[string]command{
+	"copy": {"Copy every table into another (empty) database, ie from SQLite to PostgreSQL", dbCopy},
+}
+
+// printJSON writes the value indented
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// recordEvent records an admin action done from the command line (nor user nor IP address acting), the user
+// it applies to is only its target
+func recordEvent(ctx context.Context, db models.Datastore, e *models.Event) {
+	e.UUID = uuid.New().String()
+	e.Date = time.Now().UTC()
+	if err := db.AddEvent(ctx, e); err != nil {
+		logger.WithError(err).WithField("event_type", e.Type).Error("Failed to record the event")
+	}
+}
+
+// findUser finds the user by email or id
+func findUser(ctx context.Context, db models.Datastore, ref string) (*models.User, error) {
+	u, err := db.GetUserFromEmail(ctx, strings.ToLower(ref))
+	if errors.Is(err, models.ErrNotFound) {
+		u, err = db.GetUser(ctx, ref)
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, fmt.Errorf("no user %q", ref)
+	}
+	return u, err
+}
+
+func userList(args []string) error {
+	flags := newFlags("user list", "")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	users, err := handlers.ListUsers(ctx, db)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(users)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tNAME\tDISABLED\t2FA\tDEVICES\tSTORAGE\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%t\t%d\t%s\t%s\n", u.UUID, u.Email, u.Name, u.Disabled, u.TwoFactorEnabled, u.Devices, u.StorageUsedName, u.CreatedAt)
+	}
+	return tw.Flush()
+}
+
+// userAction provides the command running the admin action on the user
+func userAction(name, done string) func(args []string) error {
+	return func(args []string) error {
+		flags := newFlags("user "+name, "<email or id>")
+		var confirmed *bool
+		if name == "delete" {
+			confirmed = flags.Bool("yes", false, "confirm the deletion of the user and its vault")
+		}
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return errors.New("the user is needed")
+		}
+		if confirmed != nil && !*confirmed {
+			return errors.New("the user and its vault are deleted for good, add -yes to confirm")
+		}
+		conf, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		db, err := openDatastore(conf)
+		if err != nil {
+			return err
+		}
+		ctx, stop := commandContext()
+		defer stop()
+
+		u, err := findUser(ctx, db, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		event, err := handlers.RunUserAction(ctx, db, name, u)
+		if err != nil {
+			return err
+		}
+		recordEvent(ctx, db, &models.Event{Type: event, TargetUserUUID: u.UUID})
+		fmt.Fprintf(stdout, "User %s %s\n", u.Email, done)
+		return nil
+	}
+}
+
+func userInvite(args []string) error {
+	flags := newFlags("user invite", "<email>")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || !strings.Contains(flags.Arg(0), "@") {
+		flags.Usage()
+		return errors.New("an email is needed")
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	email := strings.ToLower(flags.Arg(0))
+	invited, e := handlers.InviteUser(ctx, db, conf.SMTP, conf.Domain, email)
+	if invited {
+		recordEvent(ctx, db, &models.Event{Type: models.EventAdminUserInvited})
+	}
+	if e != nil {
+		return e
+	}
+	if conf.SMTP.Configured() {
+		fmt.Fprintf(stdout, "Invitation of %s sent\n", email)
+	} else {
+		fmt.Fprintf(stdout, "Invitation of %s recorded (no email sent, SMTP is not configured)\n", email)
+	}
+	return nil
+}
+
+// deviceObject is the device as listed (without its tokens)
+type deviceObject struct {
+	UUID      string `json:"Id"`
+	UserUUID  string `json:"UserId"`
+	UserEmail string
+	Name      string
+	Type      string
+	Push      bool
+}
+
+func deviceList(args []string) error {
+	flags := newFlags("device list", "")
+	owner := flags.String("user", "", "only the devices of the user (email or id)")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	var devices *[]models.Device
+	if *owner != "" {
+		u, err := findUser(ctx, db, *owner)
+		if err != nil {
+			return err
+		}
+		devices, err = db.GetDevicesByUserUUID(ctx, u.UUID)
+		if err != nil {
+			return err
+		}
+	} else if devices, err = db.AllDevices(ctx); err != nil {
+		return err
+	}
+	users, err := db.AllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	emails := make(map[string]string, len(*users))
+	for _, u := range *users {
+		emails[u.UUID] = u.Email
+	}
+
+	list := []deviceObject{}
+	for _, d := range *devices {
+		list = append(list, deviceObject{
+			UUID:      d.UUID,
+			UserUUID:  d.UserUUID,
+			UserEmail: emails[d.UserUUID],
+			Name:      d.Name,
+			Type:      d.Type,
+			Push:      d.PushToken != "",
+		})
+	}
+	if *asJSON {
+		return printJSON(list)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tNAME\tTYPE\tPUSH")
+	for _, d := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n", d.UUID, d.UserEmail, d.Name, d.Type, d.Push)
+	}
+	return tw.Flush()
+}
+
+func deviceRevoke(args []string) error {
+	flags := newFlags("device revoke", "<device id>")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the device is needed")
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	d, err := db.GetDevice(ctx, flags.Arg(0))
+	if errors.Is(err, models.ErrNotFound) {
+		return fmt.Errorf("no device %q", flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	if err := handlers.RevokeDevice(ctx, db, d); err != nil {
+		return err
+	}
+	recordEvent(ctx, db, &models.Event{Type: models.EventAdminUserDeauthorized, TargetUserUUID: d.UserUUID, DeviceUUID: d.UUID})
+	fmt.Fprintf(stdout, "Device %s revoked, it has to log in again once its access token expires (within %s)\n", d.UUID, conf.Validity)
+	return nil
+}
+
+// cipherTypes names the types of the ciphers
+var cipherTypes = map[int]string{1: "logins", 2: "notes", 3: "cards", 4: "identities"}
+
+// statistics are the counts of the instance
+type statistics struct {
+	Users          int
+	DisabledUsers  int
+	TwoFactorUsers int
+	Devices        int
+	Folders        int
+	Ciphers        map[string]int
+	DeletedCiphers int
+	Organizations  int
+	StorageUsed    int64
+	SchemaVersion  int
+}
+
+func stats(args []string) error {
+	flags := newFlags("stats", "")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	db, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	s := statistics{Ciphers: map[string]int{}}
+	users, err := db.AllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range *users {
+		s.Users++
+		if u.Disabled {
+			s.DisabledUsers++
+		}
+		if u.TotpSecret != "" {
+			s.TwoFactorUsers++
+		}
+	}
+	devices, err := db.AllDevices(ctx)
+	if err != nil {
+		return err
+	}
+	s.Devices = len(*devices)
+	folders, err := db.AllFolders(ctx)
+	if err != nil {
+		return err
+	}
+	s.Folders = len(*folders)
+	ciphers, err := db.AllCiphers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range *ciphers {
+		if c.DeletedAt != nil {
+			s.DeletedCiphers++
+			continue
+		}
+		name, ok := cipherTypes[c.Type]
+		if !ok {
+			name = "others"
+		}
+		s.Ciphers[name]++
+	}
+	organizations, err := db.AllOrganizations(ctx)
+	if err != nil {
+		return err
+	}
+	s.Organizations = len(*organizations)
+	storage, err := db.GetStorageByUser(ctx)
+	if err != nil {
+		return err
+	}
+	for _, size := range storage {
+		s.StorageUsed += size
+	}
+	if s.SchemaVersion, err = db.GetSchemaVersion(ctx); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(s)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Users\t%d (%d disabled, %d with two-factor)\n", s.Users, s.DisabledUsers, s.TwoFactorUsers)
+	fmt.Fprintf(tw, "Devices\t%d\n", s.Devices)
+	fmt.Fprintf(tw, "Folders\t%d\n", s.Folders)
+	for _, name := range []string{"logins", "notes", "cards", "identities", "others"} {
+		if s.Ciphers[name] > 0 {
+			fmt.Fprintf(tw, "Ciphers (%s)\t%d\n", name, s.Ciphers[name])
+		}
+	}
+	fmt.Fprintf(tw, "Ciphers in the trash\t%d\n", s.DeletedCiphers)
+	fmt.Fprintf(tw, "Organizations\t%d\n", s.Organizations)
+	fmt.Fprintf(tw, "Attachments\t%s\n", humanize.Bytes(uint64(s.StorageUsed)))
+	fmt.Fprintf(tw, "Schema version\t%d / %d\n", s.SchemaVersion, models.SchemaVersion())
+	return tw.Flush()
+}
+
+func configCheck(args []string) error {
+	flags := newFlags("config check", "")
+	release := flags.Bool("release", false, "apply the checks of the release mode (GIN_MODE=release)")
+	connect := flags.Bool("db", false, "also connect to the database and check its schema")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *release {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, conf.Dump())
+
+	if *connect && conf.Db.GetType() != util.MemoryDbType {
+		db, err := openDatastore(conf)
+		if err != nil {
+			return err
+		}
+		ctx, stop := commandContext()
+		defer stop()
+		if err := db.Ping(ctx); err != nil {
+			return fmt.Errorf("cannot connect to the database: %w", err)
+		}
+		v, err := db.GetSchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Database %s reached, schema version %d / %d\n", conf.Db.GetType(), v, models.SchemaVersion())
+	}
+	fmt.Fprintln(stdout, "Configuration OK")
+	return nil
+}
+
+func printVersion(args []string) error {
+	flags := newFlags("version", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Release: %s\nCommit: %s\nBuild time: %s\n", version.Release, version.Commit, version.BuildTime)
+	return nil
+}
+
+func backupCreate(args []string) error {
+	flags := newFlags("backup", "")
+	dir := flags.String("dir", "", "directory of the archives (WARDEN_BACKUP_DIR by default)")
+	keep := flags.Int("keep", -1, "number of archives kept, 0 keeps them all (WARDEN_BACKUP_KEEP by default)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if *dir != "" {
+		conf.Backup.Dir = *dir
+	}
+	if *keep >= 0 {
+		conf.Backup.Keep = *keep
+	}
+	store, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	archive, err := backup.Create(ctx, store.(*models.DB), conf.Db, conf.Backup)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, archive)
+	return nil
+}
+
+func backupRestore(args []string) error {
+	flags := newFlags("restore", "<archive>")
+	confirmed := flags.Bool("yes", false, "replace the database (only the archive is verified otherwise)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the archive is needed")
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	// The SQLite file is extracted next to the database, so that it is moved in place
+	workDir := os.TempDir()
+	if c, ok := conf.Db.(util.SqliteConfig); ok {
+		workDir = filepath.Dir(c.DbFilePath)
+	} else if conf.Db.GetType() == util.MemoryDbType {
+		return errors.New("the memory database cannot be restored")
+	}
+	checked, err := backup.Check(ctx, flags.Arg(0), conf.Backup.Passphrase, workDir)
+	if err != nil {
+		return err
+	}
+	defer checked.Close()
+	m := checked.Manifest
+	fmt.Fprintf(stdout, "Backup of %s (release %s, schema version %d, %s of attachments) verified\n",
+		m.CreatedAt.Format(time.RFC3339), m.Release, m.SchemaVersion, humanize.Bytes(uint64(m.AttachmentBytes)))
+	if !*confirmed {
+		fmt.Fprintln(stdout, "Stop the server then add -yes to replace the database")
+		return nil
+	}
+
+	if err := checked.Restore(ctx, conf.Db); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Database restored, the migrations run when the server starts")
+	return nil
+}
+
+// parseDatabase reads a database given as sqlite:<path>, postgres://<user>:<password>@<host>/<name>
+// or postgres:<key=value settings>, and gives its driver and connection
+func parseDatabase(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, "sqlite:"):
+		if path := strings.TrimPrefix(s, "sqlite:"); path != "" {
+			return "sqlite3", path, nil
+		}
+	case strings.HasPrefix(s, "postgres://"), strings.HasPrefix(s, "postgresql://"):
+		return "postgres", s, nil
+	case strings.HasPrefix(s, "postgres:"):
+		if settings := strings.TrimPrefix(s, "postgres:"); settings != "" {
+			return "postgres", settings, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid database %q (sqlite:<path> or postgres://<user>:<password>@<host>/<name>)", s)
+}
+
+func dbCopy(args []string) error {
+	flags := newFlags("db copy", "")
+	from := flags.String("from", "", "source database (sqlite:<path> or postgres://...)")
+	to := flags.String("to", "", "target database, empty or partly copied (sqlite:<path> or postgres://...)")
+	batch := flags.Int("batch", 500, "rows copied by transaction")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		flags.Usage()
+		return errors.New("the source and the target are needed")
+	}
+	if *from == *to {
+		return errors.New("the source and the target are the same database")
+	}
+	fromType, fromConnect, err := parseDatabase(*from)
+	if err != nil {
+		return err
+	}
+	toType, toConnect, err := parseDatabase(*to)
+	if err != nil {
+		return err
+	}
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	source, err := models.NewDB(fromType, fromConnect)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer source.Db.Close()
+	target, err := models.NewDB(toType, toConnect)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	defer target.Db.Close()
+	ctx, stop := commandContext()
+	defer stop()
+
+	// A line by table once copied, the batches are logged
+	last, rows := "", 0
+	err = models.CopyDatabase(ctx, source, target, *batch, func(table string, copied int) {
+		if last != "" && table != last {
+			fmt.Fprintf(stdout, "%s: %d rows copied\n", last, rows)
+		}
+		last, rows = table, copied
+		logger.WithFields(logrus.Fields{"table": table, "rows": copied}).Debug("Batch copied")
+	})
+	if err == nil && last != "" {
+		fmt.Fprintf(stdout, "%s: %d rows copied\n", last, rows)
+	}
+	if errors.Is(err, models.ErrTargetNotEmpty) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w (run the same command to resume)", err)
+	}
+
+	// The checksums are compared once everything is copied
+	sourceSums, err := source.Checksums(ctx, *batch)
+	if err != nil {
+		return err
+	}
+	targetSums, err := target.Checksums(ctx, *batch)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tSOURCE\tTARGET\tCHECKSUM")
+	var mismatches []string
+	for i, s := range sourceSums {
+		t := targetSums[i]
+		result := "ok"
+		if s.Rows != t.Rows || s.Checksum != t.Checksum {
+			result = "MISMATCH"
+			mismatches = append(mismatches, s.Table)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", s.Table, s.Rows, t.Rows, result)
+	}
+	tw.Flush()
+	if len(mismatches) > 0 {
+		return fmt.Errorf("the copy differs from the source (%s), has the source changed meanwhile?", strings.Join(mismatches, ", "))
+	}
+	if err := target.FinishCopy(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Copy verified")
+	return nil
+}
+
+func importServer(args []string) error {
+	flags := newFlags("import", "")
+	kind := flags.String("source", "", "server of the database ("+importer.Rubywarden+" or "+importer.Vaultwarden+")")
+	from := flags.String("from", "", "database imported (sqlite:<path> or postgres://...)")
+	attachments := flags.String("attachments", "", "directory of the attachments of vaultwarden (data/attachments)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *kind == "" || *from == "" {
+		flags.Usage()
+		return errors.New("the source and its database are needed")
+	}
+	driver, connect, err := parseDatabase(*from)
+	if err != nil {
+		return err
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	store, err := openDatastore(conf)
+	if err != nil {
+		return err
+	}
+	ctx, stop := commandContext()
+	defer stop()
+
+	report, err := importer.Import(ctx, store.(*models.DB), importer.Source{
+		Kind:           *kind,
+		Driver:         driver,
+		Connect:        connect,
+		AttachmentsDir: *attachments,
+	})
+	if err != nil {
+		return err
+	}
+	for _, w := range report.Warnings {
+		fmt.Fprintln(stdout, "warning:", w)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Users\t%d\nDevices\t%d\nFolders\t%d\nCiphers\t%d\nAttachments\t%d\nOrganizations\t%d\nMembers\t%d\nCollections\t%d\n",
+		report.Users, report.Devices, report.Folders, report.Ciphers, report.Attachments, report.Organizations, report.Members, report.Collections)
+	tw.Flush()
+	fmt.Fprintln(stdout, "Import done, the users log in with their master password")
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotwarden/models"
+	"gotwarden/util"
+)
+
+// runCommand runs the command line and gives back its output
+func runCommand(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	stdout = &out
+	err := run(args)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cli.db")
+	t.Setenv(util.ConfigFileEnv, "")
+	t.Setenv("DB_TYPE", "sqlite")
+	t.Setenv("DB_FILEPATH", path)
+	t.Setenv("WARDEN_LOG_LEVEL", "error")
+
+	db, err := models.NewDB("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	u := models.NewUser("Alice", "alice@example.com", "hash", "", "key", 0, 100000)
+	if err := db.AddUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	d := models.NewDevice("device", "firefox", "9", u.UUID)
+	if err := db.AddDevice(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCommand(t, "user", "list", "-json")
+	var users []map[string]interface{}
+	if err != nil || json.Unmarshal([]byte(out), &users) != nil || len(users) != 1 || users[0]["Email"] != "alice@example.com" || users[0]["Devices"] != float64(1) {
+		t.Fatalf("unexpected users %s (%v)", out, err)
+	}
+
+	if _, err := runCommand(t, "user", "disable", "ALICE@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if disabled, _ := db.GetUser(ctx, u.UUID); !disabled.Disabled || disabled.SecurityStamp == u.SecurityStamp {
+		t.Error("the user is not disabled and logged out")
+	}
+	if _, err := runCommand(t, "user", "enable", u.UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := runCommand(t, "device", "list", "-user", "alice@example.com"); err != nil || !strings.Contains(out, "firefox") || strings.Contains(out, d.RefreshToken) {
+		t.Errorf("unexpected devices %s (%v)", out, err)
+	}
+	if _, err := runCommand(t, "device", "revoke", "device"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := db.GetDevice(ctx, "device"); revoked.RefreshToken == d.RefreshToken {
+		t.Error("the refresh token of the device is still valid")
+	}
+
+	if _, err := runCommand(t, "user", "invite", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetInvitation(ctx, "bob@example.com"); err != nil {
+		t.Errorf("the invitation is not recorded: %s", err)
+	}
+	if out, err := runCommand(t, "stats"); err != nil || !strings.Contains(out, "Users") || !strings.Contains(out, "1 (0 disabled") {
+		t.Errorf("unexpected stats %s (%v)", out, err)
+	}
+
+	if _, err := runCommand(t, "user", "delete", "alice@example.com"); err == nil {
+		t.Error("the user has been deleted without confirmation")
+	}
+	if _, err := runCommand(t, "user", "delete", "-yes", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUser(ctx, u.UUID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("the user is not deleted: %v", err)
+	}
+	events, _, err := db.GetEvents(ctx, &models.EventFilter{Types: models.AdminEventTypes, End: time.Now().Add(time.Hour)})
+	if err != nil || len(*events) != 5 {
+		t.Errorf("the admin actions are not recorded: %v (%v)", events, err)
+	}
+	for _, e := range *events {
+		if e.Type != models.EventAdminUserInvited && (e.TargetUserUUID != u.UUID || e.UserUUID != "") {
+			t.Errorf("the admin action is not recorded with the user as target: %+v", e)
+		}
+	}
+
+	if _, err := runCommand(t, "user", "disable", "nobody@example.com"); err == nil {
+		t.Error("an unknown user has been found")
+	}
+	if _, err := runCommand(t, "bogus"); err == nil {
+		t.Error("an unknown command has been accepted")
+	}
+	if out, err := runCommand(t, "version"); err != nil || !strings.Contains(out, "Release: ") {
+		t.Errorf("unexpected version %s (%v)", out, err)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	t.Setenv(util.ConfigFileEnv, "")
+	t.Setenv("DB_FILEPATH", filepath.Join(t.TempDir(), "check.db"))
+	t.Setenv("WARDEN_LOG_LEVEL", "error")
+	t.Setenv("WARDEN_SECRET_PHRASE", "a long and random secret")
+
+	out, err := runCommand(t, "config", "check", "-db")
+	if err != nil || !strings.Contains(out, `WARDEN_SECRET_PHRASE=<redacted>`) || !strings.Contains(out, "Configuration OK") {
+		t.Errorf("unexpected check %s (%v)", out, err)
+	}
+
+	t.Setenv("PORT", "http")
+	if _, err := runCommand(t, "config", "check"); err == nil || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("the invalid port is not reported: %v", err)
+	}
+}
+
+func TestDbCopy(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(util.ConfigFileEnv, "")
+	t.Setenv("DB_FILEPATH", filepath.Join(dir, "unused.db"))
+	t.Setenv("WARDEN_LOG_LEVEL", "error")
+
+	source, err := models.NewDB("sqlite3", filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	u := models.NewUser("Alice", "alice@example.com", "hash", "", "key", 0, 100000)
+	if err := source.AddUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target.db")
+	out, err := runCommand(t, "db", "copy", "-from", "sqlite:"+filepath.Join(dir, "source.db"), "-to", "sqlite:"+target)
+	if err != nil || !strings.Contains(out, "users: 1 rows copied") || !strings.Contains(out, "Copy verified") {
+		t.Fatalf("unexpected copy %s (%v)", out, err)
+	}
+	copied, err := models.NewDB("sqlite3", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copied.GetUserFromEmail(ctx, "alice@example.com"); err != nil {
+		t.Errorf("the user is not copied: %v", err)
+	}
+
+	if _, err := runCommand(t, "db", "copy", "-from", "mysql:gotwarden", "-to", "sqlite:"+target); err == nil {
+		t.Error("an unknown database has been accepted")
+	}
+}
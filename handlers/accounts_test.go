@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPreLoginKdf(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	w := call(router, "POST", "/api/accounts/register", "", gin.H{
+		"email": "argon@example.com", "masterPasswordHash": "hash", "key": "key",
+		"kdf": 1, "kdfIterations": 3, "kdfMemory": 64, "kdfParallelism": 4,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body.String())
+	}
+	login(t, router, "pbkdf2@example.com")
+
+	for _, c := range []struct {
+		email string
+		want  map[string]interface{}
+	}{
+		{"argon@example.com", map[string]interface{}{"Kdf": 1.0, "KdfIterations": 3.0, "KdfMemory": 64.0, "KdfParallelism": 4.0}},
+		// The users of PBKDF2 get its settings only
+		{"pbkdf2@example.com", map[string]interface{}{"Kdf": 0.0, "KdfIterations": 100000.0}},
+	} {
+		w := call(router, "POST", "/api/accounts/prelogin", "", gin.H{"email": c.email})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: prelogin %d %s", c.email, w.Code, w.Body.String())
+		}
+		got := decode(t, w)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: unexpected settings %v", c.email, got)
+		}
+		for k, v := range c.want {
+			if got[k] != v {
+				t.Errorf("%s: %s is %v, want %v", c.email, k, got[k], v)
+			}
+		}
+	}
+}
@@ -1,47 +1,405 @@
 package handlers
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gotwarden/apierror"
+	"gotwarden/models"
+	"gotwarden/util"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
-// ShowDevices shows all devices
-func (ctx *WardenCtx) ShowDevices(c *gin.Context) {
-	devices, err := ctx.Db.AllDevices()
+// adminCookie is the cookie keeping the admin session
+const adminCookie = "gotwarden_admin"
+
+// adminSessionValidity is the lifetime of an admin session
+const adminSessionValidity = 20 * time.Minute
+
+// adminSessionLabel derives the key signing the admin sessions from the secret phrase
+const adminSessionLabel = "gotwarden admin sessions"
+
+// derivedKey provides a key derived from the secret phrase for the usage labelled, so that the signatures
+// survive a restart and are shared by the replicas
+func (ctx *WardenCtx) derivedKey(label string) []byte {
+	mac := hmac.New(sha256.New, []byte(ctx.SecretPhrase))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// AdminLogin contains the admin token
+type AdminLogin struct {
+	Token string `json:"token" form:"token" binding:"required"`
+}
+
+// AdminEmail contains the email targeted by an admin action
+type AdminEmail struct {
+	Email string `json:"email" form:"email" binding:"required,email"`
+}
+
+// AdminUserObject is the user as seen by the admin (no secret fields)
+type AdminUserObject struct {
+	UUID             string `json:"Id"`
+	Email            string
+	Name             string
+	EmailVerified    bool
+	Premium          bool
+	Disabled         bool
+	TwoFactorEnabled bool
+	CreatedAt        string
+	Devices          int
+	StorageUsed      int64
+	StorageUsedName  string
+	Object           string
+}
+
+// checkAdminToken checks the token provided against the hash of the config
+func (ctx *WardenCtx) checkAdminToken(token string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(ctx.AdminToken), []byte(token)) == nil
+}
+
+// adminSession signs an admin session valid until the expiry provided. The signature depends on the hash of
+// the admin token, so that a new token closes the sessions opened with the previous one
+func (ctx *WardenCtx) adminSession(expiry int64) string {
+	exp := strconv.FormatInt(expiry, 10)
+	mac := hmac.New(sha256.New, ctx.derivedKey(adminSessionLabel))
+	mac.Write([]byte(ctx.AdminToken))
+	mac.Write([]byte("|admin|" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validAdminSession checks the signature and the expiry of an admin session, which cannot last longer than
+// adminSessionValidity
+func (ctx *WardenCtx) validAdminSession(session string) bool {
+	parts := strings.SplitN(session, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	now := time.Now()
+	if err != nil || now.Unix() > expiry || expiry > now.Add(adminSessionValidity).Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(session), []byte(ctx.adminSession(expiry)))
+}
+
+// isAdmin tells if the request comes from an admin (bearer token or session cookie)
+func (ctx *WardenCtx) isAdmin(c *gin.Context) bool {
+	if session, err := c.Cookie(adminCookie); err == nil && ctx.validAdminSession(session) {
+		return true
+	}
+	auth := c.GetHeader("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return ctx.checkAdminToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return false
+}
+
+// RequireClientCert restricts the access to the clients with a certificate signed by WARDEN_TLS_ADMIN_CLIENT_CA
+func (ctx *WardenCtx) RequireClientCert(c *gin.Context) {
+	if !ctx.AdminMTLS {
+		c.Next()
+		return
+	}
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		apierror.Abort(c, apierror.Forbidden("A client certificate is required"))
+		return
+	}
+	c.Next()
+}
+
+// AdminMiddleware restricts the access to the admins (disabled if no admin token configured)
+func (ctx *WardenCtx) AdminMiddleware(c *gin.Context) {
+	if ctx.AdminToken == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !ctx.isAdmin(c) {
+		apierror.Abort(c, apierror.Unauthorized("Admin authentication required"))
+		return
+	}
+	c.Next()
+}
+
+// AdminLogin opens an admin session
+func (ctx *WardenCtx) AdminLogin(c *gin.Context) {
+	if ctx.AdminToken == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var login AdminLogin
+	if err := c.ShouldBind(&login); err != nil {
+		apierror.Abort(c, apierror.Validation("Token", "Admin token is missing"))
+		return
+	}
+	if !ctx.checkAdminToken(login.Token) {
+		requestLog(c).WithField("client_ip", c.ClientIP()).Warn("Invalid admin token")
+		ctx.logEvent(c, &models.Event{Type: models.EventAdminFailedLogIn})
+		apierror.Abort(c, apierror.Unauthorized("Invalid admin token"))
+		return
+	}
+
+	ctx.setAdminSession(c)
+	ctx.logEvent(c, &models.Event{Type: models.EventAdminLoggedIn})
+	c.Status(http.StatusNoContent)
+}
+
+// setAdminSession sets the cookie of a new admin session
+func (ctx *WardenCtx) setAdminSession(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(adminCookie, ctx.adminSession(time.Now().Add(adminSessionValidity).Unix()),
+		int(adminSessionValidity.Seconds()), "/admin", "", c.Request.TLS != nil, true)
+}
+
+// AdminLogout closes the admin session
+func (ctx *WardenCtx) AdminLogout(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(adminCookie, "", -1, "/admin", "", c.Request.TLS != nil, true)
+	c.Status(http.StatusNoContent)
+}
+
+// adminUsers gets all the users as seen by the admin
+func (ctx *WardenCtx) adminUsers(c *gin.Context) ([]AdminUserObject, error) {
+	return ListUsers(c.Request.Context(), ctx.Db)
+}
+
+// ListUsers gets all the users with their devices and storage use (no secret fields)
+func ListUsers(c context.Context, db models.Datastore) ([]AdminUserObject, error) {
+	users, err := db.AllUsers(c)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := db.GetStorageByUser(c)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := db.AllDevices(c)
+	if err != nil {
+		return nil, err
+	}
+	devicesByUser := make(map[string]int)
+	for _, d := range *devices {
+		devicesByUser[d.UserUUID]++
+	}
+
+	list := []AdminUserObject{}
+	for _, u := range *users {
+		list = append(list, AdminUserObject{
+			UUID:             u.UUID,
+			Email:            u.Email,
+			Name:             u.Name,
+			EmailVerified:    u.EmailVerified,
+			Premium:          u.Premium,
+			Disabled:         u.Disabled,
+			TwoFactorEnabled: u.TotpSecret != "",
+			CreatedAt:        u.CreatedAt.Format(time.RFC3339),
+			Devices:          devicesByUser[u.UUID],
+			StorageUsed:      storage[u.UUID],
+			StorageUsedName:  humanize.Bytes(uint64(storage[u.UUID])),
+			Object:           "adminUser",
+		})
+	}
+	return list, nil
+}
+
+// AdminListUsers lists the users with their storage use
+func (ctx *WardenCtx) AdminListUsers(c *gin.Context) {
+	users, err := ctx.adminUsers(c)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-	} else {
-		c.JSON(http.StatusOK, gin.H{"devices": devices})
+		apierror.Abort(c, apierror.Internal("Database failed to get users", err))
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"Data":   users,
+		"Object": "list",
+	})
 }
 
-// ShowUsers shows all the users data
-func (ctx *WardenCtx) ShowUsers(c *gin.Context) {
-	users, err := ctx.Db.AllUsers()
+// adminUser gets the user targeted by the admin action
+func (ctx *WardenCtx) adminUser(c *gin.Context) *models.User {
+	u, err := ctx.Db.GetUser(c.Request.Context(), c.Param("uuid"))
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-	} else {
-		c.JSON(http.StatusOK, gin.H{"users": users})
+		apierror.Abort(c, dbError("User", err))
+		return nil
+	}
+	return u
+}
+
+// userAction is an action an admin can do on a user
+type userAction struct {
+	event int
+	run   func(ctx context.Context, db models.Datastore, u *models.User) error
+}
+
+// userActions are the admin actions available on a user
+var userActions = map[string]userAction{
+	"disable": {models.EventAdminUserDisabled, func(ctx context.Context, db models.Datastore, u *models.User) error {
+		return setUserDisabled(ctx, db, u, true)
+	}},
+	"enable": {models.EventAdminUserEnabled, func(ctx context.Context, db models.Datastore, u *models.User) error {
+		return setUserDisabled(ctx, db, u, false)
+	}},
+	"deauth": {models.EventAdminUserDeauthorized, deauthUser},
+	"delete": {models.EventAdminUserDeleted, func(ctx context.Context, db models.Datastore, u *models.User) error {
+		return db.DeleteUser(ctx, u)
+	}},
+}
+
+// RunUserAction runs the admin action (disable, enable, deauth or delete) on the user in one transaction,
+// the event to record is given back
+func RunUserAction(c context.Context, db models.Datastore, name string, u *models.User) (int, error) {
+	action, ok := userActions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown action %q", name)
 	}
+	err := db.WithTx(c, func(db models.Datastore) error {
+		return action.run(c, db, u)
+	})
+	return action.event, err
 }
 
-// ShowFolders shows all folders data
-func (ctx *WardenCtx) ShowFolders(c *gin.Context) {
-	folders, err := ctx.Db.AllFolders()
+// applyUserAction runs the admin action on the user (in one transaction) and records it
+func (ctx *WardenCtx) applyUserAction(c *gin.Context, name string, u *models.User) error {
+	event, err := RunUserAction(c.Request.Context(), ctx.Db, name, u)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-	} else {
-		c.JSON(http.StatusOK, gin.H{"folders": folders})
+		return err
+	}
+	ctx.logEvent(c, &models.Event{Type: event, TargetUserUUID: u.UUID})
+	return nil
+}
+
+// AdminUserAction provides the handler running the admin action on the user
+func (ctx *WardenCtx) AdminUserAction(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := ctx.adminUser(c)
+		if u == nil {
+			return
+		}
+		if err := ctx.applyUserAction(c, name, u); err != nil {
+			apierror.Abort(c, apierror.Internal("Database failed to "+name+" user", err))
+			return
+		}
+		c.Status(http.StatusNoContent)
 	}
 }
 
-// ShowCiphers shows all folders data
-func (ctx *WardenCtx) ShowCiphers(c *gin.Context) {
-	ciphers, err := ctx.Db.AllCiphers()
+// setUserDisabled disables (and logs out) or enables the user
+func setUserDisabled(ctx context.Context, db models.Datastore, u *models.User, disabled bool) error {
+	u.Disabled = disabled
+	if disabled {
+		u.SecurityStamp = uuid.New().String()
+	}
+	return db.SaveUser(ctx, u)
+}
+
+// deauthUser invalidates the access and refresh tokens of the user
+func deauthUser(ctx context.Context, db models.Datastore, u *models.User) error {
+	// A new security stamp invalidates all the access tokens
+	u.SecurityStamp = uuid.New().String()
+	if err := db.SaveUser(ctx, u); err != nil {
+		return err
+	}
+
+	devices, err := db.GetDevicesByUserUUID(ctx, u.UUID)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-	} else {
-		c.JSON(http.StatusOK, gin.H{"folders": ciphers})
+		return err
+	}
+	for _, d := range *devices {
+		if err := RevokeDevice(ctx, db, &d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeDevice invalidates the refresh token of the device, so it has to log in again once its access token expires
+func RevokeDevice(ctx context.Context, db models.Datastore, d *models.Device) error {
+	d.AccessToken = ""
+	d.RefreshToken = models.NewTokenURLSafe()
+	return db.SaveDevice(ctx, d)
+}
+
+// AdminInviteUser invites a new user (allowed to register even if signups are closed)
+func (ctx *WardenCtx) AdminInviteUser(c *gin.Context) {
+	var req AdminEmail
+	if err := c.ShouldBind(&req); err != nil {
+		apierror.Abort(c, apierror.Validation("Email", "A valid email is required"))
+		return
+	}
+
+	if err := ctx.inviteUser(c, req.Email); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// inviteUser records the invitation and sends it by email (if SMTP is configured)
+func (ctx *WardenCtx) inviteUser(c *gin.Context, email string) *apierror.Error {
+	invited, err := InviteUser(c.Request.Context(), ctx.Db, ctx.SMTP, ctx.Domain, email)
+	if invited {
+		ctx.logEvent(c, &models.Event{Type: models.EventAdminUserInvited})
+	}
+	return err
+}
+
+// InviteUser records the invitation (if new) and sends it by email when SMTP is configured,
+// invited tells if the invitation has been recorded
+func InviteUser(c context.Context, db models.Datastore, smtp util.SMTPConfig, domain, email string) (invited bool, e *apierror.Error) {
+	email = strings.ToLower(email)
+	_, err := db.GetUserFromEmail(c, email)
+	if err == nil {
+		return false, apierror.Conflict("A user with this email already exists")
+	}
+	if !errors.Is(err, models.ErrNotFound) {
+		return false, apierror.Internal("Database failed to get the user", err)
+	}
+
+	_, err = db.GetInvitation(c, email)
+	if errors.Is(err, models.ErrNotFound) {
+		if err := db.AddInvitation(c, &models.Invitation{Email: email, CreatedAt: time.Now()}); err != nil {
+			return false, apierror.Internal("Database failed to add invitation", err)
+		}
+		invited = true
+	} else if err != nil {
+		return false, apierror.Internal("Database failed to get the invitation", err)
+	}
+
+	if smtp.Configured() {
+		err := smtp.SendMail(email, "Join gotwarden",
+			"You have been invited to join the gotwarden server "+domain+"\r\n\r\n"+
+				"Create your account from a Bitwarden client pointing to this server.\r\n")
+		if err != nil {
+			return invited, apierror.Upstream("Invitation recorded but the email failed to be sent", err)
+		}
+	}
+	return invited, nil
+}
+
+// AdminTestSMTP sends a test email
+func (ctx *WardenCtx) AdminTestSMTP(c *gin.Context) {
+	var req AdminEmail
+	if err := c.ShouldBind(&req); err != nil {
+		apierror.Abort(c, apierror.Validation("Email", "A valid email is required"))
+		return
+	}
+
+	if err := ctx.SMTP.SendMail(req.Email, "gotwarden SMTP test", "This is a test email sent by the gotwarden server "+ctx.Domain+"\r\n"); err != nil {
+		apierror.Abort(c, apierror.Upstream("Test email failed: "+err.Error(), err))
+		return
 	}
+	ctx.logEvent(c, &models.Event{Type: models.EventAdminSMTPTested})
+	c.Status(http.StatusNoContent)
 }
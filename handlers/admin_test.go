@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"gotwarden/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := newWardenCtx(models.NewMemoryDB())
+	ctx.SecretPhrase = "This a secret ... sshhhshh"
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin token"), bcrypt.MinCost)
+	ctx.AdminToken = string(hash)
+	router := ctx.Router()
+
+	send := func(session string) int {
+		req := httptest.NewRequest("GET", "/admin/api/users", nil)
+		req.AddCookie(&http.Cookie{Name: adminCookie, Value: session})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	session := ctx.adminSession(time.Now().Add(time.Minute).Unix())
+	if code := send(session); code != http.StatusOK {
+		t.Fatalf("the session is refused: %d", code)
+	}
+
+	// Signed with the secret of the tokens (the public default one here)
+	exp := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(ctx.SecretPhrase))
+	mac.Write([]byte("admin|" + exp))
+	forged := exp + "." + hex.EncodeToString(mac.Sum(nil))
+
+	for name, session := range map[string]string{
+		"forged":   forged,
+		"expired":  ctx.adminSession(time.Now().Add(-time.Second).Unix()),
+		"too long": ctx.adminSession(time.Now().Add(adminSessionValidity + time.Hour).Unix()),
+		"altered":  strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10) + session[strings.Index(session, "."):],
+		"garbage":  "session",
+	} {
+		if code := send(session); code != http.StatusUnauthorized {
+			t.Errorf("%s session: expected 401, got %d", name, code)
+		}
+	}
+
+	// The sessions survive a restart of the server and are valid on the other replicas sharing the secret
+	restarted := &WardenCtx{SecretPhrase: ctx.SecretPhrase, AdminToken: ctx.AdminToken}
+	if !restarted.validAdminSession(session) {
+		t.Error("the session is lost on restart")
+	}
+	restarted.SecretPhrase = "other secret"
+	if restarted.validAdminSession(session) {
+		t.Error("the session is valid with another secret")
+	}
+
+	// A new admin token closes the sessions
+	hash, _ = bcrypt.GenerateFromPassword([]byte("new admin token"), bcrypt.MinCost)
+	ctx.AdminToken = string(hash)
+	if code := send(session); code != http.StatusUnauthorized {
+		t.Errorf("the session survives the rotation of the admin token: %d", code)
+	}
+}
+
+func TestAdminActionsEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.NewMemoryDB()
+	ctx := newWardenCtx(db)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin token"), bcrypt.MinCost)
+	ctx.AdminToken = string(hash)
+	router := ctx.Router()
+
+	token := login(t, router, "target@example.com")
+	target, err := db.GetUserFromEmail(context.Background(), "target@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := &http.Cookie{Name: adminCookie, Value: ctx.adminSession(time.Now().Add(time.Minute).Unix())}
+	req := httptest.NewRequest("POST", "/admin/api/users/"+target.UUID+"/enable", nil)
+	req.AddCookie(session)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("enable: %d %s", w.Code, w.Body.String())
+	}
+
+	// The admin acts on the user, not as the user
+	events, _, err := db.GetEvents(context.Background(), &models.EventFilter{Types: models.AdminEventTypes, End: time.Now().Add(time.Hour)})
+	if err != nil || len(*events) != 1 {
+		t.Fatalf("the admin action is not recorded: %v (%v)", events, err)
+	}
+	if e := (*events)[0]; e.TargetUserUUID != target.UUID || e.UserUUID != "" || e.ActingUserUUID != "" {
+		t.Errorf("unexpected users of the admin action: %+v", e)
+	}
+
+	w = call(router, "GET", "/api/accounts/events", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("events: %d %s", w.Code, w.Body.String())
+	}
+	for _, e := range decode(t, w)["Data"].([]interface{}) {
+		if int(e.(map[string]interface{})["Type"].(float64)) == models.EventAdminUserEnabled {
+			t.Errorf("the admin action is into the events of the user: %v", e)
+		}
+	}
+
+	// The console log shows the target, its pages forbid the inline scripts
+	req = httptest.NewRequest("GET", "/admin/log", nil)
+	req.AddCookie(session)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), target.UUID) {
+		t.Errorf("the target is not into the log: %d %s", w.Code, w.Body.String())
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("unexpected CSP %q", csp)
+	}
+	for _, file := range []string{"/admin/static/console.css", "/admin/static/console.js"} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", file, nil))
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("%s: %d", file, w.Code)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package handlers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"gotwarden/apierror"
+	"gotwarden/metrics"
 	"gotwarden/models"
 	"gotwarden/util"
-	"log"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
@@ -15,13 +22,15 @@ import (
 
 // Login contains data when log in
 type Login struct {
-	Email         string `json:"email" binding:"required"`
-	Name          string `json:"name"`
-	PasswordHash  string `json:"masterPasswordHash" binding:"required"`
-	PasswordHint  string `json:"masterPasswordHint"`
-	Key           string `json:"key" binding:"required"`
-	Kdf           int    `json:"kdf"`
-	KdfIterations int    `json:"kdfIterations" binding:"required"`
+	Email          string `json:"email" binding:"required"`
+	Name           string `json:"name"`
+	PasswordHash   string `json:"masterPasswordHash" binding:"required"`
+	PasswordHint   string `json:"masterPasswordHint"`
+	Key            string `json:"key" binding:"required"`
+	Kdf            int    `json:"kdf"`
+	KdfIterations  int    `json:"kdfIterations" binding:"required"`
+	KdfMemory      int    `json:"kdfMemory"`
+	KdfParallelism int    `json:"kdfParallelism"`
 }
 
 // PreLogin contains data needed to prepare login
@@ -35,6 +44,7 @@ type Cipher struct {
 	FolderID        string        `json:"folderId"`
 	OrganisationID  string        `json:"organisationId"`
 	Name            string        `json:"name" binding:"required"`
+	Key             string        `json:"key"`
 	Notes           string        `json:"notes"`
 	Favorite        bool          `json:"favorite"`
 	Fields          []interface{} `json:"fields"`
@@ -45,6 +55,18 @@ type Cipher struct {
 	Identity        interface{}   `json:"identity"`
 }
 
+// PartialCipher data request (the favorite flag is required to never reset it by mistake)
+type PartialCipher struct {
+	FolderID string `json:"folderId"`
+	Favorite *bool  `json:"favorite" binding:"required"`
+}
+
+// DomainsSettings data request
+type DomainsSettings struct {
+	EquivalentDomains               [][]string `json:"equivalentDomains"`
+	ExcludedGlobalEquivalentDomains []int      `json:"excludedGlobalEquivalentDomains"`
+}
+
 // Attachment data Request
 type Attachment struct {
 	UUID string `json:"Id"`
@@ -52,7 +74,7 @@ type Attachment struct {
 		Head     string `json:"head"`
 		Filename string `json:"filename"`
 	} `json:"data" binding:"required"`
-	Size int    `dv:"size" json:"Size"`
+	Size int    `db:"size" json:"Size"`
 	File []byte `db:"file" json:"File"`
 }
 
@@ -62,42 +84,73 @@ func (ctx *WardenCtx) SignUp(c *gin.Context) {
 
 	err := c.BindJSON(&l)
 	if err != nil {
-		log.Printf("Binding error %s", err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("This email doesn't exist"))
+		apierror.Abort(c, apierror.Binding(err))
 		return
 	}
 
 	// Check if a user with this profile exists (based on email)
-	_, err = ctx.Db.GetUserFromEmail(l.Email)
+	_, err = ctx.Db.GetUserFromEmail(c.Request.Context(), l.Email)
 	if err == nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("A user with this email already exists"))
+		apierror.Abort(c, apierror.Conflict("A user with this email already exists"))
+		return
+	}
+	if !errors.Is(err, models.ErrNotFound) {
+		apierror.Abort(c, apierror.Internal("Cannot register this new user", err))
 		return
 	}
 
-	// Create new user based on the profile data
+	// When signups are closed, only invited emails can register
+	invitation, err := ctx.Db.GetInvitation(c.Request.Context(), strings.ToLower(l.Email))
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		apierror.Abort(c, apierror.Internal("Cannot register this new user", err))
+		return
+	}
+	if !ctx.SignupsAllowed && invitation == nil {
+		apierror.Abort(c, apierror.Forbidden("Registration not allowed"))
+		return
+	}
+
+	// Create new user based on the profile data (the invitation is used)
 	u := models.NewUser(l.Name, l.Email, l.PasswordHash, l.PasswordHint, l.Key, l.Kdf, l.KdfIterations)
-	err = ctx.Db.AddUser(u)
+	u.KdfMemory, u.KdfParallelism = l.KdfMemory, l.KdfParallelism
+	err = ctx.Db.WithTx(c.Request.Context(), func(db models.Datastore) error {
+		if err := db.AddUser(c.Request.Context(), u); err != nil {
+			return err
+		}
+		if invitation != nil {
+			return db.DeleteInvitation(c.Request.Context(), invitation)
+		}
+		return nil
+	})
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Cannot register this new user"))
+		apierror.Abort(c, apierror.Internal("Cannot register this new user", err))
 		return
 	}
+	metrics.Registrations.Inc()
 }
 
 // PreLogin gets info needed for login
 func (ctx *WardenCtx) PreLogin(c *gin.Context) {
 	var login PreLogin
 	if err := c.ShouldBindJSON(&login); err != nil {
-		c.JSON(http.StatusBadRequest, FormattedError("Bad data request provided"))
+		apierror.Abort(c, apierror.Binding(err))
 	} else {
-		u, err := ctx.Db.GetUserFromEmail(login.Email)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("Bad data request provided"))
+		u, err := ctx.Db.GetUserFromEmail(c.Request.Context(), login.Email)
+		if errors.Is(err, models.ErrNotFound) {
+			apierror.Abort(c, apierror.Validation("Email", "This email doesn't exist"))
+		} else if err != nil {
+			apierror.Abort(c, apierror.Internal("Database failed to get the user", err))
 		} else {
-			// Response Kdf and KdfIterations used
-			c.JSON(200, gin.H{
+			// Response Kdf and KdfIterations used (and the memory and parallelism of Argon2id)
+			kdf := gin.H{
 				"Kdf":           u.Kdf,
 				"KdfIterations": u.KdfIterations,
-			})
+			}
+			if u.Kdf == models.KdfArgon2id {
+				kdf["KdfMemory"] = u.KdfMemory
+				kdf["KdfParallelism"] = u.KdfParallelism
+			}
+			c.JSON(200, kdf)
 		}
 	}
 }
@@ -107,46 +160,156 @@ func (ctx *WardenCtx) Synchronize(c *gin.Context) {
 	claim := jwt.ExtractClaims(c)
 
 	if claim["sub"] == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("JWT fail to reach user"))
+		apierror.Abort(c, apierror.Unauthorized("JWT fail to reach user"))
 		return
 	}
 
 	// Get user from the id into the token
-	u := ctx.Db.GetUser(claim["sub"].(string))
+	u, err := ctx.Db.GetUser(c.Request.Context(), claim["sub"].(string))
+	if err != nil {
+		apierror.Abort(c, dbError("User", err))
+		return
+	}
+
+	// Nothing changed since the last sync of the client
+	etag := u.SyncETag(c.Query("excludeDomains") == "true")
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
 
-	ciphers, _ := ctx.Db.GetCiphersByUserUUID(u.UUID)
-	var cj []interface{}
-	for _, cipher := range *ciphers {
-		cj = append(cj, cipher.Jsonify())
+	ciphers, err := ctx.Db.GetCiphersByUserUUID(c.Request.Context(), u.UUID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to load the ciphers", err))
+		return
+	}
+	cj := make([]interface{}, 0, len(*ciphers))
+	for i := range *ciphers {
+		cj = append(cj, ctx.cipherJSON(&(*ciphers)[i]))
 	}
 
-	folders, _ := ctx.Db.GetFoldersByUserUUID(u.UUID)
+	folders, err := ctx.Db.GetFoldersByUserUUID(c.Request.Context(), u.UUID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to load the folders", err))
+		return
+	}
+	collections, err := ctx.Db.GetCollectionsByUserUUID(c.Request.Context(), u.UUID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to load the collections", err))
+		return
+	}
+
+	// The web vault gets the domains from the settings
+	var domains *models.Domains
+	if c.Query("excludeDomains") != "true" {
+		domains = u.GetDomains()
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"Profile": u,
-		"Folders": folders,
-		"Ciphers": cj,
-		"Domains": models.Domains{
-			EquivalentDomains: nil,
-			Object:            "domains",
-		},
-		"Object": "sync",
+		"Profile":     u,
+		"Folders":     folders,
+		"Collections": collections,
+		"Ciphers":     cj,
+		"Domains":     domains,
+		"Object":      "sync",
 	})
 }
 
+// GetDomains provides the equivalent domains settings
+func (ctx *WardenCtx) GetDomains(c *gin.Context) {
+	claim := jwt.ExtractClaims(c)
+
+	u, err := ctx.Db.GetUser(c.Request.Context(), claim["sub"].(string))
+	if err != nil {
+		apierror.Abort(c, dbError("User", err))
+		return
+	}
+	c.JSON(http.StatusOK, u.GetDomains())
+}
+
+// SaveDomains updates the equivalent domains settings
+func (ctx *WardenCtx) SaveDomains(c *gin.Context) {
+	claim := jwt.ExtractClaims(c)
+
+	var settings DomainsSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		apierror.Abort(c, apierror.Binding(err))
+		return
+	}
+
+	u, err := ctx.Db.GetUser(c.Request.Context(), claim["sub"].(string))
+	if err != nil {
+		apierror.Abort(c, dbError("User", err))
+		return
+	}
+	u.SetDomains(settings.EquivalentDomains, settings.ExcludedGlobalEquivalentDomains)
+	u.RevisionDate = time.Now()
+	if err := ctx.Db.SaveUser(c.Request.Context(), u); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to save domains", err))
+		return
+	}
+	c.JSON(http.StatusOK, u.GetDomains())
+}
+
+// GetRevisionDate provides the date of the last change of the account (milliseconds since epoch)
+func (ctx *WardenCtx) GetRevisionDate(c *gin.Context) {
+	claim := jwt.ExtractClaims(c)
+
+	u, err := ctx.Db.GetUser(c.Request.Context(), claim["sub"].(string))
+	if err != nil {
+		apierror.Abort(c, dbError("User", err))
+		return
+	}
+	c.JSON(http.StatusOK, u.RevisionDate.UnixNano()/int64(time.Millisecond))
+}
+
+// touchUser updates the revision date of the account (the clients will sync again)
+func (ctx *WardenCtx) touchUser(c *gin.Context, userUUID string) {
+	if err := ctx.Db.TouchUser(c.Request.Context(), userUUID); err != nil {
+		requestLog(c).WithError(err).WithField("target_user_id", userUUID).Error("Failed to update the revision date")
+	}
+}
+
+// touchCipher updates the revision date of the accounts having the cipher: its owner or the confirmed members of
+// its organization
+func (ctx *WardenCtx) touchCipher(c *gin.Context, cd *models.CipherData) {
+	if cd.OrganizationUUID == "" {
+		ctx.touchUser(c, cd.UserUUID)
+		return
+	}
+	ctx.touchOrganization(c, cd.OrganizationUUID)
+}
+
+// touchOrganization updates the revision date of the confirmed members of the organization
+func (ctx *WardenCtx) touchOrganization(c *gin.Context, orgUUID string) {
+	if err := ctx.Db.TouchOrganizationUsers(c.Request.Context(), orgUUID); err != nil {
+		requestLog(c).WithError(err).WithField("organization_id", orgUUID).Error("Failed to update the revision date of the members")
+	}
+}
+
 // GetKeys provides public and encrypted private keys
 func (ctx *WardenCtx) GetKeys(c *gin.Context) {
 	claim := jwt.ExtractClaims(c)
 	if claim["sub"] == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Middleware JWT failed"))
+		apierror.Abort(c, apierror.Unauthorized("Middleware JWT failed"))
 		return
 	}
 	// Get user from the id into the token
-	u := ctx.Db.GetUser(claim["sub"].(string))
+	u, err := ctx.Db.GetUser(c.Request.Context(), claim["sub"].(string))
+	if err != nil {
+		apierror.Abort(c, dbError("User", err))
+		return
+	}
 	u.PrivateKey = []byte(c.PostForm("encryptedPrivateKey"))
 	u.PublicKey = []byte(c.PostForm("publicKey"))
+	u.RevisionDate = time.Now()
 
-	ctx.Db.SaveUser(u)
+	if err := ctx.Db.SaveUser(c.Request.Context(), u); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to save the keys", err))
+		return
+	}
 }
 
 // SaveCipher creates a new Cipher component
@@ -159,23 +322,12 @@ func (ctx *WardenCtx) SaveCipher(c *gin.Context) {
 	cipher := Cipher{}
 
 	if err := c.ShouldBindJSON(&cipher); err != nil {
-		log.Printf("A : %s", err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError(err.Error()))
+		apierror.Abort(c, apierror.Binding(err))
 		return
 	}
 	// Check if the folder id exist and is belonging to the user
-	if cipher.FolderID != "" {
-		f := ctx.Db.GetFolder(cipher.FolderID)
-		if f == nil {
-			log.Print("B")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Database failed to find a folder for this id"))
-			return
-		}
-		if f.UserUUID != userUUID {
-			log.Printf("C")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Invalid folder"))
-			return
-		}
+	if !ctx.userFolder(c, cipher.FolderID) {
+		return
 	}
 
 	// Save the cipher
@@ -183,50 +335,83 @@ func (ctx *WardenCtx) SaveCipher(c *gin.Context) {
 
 	switch c.Request.Method {
 	case "POST":
-		// Create a new cipher with uuid.New() UUID
+		// Create a new cipher with uuid.New() UUID (shared later with an organization by /ciphers/share)
 		cd = cipher.ToCipherData(userUUID, uuid.New().String())
-		err := ctx.Db.AddCipher(cd)
+		cd.OrganizationUUID = ""
+		err := ctx.Db.AddCipher(c.Request.Context(), cd)
 		if err != nil {
-			log.Printf("D1 : %s", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Database failed to add cipher"))
+			apierror.Abort(c, apierror.Internal("Database failed to add cipher", err))
 			return
 		}
+		ctx.logEvent(c, &models.Event{Type: models.EventCipherCreated, CipherUUID: cd.UUID, OrganizationUUID: cd.OrganizationUUID})
+		ctx.touchUser(c, userUUID)
 	case "PUT":
-		// Update existing cipher with uuid from parameter
-		cd = cipher.ToCipherData(userUUID, c.Param("uuid"))
-		err := ctx.Db.SaveCipher(cd)
+		// Update existing cipher loaded by the authorization layer (owner, organization and trash are kept)
+		stored := loadedCipher(c)
+		cd = cipher.ToCipherData(stored.UserUUID, stored.UUID)
+		cd.OrganizationUUID = stored.OrganizationUUID
+		cd.DeletedAt = stored.DeletedAt
+		cd.Attachments = stored.Attachments
+		cd.CollectionUUIDs = stored.CollectionUUIDs
+		if stored.UserUUID != userUUID {
+			// The folder and the favorite flag are the ones of the owner
+			cd.FolderUUID = stored.FolderUUID
+			cd.Favorite = stored.Favorite
+		}
+		err := ctx.Db.SaveCipher(c.Request.Context(), cd)
 		if err != nil {
-			log.Printf("D2 : %s", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Database failed to save cipher"))
+			apierror.Abort(c, apierror.Internal("Database failed to save cipher", err))
 			return
 		}
+		ctx.logEvent(c, &models.Event{Type: models.EventCipherUpdated, CipherUUID: cd.UUID, OrganizationUUID: cd.OrganizationUUID})
+		ctx.touchCipher(c, cd)
 	default:
-		log.Print("default")
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("Unexpected method found"))
+		apierror.Abort(c, apierror.BadRequest("Unexpected method found"))
 		return
 	}
 
-	c.JSON(http.StatusOK, cd.Jsonify())
+	c.JSON(http.StatusOK, ctx.cipherJSON(cd))
 
 }
 
-// DeleteCipher action
-func (ctx *WardenCtx) DeleteCipher(c *gin.Context) {
-	claim := jwt.ExtractClaims(c)
-	// Get user from the id into the token
-	userUUID := claim["sub"].(string)
-	log.Printf("Delete Cipher for user %s", userUUID)
+// SavePartialCipher updates only the folder and the favorite flag of a cipher (the encrypted data are kept)
+func (ctx *WardenCtx) SavePartialCipher(c *gin.Context) {
+	var partial PartialCipher
+	if err := c.ShouldBindJSON(&partial); err != nil {
+		apierror.Abort(c, apierror.Binding(err))
+		return
+	}
+
+	cd := loadedCipher(c)
 
-	uuid := c.Param("uuid")
-	log.Printf("Cipher UUID %s", uuid)
+	// Check if the folder id exist and is belonging to the user
+	if !ctx.userFolder(c, partial.FolderID) {
+		return
+	}
 
-	cipher := ctx.Db.GetCipher(uuid)
-	if cipher == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Failed to get the designed cipher"))
+	cd.FolderUUID = partial.FolderID
+	cd.Favorite = *partial.Favorite
+	cd.UpdateAt = time.Now()
+	if err := ctx.Db.SaveCipher(c.Request.Context(), cd); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to save cipher", err))
 		return
 	}
+	ctx.logEvent(c, &models.Event{Type: models.EventCipherUpdated, CipherUUID: cd.UUID, OrganizationUUID: cd.OrganizationUUID})
+	ctx.touchCipher(c, cd)
 
-	ctx.Db.DeleteCipher(cipher)
+	c.JSON(http.StatusOK, ctx.cipherJSON(cd))
+}
+
+// DeleteCipher action
+func (ctx *WardenCtx) DeleteCipher(c *gin.Context) {
+	cipher := loadedCipher(c)
+
+	if err := ctx.Db.DeleteCipher(c.Request.Context(), cipher); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to delete cipher", err))
+		return
+	}
+	ctx.logEvent(c, &models.Event{Type: models.EventCipherDeleted, UserUUID: cipher.UserUUID, CipherUUID: cipher.UUID, OrganizationUUID: cipher.OrganizationUUID})
+	ctx.touchCipher(c, cipher)
 }
 
 // SaveFolder creates or updates a Folder
@@ -239,7 +424,7 @@ func (ctx *WardenCtx) SaveFolder(c *gin.Context) {
 	f.UserUUID = claim["sub"].(string)
 
 	if err := c.ShouldBindJSON(&f); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError(err.Error()))
+		apierror.Abort(c, apierror.Binding(err))
 		return
 	}
 
@@ -247,21 +432,25 @@ func (ctx *WardenCtx) SaveFolder(c *gin.Context) {
 	case "POST":
 		// Create a new folder with uuid.New() UUID
 		f.UUID = uuid.New().String()
-		err := ctx.Db.AddFolder(&f)
+		err := ctx.Db.AddFolder(c.Request.Context(), &f)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Database failed to add cipher"))
+			apierror.Abort(c, apierror.Internal("Database failed to add folder", err))
 			return
 		}
+		ctx.logEvent(c, &models.Event{Type: models.EventFolderCreated, FolderUUID: f.UUID})
+		ctx.touchUser(c, f.UserUUID)
 	case "PUT":
-		// Update existing cipher with uuid from parameter
-		f.UUID = c.Param("uuid")
-		err := ctx.Db.SaveFolder(&f)
+		// Update existing folder loaded by the authorization layer
+		f.UUID = loadedFolder(c).UUID
+		err := ctx.Db.SaveFolder(c.Request.Context(), &f)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Database failed to save cipher"))
+			apierror.Abort(c, apierror.Internal("Database failed to save folder", err))
 			return
 		}
+		ctx.logEvent(c, &models.Event{Type: models.EventFolderUpdated, FolderUUID: f.UUID})
+		ctx.touchUser(c, f.UserUUID)
 	default:
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("Unexpected method found"))
+		apierror.Abort(c, apierror.BadRequest("Unexpected method found"))
 		return
 	}
 
@@ -271,129 +460,131 @@ func (ctx *WardenCtx) SaveFolder(c *gin.Context) {
 
 // DeleteFolder action
 func (ctx *WardenCtx) DeleteFolder(c *gin.Context) {
-	claim := jwt.ExtractClaims(c)
-	// Get user from the id into the token
-	userUUID := claim["sub"].(string)
-	log.Printf("Delete Folder for user %s", userUUID)
-
-	uuid := c.Param("uuid")
-	log.Printf("Folder UUID %s", uuid)
+	f := loadedFolder(c)
 
-	f := ctx.Db.GetFolder(uuid)
-	if f == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Failed to get the designed cipher"))
+	if err := ctx.Db.DeleteFolder(c.Request.Context(), f); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to delete folder", err))
 		return
 	}
-
-	ctx.Db.DeleteFolder(f)
+	ctx.logEvent(c, &models.Event{Type: models.EventFolderDeleted, UserUUID: f.UserUUID, FolderUUID: f.UUID})
+	ctx.touchUser(c, f.UserUUID)
 }
 
 // ClearToken clears token for the device
 func (ctx *WardenCtx) ClearToken(c *gin.Context) {
-	claim := jwt.ExtractClaims(c)
-	// Get device UUID from the token
-	deviceUUID := claim["device"].(string)
-
-	device := ctx.Db.GetDevice(deviceUUID)
-
-	if device == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Failed to get data for the device"))
-		return
-	}
+	device := loadedDevice(c)
 	device.PushToken = ""
 
-	err := ctx.Db.SaveDevice(device)
+	err := ctx.Db.SaveDevice(c.Request.Context(), device)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Failed to update device"))
+		apierror.Abort(c, apierror.Internal("Failed to update device", err))
 		return
 	}
 }
 
 // UpdateToken updates device with provided token
 func (ctx *WardenCtx) UpdateToken(c *gin.Context) {
-	claim := jwt.ExtractClaims(c)
-	// Get device UUID from the token
-	deviceUUID := claim["device"].(string)
-
-	device := ctx.Db.GetDevice(deviceUUID)
-
-	if device == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Failed to get data for the device"))
-		return
-	}
+	device := loadedDevice(c)
 	device.PushToken = c.PostForm("pushtoken")
 
-	err := ctx.Db.SaveDevice(device)
+	err := ctx.Db.SaveDevice(c.Request.Context(), device)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, FormattedError("Failed to update device"))
+		apierror.Abort(c, apierror.Internal("Failed to update device", err))
 		return
 	}
 }
 
-// GetAttachment provides a pointed attachment (no auth needed)
+// cipherJSON provides the cipher with the download URLs of its attachments
+func (ctx *WardenCtx) cipherJSON(cd *models.CipherData) *models.CipherObject {
+	json := cd.Jsonify()
+	for i := range json.Attachments {
+		json.Attachments[i].URL = ctx.attachmentURL(cd.UUID, json.Attachments[i].UUID)
+	}
+	return json
+}
+
+// attachmentURLLabel derives the key signing the download URLs of the attachments from the secret phrase
+const attachmentURLLabel = "gotwarden attachment urls"
+
+// attachmentURL provides the download URL of the attachment, signed for the lifetime of an access token
+func (ctx *WardenCtx) attachmentURL(cipherUUID, attachmentUUID string) string {
+	exp := strconv.FormatInt(time.Now().Add(ctx.Validity).Unix(), 10)
+	return ctx.AttachmentURL + "/" + cipherUUID + "/" + attachmentUUID + "?expires=" + exp + "&signature=" + ctx.attachmentSignature(cipherUUID, attachmentUUID, exp)
+}
+
+// attachmentSignature signs the download URL of an attachment until the expiry provided
+func (ctx *WardenCtx) attachmentSignature(cipherUUID, attachmentUUID, exp string) string {
+	mac := hmac.New(sha256.New, ctx.derivedKey(attachmentURLLabel))
+	mac.Write([]byte(cipherUUID + "/" + attachmentUUID + "|" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GetAttachment provides a pointed attachment from its signed URL (no access token sent by the clients)
 func (ctx *WardenCtx) GetAttachment(c *gin.Context) {
-	att := ctx.Db.GetAttachment(c.Param("attachment_uuid"))
-	if att == nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("Cannot find an attachment with this uuid"))
+	exp, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	signature := ctx.attachmentSignature(c.Param("uuid"), c.Param("attachment_uuid"), c.Query("expires"))
+	if err != nil || time.Now().Unix() > exp || !hmac.Equal([]byte(c.Query("signature")), []byte(signature)) {
+		apierror.Abort(c, apierror.NotFound("Attachment"))
 		return
 	}
 
-	json := att.Jsonify()
-	json.URL = ctx.AttachmentURL + "/" + att.CipherUUID + "/" + att.UUID
+	att, err := ctx.Db.GetAttachment(c.Request.Context(), c.Param("attachment_uuid"))
+	if err != nil {
+		apierror.Abort(c, dbError("Attachment", err))
+		return
+	}
+	if att.CipherUUID != c.Param("uuid") {
+		apierror.Abort(c, apierror.NotFound("Attachment"))
+		return
+	}
 
 	c.JSON(http.StatusOK, att.Jsonify())
 }
 
-// SaveAttachment saves a pointed attachment into a Cypher
-func (ctx *WardenCtx) SaveAttachment(c *gin.Context) {
-	claim := jwt.ExtractClaims(c)
+// GetAttachmentData provides a fresh download URL of the attachment, asked by the clients before downloading it
+func (ctx *WardenCtx) GetAttachmentData(c *gin.Context) {
+	att := loadedAttachment(c)
 
-	// Check if the cipher belong to the user
-	userUUID := claim["sub"].(string)
+	json := att.Jsonify()
+	json.URL = ctx.attachmentURL(att.CipherUUID, att.UUID)
+	c.JSON(http.StatusOK, json)
+}
 
-	cipher := ctx.Db.GetCipher(c.Param("uuid"))
-	if cipher.UserUUID != userUUID {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, FormattedError("Oops! This cipher belong to another user"))
-		return
-	}
+// SaveAttachment saves a pointed attachment into a Cypher
+func (ctx *WardenCtx) SaveAttachment(c *gin.Context) {
+	cipher := loadedCipher(c)
 	a := Attachment{}
 
 	if err := c.ShouldBindJSON(&a); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("Bad request: "+err.Error()))
+		apierror.Abort(c, apierror.Binding(err))
 		return
 	}
 
 	attachment := a.ToAttachmentData(cipher.UUID)
-	ctx.Db.AddAttachment(attachment)
+	if err := ctx.Db.AddAttachment(c.Request.Context(), attachment); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to add attachment", err))
+		return
+	}
+	ctx.logEvent(c, &models.Event{Type: models.EventCipherAttachmentCreated, CipherUUID: cipher.UUID, OrganizationUUID: cipher.OrganizationUUID})
+	ctx.touchCipher(c, cipher)
 	json := attachment.Jsonify()
-	json.URL = ctx.AttachmentURL + "/" + cipher.UUID + "/" + attachment.UUID
+	json.URL = ctx.attachmentURL(cipher.UUID, attachment.UUID)
 
 	c.JSON(http.StatusOK, json)
 }
 
 // DeleteAttachment deletes a pointed attachment into a Cypher
 func (ctx *WardenCtx) DeleteAttachment(c *gin.Context) {
-	claim := jwt.ExtractClaims(c)
+	cipher := loadedCipher(c)
+	a := loadedAttachment(c)
 
-	// Check if the cipher belong to the user
-	userUUID := claim["sub"].(string)
-
-	a := ctx.Db.GetAttachment(c.Param("uuid_attachment"))
-
-	// Check if this attachment belong to cipher
-	if a.CipherUUID != c.Param(("uuid")) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("The attachment doesn't belong to this cipher"))
-		return
-	}
-
-	cipher := ctx.Db.GetCipher(c.Param("uuid"))
-	if cipher.UserUUID != userUUID {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, FormattedError("Oops! This cipher belong to another user"))
+	// This user can delete this attachment
+	if err := ctx.Db.DeleteAttachment(c.Request.Context(), a); err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to delete attachment", err))
 		return
 	}
-
-	// This user can delete this attachment
-	ctx.Db.DeleteAttachment(a)
+	ctx.logEvent(c, &models.Event{Type: models.EventCipherAttachmentDeleted, CipherUUID: cipher.UUID, OrganizationUUID: cipher.OrganizationUUID})
+	ctx.touchCipher(c, cipher)
 }
 
 // ToAttachmentData populates data fields for Attachment
@@ -427,6 +618,7 @@ func (c *Cipher) ToCipherData(uu string, uuid string) *models.CipherData {
 		Favorite:         c.Favorite,
 		Type:             c.Type,
 		Name:             c.Name,
+		Key:              c.Key,
 		Notes:            util.MarshalObject(c.Notes),
 		Fields:           util.MarshalArray(c.Fields),
 		Login:            util.MarshalObject(c.Login),
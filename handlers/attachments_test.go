@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentURL(t *testing.T) {
+	v := newVault(t)
+
+	w := call(v.router, "GET", "/api/ciphers/"+v.cipher+"/attachment/"+v.attachment, v.tokens["owner"], nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("attachment data: %d %s", w.Code, w.Body.String())
+	}
+	signed := decode(t, w)["Url"].(string)
+	if !strings.HasPrefix(signed, "/attachments/"+v.cipher+"/"+v.attachment+"?") {
+		t.Fatalf("unexpected URL %s", signed)
+	}
+
+	// The clients download the attachment without access token
+	w = call(v.router, "GET", signed, "", nil)
+	if w.Code != http.StatusOK || decode(t, w)["File"] != "ZmlsZQ==" {
+		t.Fatalf("download: %d %s", w.Code, w.Body.String())
+	}
+	sync := decode(t, call(v.router, "GET", "/api/sync", v.tokens["owner"], nil))
+	for _, c := range sync["Ciphers"].([]interface{}) {
+		attachments, _ := c.(map[string]interface{})["Attachments"].([]interface{})
+		for _, a := range attachments {
+			if w := call(v.router, "GET", a.(map[string]interface{})["Url"].(string), "", nil); w.Code != http.StatusOK {
+				t.Errorf("download from the sync: %d %s", w.Code, w.Body.String())
+			}
+		}
+	}
+
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+	other := create(t, v.router, "/api/ciphers/"+v.cipher+"/attachment", v.tokens["owner"], map[string]interface{}{"data": map[string]interface{}{"filename": "2.other"}, "Size": 1, "File": "eA=="})
+	for name, path := range map[string]string{
+		"unsigned": "/attachments/" + v.cipher + "/" + v.attachment,
+		"tampered": signed[:len(signed)-1] + "0",
+		"expired":  "/attachments/" + v.cipher + "/" + v.attachment + "?expires=" + past + "&signature=" + newWardenCtx(v.db).attachmentSignature(v.cipher, v.attachment, past),
+		"extended": "/attachments/" + v.cipher + "/" + v.attachment + "?expires=" + future + "&signature=" + signed[strings.Index(signed, "signature=")+len("signature="):],
+		"other":    "/attachments/" + v.cipher + "/" + other + signed[strings.Index(signed, "?"):],
+	} {
+		if w := call(v.router, "GET", path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s URL: expected 404, got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	// The URLs survive a restart of the server and are valid on the other replicas sharing the secret
+	restarted := newWardenCtx(v.db)
+	if w := call(restarted.Router(), "GET", signed, "", nil); w.Code != http.StatusOK {
+		t.Errorf("download after a restart: %d %s", w.Code, w.Body.String())
+	}
+	restarted.SecretPhrase = "other secret"
+	if w := call(restarted.Router(), "GET", signed, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("download with another secret: expected 404, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"errors"
+	"gotwarden/apierror"
+	"gotwarden/models"
+	"strings"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Keys of the resources loaded into the gin context by the authorization layer
+const (
+	cipherKey           = "gotwarden.cipher"
+	folderKey           = "gotwarden.folder"
+	attachmentKey       = "gotwarden.attachment"
+	deviceKey           = "gotwarden.device"
+	organizationUserKey = "gotwarden.organization_user"
+)
+
+// Access levels of the authorization layer
+const (
+	// accessRead lets the user see the resource
+	accessRead = iota
+	// accessWrite lets the user modify the resource
+	accessWrite
+	// accessOwner is needed for the data specific to the owner (ie folder and favorite of a cipher)
+	accessOwner
+)
+
+// currentUser provides the uuid of the user logged in
+func currentUser(c *gin.Context) string {
+	sub, _ := jwt.ExtractClaims(c)["sub"].(string)
+	return sub
+}
+
+// dbError hides the records not found and reports the other failures of the database
+func dbError(resource string, err error) *apierror.Error {
+	if errors.Is(err, models.ErrNotFound) {
+		return apierror.NotFound(resource)
+	}
+	return apierror.Internal("Database failed to get the "+strings.ToLower(resource), err)
+}
+
+// LoadCipher loads the cipher of the route param if the user has the access (404 if he cannot see it, 403 if he cannot modify it)
+func (ctx *WardenCtx) LoadCipher(param string, access int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userUUID := currentUser(c)
+
+		cd, err := ctx.Db.GetCipher(c.Request.Context(), c.Param(param))
+		if err != nil {
+			apierror.Abort(c, dbError("Cipher", err))
+			return
+		}
+		if cd.UserUUID != userUUID {
+			canRead, err := ctx.Db.CanAccessCipher(c.Request.Context(), userUUID, cd.UUID, false)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal("Database failed to check the access to the cipher", err))
+				return
+			}
+			if !canRead {
+				apierror.Abort(c, apierror.NotFound("Cipher"))
+				return
+			}
+			canWrite, err := ctx.Db.CanAccessCipher(c.Request.Context(), userUUID, cd.UUID, true)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal("Database failed to check the access to the cipher", err))
+				return
+			}
+			if access == accessOwner || (access == accessWrite && !canWrite) {
+				apierror.Abort(c, apierror.Forbidden("You cannot modify this cipher"))
+				return
+			}
+			// The responses tell the clients whether the cipher can be edited
+			cd.ReadOnly = !canWrite
+		}
+		c.Set(cipherKey, cd)
+	}
+}
+
+// LoadFolder loads the folder of the route param if it belongs to the user
+func (ctx *WardenCtx) LoadFolder(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f, err := ctx.Db.GetFolder(c.Request.Context(), c.Param(param))
+		if err != nil {
+			apierror.Abort(c, dbError("Folder", err))
+			return
+		}
+		if f.UserUUID != currentUser(c) {
+			apierror.Abort(c, apierror.NotFound("Folder"))
+			return
+		}
+		c.Set(folderKey, f)
+	}
+}
+
+// userFolder checks the folder (none if empty) belongs to the user
+func (ctx *WardenCtx) userFolder(c *gin.Context, folderUUID string) bool {
+	if folderUUID == "" {
+		return true
+	}
+	f, err := ctx.Db.GetFolder(c.Request.Context(), folderUUID)
+	if err == nil && f.UserUUID != currentUser(c) {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		apierror.Abort(c, dbError("Folder", err))
+		return false
+	}
+	return true
+}
+
+// LoadAttachment loads the attachment of the route param if it belongs to the cipher loaded before
+func (ctx *WardenCtx) LoadAttachment(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cd := loadedCipher(c)
+		a, err := ctx.Db.GetAttachment(c.Request.Context(), c.Param(param))
+		if err != nil {
+			apierror.Abort(c, dbError("Attachment", err))
+			return
+		}
+		if cd == nil || a.CipherUUID != cd.UUID {
+			apierror.Abort(c, apierror.NotFound("Attachment"))
+			return
+		}
+		c.Set(attachmentKey, a)
+	}
+}
+
+// LoadDevice loads the device of the route param if it belongs to the user
+func (ctx *WardenCtx) LoadDevice(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d, err := ctx.Db.GetDevice(c.Request.Context(), c.Param(param))
+		if err != nil {
+			apierror.Abort(c, dbError("Device", err))
+			return
+		}
+		if d.UserUUID != currentUser(c) {
+			apierror.Abort(c, apierror.NotFound("Device"))
+			return
+		}
+		c.Set(deviceKey, d)
+	}
+}
+
+// LoadOrganization loads the membership of the user into the organization of the route param (403 if admin is required)
+func (ctx *WardenCtx) LoadOrganization(param string, admin bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ou, err := ctx.Db.GetOrganizationUser(c.Request.Context(), c.Param(param), currentUser(c))
+		if err != nil {
+			apierror.Abort(c, dbError("Organization", err))
+			return
+		}
+		if ou.Status != models.OrganizationUserConfirmed {
+			apierror.Abort(c, apierror.NotFound("Organization"))
+			return
+		}
+		if admin && !ou.IsAdmin() {
+			apierror.Abort(c, apierror.Forbidden("Only the administrators can manage the organization"))
+			return
+		}
+		c.Set(organizationUserKey, ou)
+	}
+}
+
+func loadedCipher(c *gin.Context) *models.CipherData {
+	cd, _ := c.Get(cipherKey)
+	cipher, _ := cd.(*models.CipherData)
+	return cipher
+}
+
+func loadedFolder(c *gin.Context) *models.Folder {
+	f, _ := c.Get(folderKey)
+	folder, _ := f.(*models.Folder)
+	return folder
+}
+
+func loadedAttachment(c *gin.Context) *models.AttachmentData {
+	a, _ := c.Get(attachmentKey)
+	attachment, _ := a.(*models.AttachmentData)
+	return attachment
+}
+
+func loadedDevice(c *gin.Context) *models.Device {
+	d, _ := c.Get(deviceKey)
+	device, _ := d.(*models.Device)
+	return device
+}
+
+func loadedOrganizationUser(c *gin.Context) *models.OrganizationUser {
+	ou, _ := c.Get(organizationUserKey)
+	member, _ := ou.(*models.OrganizationUser)
+	return member
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"gotwarden/models"
+	"gotwarden/notifications"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// vault is the data of the users of the authorization tests
+type vault struct {
+	router http.Handler
+	db     *models.DB
+	tokens map[string]string
+	users  map[string]string
+
+	cipher, folder, attachment, device string
+	orgCipher, organization            string
+	intruderCipher                     string
+}
+
+// newTestRouter creates a router on a temporary sqlite database
+func newTestRouter(t *testing.T) (http.Handler, *models.DB) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := models.NewDB("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newWardenCtx(db).Router(), db
+}
+
+// newWardenCtx creates the context of the test routers on the store
+func newWardenCtx(db models.Datastore) *WardenCtx {
+	return &WardenCtx{
+		Db:             db,
+		SecretPhrase:   "test secret",
+		Validity:       time.Hour,
+		RefeshValidity: time.Hour,
+		IdentityURL:    "/identity",
+		AttachmentURL:  "/attachments",
+		IconURL:        "/icons",
+		SignupsAllowed: true,
+		Notifications:  notifications.NewHub(),
+	}
+}
+
+// call sends a request with a JSON body (nil for none) as the user of the token
+func call(router http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// decode reads the JSON response
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("invalid response %d %s: %s", w.Code, w.Body.String(), err)
+	}
+	return m
+}
+
+// login registers the user and provides its access token
+func login(t *testing.T, router http.Handler, email string) string {
+	t.Helper()
+	w := call(router, "POST", "/api/accounts/register", "", gin.H{
+		"email": email, "name": email, "masterPasswordHash": "hash", "key": "key", "kdf": 0, "kdfIterations": 100000,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("register %s: %d %s", email, w.Code, w.Body.String())
+	}
+
+	form := url.Values{
+		"grant_type": {"password"}, "username": {email}, "password": {"hash"}, "scope": {"api offline_access"},
+		"client_id": {"web"}, "deviceIdentifier": {"device-" + email}, "deviceName": {"firefox"}, "deviceType": {"10"},
+	}
+	req := httptest.NewRequest("POST", "/identity/connect/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	token, _ := decode(t, w)["access_token"].(string)
+	if token == "" {
+		t.Fatalf("login %s: %d %s", email, w.Code, w.Body.String())
+	}
+	return token
+}
+
+// create posts the resource and provides its id
+func create(t *testing.T, router http.Handler, path, token string, body interface{}) string {
+	t.Helper()
+	w := call(router, "POST", path, token, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST %s: %d %s", path, w.Code, w.Body.String())
+	}
+	return decode(t, w)["Id"].(string)
+}
+
+func insert(t *testing.T, db *models.DB, rows ...interface{}) {
+	t.Helper()
+	for _, row := range rows {
+		if err := db.Insert(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newVault creates the owner with his data, a reader (read only member of the organization) and an intruder
+func newVault(t *testing.T) *vault {
+	router, db := newTestRouter(t)
+	v := &vault{router: router, db: db, tokens: map[string]string{}, users: map[string]string{}}
+
+	for _, name := range []string{"owner", "reader", "intruder"} {
+		email := name + "@example.com"
+		v.tokens[name] = login(t, router, email)
+		u, err := db.GetUserFromEmail(context.Background(), email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.users[name] = u.UUID
+	}
+	owner := v.tokens["owner"]
+	v.device = "device-owner@example.com"
+
+	v.folder = create(t, router, "/api/folders", owner, gin.H{"Name": "Zm9sZGVy"})
+	v.cipher = create(t, router, "/api/ciphers", owner, gin.H{"type": 1, "name": "2.name", "folderId": v.folder})
+	v.attachment = create(t, router, "/api/ciphers/"+v.cipher+"/attachment", owner, gin.H{"data": gin.H{"filename": "2.file"}, "Size": 4, "File": "ZmlsZQ=="})
+	v.intruderCipher = create(t, router, "/api/ciphers", v.tokens["intruder"], gin.H{"type": 1, "name": "2.intruder"})
+
+	// The reader sees the shared cipher through a read only collection
+	v.organization = "organization"
+	insert(t, db,
+		&models.Organization{UUID: v.organization, Name: "Organization", UpdateAt: time.Now()},
+		&models.OrganizationUser{UUID: "owner-member", OrganizationUUID: v.organization, UserUUID: v.users["owner"],
+			Type: models.OrganizationUserOwner, Status: models.OrganizationUserConfirmed, AccessAll: true},
+		&models.OrganizationUser{UUID: "reader-member", OrganizationUUID: v.organization, UserUUID: v.users["reader"],
+			Type: models.OrganizationUserUser, Status: models.OrganizationUserConfirmed},
+		&models.Collection{UUID: "collection", OrganizationUUID: v.organization, Name: "2.collection"},
+		&models.CollectionUser{CollectionUUID: "collection", UserUUID: v.users["reader"], ReadOnly: true},
+	)
+	v.orgCipher = create(t, router, "/api/ciphers", owner, gin.H{"type": 1, "name": "2.shared"})
+	w := call(router, "PUT", "/api/ciphers/share", owner, gin.H{
+		"ciphers":       []gin.H{{"id": v.orgCipher, "organizationId": v.organization, "type": 1, "name": "2.shared"}},
+		"collectionIds": []string{"collection"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("share: %d %s", w.Code, w.Body.String())
+	}
+	return v
+}
+
+// route is a request tried by a user who should not be allowed to do it
+type route struct {
+	method string
+	path   string
+	body   interface{}
+}
+
+func TestRoutesAsWrongUser(t *testing.T) {
+	v := newVault(t)
+	cipher := gin.H{"type": 1, "name": "2.hacked"}
+
+	routes := []route{
+		{"PUT", "/api/ciphers/" + v.cipher, cipher},
+		{"PUT", "/api/ciphers/" + v.cipher + "/delete", nil},
+		{"PUT", "/api/ciphers/" + v.cipher + "/partial", gin.H{"folderId": "", "favorite": true}},
+		{"POST", "/api/ciphers/move", gin.H{"ids": []string{v.cipher}, "folderId": ""}},
+		{"PUT", "/api/ciphers/move", gin.H{"ids": []string{v.intruderCipher, v.cipher}, "folderId": ""}},
+		{"PUT", "/api/ciphers/delete", gin.H{"ids": []string{v.cipher}}},
+		{"POST", "/api/ciphers/delete", gin.H{"ids": []string{v.cipher}}},
+		{"DELETE", "/api/ciphers", gin.H{"ids": []string{v.intruderCipher, v.cipher}}},
+		{"PUT", "/api/ciphers/restore", gin.H{"ids": []string{v.cipher}}},
+		{"PUT", "/api/ciphers/share", gin.H{
+			"ciphers":       []gin.H{{"id": v.cipher, "organizationId": v.organization, "type": 1, "name": "2.hacked"}},
+			"collectionIds": []string{"collection"},
+		}},
+		{"POST", "/api/ciphers/" + v.cipher + "/attachment", gin.H{"data": gin.H{"filename": "2.file"}, "Size": 1, "File": "eA=="}},
+		{"GET", "/api/ciphers/" + v.cipher + "/attachment/" + v.attachment, nil},
+		{"DELETE", "/api/ciphers/" + v.cipher + "/attachment/" + v.attachment, nil},
+		{"DELETE", "/api/cyphers/" + v.cipher + "/attachment/" + v.attachment, nil},
+		{"POST", "/api/ciphers/" + v.cipher + "/attachment/" + v.attachment + "/delete", nil},
+		{"DELETE", "/api/ciphers/" + v.intruderCipher + "/attachment/" + v.attachment, nil},
+		{"GET", "/api/ciphers/" + v.cipher + "/events", nil},
+		{"PUT", "/api/folders/" + v.folder, gin.H{"Name": "aGFja2Vk"}},
+		{"DELETE", "/api/folders/" + v.folder, nil},
+		{"POST", "/api/ciphers", gin.H{"type": 1, "name": "2.hacked", "folderId": v.folder}},
+		{"PUT", "/api/ciphers/" + v.intruderCipher + "/partial", gin.H{"folderId": v.folder, "favorite": true}},
+		{"POST", "/api/ciphers/move", gin.H{"ids": []string{v.intruderCipher}, "folderId": v.folder}},
+		{"PUT", "/api/devices/identifier/" + v.device + "/clear-token", nil},
+		{"PUT", "/api/devices/identifier/" + v.device + "/token", nil},
+		{"GET", "/api/organizations/" + v.organization + "/events", nil},
+		{"PUT", "/api/ciphers/" + v.orgCipher, cipher},
+		{"PUT", "/api/ciphers/delete", gin.H{"ids": []string{v.orgCipher}}},
+		{"GET", "/attachments/" + v.intruderCipher + "/" + v.attachment, nil},
+	}
+
+	for _, r := range routes {
+		t.Run(r.method+" "+r.path, func(t *testing.T) {
+			w := call(v.router, r.method, r.path, v.tokens["intruder"], r.body)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("got %d %s, want 404", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Nothing has been changed
+	sync := decode(t, call(v.router, "GET", "/api/sync", v.tokens["owner"], nil))
+	ciphers := sync["Ciphers"].([]interface{})
+	if len(ciphers) != 2 {
+		t.Fatalf("the owner has %d ciphers, want 2", len(ciphers))
+	}
+	for _, c := range ciphers {
+		c := c.(map[string]interface{})
+		if c["Name"] == "2.hacked" || c["DeletedDate"] != nil || c["Favorite"] == true {
+			t.Errorf("cipher modified by the intruder: %v", c)
+		}
+		if c["Id"] == v.cipher && (c["FolderId"] != v.folder || len(c["Attachments"].([]interface{})) != 1) {
+			t.Errorf("cipher modified by the intruder: %v", c)
+		}
+	}
+	if folders := sync["Folders"].([]interface{}); len(folders) != 1 || folders[0].(map[string]interface{})["Name"] != "Zm9sZGVy" {
+		t.Errorf("folder modified by the intruder: %v", folders)
+	}
+}
+
+func TestRoutesAsReadOnlyMember(t *testing.T) {
+	v := newVault(t)
+
+	routes := []route{
+		{"PUT", "/api/ciphers/" + v.orgCipher, gin.H{"type": 1, "name": "2.modified"}},
+		{"PUT", "/api/ciphers/" + v.orgCipher + "/delete", nil},
+		{"PUT", "/api/ciphers/" + v.orgCipher + "/partial", gin.H{"folderId": "", "favorite": true}},
+		{"PUT", "/api/ciphers/delete", gin.H{"ids": []string{v.orgCipher}}},
+		{"DELETE", "/api/ciphers", gin.H{"ids": []string{v.orgCipher}}},
+		{"POST", "/api/ciphers/move", gin.H{"ids": []string{v.orgCipher}, "folderId": ""}},
+		{"POST", "/api/ciphers/" + v.orgCipher + "/attachment", gin.H{"data": gin.H{"filename": "2.file"}, "Size": 1, "File": "eA=="}},
+		{"GET", "/api/ciphers/" + v.orgCipher + "/events", nil},
+		{"GET", "/api/organizations/" + v.organization + "/events", nil},
+	}
+
+	for _, r := range routes {
+		t.Run(r.method+" "+r.path, func(t *testing.T) {
+			w := call(v.router, r.method, r.path, v.tokens["reader"], r.body)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("got %d %s, want 403", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// The reader still sees the shared cipher (and only it)
+	sync := decode(t, call(v.router, "GET", "/api/sync", v.tokens["reader"], nil))
+	ciphers := sync["Ciphers"].([]interface{})
+	if len(ciphers) != 1 || ciphers[0].(map[string]interface{})["Id"] != v.orgCipher || ciphers[0].(map[string]interface{})["Name"] != "2.shared" {
+		t.Errorf("unexpected ciphers for the reader: %v", ciphers)
+	}
+	// The clients don't offer to edit it
+	if ciphers[0].(map[string]interface{})["Edit"] != false {
+		t.Errorf("the read only cipher can be edited: %v", ciphers[0])
+	}
+	for _, c := range decode(t, call(v.router, "GET", "/api/sync", v.tokens["owner"], nil))["Ciphers"].([]interface{}) {
+		if c.(map[string]interface{})["Edit"] != true {
+			t.Errorf("the cipher of the owner cannot be edited: %v", c)
+		}
+	}
+}
+
+func TestRoutesAsOwner(t *testing.T) {
+	v := newVault(t)
+	owner := v.tokens["owner"]
+
+	routes := []route{
+		{"PUT", "/api/ciphers/" + v.cipher + "/partial", gin.H{"folderId": "", "favorite": true}},
+		{"PUT", "/api/ciphers/" + v.cipher, gin.H{"type": 1, "name": "2.renamed", "folderId": v.folder}},
+		{"GET", "/api/ciphers/" + v.cipher + "/events", nil},
+		{"GET", "/api/organizations/" + v.organization + "/events", nil},
+		{"PUT", "/api/devices/identifier/" + v.device + "/clear-token", nil},
+		{"GET", "/api/ciphers/" + v.cipher + "/attachment/" + v.attachment, nil},
+		{"POST", "/api/ciphers/" + v.cipher + "/attachment/" + v.attachment + "/delete", nil},
+		{"PUT", "/api/folders/" + v.folder, gin.H{"Name": "cmVuYW1lZA=="}},
+		{"PUT", "/api/ciphers/delete", gin.H{"ids": []string{v.cipher, v.orgCipher}}},
+		{"PUT", "/api/ciphers/restore", gin.H{"ids": []string{v.cipher}}},
+		{"PUT", "/api/ciphers/" + v.orgCipher + "/delete", nil},
+		{"DELETE", "/api/folders/" + v.folder, nil},
+	}
+
+	for _, r := range routes {
+		t.Run(r.method+" "+r.path, func(t *testing.T) {
+			w := call(v.router, r.method, r.path, owner, r.body)
+			if w.Code != http.StatusOK {
+				t.Errorf("got %d %s, want 200", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminClientCertificate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := newWardenCtx(models.NewMemoryDB())
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin token"), bcrypt.MinCost)
+	ctx.AdminToken = string(hash)
+	ctx.AdminMTLS = true
+	router := ctx.Router()
+
+	send := func(path string, state *tls.ConnectionState) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer admin token")
+		req.TLS = state
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	for path, expected := range map[string]int{"/admin/api/users": http.StatusOK, "/admin/login": http.StatusOK} {
+		if code := send(path, nil); code != http.StatusForbidden {
+			t.Errorf("%s without TLS: expected 403, got %d", path, code)
+		}
+		if code := send(path, &tls.ConnectionState{}); code != http.StatusForbidden {
+			t.Errorf("%s without certificate: expected 403, got %d", path, code)
+		}
+		if code := send(path, verified); code != expected {
+			t.Errorf("%s with a certificate: expected %d, got %d", path, expected, code)
+		}
+	}
+	if code := send("/api/config", &tls.ConnectionState{}); code != http.StatusOK {
+		t.Errorf("the certificate is required outside of /admin: %d", code)
+	}
+}
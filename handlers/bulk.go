@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"gotwarden/apierror"
+	"gotwarden/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CiphersIds data request of the bulk actions
+type CiphersIds struct {
+	Ids      []string `json:"ids" binding:"required"`
+	FolderID string   `json:"folderId"`
+}
+
+// ShareCipher is a cipher encrypted with the key of the organization
+type ShareCipher struct {
+	ID             string `json:"id" binding:"required"`
+	OrganizationID string `json:"organizationId" binding:"required"`
+	Cipher
+}
+
+// ShareCiphers data request to move ciphers into an organization
+type ShareCiphers struct {
+	Ciphers       []ShareCipher `json:"ciphers" binding:"required,dive"`
+	CollectionIDs []string      `json:"collectionIds" binding:"required"`
+}
+
+// bindCiphersIds reads the ids of the ciphers (without duplicate)
+func bindCiphersIds(c *gin.Context) (*CiphersIds, bool) {
+	var req CiphersIds
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.Binding(err))
+		return nil, false
+	}
+	req.Ids = uniqueIds(req.Ids)
+	if len(req.Ids) == 0 {
+		apierror.Abort(c, apierror.Validation("Ids", "No cipher selected"))
+		return nil, false
+	}
+	return &req, true
+}
+
+func uniqueIds(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// bulkCiphers applies the change to all the ciphers of the request then logs and notifies it once, to the user and
+// to the members of the organizations of the ciphers (cipherOrgs gives the organization of each cipher shared)
+func (ctx *WardenCtx) bulkCiphers(c *gin.Context, ids []string, eventType int, cipherOrgs map[string]string, apply func(userUUID string) error) {
+	userUUID := currentUser(c)
+
+	if err := apply(userUUID); err != nil {
+		switch err {
+		case models.ErrCipherNotFound:
+			apierror.Abort(c, apierror.NotFound("Cipher"))
+		case models.ErrCipherForbidden:
+			apierror.Abort(c, apierror.Forbidden("You cannot modify this cipher"))
+		default:
+			apierror.Abort(c, apierror.Internal("Database failed to update the ciphers", err))
+		}
+		return
+	}
+
+	seen := make(map[string]bool)
+	orgs := []string{}
+	for _, id := range ids {
+		orgUUID := cipherOrgs[id]
+		ctx.logEvent(c, &models.Event{Type: eventType, CipherUUID: id, OrganizationUUID: orgUUID})
+		if orgUUID != "" && !seen[orgUUID] {
+			seen[orgUUID] = true
+			orgs = append(orgs, orgUUID)
+		}
+	}
+	ctx.touchUser(c, userUUID)
+	for _, orgUUID := range orgs {
+		ctx.touchOrganization(c, orgUUID)
+	}
+	ctx.notifyOrganizations(c, userUUID, orgs)
+	c.Status(http.StatusOK)
+}
+
+// cipherOrganizations maps the ciphers to their organization, read before the change (the ciphers deleted are
+// gone after, the unknown ones are left to the change to refuse)
+func (ctx *WardenCtx) cipherOrganizations(c *gin.Context, ids []string) map[string]string {
+	orgs := make(map[string]string)
+	for _, id := range ids {
+		cd, err := ctx.Db.GetCipher(c.Request.Context(), id)
+		if err == nil && cd.OrganizationUUID != "" {
+			orgs[id] = cd.OrganizationUUID
+		}
+	}
+	return orgs
+}
+
+// MoveCiphers moves several ciphers into a folder
+func (ctx *WardenCtx) MoveCiphers(c *gin.Context) {
+	req, ok := bindCiphersIds(c)
+	if !ok {
+		return
+	}
+	// Check if the folder id exist and is belonging to the user
+	if !ctx.userFolder(c, req.FolderID) {
+		return
+	}
+
+	// The folders are personal, only the user sees the change
+	ctx.bulkCiphers(c, req.Ids, models.EventCipherUpdated, nil, func(userUUID string) error {
+		return ctx.Db.MoveCiphers(c.Request.Context(), userUUID, req.Ids, req.FolderID)
+	})
+}
+
+// SoftDeleteCiphers moves several ciphers into the trash
+func (ctx *WardenCtx) SoftDeleteCiphers(c *gin.Context) {
+	req, ok := bindCiphersIds(c)
+	if !ok {
+		return
+	}
+	ctx.bulkCiphers(c, req.Ids, models.EventCipherSoftDeleted, ctx.cipherOrganizations(c, req.Ids), func(userUUID string) error {
+		return ctx.Db.SoftDeleteCiphers(c.Request.Context(), userUUID, req.Ids)
+	})
+}
+
+// RestoreCiphers gets several ciphers out of the trash
+func (ctx *WardenCtx) RestoreCiphers(c *gin.Context) {
+	req, ok := bindCiphersIds(c)
+	if !ok {
+		return
+	}
+	ctx.bulkCiphers(c, req.Ids, models.EventCipherRestored, ctx.cipherOrganizations(c, req.Ids), func(userUUID string) error {
+		return ctx.Db.RestoreCiphers(c.Request.Context(), userUUID, req.Ids)
+	})
+}
+
+// DeleteCiphers deletes definitely several ciphers
+func (ctx *WardenCtx) DeleteCiphers(c *gin.Context) {
+	req, ok := bindCiphersIds(c)
+	if !ok {
+		return
+	}
+	ctx.bulkCiphers(c, req.Ids, models.EventCipherDeleted, ctx.cipherOrganizations(c, req.Ids), func(userUUID string) error {
+		return ctx.Db.DeleteCiphers(c.Request.Context(), userUUID, req.Ids)
+	})
+}
+
+// ShareCiphers moves several ciphers into collections of an organization
+func (ctx *WardenCtx) ShareCiphers(c *gin.Context) {
+	var req ShareCiphers
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, apierror.Binding(err))
+		return
+	}
+	req.CollectionIDs = uniqueIds(req.CollectionIDs)
+	if len(req.Ciphers) == 0 || len(req.CollectionIDs) == 0 {
+		apierror.Abort(c, apierror.Validation("CollectionIds", "No cipher or collection selected"))
+		return
+	}
+	userUUID := currentUser(c)
+
+	// All the ciphers go into collections of the same organization, writable by the user
+	orgUUID := req.Ciphers[0].OrganizationID
+	collections, err := ctx.Db.GetCollectionsByUserUUID(c.Request.Context(), userUUID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to get the collections", err))
+		return
+	}
+	writable := make(map[string]bool)
+	for _, col := range *collections {
+		writable[col.UUID] = col.OrganizationUUID == orgUUID && !col.ReadOnly
+	}
+	for _, id := range req.CollectionIDs {
+		if !writable[id] {
+			apierror.Abort(c, apierror.NotFound("Collection"))
+			return
+		}
+	}
+
+	ciphers := make([]*models.CipherData, 0, len(req.Ciphers))
+	ids := make([]string, 0, len(req.Ciphers))
+	cipherOrgs := make(map[string]string, len(req.Ciphers))
+	for _, sc := range req.Ciphers {
+		if sc.OrganizationID != orgUUID {
+			apierror.Abort(c, apierror.Validation("OrganizationId", "The ciphers must be shared with the same organization"))
+			return
+		}
+		stored, err := ctx.Db.GetCipher(c.Request.Context(), sc.ID)
+		if err == nil && stored.UserUUID != userUUID {
+			err = models.ErrCipherNotFound
+		}
+		if err != nil {
+			apierror.Abort(c, dbError("Cipher", err))
+			return
+		}
+		if stored.OrganizationUUID != "" {
+			apierror.Abort(c, apierror.Conflict("One of the ciphers already belongs to an organization"))
+			return
+		}
+
+		cd := sc.ToCipherData(userUUID, sc.ID)
+		cd.OrganizationUUID = orgUUID
+		cd.DeletedAt = stored.DeletedAt
+		ciphers = append(ciphers, cd)
+		ids = append(ids, sc.ID)
+		cipherOrgs[sc.ID] = orgUUID
+	}
+
+	// The members of the organization gain the ciphers
+	ctx.bulkCiphers(c, ids, models.EventCipherShared, cipherOrgs, func(userUUID string) error {
+		return ctx.Db.ShareCiphers(c.Request.Context(), userUUID, ciphers, req.CollectionIDs)
+	})
+}
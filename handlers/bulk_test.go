@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotwarden/models"
+	"gotwarden/notifications"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// getCipher reads the cipher from the database (nil once deleted)
+func getCipher(t *testing.T, v *vault, uuid string) *models.CipherData {
+	t.Helper()
+	cd, err := v.db.GetCipher(context.Background(), uuid)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd
+}
+
+// countEvents counts the events of the type recorded for the cipher
+func countEvents(t *testing.T, v *vault, eventType int, cipherUUID string) int {
+	t.Helper()
+	events, _, err := v.db.GetEvents(context.Background(), &models.EventFilter{CipherUUID: cipherUUID, End: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range *events {
+		if e.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+// listen opens a websocket of the user to the notifications (JSON protocol), past the handshake
+func listen(t *testing.T, v *vault, user string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(v.router)
+	t.Cleanup(server.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/notifications/hub?access_token="+v.tokens[user], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("{\"protocol\":\"json\",\"version\":1}\x1e")); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestBulkCiphers(t *testing.T) {
+	v := newVault(t)
+	owner := v.tokens["owner"]
+	other := create(t, v.router, "/api/ciphers", owner, gin.H{"type": 1, "name": "2.other"})
+	ids := []string{v.cipher, other}
+
+	// Move
+	if w := call(v.router, "PUT", "/api/ciphers/move", owner, gin.H{"ids": ids, "folderId": v.folder}); w.Code != http.StatusOK {
+		t.Fatalf("move: %d %s", w.Code, w.Body.String())
+	}
+	if getCipher(t, v, other).FolderUUID != v.folder {
+		t.Error("the cipher is not moved into the folder")
+	}
+	if w := call(v.router, "POST", "/api/ciphers/move", owner, gin.H{"ids": ids, "folderId": ""}); w.Code != http.StatusOK {
+		t.Fatalf("move out: %d %s", w.Code, w.Body.String())
+	}
+	if getCipher(t, v, v.cipher).FolderUUID != "" || getCipher(t, v, other).FolderUUID != "" {
+		t.Error("the ciphers are still into the folder")
+	}
+
+	// Soft delete then restore, one event by cipher
+	if w := call(v.router, "PUT", "/api/ciphers/delete", owner, gin.H{"ids": append(ids, other)}); w.Code != http.StatusOK {
+		t.Fatalf("soft delete: %d %s", w.Code, w.Body.String())
+	}
+	if getCipher(t, v, v.cipher).DeletedAt == nil || getCipher(t, v, other).DeletedAt == nil {
+		t.Error("the ciphers are not into the trash")
+	}
+	if n := countEvents(t, v, models.EventCipherSoftDeleted, other); n != 1 {
+		t.Errorf("%d soft delete events for the cipher", n)
+	}
+	if w := call(v.router, "PUT", "/api/ciphers/restore", owner, gin.H{"ids": ids}); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body.String())
+	}
+	if getCipher(t, v, v.cipher).DeletedAt != nil || getCipher(t, v, other).DeletedAt != nil {
+		t.Error("the ciphers are still into the trash")
+	}
+	if n := countEvents(t, v, models.EventCipherRestored, v.cipher); n != 1 {
+		t.Errorf("%d restore events for the cipher", n)
+	}
+
+	// Delete
+	if w := call(v.router, "DELETE", "/api/ciphers", owner, gin.H{"ids": []string{other}}); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if getCipher(t, v, other) != nil {
+		t.Error("the cipher is not deleted")
+	}
+	if getCipher(t, v, v.cipher) == nil {
+		t.Error("a cipher not selected is deleted")
+	}
+}
+
+// deviceCounter counts the devices read from the store
+type deviceCounter struct {
+	models.Datastore
+	reads int
+}
+
+func (d *deviceCounter) GetDevice(ctx context.Context, uuid string) (*models.Device, error) {
+	d.reads++
+	return d.Datastore.GetDevice(ctx, uuid)
+}
+
+func TestBulkCiphersEvents(t *testing.T) {
+	v := newVault(t)
+	store := &deviceCounter{Datastore: v.db}
+	router := newWardenCtx(store).Router()
+	other := create(t, v.router, "/api/ciphers", v.tokens["owner"], gin.H{"type": 1, "name": "2.other"})
+
+	ids := []string{v.cipher, other, v.orgCipher}
+	if w := call(router, "PUT", "/api/ciphers/delete", v.tokens["owner"], gin.H{"ids": ids}); w.Code != http.StatusOK {
+		t.Fatalf("soft delete: %d %s", w.Code, w.Body.String())
+	}
+	if store.reads != 1 {
+		t.Errorf("the device is read %d times for a request", store.reads)
+	}
+
+	// The events of the ciphers shared are in the feed of the organization
+	events, _, err := v.db.GetEvents(context.Background(), &models.EventFilter{OrganizationUUID: v.organization, End: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, e := range *events {
+		if e.Type == models.EventCipherSoftDeleted {
+			if e.CipherUUID != v.orgCipher {
+				t.Errorf("event of the personal cipher %s in the feed of the organization", e.CipherUUID)
+			}
+			if e.DeviceType == 0 {
+				t.Error("no device type for the event")
+			}
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("%d soft delete events in the feed of the organization", found)
+	}
+}
+
+func TestBulkCiphersRefused(t *testing.T) {
+	v := newVault(t)
+
+	for _, c := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{"no cipher", "PUT", "/api/ciphers/delete", v.tokens["owner"], gin.H{"ids": []string{}}, http.StatusBadRequest},
+		{"unknown folder", "PUT", "/api/ciphers/move", v.tokens["owner"], gin.H{"ids": []string{v.cipher}, "folderId": "unknown"}, http.StatusNotFound},
+		{"read only cipher", "POST", "/api/ciphers/delete", v.tokens["reader"], gin.H{"ids": []string{v.orgCipher}}, http.StatusForbidden},
+		// Nothing is changed when one of the ciphers is refused
+		{"cipher of another user", "PUT", "/api/ciphers/delete", v.tokens["owner"], gin.H{"ids": []string{v.cipher, v.intruderCipher}}, http.StatusNotFound},
+	} {
+		if w := call(v.router, c.method, c.path, c.token, c.body); w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.status, w.Code, w.Body.String())
+		}
+	}
+	if getCipher(t, v, v.cipher).DeletedAt != nil || getCipher(t, v, v.orgCipher) == nil {
+		t.Error("a cipher is changed by a refused request")
+	}
+}
+
+func TestShareCiphers(t *testing.T) {
+	v := newVault(t)
+	owner := v.tokens["owner"]
+
+	// The reader listens to the notifications
+	ws := listen(t, v, "reader")
+	etag := getSync(v.router, "/api/sync", v.tokens["reader"], "").Header().Get("ETag")
+
+	share := func(ids ...string) *httptest.ResponseRecorder {
+		ciphers := []gin.H{}
+		for _, id := range ids {
+			ciphers = append(ciphers, gin.H{"id": id, "organizationId": v.organization, "type": 1, "name": "2.shared"})
+		}
+		return call(v.router, "PUT", "/api/ciphers/share", owner, gin.H{"ciphers": ciphers, "collectionIds": []string{"collection"}})
+	}
+	if w := share(v.cipher); w.Code != http.StatusOK {
+		t.Fatalf("share: %d %s", w.Code, w.Body.String())
+	}
+	if cd := getCipher(t, v, v.cipher); cd.OrganizationUUID != v.organization || cd.Name != "2.shared" {
+		t.Errorf("the cipher is not shared: %+v", cd)
+	}
+	if n := countEvents(t, v, models.EventCipherShared, v.cipher); n != 1 {
+		t.Errorf("%d share events for the cipher", n)
+	}
+
+	// The reader gains the cipher: its vault changed and its devices are asked to sync
+	w := getSync(v.router, "/api/sync", v.tokens["reader"], etag)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), v.cipher) {
+		t.Errorf("the reader does not get the cipher shared: %d", w.Code)
+	}
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("no notification for the reader: %v", err)
+	}
+	var message struct {
+		Target    string
+		Arguments []struct{ Type int }
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(string(data), "\x1e")), &message); err != nil || len(message.Arguments) != 1 || message.Arguments[0].Type != notifications.SyncCiphers {
+		t.Errorf("unexpected notification %s (%v)", data, err)
+	}
+
+	// Shared once only
+	if w := share(v.cipher); w.Code != http.StatusConflict {
+		t.Errorf("shared again: %d %s", w.Code, w.Body.String())
+	}
+	if w := share(v.intruderCipher); w.Code != http.StatusNotFound {
+		t.Errorf("cipher of another user shared: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBulkCiphersNotifiedOnce(t *testing.T) {
+	v := newVault(t)
+	owner := v.tokens["owner"]
+	ws := listen(t, v, "owner")
+
+	// The owner is a member of the organization of the ciphers, and their actor
+	paths := []string{"/api/ciphers/delete", "/api/ciphers/restore"}
+	for _, path := range paths {
+		if w := call(v.router, "PUT", path, owner, gin.H{"ids": []string{v.cipher, v.orgCipher}}); w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	// The messages are counted until the websocket stays silent (its read then fails for good)
+	messages := 0
+	for {
+		ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		messages += strings.Count(string(data), "\x1e")
+	}
+	if messages != len(paths) {
+		t.Errorf("%d notifications for %d bulk actions", messages, len(paths))
+	}
+}
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"gotwarden/models"
+	"gotwarden/util"
+	"gotwarden/version"
+	"html/template"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// csrfCookie is the cookie holding the CSRF token (double submit)
+const csrfCookie = "gotwarden_csrf"
+
+// consoleUsersPerPage is the number of users displayed per page
+const consoleUsersPerPage = 20
+
+// consoleCSP forbids the inline scripts and styles into the console pages
+const consoleCSP = "default-src 'self'; form-action 'self'; frame-ancestors 'none'"
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+// consoleEventNames are the labels of the events displayed into the action log
+var consoleEventNames = map[int]string{
+	models.EventAdminLoggedIn:         "Admin logged in",
+	models.EventAdminFailedLogIn:      "Admin failed to log in",
+	models.EventAdminUserDisabled:     "User disabled",
+	models.EventAdminUserEnabled:      "User enabled",
+	models.EventAdminUserDeauthorized: "User logged out",
+	models.EventAdminUserDeleted:      "User deleted",
+	models.EventAdminUserInvited:      "User invited",
+	models.EventAdminSMTPTested:       "Test email sent",
+}
+
+// consoleAction is the data of the form of a user action
+type consoleAction struct {
+	CSRF string
+	UUID string
+	Name string
+}
+
+// consoleCheck is a configuration check displayed into the diagnostics
+type consoleCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// consoleOrganization is an organization with its members count
+type consoleOrganization struct {
+	models.Organization
+	Members int
+	Admins  int
+}
+
+// consoleTemplates parses the templates embedded into the binary
+func consoleTemplates() *template.Template {
+	return template.Must(template.New("").Funcs(template.FuncMap{
+		"action": func(csrf, uuid, name string) consoleAction {
+			return consoleAction{csrf, uuid, name}
+		},
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"eventName": func(t int) string {
+			if name, ok := consoleEventNames[t]; ok {
+				return name
+			}
+			return strconv.Itoa(t)
+		},
+	}).ParseFS(templatesFS, "templates/*.html"))
+}
+
+// render displays the page with the common data (CSRF token, session state and message)
+func (ctx *WardenCtx) render(c *gin.Context, page, title string, data gin.H) {
+	data["Title"] = title
+	data["CSRF"] = c.GetString(csrfCookie)
+	data["LoggedIn"] = c.GetBool(adminCookie)
+	data["Message"] = c.Query("msg")
+	c.Header("Content-Security-Policy", consoleCSP)
+	c.HTML(http.StatusOK, page, data)
+}
+
+// redirect goes back to the page with a message
+func redirect(c *gin.Context, page, msg string) {
+	c.Redirect(http.StatusSeeOther, page+"?msg="+url.QueryEscape(msg))
+}
+
+// ConsoleCSRF provides the CSRF token and checks it on every form sent
+func (ctx *WardenCtx) ConsoleCSRF(c *gin.Context) {
+	if ctx.AdminToken == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	token, err := c.Cookie(csrfCookie)
+	if err != nil || len(token) != 64 {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		token = hex.EncodeToString(raw)
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(csrfCookie, token, 0, "/admin", "", c.Request.TLS != nil, true)
+	}
+
+	if c.Request.Method == http.MethodPost && !hmac.Equal([]byte(c.PostForm("csrf_token")), []byte(token)) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.Set(csrfCookie, token)
+	c.Next()
+}
+
+// ConsoleAuth redirects to the login page when there is no admin session
+func (ctx *WardenCtx) ConsoleAuth(c *gin.Context) {
+	session, err := c.Cookie(adminCookie)
+	if err != nil || !ctx.validAdminSession(session) {
+		c.Redirect(http.StatusSeeOther, "/admin/login")
+		c.Abort()
+		return
+	}
+	c.Set(adminCookie, true)
+	c.Next()
+}
+
+// ConsoleLoginPage displays the login form
+func (ctx *WardenCtx) ConsoleLoginPage(c *gin.Context) {
+	ctx.render(c, "login.html", "Log in", gin.H{})
+}
+
+// ConsoleLogin opens an admin session from the login form
+func (ctx *WardenCtx) ConsoleLogin(c *gin.Context) {
+	if !ctx.checkAdminToken(c.PostForm("token")) {
+		requestLog(c).WithField("client_ip", c.ClientIP()).Warn("Invalid admin token")
+		ctx.logEvent(c, &models.Event{Type: models.EventAdminFailedLogIn})
+		redirect(c, "/admin/login", "Invalid admin token")
+		return
+	}
+	ctx.setAdminSession(c)
+	ctx.logEvent(c, &models.Event{Type: models.EventAdminLoggedIn})
+	c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+// ConsoleLogout closes the admin session
+func (ctx *WardenCtx) ConsoleLogout(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(adminCookie, "", -1, "/admin", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusSeeOther, "/admin/login")
+}
+
+// ConsoleUsers displays the users (search and paging)
+func (ctx *WardenCtx) ConsoleUsers(c *gin.Context) {
+	users, err := ctx.adminUsers(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query != "" {
+		needle := strings.ToLower(query)
+		filtered := []AdminUserObject{}
+		for _, u := range users {
+			if strings.Contains(strings.ToLower(u.Email), needle) || strings.Contains(strings.ToLower(u.Name), needle) {
+				filtered = append(filtered, u)
+			}
+		}
+		users = filtered
+	}
+
+	pages := (len(users) + consoleUsersPerPage - 1) / consoleUsersPerPage
+	if pages == 0 {
+		pages = 1
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * consoleUsersPerPage
+	end := start + consoleUsersPerPage
+	if end > len(users) {
+		end = len(users)
+	}
+
+	ctx.render(c, "users.html", "Users", gin.H{
+		"Users": users[start:end],
+		"Query": query,
+		"Page":  page,
+		"Pages": pages,
+	})
+}
+
+// ConsoleUserAction runs the admin action chosen from the users page
+func (ctx *WardenCtx) ConsoleUserAction(c *gin.Context) {
+	name := c.Param("action")
+	if _, ok := userActions[name]; !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	u, err := ctx.Db.GetUser(c.Request.Context(), c.Param("uuid"))
+	if err != nil {
+		redirect(c, "/admin/users", dbError("User", err).Message)
+		return
+	}
+	if err := ctx.applyUserAction(c, name, u); err != nil {
+		requestLog(c).WithError(err).WithFields(logrus.Fields{"action": name, "target_user_id": u.UUID}).Error("Admin action failed")
+		redirect(c, "/admin/users", "Failed to "+name+" "+u.Email)
+		return
+	}
+	redirect(c, "/admin/users", "Done: "+name+" "+u.Email)
+}
+
+// ConsoleInvite invites the email provided
+func (ctx *WardenCtx) ConsoleInvite(c *gin.Context) {
+	var req AdminEmail
+	if err := c.ShouldBind(&req); err != nil {
+		redirect(c, "/admin/users", "A valid email is required")
+		return
+	}
+	if err := ctx.inviteUser(c, req.Email); err != nil {
+		if err.Status >= http.StatusInternalServerError {
+			requestLog(c).WithError(err).WithField("email", req.Email).Error("Invitation failed")
+		}
+		redirect(c, "/admin/users", err.Message)
+		return
+	}
+	redirect(c, "/admin/users", req.Email+" invited")
+}
+
+// ConsoleTestSMTP sends a test email
+func (ctx *WardenCtx) ConsoleTestSMTP(c *gin.Context) {
+	var req AdminEmail
+	if err := c.ShouldBind(&req); err != nil {
+		redirect(c, "/admin/diagnostics", "A valid email is required")
+		return
+	}
+	if err := ctx.SMTP.SendMail(req.Email, "gotwarden SMTP test", "This is a test email sent by the gotwarden server "+ctx.Domain+"\r\n"); err != nil {
+		requestLog(c).WithError(err).Error("Test email failed")
+		redirect(c, "/admin/diagnostics", err.Error())
+		return
+	}
+	ctx.logEvent(c, &models.Event{Type: models.EventAdminSMTPTested})
+	redirect(c, "/admin/diagnostics", "Test email sent to "+req.Email)
+}
+
+// ConsoleDevices displays the devices of a user
+func (ctx *WardenCtx) ConsoleDevices(c *gin.Context) {
+	u, err := ctx.Db.GetUser(c.Request.Context(), c.Param("uuid"))
+	if err != nil {
+		redirect(c, "/admin/users", dbError("User", err).Message)
+		return
+	}
+	devices, err := ctx.Db.GetDevicesByUserUUID(c.Request.Context(), u.UUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.render(c, "devices.html", "Devices", gin.H{
+		"User":    u,
+		"Devices": *devices,
+	})
+}
+
+// ConsoleOrganizations displays the organizations with their members count
+func (ctx *WardenCtx) ConsoleOrganizations(c *gin.Context) {
+	orgs, err := ctx.Db.AllOrganizations(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ous, err := ctx.Db.AllOrganizationUsers(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	members := make(map[string]int)
+	admins := make(map[string]int)
+	for _, ou := range *ous {
+		members[ou.OrganizationUUID]++
+		if ou.IsAdmin() {
+			admins[ou.OrganizationUUID]++
+		}
+	}
+
+	list := []consoleOrganization{}
+	for _, o := range *orgs {
+		list = append(list, consoleOrganization{o, members[o.UUID], admins[o.UUID]})
+	}
+	ctx.render(c, "organizations.html", "Organizations", gin.H{"Organizations": list})
+}
+
+// ConsoleDiagnostics displays the version, the database and the configuration checks
+func (ctx *WardenCtx) ConsoleDiagnostics(c *gin.Context) {
+	schemaVersion, err := ctx.Db.GetSchemaVersion(c.Request.Context())
+	if err != nil {
+		requestLog(c).WithError(err).Error("Failed to get the schema version")
+	}
+
+	checks := []consoleCheck{
+		{"Secret phrase", ctx.SecretPhrase != util.DefaultSecretPhrase, "WARDEN_SECRET_PHRASE must not be the default one"},
+		{"Domain", strings.HasPrefix(ctx.Domain, "https://"), "WARDEN_DOMAIN is " + ctx.Domain + " (clients need https)"},
+		{"Database schema", schemaVersion == models.SchemaVersion(), "Schema version " + strconv.Itoa(schemaVersion) + " / " + strconv.Itoa(models.SchemaVersion())},
+		{"SMTP", ctx.SMTP.Configured(), "SMTP_HOST and SMTP_FROM are needed to send emails"},
+		{"Signups", !ctx.SignupsAllowed, "WARDEN_SIGNUPS_ALLOWED is " + strconv.FormatBool(ctx.SignupsAllowed)},
+	}
+
+	ctx.render(c, "diagnostics.html", "Diagnostics", gin.H{
+		"Release":               version.Release,
+		"Commit":                version.Commit,
+		"BuildTime":             version.BuildTime,
+		"GoVersion":             runtime.Version(),
+		"ServerTime":            time.Now().Format(time.RFC3339),
+		"DbType":                ctx.DbType,
+		"SchemaVersion":         schemaVersion,
+		"ExpectedSchemaVersion": models.SchemaVersion(),
+		"Checks":                checks,
+	})
+}
+
+// ConsoleLog displays the actions made by the admins
+func (ctx *WardenCtx) ConsoleLog(c *gin.Context) {
+	filter, err := models.NewEventFilter("", "", c.Query("continuationToken"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	filter.Start = time.Time{}
+	filter.Types = models.AdminEventTypes
+
+	events, token, err := ctx.Db.GetEvents(c.Request.Context(), filter)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.render(c, "log.html", "Action log", gin.H{
+		"Events":            *events,
+		"ContinuationToken": token,
+	})
+}
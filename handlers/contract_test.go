@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gotwarden/models"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// volatile are the values generated by the server (ids and redacted tokens), which change at each replay
+var volatile = regexp.MustCompile(`^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|redacted-[0-9a-f]{16})$`)
+
+// replayer replays recorded exchanges, mapping the ids and tokens of the recording to the ones of the replay
+type replayer struct {
+	t       *testing.T
+	router  http.Handler
+	mapping map[string]string
+}
+
+func readExchanges(t *testing.T, r io.Reader) []Exchange {
+	t.Helper()
+	var exchanges []Exchange
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid exchange %d: %s", len(exchanges)+1, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return exchanges
+}
+
+// replay sends the exchanges to a new server with an in-memory store
+func replay(t *testing.T, exchanges []Exchange) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := &replayer{t: t, router: newWardenCtx(models.NewMemoryDB()).Router(), mapping: map[string]string{}}
+	for i, e := range exchanges {
+		r.replay(fmt.Sprintf("#%d %s %s", i+1, e.Request.Method, e.Request.Path), e)
+	}
+}
+
+// replace substitutes the values of the recording by the ones of the replay
+func (r *replayer) replace(s string) string {
+	for recorded, actual := range r.mapping {
+		s = strings.ReplaceAll(s, recorded, actual)
+	}
+	return s
+}
+
+func decodeBody(body, encoding string) []byte {
+	if encoding == "base64" {
+		data, _ := base64.StdEncoding.DecodeString(body)
+		return data
+	}
+	return []byte(body)
+}
+
+func (r *replayer) replay(name string, e Exchange) {
+	body := decodeBody(e.Request.Body, e.Request.Encoding)
+	if e.Request.Encoding == "" {
+		body = []byte(r.replace(string(body)))
+	}
+	req := httptest.NewRequest(e.Request.Method, r.replace(e.Request.Path), bytes.NewReader(body))
+	for name, value := range e.Request.Header {
+		req.Header.Set(name, r.replace(value))
+	}
+	w := httptest.NewRecorder()
+	r.router.ServeHTTP(w, req)
+
+	if w.Code != e.Response.Status {
+		r.t.Errorf("%s: expected status %d, got %d %s", name, e.Response.Status, w.Code, w.Body.String())
+		return
+	}
+
+	expected := decodeBody(e.Response.Body, e.Response.Encoding)
+	var recorded, actual interface{}
+	if json.Unmarshal(expected, &recorded) == nil && json.Unmarshal(w.Body.Bytes(), &actual) == nil {
+		r.learn(recorded, actual)
+		if diff := r.diff("", recorded, actual); diff != "" {
+			r.t.Errorf("%s: %s", name, diff)
+		}
+		return
+	}
+	if e.Response.Encoding == "" {
+		expected = []byte(r.replace(string(expected)))
+	}
+	if !bytes.Equal(expected, w.Body.Bytes()) {
+		r.t.Errorf("%s: expected body %q, got %q", name, expected, w.Body.String())
+	}
+}
+
+// learn maps the ids and tokens of the recorded response to the ones generated by the replay
+func (r *replayer) learn(recorded, actual interface{}) {
+	switch rec := recorded.(type) {
+	case map[string]interface{}:
+		if act, ok := actual.(map[string]interface{}); ok {
+			for k, v := range rec {
+				r.learn(v, act[k])
+			}
+		}
+	case []interface{}:
+		if act, ok := actual.([]interface{}); ok && len(act) == len(rec) {
+			for i := range rec {
+				r.learn(rec[i], act[i])
+			}
+		}
+	case string:
+		if act, ok := actual.(string); ok && act != rec {
+			if volatile.MatchString(rec) {
+				r.learnValue(rec, act)
+			}
+			r.learnSignedURL(rec, act)
+		}
+	}
+}
+
+func (r *replayer) learnValue(recorded, actual string) {
+	if _, known := r.mapping[recorded]; !known {
+		r.mapping[recorded] = actual
+	}
+}
+
+// learnSignedURL maps the expiry and the signature of the signed URLs (attachments)
+func (r *replayer) learnSignedURL(recorded, actual string) {
+	rec, err := url.Parse(recorded)
+	if err != nil {
+		return
+	}
+	act, err := url.Parse(actual)
+	if err != nil {
+		return
+	}
+	for _, param := range []string{"expires", "signature"} {
+		if rv, av := rec.Query().Get(param), act.Query().Get(param); rv != "" && av != "" && rv != av {
+			r.learnValue(rv, av)
+		}
+	}
+}
+
+func isDate(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
+
+// isTimestamp tells if the number is a date in milliseconds (ie the revision date)
+func isTimestamp(v interface{}) bool {
+	n, ok := v.(float64)
+	return ok && n >= 1e12 && n < 1e13
+}
+
+// diff compares the normalized responses (ids and tokens mapped, any date accepted)
+func (r *replayer) diff(path string, recorded, actual interface{}) string {
+	switch rec := recorded.(type) {
+	case map[string]interface{}:
+		act, ok := actual.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: expected an object, got %v", path, actual)
+		}
+		keys := make([]string, 0, len(rec)+len(act))
+		for k := range rec {
+			keys = append(keys, k)
+		}
+		for k := range act {
+			if _, ok := rec[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, ok := act[k]; !ok {
+				return fmt.Sprintf("%s.%s: missing", path, k)
+			}
+			if _, ok := rec[k]; !ok {
+				return fmt.Sprintf("%s.%s: unexpected", path, k)
+			}
+			if d := r.diff(path+"."+k, rec[k], act[k]); d != "" {
+				return d
+			}
+		}
+	case []interface{}:
+		act, ok := actual.([]interface{})
+		if !ok || len(act) != len(rec) {
+			return fmt.Sprintf("%s: expected %d items, got %v", path, len(rec), actual)
+		}
+		for i := range rec {
+			if d := r.diff(fmt.Sprintf("%s[%d]", path, i), rec[i], act[i]); d != "" {
+				return d
+			}
+		}
+	case string:
+		act, ok := actual.(string)
+		if !ok || (r.replace(rec) != act && !(isDate(rec) && isDate(act))) {
+			return fmt.Sprintf("%s: expected %q, got %v", path, rec, actual)
+		}
+	default:
+		if !reflect.DeepEqual(recorded, actual) && !(isTimestamp(recorded) && isTimestamp(actual)) {
+			return fmt.Sprintf("%s: expected %v, got %v", path, recorded, actual)
+		}
+	}
+	return ""
+}
+
+// replayFiles replays the exchanges of each JSONL file matching the pattern
+func replayFiles(t *testing.T, pattern string) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no recording")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			replay(t, readExchanges(t, f))
+		})
+	}
+}
+
+// TestContractRecordings replays the traffic recorded from the clients (WARDEN_RECORD_PATH) into testdata/contract
+func TestContractRecordings(t *testing.T) {
+	replayFiles(t, filepath.Join("testdata", "contract", "*.jsonl"))
+}
+
+// TestSyntheticExchanges replays the hand-written exchanges of testdata/synthetic, shaped after the traffic of the
+// clients but changed along with the server (they are not a contract)
+func TestSyntheticExchanges(t *testing.T) {
+	replayFiles(t, filepath.Join("testdata", "synthetic", "*.jsonl"))
+}
+
+// clientSession plays the requests of a client: register, login, sync, folders, ciphers and attachments
+func clientSession(t *testing.T, router http.Handler) {
+	t.Helper()
+	email := "Alice@Example.com"
+	call(router, "POST", "/api/accounts/prelogin", "", gin.H{"email": email})
+	w := call(router, "POST", "/api/accounts/register", "", gin.H{"email": email, "name": "Alice", "masterPasswordHash": "c2VjcmV0",
+		"masterPasswordHint": "my hint", "key": "2.key|iv|mac", "kdf": 0, "kdfIterations": 100000})
+	if w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body.String())
+	}
+	call(router, "POST", "/api/accounts/prelogin", "", gin.H{"email": email})
+
+	token := func(form url.Values, access string) map[string]interface{} {
+		req := httptest.NewRequest("POST", "/identity/connect/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if access != "" {
+			req.Header.Set("Authorization", "Bearer "+access)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return decode(t, w)
+	}
+	form := url.Values{
+		"grant_type": {"password"}, "username": {email}, "password": {"wrong"}, "scope": {"api offline_access"},
+		"client_id": {"web"}, "deviceIdentifier": {"6f5c2b0e-3f1a-4c55-9d7e-1b2a3c4d5e6f"}, "deviceName": {"firefox"}, "deviceType": {"10"},
+	}
+	token(form, "")
+	form.Set("password", "c2VjcmV0")
+	login := token(form, "")
+	access, _ := login["access_token"].(string)
+	if access == "" {
+		t.Fatalf("login: %v", login)
+	}
+	refreshed := token(url.Values{"grant_type": {"refresh_token"}, "client_id": {"web"}, "refresh_token": {login["refresh_token"].(string)}}, access)
+	if access, _ = refreshed["access_token"].(string); access == "" {
+		t.Fatalf("refresh: %v", refreshed)
+	}
+
+	folder := create(t, router, "/api/folders", access, gin.H{"name": "Mi5mb2xkZXI="})
+	cipher := create(t, router, "/api/ciphers", access, gin.H{"type": 1, "name": "2.name|iv|mac", "folderId": folder,
+		"login": gin.H{"username": "2.user|iv|mac", "password": "2.password|iv|mac", "uris": []gin.H{{"uri": "2.uri|iv|mac", "match": nil}}}})
+	attachment := create(t, router, "/api/ciphers/"+cipher+"/attachment", access, gin.H{"data": gin.H{"filename": "2.file|iv|mac"}, "Size": 4, "File": "ZmlsZQ=="})
+
+	steps := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", "/api/sync", nil},
+		{"PUT", "/api/folders/" + folder, gin.H{"name": "Mi5yZW5hbWVk"}},
+		{"PUT", "/api/ciphers/" + cipher, gin.H{"type": 1, "name": "2.updated|iv|mac", "folderId": folder, "notes": "2.notes|iv|mac"}},
+		{"PUT", "/api/ciphers/" + cipher + "/partial", gin.H{"folderId": folder, "favorite": true}},
+		{"GET", "/attachments/" + cipher + "/" + attachment, nil},
+		{"GET", "/api/sync", nil},
+		{"DELETE", "/api/ciphers/" + cipher + "/attachment/" + attachment, nil},
+		{"PUT", "/api/ciphers/delete", gin.H{"ids": []string{cipher}}},
+		{"PUT", "/api/ciphers/restore", gin.H{"ids": []string{cipher}}},
+		{"DELETE", "/api/folders/" + folder, nil},
+		{"PUT", "/api/folders/unknown", gin.H{"name": "Mi5mb2xkZXI="}},
+		{"PUT", "/api/ciphers/" + cipher + "/delete", nil},
+		{"GET", "/api/accounts/revision-date", nil},
+		{"GET", "/api/sync", nil},
+	}
+	for _, s := range steps {
+		call(router, s.method, s.path, access, s.body)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var recording bytes.Buffer
+	ctx := newWardenCtx(models.NewMemoryDB())
+	ctx.Recorder = NewRecorder(&recording)
+	clientSession(t, ctx.Router())
+
+	for _, secret := range []string{"Alice@Example.com", "alice@example.com", "c2VjcmV0", "my hint", "2.key|iv|mac", "Bearer ey", `"access_token":"ey`} {
+		if strings.Contains(recording.String(), secret) {
+			t.Errorf("the recording contains %q", secret)
+		}
+	}
+	exchanges := readExchanges(t, &recording)
+	if len(exchanges) < 20 {
+		t.Fatalf("only %d exchanges have been recorded", len(exchanges))
+	}
+
+	replay(t, exchanges)
+}
+
+func TestRecorderRedaction(t *testing.T) {
+	rec := NewRecorder(ioutil.Discard)
+	body, _ := rec.redactBody("application/json", []byte(`{"key":"2.key|iv|mac","encryptedPrivateKey":"2.private|iv|mac",
+		"Key":"2.key|iv|mac","PublicKey":"public","Profile":{"Email":"alice@example.com"}}`))
+	for _, secret := range []string{"2.key|iv|mac", "2.private|iv|mac", "alice@example.com"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the body %s contains %q", body, secret)
+		}
+	}
+	if !strings.Contains(body, `"PublicKey":"public"`) {
+		t.Errorf("the public key is redacted: %s", body)
+	}
+	form, _ := rec.redactBody("application/x-www-form-urlencoded", []byte("encryptedPrivateKey=2.private&publicKey=public"))
+	if strings.Contains(form, "2.private") || !strings.Contains(form, "publicKey=public") {
+		t.Errorf("unexpected form %s", form)
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getSync gets the vault of the user, with the ETag of the last sync
+func getSync(router http.Handler, path, token, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestDomains(t *testing.T) {
+	router, _ := newTestRouter(t)
+	token := login(t, router, "user@example.com")
+
+	full := getSync(router, "/api/sync", token, "")
+	light := getSync(router, "/api/sync?excludeDomains=true", token, "")
+	if full.Code != http.StatusOK || light.Code != http.StatusOK || full.Header().Get("ETag") == light.Header().Get("ETag") {
+		t.Fatalf("the syncs with and without domains share the ETag %s", full.Header().Get("ETag"))
+	}
+	if decode(t, light)["Domains"] != nil {
+		t.Error("the domains are sent despite excludeDomains")
+	}
+
+	w := call(router, "PUT", "/api/settings/domains", token, gin.H{
+		"equivalentDomains":               [][]string{{"Example.com", "example.org"}},
+		"excludedGlobalEquivalentDomains": []int{0, 99999},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("save domains: %d %s", w.Code, w.Body.String())
+	}
+
+	// The settings are read back by the settings page and by the sync, whose ETag changes
+	w = call(router, "GET", "/api/settings/domains", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get domains: %d %s", w.Code, w.Body.String())
+	}
+	checkDomains(t, decode(t, w))
+
+	for path, previous := range map[string]string{"/api/sync": full.Header().Get("ETag"), "/api/sync?excludeDomains=true": light.Header().Get("ETag")} {
+		w := getSync(router, path, token, previous)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: the ETag did not change with the domains: %d", path, w.Code)
+		}
+		if w := getSync(router, path, token, w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 with the new ETag, got %d", path, w.Code)
+		}
+	}
+	checkDomains(t, decode(t, getSync(router, "/api/sync", token, ""))["Domains"].(map[string]interface{}))
+}
+
+// checkDomains checks the domains saved by TestDomains are sent back
+func checkDomains(t *testing.T, domains map[string]interface{}) {
+	t.Helper()
+	equivalent := domains["EquivalentDomains"].([]interface{})
+	if len(equivalent) != 1 || equivalent[0].([]interface{})[0] != "example.com" {
+		t.Errorf("unexpected equivalent domains %v", equivalent)
+	}
+	for _, gd := range domains["GlobalEquivalentDomains"].([]interface{}) {
+		gd := gd.(map[string]interface{})
+		if gd["Excluded"] != (gd["Type"] == float64(0)) {
+			t.Errorf("group %v excluded: %v", gd["Type"], gd["Excluded"])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorModel(t *testing.T) {
+	router, _ := newTestRouter(t)
+	token := login(t, router, "user@example.com")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       interface{}
+		status     int
+		validation string
+	}{
+		{"missing field", "POST", "/api/ciphers", token, gin.H{"type": 1}, http.StatusBadRequest, "Name"},
+		{"invalid type", "POST", "/api/ciphers", token, gin.H{"type": "login", "name": "2.name"}, http.StatusBadRequest, "Type"},
+		{"unknown folder", "POST", "/api/ciphers", token, gin.H{"type": 1, "name": "2.name", "folderId": "unknown"}, http.StatusNotFound, ""},
+		{"unknown cipher", "PUT", "/api/ciphers/unknown", token, gin.H{"type": 1, "name": "2.name"}, http.StatusNotFound, ""},
+		{"no token", "GET", "/api/sync", "", nil, http.StatusUnauthorized, ""},
+		{"existing user", "POST", "/api/accounts/register", "", gin.H{
+			"email": "user@example.com", "masterPasswordHash": "hash", "key": "key", "kdfIterations": 100000,
+		}, http.StatusConflict, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := call(router, test.method, test.path, test.token, test.body)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d %s", test.status, w.Code, w.Body.String())
+			}
+			m := decode(t, w)
+			if m["Object"] != "error" || m["Message"] == "" {
+				t.Fatalf("not an ErrorModel: %s", w.Body.String())
+			}
+			if test.validation != "" {
+				errs, _ := m["ValidationErrors"].(map[string]interface{})
+				if _, ok := errs[test.validation]; !ok {
+					t.Fatalf("no validation error for %s: %s", test.validation, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestIdentityErrors(t *testing.T) {
+	router, _ := newTestRouter(t)
+	login(t, router, "user@example.com")
+
+	tests := []struct {
+		name  string
+		form  url.Values
+		error string
+	}{
+		{"wrong password", url.Values{
+			"grant_type": {"password"}, "username": {"user@example.com"}, "password": {"wrong"}, "scope": {"api offline_access"},
+			"client_id": {"web"}, "deviceIdentifier": {"device"}, "deviceName": {"firefox"}, "deviceType": {"10"},
+		}, "invalid_grant"},
+		{"missing refresh token", url.Values{"grant_type": {"refresh_token"}}, "invalid_request"},
+		{"unknown grant", url.Values{"grant_type": {"client_credentials"}}, "unsupported_grant_type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/identity/connect/token", strings.NewReader(test.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d %s", w.Code, w.Body.String())
+			}
+			m := decode(t, w)
+			if m["error"] != test.error || m["error_description"] == "" {
+				t.Fatalf("expected %s: %s", test.error, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRevokedToken(t *testing.T) {
+	router, db := newTestRouter(t)
+	token := login(t, router, "user@example.com")
+
+	// The tokens issued before the change of the security stamp are refused with 401, so the clients log out
+	u, err := db.GetUserFromEmail(context.Background(), "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SecurityStamp = "changed"
+	if err := db.SaveUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	w := call(router, "GET", "/api/sync", token, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, w); m["Object"] != "error" {
+		t.Errorf("not an ErrorModel: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"gotwarden/apierror"
+	"gotwarden/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ClientEvent is an event sent by the clients (ie cipher viewed)
+type ClientEvent struct {
+	Type     int    `json:"type" binding:"required"`
+	CipherID string `json:"cipherId"`
+	Date     string `json:"date"`
+}
+
+// eventDeviceKey keeps into the gin context the types of the devices of the events
+const eventDeviceKey = "gotwarden.event_device"
+
+// clientEventTypes lists the events the clients are allowed to send
+var clientEventTypes = map[int]bool{
+	models.EventUserClientExportedVault: true,
+	models.EventCipherClientViewed:      true,
+	models.EventCipherClientCopied:      true,
+}
+
+// logEvent records an audit event for the current request
+func (ctx *WardenCtx) logEvent(c *gin.Context, e *models.Event) {
+	countEvent(e.Type)
+	claim := jwt.ExtractClaims(c)
+	if e.ActingUserUUID == "" && claim["sub"] != nil {
+		e.ActingUserUUID = claim["sub"].(string)
+	}
+	if e.UserUUID == "" {
+		e.UserUUID = e.ActingUserUUID
+	}
+	if e.DeviceUUID == "" && claim["device"] != nil {
+		e.DeviceUUID = claim["device"].(string)
+	}
+	if e.DeviceUUID != "" && e.DeviceType == 0 {
+		e.DeviceType = ctx.eventDeviceType(c, e.DeviceUUID)
+	}
+	e.UUID = uuid.New().String()
+	e.IPAddress = c.ClientIP()
+	if e.Date.IsZero() {
+		e.Date = time.Now()
+	}
+	e.Date = e.Date.UTC()
+
+	if err := ctx.Db.AddEvent(c.Request.Context(), e); err != nil {
+		requestLog(c).WithError(err).WithField("event_type", e.Type).Error("Failed to record the event")
+	}
+}
+
+// eventDeviceType provides the type of the device of the events, read once by request (the bulk actions log an
+// event by cipher)
+func (ctx *WardenCtx) eventDeviceType(c *gin.Context, deviceUUID string) int {
+	key := eventDeviceKey + "." + deviceUUID
+	if deviceType, ok := c.Get(key); ok {
+		return deviceType.(int)
+	}
+	deviceType := 0
+	if d, err := ctx.Db.GetDevice(c.Request.Context(), deviceUUID); err == nil {
+		deviceType, _ = strconv.Atoi(d.Type)
+	}
+	c.Set(key, deviceType)
+	return deviceType
+}
+
+// sendEvents sends back the page of events matching the filter
+func (ctx *WardenCtx) sendEvents(c *gin.Context, filter *models.EventFilter) {
+	events, token, err := ctx.Db.GetEvents(c.Request.Context(), filter)
+	if err == models.ErrInvalidContinuationToken {
+		apierror.Abort(c, apierror.Validation("ContinuationToken", err.Error()))
+		return
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Internal("Database failed to get events", err))
+		return
+	}
+
+	data := []*models.EventObject{}
+	for _, e := range *events {
+		data = append(data, e.Jsonify())
+	}
+
+	var continuationToken interface{}
+	if token != "" {
+		continuationToken = token
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"Data":              data,
+		"ContinuationToken": continuationToken,
+		"Object":            "list",
+	})
+}
+
+// eventFilter builds the filter from the query parameters
+func eventFilter(c *gin.Context) (*models.EventFilter, bool) {
+	filter, err := models.NewEventFilter(c.Query("start"), c.Query("end"), c.Query("continuationToken"))
+	if err != nil {
+		apierror.Abort(c, apierror.BadRequest("Invalid date range: "+err.Error()))
+		return nil, false
+	}
+	return filter, true
+}
+
+// GetCipherEvents provides the events of a cipher
+func (ctx *WardenCtx) GetCipherEvents(c *gin.Context) {
+	cipher := loadedCipher(c)
+
+	filter, ok := eventFilter(c)
+	if !ok {
+		return
+	}
+	filter.CipherUUID = cipher.UUID
+	ctx.sendEvents(c, filter)
+}
+
+// GetOrganizationEvents provides the events of an organization (admins only)
+func (ctx *WardenCtx) GetOrganizationEvents(c *gin.Context) {
+	ou := loadedOrganizationUser(c)
+
+	filter, ok := eventFilter(c)
+	if !ok {
+		return
+	}
+	filter.OrganizationUUID = ou.OrganizationUUID
+	ctx.sendEvents(c, filter)
+}
+
+// GetUserEvents provides the events of the user logged in
+func (ctx *WardenCtx) GetUserEvents(c *gin.Context) {
+	claim := jwt.ExtractClaims(c)
+
+	filter, ok := eventFilter(c)
+	if !ok {
+		return
+	}
+	filter.UserUUID = claim["sub"].(string)
+	ctx.sendEvents(c, filter)
+}
+
+// CollectEvents records the events sent by the clients
+func (ctx *WardenCtx) CollectEvents(c *gin.Context) {
+	claim := jwt.ExtractClaims(c)
+	userUUID := claim["sub"].(string)
+
+	var events []ClientEvent
+	if err := c.ShouldBindJSON(&events); err != nil {
+		apierror.Abort(c, apierror.Binding(err))
+		return
+	}
+
+	for _, ce := range events {
+		if !clientEventTypes[ce.Type] {
+			continue
+		}
+		e := &models.Event{Type: ce.Type}
+		if ce.CipherID != "" {
+			// Ignore events about ciphers the user cannot see
+			if ok, err := ctx.Db.CanAccessCipher(c.Request.Context(), userUUID, ce.CipherID, false); err != nil || !ok {
+				continue
+			}
+			cipher, err := ctx.Db.GetCipher(c.Request.Context(), ce.CipherID)
+			if err != nil {
+				continue
+			}
+			e.CipherUUID = cipher.UUID
+			e.OrganizationUUID = cipher.OrganizationUUID
+		}
+		if date, err := time.Parse(time.RFC3339, ce.Date); err == nil {
+			e.Date = date
+		}
+		ctx.logEvent(c, e)
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"gotwarden/models"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUserEventsContinuationToken(t *testing.T) {
+	v := newVault(t)
+
+	// The token only positions the page, the events stay those of the user
+	forged := base64.RawURLEncoding.EncodeToString([]byte(time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano) + "|zzz"))
+	w := call(v.router, "GET", "/api/accounts/events?continuationToken="+forged, v.tokens["intruder"], nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	for _, e := range decode(t, w)["Data"].([]interface{}) {
+		e := e.(map[string]interface{})
+		if e["UserId"] != v.users["intruder"] && e["ActingUserId"] != v.users["intruder"] {
+			t.Errorf("event of another user: %v", e)
+		}
+	}
+
+	for _, tampered := range []string{url.QueryEscape("not base64!"), url.QueryEscape(base64.RawURLEncoding.EncodeToString([]byte("2022-01-01")))} {
+		w := call(v.router, "GET", "/api/accounts/events?continuationToken="+tampered, v.tokens["intruder"], nil)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d %s", tampered, w.Code, w.Body.String())
+		}
+		errs, _ := decode(t, w)["ValidationErrors"].(map[string]interface{})
+		if _, ok := errs["ContinuationToken"]; !ok {
+			t.Errorf("%s: no validation error for the token: %s", tampered, w.Body.String())
+		}
+	}
+}
+
+func TestCollectEvents(t *testing.T) {
+	v := newVault(t)
+
+	collect := func(user, cipher string) {
+		t.Helper()
+		w := call(v.router, "POST", "/api/collect", v.tokens[user], []map[string]interface{}{{"type": models.EventCipherClientViewed, "cipherId": cipher}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("collect: %d %s", w.Code, w.Body.String())
+		}
+	}
+	// The members log the views of the ciphers of the organization, not those of other users
+	collect("reader", v.orgCipher)
+	collect("intruder", v.cipher)
+	collect("reader", "unknown")
+	if n := countEvents(t, v, models.EventCipherClientViewed, v.orgCipher); n != 1 {
+		t.Errorf("%d view events for the cipher of the organization", n)
+	}
+	if n := countEvents(t, v, models.EventCipherClientViewed, v.cipher); n != 0 {
+		t.Errorf("%d view events from the intruder", n)
+	}
+}
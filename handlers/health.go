@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"gotwarden/models"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readyTimeout bounds the checks of the readiness probe
+const readyTimeout = 2 * time.Second
+
+// Alive gives the time of the server (the probe of the Bitwarden clients)
+func (ctx *WardenCtx) Alive(c *gin.Context) {
+	c.JSON(http.StatusOK, time.Now().UTC())
+}
+
+// Healthz tells the process is running (liveness probe)
+func (ctx *WardenCtx) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Drain reports the server as not ready, ie during the graceful shutdown
+func (ctx *WardenCtx) Drain() {
+	atomic.StoreInt32(&ctx.draining, 1)
+}
+
+// Readyz tells the server can handle requests (readiness probe): database, attachments and schema
+func (ctx *WardenCtx) Readyz(c *gin.Context) {
+	if atomic.LoadInt32(&ctx.draining) == 1 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+
+	checkCtx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+	defer cancel()
+	checks := []struct {
+		name  string
+		check func(context.Context) error
+	}{
+		{"database", ctx.Db.Ping},
+		{"attachments", ctx.Db.CheckWritable},
+		{"migrations", func(c context.Context) error {
+			version, err := ctx.Db.GetSchemaVersion(c)
+			if err == nil && version != models.SchemaVersion() {
+				err = fmt.Errorf("schema version %d, expected %d", version, models.SchemaVersion())
+			}
+			return err
+		}},
+	}
+
+	status, code := "ok", http.StatusOK
+	results := make(gin.H, len(checks))
+	for _, ch := range checks {
+		if err := ch.check(checkCtx); err != nil {
+			results[ch.name] = err.Error()
+			status, code = "unavailable", http.StatusServiceUnavailable
+			continue
+		}
+		results[ch.name] = "ok"
+	}
+	c.JSON(code, gin.H{"status": status, "checks": results})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"gotwarden/models"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProbes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := models.NewDB("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newWardenCtx(db)
+	router := ctx.Router()
+
+	for _, path := range []string{"/alive", "/api/alive"} {
+		w := call(router, "GET", path, "", nil)
+		var now time.Time
+		if err := json.Unmarshal(w.Body.Bytes(), &now); w.Code != http.StatusOK || err != nil || time.Since(now) > time.Minute {
+			t.Errorf("%s: unexpected response %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	if w := call(router, "GET", "/healthz", "", nil); w.Code != http.StatusOK {
+		t.Errorf("/healthz: %d", w.Code)
+	}
+
+	w := call(router, "GET", "/readyz", "", nil)
+	checks, _ := decode(t, w)["checks"].(map[string]interface{})
+	if w.Code != http.StatusOK || checks["database"] != "ok" || checks["attachments"] != "ok" || checks["migrations"] != "ok" {
+		t.Errorf("/readyz: unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	// The schema is behind the binary
+	if _, err := db.Exec("DELETE FROM schema_version WHERE version = ?", models.SchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	w = call(router, "GET", "/readyz", "", nil)
+	checks, _ = decode(t, w)["checks"].(map[string]interface{})
+	if w.Code != http.StatusServiceUnavailable || checks["migrations"] == "ok" || checks["database"] != "ok" {
+		t.Errorf("/readyz with an old schema: unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	// Shutting down
+	ctx = newWardenCtx(models.NewMemoryDB())
+	router = ctx.Router()
+	if w := call(router, "GET", "/readyz", "", nil); w.Code != http.StatusOK {
+		t.Errorf("/readyz: %d %s", w.Code, w.Body.String())
+	}
+	ctx.Drain()
+	if w := call(router, "GET", "/readyz", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while draining: %d %s", w.Code, w.Body.String())
+	}
+	if w := call(router, "GET", "/healthz", "", nil); w.Code != http.StatusOK {
+		t.Errorf("/healthz while draining: %d", w.Code)
+	}
+}
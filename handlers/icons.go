@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"gotwarden/apierror"
+	"gotwarden/icons"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetIcon provides the favicon of the domain (no auth needed)
+func (ctx *WardenCtx) GetIcon(c *gin.Context) {
+	icon, err := ctx.Icons.Get(c.Request.Context(), c.Param("domain"))
+	switch err {
+	case nil:
+		c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(ctx.Icons.TTL.Seconds())))
+		// The icons come from any site: never sniffed nor run as a document of the vault
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+		c.Data(http.StatusOK, http.DetectContentType(icon), icon)
+	case icons.ErrInvalidDomain:
+		apierror.Abort(c, apierror.Validation("domain", "Invalid domain"))
+	case icons.ErrUnavailable:
+		// Asked again on the next request
+		c.Header("Cache-Control", "no-cache")
+		c.AbortWithStatus(http.StatusNotFound)
+	default:
+		// Let the clients cache the miss as well
+		c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(ctx.Icons.NegativeTTL.Seconds())))
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotwarden/icons"
+	"gotwarden/models"
+)
+
+func TestGetIcon(t *testing.T) {
+	ctx := newWardenCtx(models.NewMemoryDB())
+	ctx.Icons = icons.New(t.TempDir(), time.Hour, time.Hour)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if err := ioutil.WriteFile(filepath.Join(ctx.Icons.CacheDir, "example.com.png"), png, 0600); err != nil {
+		t.Fatal(err)
+	}
+	router := ctx.Router()
+
+	w := call(router, "GET", "/icons/example.com/icon.png", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(png) {
+		t.Fatalf("unexpected icon %d %q", w.Code, w.Body.String())
+	}
+	for header, want := range map[string]string{
+		"Content-Type":            "image/png",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "default-src 'none'; sandbox",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s: got %q, want %q", header, got, want)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"gotwarden/apierror"
+	"gotwarden/metrics"
 	"gotwarden/models"
-	"log"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -75,51 +78,85 @@ func JwtMiddleware(ctx *WardenCtx) *jwt.GinJWTMiddleware {
 				return "", jwt.ErrMissingLoginValues
 			}
 
+			deviceType, _ := strconv.Atoi(identity.DeviceType)
+
 			// Check is user exists
-			if user, err := ctx.Db.GetUserFromEmail(identity.Username); err == nil {
-				// Verify Password
-				if user.CheckPassword(identity.Password) {
-					// TODO: Two-factor
-
-					// Get the Device for the DeviceIdentifier attach to the user
-					d := ctx.Db.GetDevice(identity.DeviceIdentifier)
-
-					if d == nil {
-						// If Device not found, create one
-						d = models.NewDevice(identity.DeviceIdentifier, identity.DeviceName, identity.DeviceType, user.UUID)
-						err = ctx.Db.AddDevice(d)
-						if err != nil {
-							log.Printf("Cannot insert Device %s : %s", identity.DeviceIdentifier, err)
-						}
+			if user, err := ctx.Db.GetUserFromEmail(c.Request.Context(), identity.Username); err == nil {
+				// Verify Password (a disabled user cannot log in)
+				if user.Disabled || !user.CheckPassword(identity.Password) {
+					ctx.logEvent(c, &models.Event{Type: models.EventUserFailedLogIn, UserUUID: user.UUID, DeviceType: deviceType})
+					return nil, jwt.ErrFailedAuthentication
+				}
+
+				// TODO: Two-factor
+
+				// Get the Device for the DeviceIdentifier attach to the user
+				d, err := ctx.Db.GetDevice(c.Request.Context(), identity.DeviceIdentifier)
+				if err != nil && !errors.Is(err, models.ErrNotFound) {
+					requestLog(c).WithError(err).WithField("device_identifier", identity.DeviceIdentifier).Error("Cannot get the device")
+					return nil, jwt.ErrFailedAuthentication
+				}
+
+				if d == nil {
+					// If Device not found, create one
+					d = models.NewDevice(identity.DeviceIdentifier, identity.DeviceName, identity.DeviceType, user.UUID)
+					err = ctx.Db.AddDevice(c.Request.Context(), d)
+					if err != nil {
+						requestLog(c).WithError(err).WithField("device_identifier", identity.DeviceIdentifier).Error("Cannot add the device")
 					} else {
-						d.Type = identity.DeviceType
-						d.Name = identity.DeviceName
-						if identity.PushToken != "" {
-							d.PushToken = identity.PushToken
-						}
-						if err = ctx.Db.SaveDevice(d); err != nil {
-							return nil, jwt.ErrFailedAuthentication
-						}
+						ctx.logEvent(c, &models.Event{Type: models.EventDeviceAdded, UserUUID: user.UUID, ActingUserUUID: user.UUID, DeviceUUID: d.UUID, DeviceType: deviceType})
+					}
+				} else {
+					d.Type = identity.DeviceType
+					d.Name = identity.DeviceName
+					if identity.PushToken != "" {
+						d.PushToken = identity.PushToken
+					}
+					if err = ctx.Db.SaveDevice(c.Request.Context(), d); err != nil {
+						return nil, jwt.ErrFailedAuthentication
 					}
-
-					return &AccessToken{
-						Sub:           user.UUID,
-						Name:          user.Name,
-						Email:         user.Email,
-						EmailVerified: strconv.FormatBool(user.EmailVerified),
-						Sstamp:        user.SecurityStamp,
-						Device:        d.UUID,
-						Scope:         strings.Split(identity.Scope, " "),
-					}, nil
 				}
+
+				ctx.logEvent(c, &models.Event{Type: models.EventUserLoggedIn, UserUUID: user.UUID, ActingUserUUID: user.UUID, DeviceUUID: d.UUID, DeviceType: deviceType})
+
+				return &AccessToken{
+					Sub:           user.UUID,
+					Name:          user.Name,
+					Email:         user.Email,
+					EmailVerified: strconv.FormatBool(user.EmailVerified),
+					Sstamp:        user.SecurityStamp,
+					Device:        d.UUID,
+					Scope:         strings.Split(identity.Scope, " "),
+				}, nil
 			}
+			metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
 			return nil, jwt.ErrFailedAuthentication
 		},
+		Authorizator: func(data interface{}, c *gin.Context) bool {
+			// Reject the tokens of disabled users or issued before the last log out
+			claim := jwt.ExtractClaims(c)
+			if claim["sub"] == nil {
+				return false
+			}
+			user, err := ctx.Db.GetUser(c.Request.Context(), claim["sub"].(string))
+			return err == nil && !user.Disabled && claim["sstamp"] == user.SecurityStamp
+		},
 		Unauthorized: func(c *gin.Context, code int, message string) {
-			c.JSON(code, gin.H{
-				"code":    code,
-				"message": message,
-			})
+			// The tokens refused by the Authorizator are no longer valid: 401 makes the clients log out
+			if code == http.StatusForbidden {
+				code = http.StatusUnauthorized
+			}
+			// The API endpoints answer with an ErrorModel
+			if !strings.HasPrefix(c.Request.URL.Path, ctx.IdentityURL) {
+				apierror.Abort(c, &apierror.Error{Status: code, Message: message})
+				return
+			}
+
+			if message == jwt.ErrMissingLoginValues.Error() {
+				apierror.Abort(c, apierror.Identity("invalid_request", message))
+				return
+			}
+			apierror.Abort(c, apierror.Identity("invalid_grant", "Username or password is incorrect. Try again."))
 		},
 		RefreshResponse: func(c *gin.Context, code int, token string, expire time.Time) {
 			c.JSON(code, gin.H{
@@ -133,14 +170,13 @@ func JwtMiddleware(ctx *WardenCtx) *jwt.GinJWTMiddleware {
 			// Get the user info
 			var identity Identity
 
-			// Récupérer depuis le contexte et la Db les infos nécessaires
+			// Get the user and the device of the login from the form
 			if err := c.ShouldBind(&identity); err == nil {
-				if user, err := ctx.Db.GetUserFromEmail(identity.Username); err == nil {
-					d := ctx.Db.GetDevice(identity.DeviceIdentifier)
-					if d != nil {
+				if user, err := ctx.Db.GetUserFromEmail(c.Request.Context(), identity.Username); err == nil {
+					if d, err := ctx.Db.GetDevice(c.Request.Context(), identity.DeviceIdentifier); err == nil {
 						// Save token
 						d.AccessToken = token
-						ctx.Db.SaveDevice(d)
+						ctx.Db.SaveDevice(c.Request.Context(), d)
 						c.JSON(code, gin.H{
 							"access_token":  token,
 							"expire_in":     int(ctx.Validity.Seconds()),
@@ -152,7 +188,7 @@ func JwtMiddleware(ctx *WardenCtx) *jwt.GinJWTMiddleware {
 					}
 				}
 			}
-			c.AbortWithStatusJSON(500, FormattedError("Inner database access issue"))
+			apierror.Abort(c, apierror.Internal("Inner database access issue", nil))
 		},
 	}
 }
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"gotwarden/logging"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logging.For("handlers")
+
+// requestLog gives the logger of the request, with its id and the user of the token
+func requestLog(c *gin.Context) *logrus.Entry {
+	return logging.WithRequest(logger, c)
+}
+
+// identityFields are the user and the device of the token (none before the JWT middleware)
+func identityFields(c *gin.Context) logrus.Fields {
+	claims := jwt.ExtractClaims(c)
+	fields := logrus.Fields{}
+	if sub, ok := claims["sub"].(string); ok {
+		fields["user_id"] = sub
+	}
+	if device, ok := claims["device"].(string); ok {
+		fields["device_id"] = device
+	}
+	return fields
+}
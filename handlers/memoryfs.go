@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memoryFS is a read-only file system holding its files into memory, the folders are deduced from the
+// paths of the files
+type memoryFS map[string]*memoryFile
+
+// memoryFile is the content of a file of a memoryFS
+type memoryFile struct {
+	Data    []byte
+	ModTime time.Time
+}
+
+// Open opens the file or the folder name
+func (m memoryFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if f, ok := m[name]; ok {
+		info := &memoryInfo{name: path.Base(name), size: int64(len(f.Data)), modTime: f.ModTime}
+		return &openMemoryFile{info: info, Reader: bytes.NewReader(f.Data)}, nil
+	}
+
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	children := map[string]*memoryInfo{}
+	for p, f := range m {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		child := strings.TrimPrefix(p, prefix)
+		if i := strings.Index(child, "/"); i >= 0 {
+			children[child[:i]] = &memoryInfo{name: child[:i], dir: true}
+		} else {
+			children[child] = &memoryInfo{name: child, size: int64(len(f.Data)), modTime: f.ModTime}
+		}
+	}
+	if len(children) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, info := range children {
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return &openMemoryDir{info: &memoryInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+}
+
+// memoryInfo describes a file or a folder of a memoryFS
+type memoryInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memoryInfo) Name() string               { return i.name }
+func (i *memoryInfo) Size() int64                { return i.size }
+func (i *memoryInfo) ModTime() time.Time         { return i.modTime }
+func (i *memoryInfo) IsDir() bool                { return i.dir }
+func (i *memoryInfo) Sys() interface{}           { return nil }
+func (i *memoryInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *memoryInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+func (i *memoryInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// openMemoryFile is a file of a memoryFS being read
+type openMemoryFile struct {
+	info *memoryInfo
+	*bytes.Reader
+}
+
+func (f *openMemoryFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *openMemoryFile) Close() error               { return nil }
+
+// openMemoryDir is a folder of a memoryFS being listed
+type openMemoryDir struct {
+	info    *memoryInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openMemoryDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *openMemoryDir) Close() error               { return nil }
+
+func (d *openMemoryDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir lists the next n entries of the folder (all the remaining ones if n <= 0)
+func (d *openMemoryDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"gotwarden/metrics"
+	"gotwarden/models"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventMetrics are the counters of the actions recorded as events
+var eventMetrics = map[int]prometheus.Counter{
+	models.EventUserLoggedIn:            metrics.Logins.WithLabelValues(metrics.LoginSuccess),
+	models.EventUserFailedLogIn:         metrics.Logins.WithLabelValues(metrics.LoginFailure),
+	models.EventCipherCreated:           metrics.Items.WithLabelValues("cipher", "created"),
+	models.EventCipherDeleted:           metrics.Items.WithLabelValues("cipher", "deleted"),
+	models.EventFolderCreated:           metrics.Items.WithLabelValues("folder", "created"),
+	models.EventFolderDeleted:           metrics.Items.WithLabelValues("folder", "deleted"),
+	models.EventCipherAttachmentCreated: metrics.Items.WithLabelValues("attachment", "created"),
+	models.EventCipherAttachmentDeleted: metrics.Items.WithLabelValues("attachment", "deleted"),
+}
+
+// countEvent updates the counter of the event (if any)
+func countEvent(eventType int) {
+	if counter, ok := eventMetrics[eventType]; ok {
+		counter.Inc()
+	}
+}
+
+var (
+	notificationConnectionsDesc = prometheus.NewDesc(metrics.Namespace+"_notification_connections", "Websockets opened to the notifications hub.", nil, nil)
+	attachmentBytesDesc         = prometheus.NewDesc(metrics.Namespace+"_attachment_storage_bytes", "Size of the attachments stored.", nil, nil)
+	dbOpenDesc                  = prometheus.NewDesc(metrics.Namespace+"_db_open_connections", "Connections opened to the database.", []string{"state"}, nil)
+	dbMaxOpenDesc               = prometheus.NewDesc(metrics.Namespace+"_db_max_open_connections", "Maximum number of connections to the database.", nil, nil)
+	dbWaitCountDesc             = prometheus.NewDesc(metrics.Namespace+"_db_wait_total", "Connections waited for.", nil, nil)
+	dbWaitDurationDesc          = prometheus.NewDesc(metrics.Namespace+"_db_wait_seconds_total", "Time waited for a connection.", nil, nil)
+)
+
+// stateCollector reads the state of the server at each scrape
+type stateCollector struct {
+	ctx *WardenCtx
+}
+
+// Describe implements prometheus.Collector
+func (s stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{notificationConnectionsDesc, attachmentBytesDesc, dbOpenDesc, dbMaxOpenDesc, dbWaitCountDesc, dbWaitDurationDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (s stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(notificationConnectionsDesc, prometheus.GaugeValue, float64(s.ctx.Notifications.Connections()))
+
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if storage, err := s.ctx.Db.GetStorageByUser(c); err == nil {
+		var total int64
+		for _, size := range storage {
+			total += size
+		}
+		ch <- prometheus.MustNewConstMetric(attachmentBytesDesc, prometheus.GaugeValue, float64(total))
+	} else {
+		logger.WithError(err).Error("Cannot get the attachment storage")
+	}
+
+	// The pool of the SQL databases
+	db, ok := s.ctx.Db.(*models.DB)
+	if !ok {
+		return
+	}
+	stats := db.Db.Stats()
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(stats.InUse), "in_use")
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(stats.Idle), "idle")
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"gotwarden/metrics"
+	"gotwarden/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := newWardenCtx(models.NewMemoryDB())
+	ctx.MetricsToken = "scraper token"
+	router := ctx.Router()
+	state := stateCollector{ctx}
+	metrics.Registry.MustRegister(state)
+	defer metrics.Registry.Unregister(state)
+
+	counters := map[string]float64{}
+	count := func(name string) float64 {
+		switch name {
+		case "registrations":
+			return testutil.ToFloat64(metrics.Registrations)
+		case "logins":
+			return testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.LoginSuccess))
+		case "failures":
+			return testutil.ToFloat64(metrics.Logins.WithLabelValues(metrics.LoginFailure))
+		}
+		kind, action, _ := strings.Cut(name, " ")
+		return testutil.ToFloat64(metrics.Items.WithLabelValues(kind, action))
+	}
+	expected := map[string]float64{
+		"registrations": 1, "logins": 1, "failures": 1,
+		"cipher created": 1, "cipher deleted": 1, "folder created": 1, "folder deleted": 1,
+		"attachment created": 1, "attachment deleted": 1,
+	}
+	for name := range expected {
+		counters[name] = count(name)
+	}
+	sync := testutil.ToFloat64(metrics.Requests.WithLabelValues("GET", "/api/sync", "200"))
+
+	clientSession(t, router)
+
+	for name, delta := range expected {
+		if got := count(name) - counters[name]; got != delta {
+			t.Errorf("%s: expected +%v, got +%v", name, delta, got)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.Requests.WithLabelValues("GET", "/api/sync", "200")) - sync; got != 3 {
+		t.Errorf("GET /api/sync: expected 3 requests, got %v", got)
+	}
+
+	scrape := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := scrape(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("the metrics are served without token: %d", w.Code)
+	}
+	if w := scrape("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("the metrics are served with a wrong token: %d", w.Code)
+	}
+	w := scrape("scraper token")
+	for _, line := range []string{
+		`gotwarden_http_request_duration_seconds_count{method="GET",route="/api/sync",status="200"}`,
+		`gotwarden_logins_total{result="failure"}`,
+		`gotwarden_items_total{action="created",type="cipher"}`,
+		"gotwarden_notification_connections 0",
+		"gotwarden_attachment_storage_bytes 0",
+		"go_goroutines",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("%s is missing:\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -1,10 +1,65 @@
 package handlers
 
 import (
+	"gotwarden/models"
+	"gotwarden/notifications"
+	"net/http"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
-// NotifHub is a function, don't what is it
+// NotifHub keeps the websocket of a device (SignalR) to push it the updates of the vault
 func (ctx *WardenCtx) NotifHub(c *gin.Context) {
-	// TODO: What the purpose of this request ?
+	claim := jwt.ExtractClaims(c)
+
+	if err := ctx.Notifications.Serve(c.Writer, c.Request, claim["sub"].(string)); err != nil {
+		requestLog(c).WithError(err).Warn("Failed to open the notifications websocket")
+	}
+}
+
+// NotifNegotiate tells the SignalR clients to use the websocket transport
+func (ctx *WardenCtx) NotifNegotiate(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"connectionId": uuid.New().String(),
+		"availableTransports": []gin.H{{
+			"transport":       "WebSockets",
+			"transferFormats": []string{"Text", "Binary"},
+		}},
+	})
+}
+
+// notifyCiphers asks the other devices of the user to sync their ciphers
+func (ctx *WardenCtx) notifyCiphers(c *gin.Context, userUUID string) {
+	var device string
+	if d, ok := jwt.ExtractClaims(c)["device"].(string); ok {
+		device = d
+	}
+	ctx.Notifications.Send(userUUID, notifications.SyncCiphers, device, map[string]interface{}{
+		"UserId": userUUID,
+		"Date":   time.Now(),
+	})
+}
+
+// notifyOrganizations asks the devices of the user and of the confirmed members of the organizations to sync their
+// ciphers, once by user
+func (ctx *WardenCtx) notifyOrganizations(c *gin.Context, userUUID string, orgs []string) {
+	users := map[string]bool{userUUID: true}
+	for _, orgUUID := range orgs {
+		ous, err := ctx.Db.GetOrganizationUsers(c.Request.Context(), orgUUID)
+		if err != nil {
+			requestLog(c).WithError(err).WithField("organization_id", orgUUID).Error("Failed to get the members to notify")
+			continue
+		}
+		for _, ou := range *ous {
+			if ou.Status == models.OrganizationUserConfirmed {
+				users[ou.UserUUID] = true
+			}
+		}
+	}
+	for u := range users {
+		ctx.notifyCiphers(c, u)
+	}
 }
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"gotwarden/logging"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Exchange is a request and its response recorded from a client (one line of the JSONL recordings)
+type Exchange struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is a redacted request of a client
+type RecordedRequest struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+	// Encoding is base64 when the body is not text
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// RecordedResponse is a redacted response of the server
+type RecordedResponse struct {
+	Status   int               `json:"status"`
+	Header   map[string]string `json:"header,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Encoding string            `json:"encoding,omitempty"`
+}
+
+// recordedHeaders are the headers kept into the recordings
+var recordedHeaders = []string{"Authorization", "Content-Type", "Device-Type", "Bitwarden-Client-Name", "Bitwarden-Client-Version"}
+
+// personalFields are the personal data replaced by pseudonyms with the credentials (json keys and form fields, case
+// insensitive)
+var personalFields = map[string]bool{
+	"email":              true,
+	"username":           true,
+	"masterpasswordhint": true,
+}
+
+// redacted tells if the field is replaced by a pseudonym: a credential (the secret fields of the logs) or personal data
+func redacted(name string) bool {
+	return logging.Secret(name) || personalFields[strings.ToLower(name)]
+}
+
+// Recorder writes the traffic of the clients as redacted JSONL, to be replayed by the contract tests
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// key of the pseudonyms (the same value gets the same pseudonym into a recording)
+	key []byte
+}
+
+// NewRecorder creates a recorder writing the exchanges into w
+func NewRecorder(w io.Writer) *Recorder {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		logger.WithError(err).Fatal("Cannot generate the key of the recorder")
+	}
+	return &Recorder{enc: json.NewEncoder(w), key: key}
+}
+
+// pseudonym replaces a secret by a stable value (an email stays an email so the request is still valid)
+func (rec *Recorder) pseudonym(value string) string {
+	if value == "" || strings.HasPrefix(value, "redacted-") {
+		return value
+	}
+	email := strings.Contains(value, "@")
+	if email {
+		value = strings.ToLower(value)
+	}
+	mac := hmac.New(sha256.New, rec.key)
+	mac.Write([]byte(value))
+	p := "redacted-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	if email {
+		p += "@example.com"
+	}
+	return p
+}
+
+// Middleware records the requests whose path starts with one of the prefixes
+func (rec *Recorder) Middleware(prefixes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPrefix(c.Request.URL.Path, prefixes) || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		w := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = w
+
+		c.Next()
+
+		e := Exchange{
+			Request: RecordedRequest{
+				Method: c.Request.Method,
+				Path:   rec.redactURL(c.Request.URL),
+				Header: rec.headers(c.Request.Header),
+			},
+			Response: RecordedResponse{
+				Status: w.Status(),
+				Header: rec.headers(w.Header()),
+			},
+		}
+		e.Request.Body, e.Request.Encoding = rec.redactBody(c.Request.Header.Get("Content-Type"), body)
+		e.Response.Body, e.Response.Encoding = rec.redactBody(w.Header().Get("Content-Type"), w.body.Bytes())
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if err := rec.enc.Encode(&e); err != nil {
+			requestLog(c).WithError(err).Error("Cannot record the exchange")
+		}
+	}
+}
+
+func hasPrefix(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rec *Recorder) headers(h http.Header) map[string]string {
+	kept := make(map[string]string)
+	for _, name := range recordedHeaders {
+		value := h.Get(name)
+		if value == "" {
+			continue
+		}
+		if name == "Authorization" {
+			scheme, credentials, _ := strings.Cut(value, " ")
+			value = scheme + " " + rec.pseudonym(credentials)
+		}
+		kept[name] = value
+	}
+	return kept
+}
+
+func (rec *Recorder) redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query := u.Query()
+	rec.redactValues(query)
+	return u.Path + "?" + query.Encode()
+}
+
+func (rec *Recorder) redactValues(values url.Values) {
+	for name, vv := range values {
+		if redacted(name) {
+			for i := range vv {
+				vv[i] = rec.pseudonym(vv[i])
+			}
+		}
+	}
+}
+
+// redactBody redacts the JSON and form bodies, the other ones are kept as is (base64 if they are not text)
+func (rec *Recorder) redactBody(contentType string, body []byte) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			redacted, _ := json.Marshal(rec.redactJSON(v))
+			return string(redacted), ""
+		}
+	case "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			rec.redactValues(values)
+			return values.Encode(), ""
+		}
+	}
+	if !utf8.Valid(body) {
+		return base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return string(body), ""
+}
+
+func (rec *Recorder) redactJSON(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			if s, ok := field.(string); ok && redacted(k) {
+				value[k] = rec.pseudonym(s)
+			} else {
+				value[k] = rec.redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = rec.redactJSON(value[i])
+		}
+	}
+	return v
+}
+
+// bodyRecorder keeps a copy of the response body
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
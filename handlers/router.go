@@ -1,10 +1,17 @@
 package handlers
 
 import (
+	"gotwarden/apierror"
+	"gotwarden/icons"
+	"gotwarden/logging"
+	"gotwarden/metrics"
 	"gotwarden/models"
+	"gotwarden/notifications"
+	"gotwarden/tracing"
 	"gotwarden/util"
-	"log"
+	"io/fs"
 	"net/http"
+	"os"
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
@@ -14,6 +21,7 @@ import (
 // WardenCtx is the db datastore functions
 type WardenCtx struct {
 	Db             models.Datastore
+	DbType         string
 	Port           string
 	SecretPhrase   string
 	Validity       time.Duration
@@ -22,28 +30,83 @@ type WardenCtx struct {
 	AttachmentURL  string
 	IconURL        string
 	StaticFilePath string
+	Domain         string
+	AdminToken     string
+	// AdminMTLS requires a verified client certificate to access /admin
+	AdminMTLS      bool
+	SignupsAllowed bool
+	SMTP           util.SMTPConfig
+	WebVaultFS     fs.FS
+	Icons          *icons.Service
+	Notifications  *notifications.Hub
+	// MetricsPort serves /metrics on its own listener (empty for the router)
+	MetricsPort string
+	// MetricsToken protects /metrics (disabled on the router if empty)
+	MetricsToken string
+	// Recorder writes the traffic of the clients for the contract tests (nil if disabled)
+	Recorder *Recorder
+	// draining is set once the server is shutting down (see Drain)
+	draining int32
 }
 
 // Init is the constructor for WardenCtx
 func Init(conf *util.Config) (*WardenCtx, error) {
 
-	db, err := models.NewDB(conf.Db.GetType(), conf.Db.GetConnect())
+	db, err := NewDatastore(conf.Db)
 	if err != nil {
 		return nil, err
 	}
 
+	webVault, err := LoadWebVault(conf.WebVaultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorder *Recorder
+	if conf.RecordPath != "" {
+		f, err := os.OpenFile(conf.RecordPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		logger.WithField("file", conf.RecordPath).Info("The traffic of the clients is recorded")
+		recorder = NewRecorder(f)
+	}
+
 	// Create WardenContext from the confg data
-	return &WardenCtx{
-		db,
-		conf.Port,
-		conf.SecretPhrase,
-		conf.Validity,
-		conf.RefeshValidity,
-		conf.IdentityURL,
-		conf.AttachmentURL,
-		conf.IconURL,
-		conf.StaticFilePath,
-	}, nil
+	ctx := &WardenCtx{
+		Db:             db,
+		DbType:         conf.Db.GetType(),
+		Port:           conf.Port,
+		SecretPhrase:   conf.SecretPhrase,
+		Validity:       conf.Validity,
+		RefeshValidity: conf.RefeshValidity,
+		IdentityURL:    conf.IdentityURL,
+		AttachmentURL:  conf.AttachmentURL,
+		IconURL:        conf.IconURL,
+		StaticFilePath: conf.StaticFilePath,
+		Domain:         conf.Domain,
+		AdminToken:     conf.AdminToken,
+		AdminMTLS:      conf.TLS.AdminClientCA != "",
+		SignupsAllowed: conf.SignupsAllowed,
+		SMTP:           conf.SMTP,
+		WebVaultFS:     webVault,
+		Icons:          icons.New(conf.StaticFilePath, conf.IconTTL, conf.IconMissTTL),
+		Notifications:  notifications.NewHub(),
+		MetricsPort:    conf.MetricsPort,
+		MetricsToken:   conf.MetricsToken,
+		Recorder:       recorder,
+	}
+	metrics.Registry.MustRegister(stateCollector{ctx})
+	return ctx, nil
+}
+
+// NewDatastore opens the database of the config (migrated to the current schema)
+func NewDatastore(conf util.DbConfig) (models.Datastore, error) {
+	if conf.GetType() == util.MemoryDbType {
+		logger.Warn("The data are kept in memory and lost when the server stops")
+		return models.NewMemoryDB(), nil
+	}
+	return models.NewDB(conf.GetType(), conf.GetConnect())
 }
 
 // Router define all the handles
@@ -52,13 +115,50 @@ func (ctx *WardenCtx) Router() http.Handler {
 	authMiddleware, err := jwt.New(JwtMiddleware(ctx))
 
 	if err != nil {
-		log.Fatal("JWT Error: " + err.Error())
+		logger.WithError(err).Fatal("Cannot create the JWT middleware")
+	}
+
+	// The websockets cannot send headers: the access token is into the URL
+	hubConfig := JwtMiddleware(ctx)
+	hubConfig.TokenLookup = "query: access_token"
+	hubMiddleware, err := jwt.New(hubConfig)
+	if err != nil {
+		logger.WithError(err).Fatal("Cannot create the JWT middleware")
+	}
+
+	apierror.RegisterValidator()
+
+	r := gin.New()
+	r.Use(gin.Recovery(), logging.Middleware(logging.For("http"), identityFields))
+	r.Use(metrics.Middleware, tracing.Middleware)
+	// The handlers given the gin context as context.Context keep the span of the request
+	r.ContextWithFallback = true
+	if ctx.Recorder != nil {
+		r.Use(ctx.Recorder.Middleware("/api", ctx.IdentityURL, ctx.AttachmentURL))
 	}
+	r.SetHTMLTemplate(consoleTemplates())
 
-	r := gin.Default()
+	// Favicons of the sites (cached into StaticFilePath)
+	r.GET(ctx.IconURL+"/:domain/icon.png", ctx.GetIcon)
 
-	// Static serve for icons ...
-	r.Static(ctx.IconURL, ctx.StaticFilePath)
+	// Prometheus metrics (on their own port if configured)
+	if ctx.MetricsToken != "" && ctx.MetricsPort == "" {
+		r.GET("/metrics", gin.WrapH(metrics.Handler(ctx.MetricsToken)))
+	}
+
+	// Probes
+	r.GET("/alive", ctx.Alive)
+	r.GET("/api/alive", ctx.Alive)
+	r.GET("/healthz", ctx.Healthz)
+	r.GET("/readyz", ctx.Readyz)
+
+	r.GET("/api/config", ctx.Config)
+	r.GET("/app-id.json", ctx.AppID)
+
+	// Web vault (optional)
+	if ctx.WebVaultFS != nil {
+		r.NoRoute(ctx.WebVault)
+	}
 
 	accounts := r.Group("/api/accounts")
 	{
@@ -67,6 +167,8 @@ func (ctx *WardenCtx) Router() http.Handler {
 		accounts.Use(authMiddleware.MiddlewareFunc())
 		{
 			accounts.POST("/keys", ctx.GetKeys).Use(authMiddleware.MiddlewareFunc())
+			accounts.GET("/events", ctx.GetUserEvents)
+			accounts.GET("/revision-date", ctx.GetRevisionDate)
 		}
 	}
 
@@ -76,16 +178,32 @@ func (ctx *WardenCtx) Router() http.Handler {
 	{
 		auth.GET("/sync", ctx.Synchronize)
 		auth.POST("/ciphers", ctx.SaveCipher)
-		auth.PUT("/ciphers/:uuid", ctx.SaveCipher)
-		auth.PUT("/ciphers/:uuid/delete", ctx.DeleteCipher)
+		auth.PUT("/ciphers/:uuid", ctx.LoadCipher("uuid", accessWrite), ctx.SaveCipher)
+		auth.PUT("/ciphers/:uuid/delete", ctx.LoadCipher("uuid", accessWrite), ctx.DeleteCipher)
+		auth.PUT("/ciphers/:uuid/partial", ctx.LoadCipher("uuid", accessOwner), ctx.SavePartialCipher)
+		auth.POST("/ciphers/move", ctx.MoveCiphers)
+		auth.PUT("/ciphers/move", ctx.MoveCiphers)
+		auth.PUT("/ciphers/delete", ctx.SoftDeleteCiphers)
+		auth.POST("/ciphers/delete", ctx.DeleteCiphers)
+		auth.DELETE("/ciphers", ctx.DeleteCiphers)
+		auth.PUT("/ciphers/restore", ctx.RestoreCiphers)
+		auth.PUT("/ciphers/share", ctx.ShareCiphers)
 		auth.POST("/folders", ctx.SaveFolder)
-		auth.PUT("/folders/:uuid", ctx.SaveFolder)
-		auth.DELETE("/folders/:uuid", ctx.DeleteFolder)
-		auth.PUT("/devices/identifier/:uuid/clear-token", ctx.ClearToken)
-		auth.PUT("/devices/identifier/:uuid/token", ctx.UpdateToken)
-		auth.POST("/ciphers/:uuid/attachment", ctx.SaveAttachment)
-		auth.DELETE("/cyphers/:uuid/attachment/:attachment_uuid", ctx.DeleteAttachment)
-		auth.POST("/ciphers/:uuid/attachment/:attachment_id/delete", ctx.DeleteAttachment)
+		auth.PUT("/folders/:uuid", ctx.LoadFolder("uuid"), ctx.SaveFolder)
+		auth.DELETE("/folders/:uuid", ctx.LoadFolder("uuid"), ctx.DeleteFolder)
+		auth.PUT("/devices/identifier/:uuid/clear-token", ctx.LoadDevice("uuid"), ctx.ClearToken)
+		auth.PUT("/devices/identifier/:uuid/token", ctx.LoadDevice("uuid"), ctx.UpdateToken)
+		auth.POST("/ciphers/:uuid/attachment", ctx.LoadCipher("uuid", accessWrite), ctx.SaveAttachment)
+		auth.GET("/ciphers/:uuid/attachment/:attachment_uuid", ctx.LoadCipher("uuid", accessRead), ctx.LoadAttachment("attachment_uuid"), ctx.GetAttachmentData)
+		auth.DELETE("/ciphers/:uuid/attachment/:attachment_uuid", ctx.LoadCipher("uuid", accessWrite), ctx.LoadAttachment("attachment_uuid"), ctx.DeleteAttachment)
+		auth.DELETE("/cyphers/:uuid/attachment/:attachment_uuid", ctx.LoadCipher("uuid", accessWrite), ctx.LoadAttachment("attachment_uuid"), ctx.DeleteAttachment)
+		auth.POST("/ciphers/:uuid/attachment/:attachment_uuid/delete", ctx.LoadCipher("uuid", accessWrite), ctx.LoadAttachment("attachment_uuid"), ctx.DeleteAttachment)
+		auth.GET("/ciphers/:uuid/events", ctx.LoadCipher("uuid", accessOwner), ctx.GetCipherEvents)
+		auth.GET("/organizations/:uuid/events", ctx.LoadOrganization("uuid", true), ctx.GetOrganizationEvents)
+		auth.POST("/collect", ctx.CollectEvents)
+		auth.GET("/settings/domains", ctx.GetDomains)
+		auth.PUT("/settings/domains", ctx.SaveDomains)
+		auth.POST("/settings/domains", ctx.SaveDomains)
 	}
 
 	attachment := r.Group(ctx.AttachmentURL)
@@ -97,7 +215,7 @@ func (ctx *WardenCtx) Router() http.Handler {
 	{
 		identity.POST("/connect/token", func(c *gin.Context) {
 
-			log.Printf("grant_type: %s", c.PostForm("grant_type"))
+			requestLog(c).WithField("grant_type", c.PostForm("grant_type")).Debug("Token requested")
 
 			switch c.PostForm("grant_type") {
 			case "refresh_token":
@@ -105,7 +223,8 @@ func (ctx *WardenCtx) Router() http.Handler {
 				refreshToken := c.PostForm("refresh_token")
 
 				if refreshToken == "" {
-					c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("'refresh_token' cannot be blank"))
+					apierror.Abort(c, apierror.Identity("invalid_request", "'refresh_token' cannot be blank"))
+					return
 				}
 
 				// Device findByRefreshToken()
@@ -115,38 +234,58 @@ func (ctx *WardenCtx) Router() http.Handler {
 				// Loginn Handler
 				authMiddleware.LoginHandler(c)
 			default:
-				c.AbortWithStatusJSON(http.StatusBadRequest, FormattedError("grant_type should be 'password' or 'refresh_token'"))
+				apierror.Abort(c, apierror.Identity("unsupported_grant_type", "grant_type should be 'password' or 'refresh_token'"))
 			}
 		})
 	}
 
 	notif := r.Group("/notifications")
 	{
-		notif.GET("/hub", ctx.NotifHub)
+		notif.GET("/hub", hubMiddleware.MiddlewareFunc(), ctx.NotifHub)
+		notif.POST("/hub/negotiate", authMiddleware.MiddlewareFunc(), ctx.NotifNegotiate)
 	}
-	// Routes to help to build the API. Should be disabled at the end.
-	admin := r.Group("/admin")
+	// Admin API (enabled only when an admin token is configured)
+	adminAPI := r.Group("/admin/api")
+	adminAPI.Use(ctx.RequireClientCert)
 	{
-		admin.GET("/users", ctx.ShowUsers)
-		admin.GET("/devices", ctx.ShowDevices)
-		admin.GET("/folders", ctx.ShowFolders)
-		admin.GET("/ciphers", ctx.ShowCiphers)
+		adminAPI.POST("/login", ctx.AdminLogin)
+		adminAPI.POST("/logout", ctx.AdminLogout)
+		adminAPI.Use(ctx.AdminMiddleware)
+		{
+			adminAPI.GET("/users", ctx.AdminListUsers)
+			adminAPI.POST("/users/:uuid/disable", ctx.AdminUserAction("disable"))
+			adminAPI.POST("/users/:uuid/enable", ctx.AdminUserAction("enable"))
+			adminAPI.POST("/users/:uuid/deauth", ctx.AdminUserAction("deauth"))
+			adminAPI.DELETE("/users/:uuid", ctx.AdminUserAction("delete"))
+			adminAPI.POST("/invite", ctx.AdminInviteUser)
+			adminAPI.POST("/test/smtp", ctx.AdminTestSMTP)
+		}
 	}
 
-	return r
-}
-
-// WardenError is a nested msg error
-type WardenError struct {
-	Message []string `binding:"required"`
-}
-
-// FormattedError formats error as BitWarden expected
-func FormattedError(msg string) map[string]interface{} {
-	return gin.H{
-		"ValidationErrors": WardenError{
-			Message: []string{msg},
-		},
-		"Object": "error",
+	// Admin web console
+	console := r.Group("/admin")
+	console.Use(ctx.RequireClientCert, ctx.ConsoleCSRF)
+	{
+		console.StaticFileFS("/static/console.css", "static/console.css", http.FS(staticFS))
+		console.StaticFileFS("/static/console.js", "static/console.js", http.FS(staticFS))
+		console.GET("/login", ctx.ConsoleLoginPage)
+		console.POST("/login", ctx.ConsoleLogin)
+		console.POST("/logout", ctx.ConsoleLogout)
+		console.Use(ctx.ConsoleAuth)
+		{
+			console.GET("", func(c *gin.Context) {
+				c.Redirect(http.StatusSeeOther, "/admin/users")
+			})
+			console.GET("/users", ctx.ConsoleUsers)
+			console.POST("/users/:uuid/:action", ctx.ConsoleUserAction)
+			console.GET("/users/:uuid/devices", ctx.ConsoleDevices)
+			console.POST("/invite", ctx.ConsoleInvite)
+			console.POST("/test/smtp", ctx.ConsoleTestSMTP)
+			console.GET("/organizations", ctx.ConsoleOrganizations)
+			console.GET("/diagnostics", ctx.ConsoleDiagnostics)
+			console.GET("/log", ctx.ConsoleLog)
+		}
 	}
+
+	return r
 }
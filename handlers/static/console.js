@@ -0,0 +1,7 @@
+// Asks for a confirmation before sending the forms having a data-confirm attribute
+document.addEventListener("submit", function (event) {
+  var message = event.target.getAttribute("data-confirm");
+  if (message && !window.confirm(message)) {
+    event.preventDefault();
+  }
+});
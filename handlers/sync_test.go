@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSharedCipherSync(t *testing.T) {
+	v := newVault(t)
+
+	// etags gets the ETag of the sync of the reader and of the intruder
+	etags := func() (string, string) {
+		return getSync(v.router, "/api/sync", v.tokens["reader"], "").Header().Get("ETag"),
+			getSync(v.router, "/api/sync", v.tokens["intruder"], "").Header().Get("ETag")
+	}
+
+	for _, change := range []route{
+		{"PUT", "/api/ciphers/" + v.orgCipher, gin.H{"type": 1, "name": "2.updated"}},
+		{"POST", "/api/ciphers/" + v.orgCipher + "/attachment", gin.H{"data": gin.H{"filename": "2.file"}, "Size": 4, "File": "ZmlsZQ=="}},
+		{"PUT", "/api/ciphers/delete", gin.H{"ids": []string{v.orgCipher}}},
+		{"PUT", "/api/ciphers/restore", gin.H{"ids": []string{v.orgCipher}}},
+		{"PUT", "/api/ciphers/" + v.orgCipher + "/delete", nil},
+	} {
+		reader, intruder := etags()
+		w := call(v.router, change.method, change.path, v.tokens["owner"], change.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", change.method, change.path, w.Code, w.Body.String())
+		}
+		// The members of the organization sync the change made by the owner, the others have nothing new
+		if w := getSync(v.router, "/api/sync", v.tokens["reader"], reader); w.Code != http.StatusOK {
+			t.Errorf("%s %s: the ETag of the reader did not change", change.method, change.path)
+		}
+		if w := getSync(v.router, "/api/sync", v.tokens["intruder"], intruder); w.Code != http.StatusNotModified {
+			t.Errorf("%s %s: the ETag of the intruder changed", change.method, change.path)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"gotwarden/apierror"
+	"gotwarden/version"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bitwardenServerVersion is the Bitwarden server version announced to the clients
+const bitwardenServerVersion = "2022.6.0"
+
+// hashedAsset matches the assets with a content hash into their name (cached forever)
+var hashedAsset = regexp.MustCompile(`\.[0-9a-f]{8,}\.`)
+
+// apiPrefixes are the routes never served by the web vault
+var apiPrefixes = []string{"/api/", "/identity/", "/admin", "/notifications/", "/icons/", "/attachments/"}
+
+// LoadWebVault opens the web vault from a directory, a .zip or a .tar.gz archive (or the one embedded)
+func LoadWebVault(source string) (fs.FS, error) {
+	var vault fs.FS
+	var err error
+
+	switch {
+	case source == "" && embeddedWebVault != nil:
+		vault, err = openTarGz(bytes.NewReader(embeddedWebVault))
+	case source == "":
+		return nil, nil
+	case strings.HasSuffix(source, ".zip"):
+		var r *zip.ReadCloser
+		r, err = zip.OpenReader(source)
+		vault = r
+	case strings.HasSuffix(source, ".tar.gz") || strings.HasSuffix(source, ".tgz"):
+		var f *os.File
+		if f, err = os.Open(source); err == nil {
+			defer f.Close()
+			vault, err = openTarGz(f)
+		}
+	default:
+		vault = os.DirFS(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The archives of the web vault contain a root folder "web-vault"
+	if _, err := fs.Stat(vault, "index.html"); err != nil {
+		if vault, err = fs.Sub(vault, "web-vault"); err != nil {
+			return nil, err
+		}
+		if _, err := fs.Stat(vault, "index.html"); err != nil {
+			return nil, errors.New("no index.html found into the web vault " + source)
+		}
+	}
+	return vault, nil
+}
+
+// openTarGz reads the archive into memory, nothing is left on the disk when the server stops
+func openTarGz(r io.Reader) (fs.FS, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	vault := memoryFS{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if hdr.Typeflag != tar.TypeReg || name == "" {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		vault[name] = &memoryFile{Data: data, ModTime: hdr.ModTime}
+	}
+	return vault, nil
+}
+
+// WebVault serves the files of the web vault (index.html for the unknown paths)
+func (ctx *WardenCtx) WebVault(c *gin.Context) {
+	p := c.Request.URL.Path
+	for _, prefix := range apiPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			apierror.Abort(c, apierror.NotFound("Resource"))
+			return
+		}
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if name == "app-id.json" {
+		ctx.AppID(c)
+		return
+	}
+
+	content, err := fs.ReadFile(ctx.WebVaultFS, name)
+	if err != nil {
+		// Single page application: the routes are managed by index.html
+		name = "index.html"
+		if content, err = fs.ReadFile(ctx.WebVaultFS, name); err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case name == "index.html":
+		c.Header("Cache-Control", "no-cache")
+	case hashedAsset.MatchString(name):
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		c.Header("Cache-Control", "public, max-age=3600")
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	c.Data(http.StatusOK, contentType, content)
+}
+
+// AppID provides the FIDO U2F facets trusted by this server
+func (ctx *WardenCtx) AppID(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Content-Type", "application/fido.trusted-apps+json")
+	c.JSON(http.StatusOK, gin.H{
+		"trustedFacets": []gin.H{{
+			"version": gin.H{"major": 1, "minor": 0},
+			"ids": []string{
+				ctx.Domain,
+				"ios:bundle-id:com.8bit.bitwarden",
+				"android:apk-key-hash:dUGFzUzf3lmHSLBDBIv+WaFyZMI",
+			},
+		}},
+	})
+}
+
+// Config provides the URLs of the services of this server
+func (ctx *WardenCtx) Config(c *gin.Context) {
+	domain := strings.TrimSuffix(ctx.Domain, "/")
+	c.JSON(http.StatusOK, gin.H{
+		"version":  bitwardenServerVersion,
+		"gitHash":  version.Commit,
+		"server":   gin.H{"name": "gotwarden", "url": "https://github.com/tutilus/gotwarden"},
+		"settings": gin.H{"disableUserRegistration": !ctx.SignupsAllowed},
+		"environment": gin.H{
+			"vault":         domain,
+			"api":           domain + "/api",
+			"identity":      domain + ctx.IdentityURL,
+			"attachments":   domain + ctx.AttachmentURL,
+			"icons":         domain + ctx.IconURL,
+			"notifications": domain + "/notifications",
+			"sso":           "",
+		},
+		"featureStates": gin.H{},
+		"object":        "config",
+	})
+}
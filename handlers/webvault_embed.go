@@ -0,0 +1,13 @@
+//go:build webvault
+// +build webvault
+
+package handlers
+
+import (
+	_ "embed"
+)
+
+// embeddedWebVault is the web vault archive (handlers/web-vault.tar.gz) built into the binary
+//
+//go:embed web-vault.tar.gz
+var embeddedWebVault []byte
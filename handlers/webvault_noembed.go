@@ -0,0 +1,7 @@
+//go:build !webvault
+// +build !webvault
+
+package handlers
+
+// embeddedWebVault is empty, build with the tag webvault to embed handlers/web-vault.tar.gz
+var embeddedWebVault []byte
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"gotwarden/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeWebVault writes a web vault archive with its root folder, like the released ones
+func writeWebVault(t *testing.T, files map[string]string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "web-vault.tar.gz")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "web-vault/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: "web-vault/" + file, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestWebVault(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	vault, err := LoadWebVault(writeWebVault(t, map[string]string{
+		"index.html":           "<html>vault</html>",
+		"app/main.1a2b3c4d.js": "console.log('vault')",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newWardenCtx(models.NewMemoryDB())
+	ctx.WebVaultFS = vault
+	router := ctx.Router()
+
+	for _, c := range []struct {
+		path, body, cache string
+	}{
+		{"/", "<html>vault</html>", "no-cache"},
+		{"/app/main.1a2b3c4d.js", "console.log('vault')", "immutable"},
+		// Single page application: the unknown paths are the routes of index.html
+		{"/vault/settings", "<html>vault</html>", "no-cache"},
+		{"/../../etc/passwd", "<html>vault</html>", "no-cache"},
+	} {
+		w := call(router, "GET", c.path, "", nil)
+		if w.Code != http.StatusOK || w.Body.String() != c.body || !strings.Contains(w.Header().Get("Cache-Control"), c.cache) {
+			t.Errorf("%s: unexpected response %d %q (%s)", c.path, w.Code, w.Body.String(), w.Header().Get("Cache-Control"))
+		}
+	}
+
+	// The unknown routes of the API are not swallowed by the web vault
+	for _, prefix := range apiPrefixes {
+		p := strings.TrimSuffix(prefix, "/") + "/unknown"
+		w := call(router, "GET", p, "", nil)
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "vault") {
+			t.Errorf("%s: unexpected response %d %s", p, w.Code, w.Body.String())
+		}
+	}
+
+	if w := call(router, "POST", "/vault/settings", "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST to the web vault: %d", w.Code)
+	}
+}
+
+func TestLoadWebVault(t *testing.T) {
+	if vault, err := LoadWebVault(""); vault != nil || err != nil {
+		t.Errorf("a web vault is loaded without source: %v (%v)", vault, err)
+	}
+	if _, err := LoadWebVault(writeWebVault(t, map[string]string{"main.js": ""})); err == nil {
+		t.Error("a web vault without index.html is loaded")
+	}
+
+	// The archives are read into memory
+	vault, err := LoadWebVault(writeWebVault(t, map[string]string{"index.html": "vault", "app/main.js": "main", "images/logo.png": "png"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(vault, "index.html", "app/main.js", "images/logo.png"); err != nil {
+		t.Error(err)
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("vault"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWebVault(dir); err != nil {
+		t.Errorf("the directory is not loaded: %v", err)
+	}
+}
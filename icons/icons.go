@@ -0,0 +1,403 @@
+package icons
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gotwarden/logging"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+var logger = logging.For("icons")
+
+const (
+	// maxPageSize is the maximum size read from the page of the site
+	maxPageSize = 1 << 20
+	// maxIconSize is the maximum size of an icon
+	maxIconSize = 512 << 10
+	// preferredSize is the size (in pixels) of the icons displayed by the clients
+	preferredSize = 32
+	// missSuffix is the suffix of the negative cache files
+	missSuffix = ".miss"
+)
+
+var (
+	// ErrInvalidDomain is returned when the domain cannot be fetched
+	ErrInvalidDomain = errors.New("invalid domain")
+	// ErrNotFound is returned when the site provides no icon
+	ErrNotFound = errors.New("icon not found")
+	// ErrForbiddenAddress is returned when the domain resolves to a non public address
+	ErrForbiddenAddress = errors.New("forbidden address")
+	// ErrUnavailable is returned when the site cannot be reached for now (not cached, tried again next time)
+	ErrUnavailable = errors.New("site unavailable")
+)
+
+// validDomain matches the host names (at least one dot, no port, no IP v6)
+var validDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+
+// internalSuffixes are the domains never resolved on Internet
+var internalSuffixes = []string{".localhost", ".local", ".internal", ".lan", ".home", ".corp", ".intranet"}
+
+// privateNetworks are the ranges not covered by the net.IP helpers
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"), // Carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),  // IETF protocol assignments
+	mustParseCIDR("198.18.0.0/15"), // Benchmarking
+}
+
+// Service fetches the icons of the sites and caches them on disk
+type Service struct {
+	CacheDir    string
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	client      *http.Client
+	checkIP     func(ip net.IP) error
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a fetch in progress, shared by the concurrent requests of the same domain
+type flight struct {
+	done chan struct{}
+	icon []byte
+	err  error
+}
+
+// statusError is an unexpected HTTP status sent by the site
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s: %d %s", e.url, e.code, http.StatusText(e.code))
+}
+
+// New creates a service caching the icons into cacheDir
+func New(cacheDir string, ttl, negativeTTL time.Duration) *Service {
+	s := &Service{
+		CacheDir:    cacheDir,
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		checkIP:     checkPublicIP,
+		flights:     make(map[string]*flight),
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: s.control,
+	}
+	s.client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+	return s
+}
+
+// ValidateDomain checks the domain can be fetched (public host name only)
+func ValidateDomain(domain string) error {
+	if len(domain) > 253 || !validDomain.MatchString(domain) {
+		return ErrInvalidDomain
+	}
+	for _, suffix := range internalSuffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return ErrInvalidDomain
+		}
+	}
+	return nil
+}
+
+// control checks the address really dialed (after DNS resolution) to block DNS rebinding
+func (s *Service) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	return s.checkIP(net.ParseIP(host))
+}
+
+// checkPublicIP refuses the loopback, private, link local and reserved addresses
+func checkPublicIP(ip net.IP) error {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return ErrForbiddenAddress
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// Get provides the icon of the domain (from the cache if still valid)
+func (s *Service) Get(ctx context.Context, domain string) ([]byte, error) {
+	domain = strings.ToLower(domain)
+	if err := ValidateDomain(domain); err != nil {
+		return nil, err
+	}
+
+	iconFile := filepath.Join(s.CacheDir, domain+".png")
+	missFile := iconFile + missSuffix
+	if fresh(missFile, s.NegativeTTL) {
+		return nil, ErrNotFound
+	}
+	if fresh(iconFile, s.TTL) {
+		// The SVG icons cached by the former versions are fetched again
+		if icon, err := ioutil.ReadFile(iconFile); err != nil || isImage(icon) {
+			return icon, err
+		}
+	}
+
+	return s.fetchOnce(ctx, domain, func() ([]byte, error) {
+		icon, err := s.fetch(ctx, domain)
+		if err != nil {
+			// Remember the definitive answers to not fetch the site again and again
+			if ctx.Err() != nil || !definitive(err) {
+				logger.WithError(err).WithField("domain", domain).Debug("Icon unavailable")
+				return nil, ErrUnavailable
+			}
+			s.store(missFile, nil)
+			return nil, ErrNotFound
+		}
+		s.store(iconFile, icon)
+		os.Remove(missFile)
+		return icon, nil
+	})
+}
+
+// fetchOnce runs the fetch of the domain once for all the requests arriving meanwhile
+func (s *Service) fetchOnce(ctx context.Context, domain string, fetch func() ([]byte, error)) ([]byte, error) {
+	s.mu.Lock()
+	if f, ok := s.flights[domain]; ok {
+		s.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.icon, f.err
+		case <-ctx.Done():
+			return nil, ErrUnavailable
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	s.flights[domain] = f
+	s.mu.Unlock()
+
+	f.icon, f.err = fetch()
+	s.mu.Lock()
+	delete(s.flights, domain)
+	s.mu.Unlock()
+	close(f.done)
+	return f.icon, f.err
+}
+
+// definitive tells if the failure is an answer of the site (no icon, not found, forbidden address) rather than a
+// transient error (timeout, server error)
+func definitive(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= 400 && status.code < 500 && status.code != http.StatusRequestTimeout && status.code != http.StatusTooManyRequests
+	}
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrForbiddenAddress)
+}
+
+// fresh tells if the cache file exists and is younger than ttl
+func fresh(name string, ttl time.Duration) bool {
+	info, err := os.Stat(name)
+	return err == nil && time.Since(info.ModTime()) < ttl
+}
+
+// store writes the cache file atomically
+func (s *Service) store(name string, content []byte) {
+	if err := os.MkdirAll(s.CacheDir, 0755); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(s.CacheDir, ".icon-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(content)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	os.Rename(tmp.Name(), name)
+}
+
+// fetch gets the page of the site then the best icon found
+func (s *Service) fetch(ctx context.Context, domain string) ([]byte, error) {
+	var lastErr error
+	for _, scheme := range []string{"https", "http"} {
+		base := &url.URL{Scheme: scheme, Host: domain, Path: "/"}
+		page, final, err := s.get(ctx, base.String(), maxPageSize)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// Without icon the site is asked again later if one of them could not be downloaded
+		result := ErrNotFound
+		for _, candidate := range parseIcons(final, page) {
+			icon, _, err := s.get(ctx, candidate.href, maxIconSize)
+			if err == nil && isImage(icon) {
+				return icon, nil
+			}
+			if err != nil && !definitive(err) {
+				result = err
+			}
+		}
+		return nil, result
+	}
+	return nil, lastErr
+}
+
+// get downloads the URL (limited to max bytes) and provides the URL after the redirections
+func (s *Service) get(ctx context.Context, u string, max int64) ([]byte, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; gotwarden icon fetcher)")
+	req.Header.Set("Accept", "text/html,image/*;q=0.9,*/*;q=0.8")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &statusError{u, resp.StatusCode}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, nil, fmt.Errorf("GET %s: response too large", u)
+	}
+	return body, resp.Request.URL, nil
+}
+
+// isImage checks the content downloaded is an image (ico, png, gif, jpeg or webp). The SVG images are refused: they
+// can hold scripts, run from the origin of the vault
+func isImage(content []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(content), "image/")
+}
+
+// candidate is an icon found into the page
+type candidate struct {
+	href  string
+	score int
+}
+
+// parseIcons finds the icons declared into the page, the best one first (/favicon.ico at last)
+func parseIcons(base *url.URL, page []byte) []candidate {
+	var candidates []candidate
+
+	z := html.NewTokenizer(strings.NewReader(string(page)))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := z.TagName()
+		if string(name) == "body" {
+			break
+		}
+		if string(name) != "link" || !hasAttr {
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for {
+			key, val, more := z.TagAttr()
+			attrs[string(key)] = string(val)
+			if !more {
+				break
+			}
+		}
+		rel := " " + strings.ToLower(attrs["rel"]) + " "
+		if !strings.Contains(rel, " icon ") && !strings.Contains(rel, "apple-touch-icon") {
+			continue
+		}
+		href, err := base.Parse(strings.TrimSpace(attrs["href"]))
+		if err != nil || (href.Scheme != "http" && href.Scheme != "https") {
+			continue
+		}
+		// The SVG icons are refused (see isImage)
+		if strings.HasSuffix(strings.ToLower(href.Path), ".svg") || strings.EqualFold(attrs["type"], "image/svg+xml") {
+			continue
+		}
+		candidates = append(candidates, candidate{href.String(), score(attrs["sizes"])})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score < candidates[j].score
+	})
+
+	favicon, _ := base.Parse("/favicon.ico")
+	return append(candidates, candidate{favicon.String(), 1000})
+}
+
+// score ranks an icon by its size (lower is better): the closest to 32px, bigger rather than smaller
+func score(sizes string) int {
+	best := 200
+	for _, size := range strings.Fields(strings.ToLower(sizes)) {
+		parts := strings.SplitN(size, "x", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		width, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		s := width - preferredSize
+		if s < 0 {
+			// A too small icon is blurry
+			s = -s * 4
+		}
+		if s < best {
+			best = s
+		}
+	}
+	return best
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
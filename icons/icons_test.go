@@ -0,0 +1,233 @@
+package icons
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// png is the header of a PNG image, enough to be detected as an image
+var png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// site is a local stand-in of the sites: the domain example.com is dialed to it, the other addresses are dialed
+// as is (and checked)
+type site struct {
+	*httptest.Server
+	requests int32
+}
+
+func newSite(t *testing.T, s *Service, handler http.HandlerFunc) *site {
+	st := &site{}
+	st.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&st.requests, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(st.Close)
+
+	dialer := &net.Dialer{Timeout: time.Second, Control: s.control}
+	s.client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "example.com" {
+			address = st.Listener.Addr().String()
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	return st
+}
+
+// newService creates a service allowing the loopback address of the stand-in only
+func newService(t *testing.T) *Service {
+	s := New(t.TempDir(), time.Hour, time.Hour)
+	s.checkIP = func(ip net.IP) error {
+		if ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			return nil
+		}
+		return checkPublicIP(ip)
+	}
+	return s
+}
+
+func TestGetCached(t *testing.T) {
+	s := newService(t)
+	st := newSite(t, s, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><head><link rel="icon" sizes="32x32" href="/icon.png"></head></html>`))
+		case "/icon.png":
+			w.Write(png)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		icon, err := s.Get(context.Background(), "Example.com")
+		if err != nil || string(icon) != string(png) {
+			t.Fatalf("unexpected icon %q (%v)", icon, err)
+		}
+	}
+	if n := atomic.LoadInt32(&st.requests); n != 2 {
+		t.Errorf("the site is asked %d times instead of 2 (page and icon)", n)
+	}
+	if _, err := os.Stat(filepath.Join(s.CacheDir, "example.com.png")); err != nil {
+		t.Errorf("the icon is not cached: %v", err)
+	}
+}
+
+func TestGetMiss(t *testing.T) {
+	s := newService(t)
+	st := newSite(t, s, http.NotFound)
+	missFile := filepath.Join(s.CacheDir, "example.com.png"+missSuffix)
+
+	if _, err := s.Get(context.Background(), "example.com"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	asked := atomic.LoadInt32(&st.requests)
+	if _, err := os.Stat(missFile); err != nil {
+		t.Fatalf("the miss is not cached: %v", err)
+	}
+	if _, err := s.Get(context.Background(), "example.com"); err != ErrNotFound || atomic.LoadInt32(&st.requests) != asked {
+		t.Errorf("the site is asked again during the miss TTL (%v)", err)
+	}
+
+	// Once the miss is expired, the site is asked again
+	past := time.Now().Add(-2 * s.NegativeTTL)
+	if err := os.Chtimes(missFile, past, past); err != nil {
+		t.Fatal(err)
+	}
+	s.Get(context.Background(), "example.com")
+	if atomic.LoadInt32(&st.requests) == asked {
+		t.Error("the site is not asked again after the miss TTL")
+	}
+}
+
+func TestGetTransient(t *testing.T) {
+	s := newService(t)
+	newSite(t, s, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	missFile := filepath.Join(s.CacheDir, "example.com.png"+missSuffix)
+
+	if _, err := s.Get(context.Background(), "example.com"); err != ErrUnavailable {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Get(canceled, "example.com"); err != ErrUnavailable {
+		t.Errorf("expected ErrUnavailable once canceled, got %v", err)
+	}
+	if _, err := os.Stat(missFile); !os.IsNotExist(err) {
+		t.Errorf("a transient error is cached as a miss: %v", err)
+	}
+}
+
+func TestGetForbiddenAddress(t *testing.T) {
+	s := New(t.TempDir(), time.Hour, time.Hour)
+	st := newSite(t, s, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	})
+
+	// example.com is dialed to 127.0.0.1
+	if _, err := s.fetch(context.Background(), "example.com"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("expected ErrForbiddenAddress, got %v", err)
+	}
+	if _, err := s.Get(context.Background(), "example.com"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if n := atomic.LoadInt32(&st.requests); n != 0 {
+		t.Errorf("the loopback address is reached %d times", n)
+	}
+	if _, err := os.Stat(filepath.Join(s.CacheDir, "example.com.png"+missSuffix)); err != nil {
+		t.Errorf("the forbidden address is not cached as a miss: %v", err)
+	}
+
+	for _, domain := range []string{"localhost", "printer.local", "10.0.0.1", "example.com:8080"} {
+		if _, err := s.Get(context.Background(), domain); err != ErrInvalidDomain {
+			t.Errorf("%s: expected ErrInvalidDomain, got %v", domain, err)
+		}
+	}
+}
+
+func TestGetRedirectToPrivateAddress(t *testing.T) {
+	s := newService(t)
+	newSite(t, s, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+
+	if _, err := s.fetch(context.Background(), "example.com"); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("expected ErrForbiddenAddress, got %v", err)
+	}
+}
+
+func TestGetConcurrent(t *testing.T) {
+	s := newService(t)
+	release := make(chan struct{})
+	st := newSite(t, s, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if r.URL.Path == "/favicon.ico" {
+			w.Write(png)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if icon, err := s.Get(context.Background(), "example.com"); err != nil || string(icon) != string(png) {
+				t.Errorf("unexpected icon %q (%v)", icon, err)
+			}
+		}()
+	}
+	// Let the requests join the fetch in progress
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// The page, then /favicon.ico, fetched once
+	if n := atomic.LoadInt32(&st.requests); n != 2 {
+		t.Errorf("the site is asked %d times instead of 2", n)
+	}
+}
+
+func TestGetSVG(t *testing.T) {
+	s := newService(t)
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	st := newSite(t, s, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><head><link rel="icon" href="/icon.svg"><link rel="icon" type="image/svg+xml" href="/icon"></head></html>`))
+		default:
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write(svg)
+		}
+	})
+
+	if _, err := s.Get(context.Background(), "example.com"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	// The page, then /favicon.ico: the SVG links are not followed
+	if n := atomic.LoadInt32(&st.requests); n != 2 {
+		t.Errorf("the site is asked %d times instead of 2", n)
+	}
+
+	// An SVG icon cached by a former version is fetched again
+	iconFile := filepath.Join(s.CacheDir, "example.com.png")
+	if err := os.Remove(iconFile + missSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(iconFile, svg, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if icon, err := s.Get(context.Background(), "example.com"); err != ErrNotFound {
+		t.Errorf("the cached SVG is served: %q (%v)", icon, err)
+	}
+}
@@ -0,0 +1,384 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gotwarden/logging"
+	"gotwarden/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logging.For("importer")
+
+// Kinds of the servers read by the importer
+const (
+	Rubywarden  = "rubywarden"
+	Vaultwarden = "vaultwarden"
+)
+
+// Source is the database of the server imported
+type Source struct {
+	// Kind is Rubywarden or Vaultwarden
+	Kind string
+	// Driver and Connect open the database (sqlite3 or postgres)
+	Driver  string
+	Connect string
+	// AttachmentsDir is the directory of the attachments of vaultwarden (data/attachments)
+	AttachmentsDir string
+}
+
+// Report counts the records imported, the warnings list what has been left aside
+type Report struct {
+	Users         int
+	Devices       int
+	Folders       int
+	Ciphers       int
+	Attachments   int
+	Organizations int
+	Members       int
+	Collections   int
+	Warnings      []string
+}
+
+// ErrConflict is returned when users of the source already exist into gotwarden
+var ErrConflict = errors.New("the users already exist")
+
+// Import reads the source and inserts its users and their vaults into the database, all or nothing
+func Import(ctx context.Context, db *models.DB, src Source) (*Report, error) {
+	var read func(ctx context.Context, r *run) error
+	switch src.Kind {
+	case Rubywarden:
+		if src.Driver != "sqlite3" {
+			return nil, errors.New("the rubywarden databases are SQLite files")
+		}
+		read = readRubywarden
+	case Vaultwarden:
+		read = readVaultwarden
+	default:
+		return nil, fmt.Errorf("unknown source %q (%s or %s)", src.Kind, Rubywarden, Vaultwarden)
+	}
+
+	connect := src.Connect
+	if src.Driver == "sqlite3" {
+		// The source is only read, a missing file is not created
+		connect = "file:" + connect + "?mode=ro"
+	}
+	source, err := sql.Open(src.Driver, connect)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s database: %w", src.Kind, err)
+	}
+	defer source.Close()
+	if err := source.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to open the %s database: %w", src.Kind, err)
+	}
+
+	users, err := db.AllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := &run{
+		src:      source,
+		report:   &Report{},
+		existing: map[string]bool{},
+		users:    map[string]bool{},
+		folders:  map[string]string{},
+		ciphers:  map[string]bool{},
+		orgs:     map[string]bool{},
+		colls:    map[string]bool{},
+		attDir:   src.AttachmentsDir,
+	}
+	for _, u := range *users {
+		r.existing[u.UUID] = true
+		r.existing[strings.ToLower(u.Email)] = true
+	}
+	err = db.ImportRecords(ctx, func(insert func(records ...interface{}) error) error {
+		r.insert = insert
+		return read(ctx, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.report, nil
+}
+
+// run is the state of an import: the records imported so far, referenced by the next tables
+type run struct {
+	src    *sql.DB
+	insert func(records ...interface{}) error
+	report *Report
+	attDir string
+	// existing are the uuids and emails of the users of gotwarden
+	existing map[string]bool
+	users    map[string]bool
+	// folders gives the owner of the folders imported
+	folders map[string]string
+	ciphers map[string]bool
+	orgs    map[string]bool
+	colls   map[string]bool
+}
+
+// warn records something left aside
+func (r *run) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Warn(msg)
+	r.report.Warnings = append(r.report.Warnings, msg)
+}
+
+// checkUsers fails if some users of the source already exist, before anything is inserted
+func (r *run) checkUsers(ctx context.Context) error {
+	var conflicts []string
+	err := r.each(ctx, "users", func(row row) error {
+		if r.existing[row.str("uuid")] || r.existing[strings.ToLower(row.str("email"))] {
+			conflicts = append(conflicts, row.str("email"))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("%w: %s", ErrConflict, strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// row is a row of the source, by lowercase column
+type row map[string]interface{}
+
+// hasTable tells if the source has the table (the older servers miss some of them)
+func (r *run) hasTable(ctx context.Context, table string) bool {
+	rows, err := r.src.QueryContext(ctx, "SELECT 1 FROM "+table+" WHERE 1=0")
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// count gives the rows of the table, 0 if it does not exist
+func (r *run) count(ctx context.Context, table string) int {
+	var n int
+	if err := r.src.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+		return 0
+	}
+	return n
+}
+
+// each calls fn with every row of the table
+func (r *run) each(ctx context.Context, table string, fn func(row row) error) error {
+	rows, err := r.src.QueryContext(ctx, "SELECT * FROM "+table)
+	if err != nil {
+		return fmt.Errorf("read of %s failed: %w", table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("read of %s failed: %w", table, err)
+		}
+		current := make(row, len(columns))
+		for i, c := range columns {
+			current[strings.ToLower(c)] = values[i]
+		}
+		if err := fn(current); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read of %s failed: %w", table, err)
+	}
+	logger.WithFields(logrus.Fields{"table": table}).Debug("Table imported")
+	return nil
+}
+
+// has tells if the column exists and is not NULL
+func (r row) has(column string) bool {
+	v, ok := r[column]
+	return ok && v != nil
+}
+
+func (r row) str(column string) string {
+	switch v := r[column].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (r row) bytes(column string) []byte {
+	switch v := r[column].(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+func (r row) int(column string) int {
+	switch v := r[column].(type) {
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case bool:
+		if v {
+			return 1
+		}
+	case string, []byte:
+		n, _ := strconv.Atoi(strings.TrimSpace(r.str(column)))
+		return n
+	}
+	return 0
+}
+
+func (r row) bool(column string) bool {
+	switch v := r[column].(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string, []byte:
+		s := strings.ToLower(r.str(column))
+		return s == "1" || s == "t" || s == "true"
+	}
+	return false
+}
+
+// timeLayouts are the formats of the dates stored as text
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05 -0700",
+}
+
+// time gives the date of the column, or now if it is missing
+func (r row) time(column string) time.Time {
+	switch v := r[column].(type) {
+	case time.Time:
+		return v
+	case string, []byte:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, r.str(column)); err == nil {
+				return t
+			}
+		}
+	case int64:
+		return time.Unix(v, 0)
+	}
+	return time.Now()
+}
+
+// Types of the ciphers and the field of their content
+var cipherObjects = map[int]string{1: "login", 2: "securenote", 3: "card", 4: "identity"}
+
+// cipherData fills the content of the cipher from its columns, or from its JSON data blob for those missing:
+// the data holds the name, the notes, the fields and the history with the properties of its type
+func cipherData(cd *models.CipherData, r row, columns map[string]string) error {
+	object, ok := cipherObjects[cd.Type]
+	if !ok {
+		return fmt.Errorf("unsupported type %d", cd.Type)
+	}
+	data := map[string]json.RawMessage{}
+	if raw := r.bytes("data"); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return fmt.Errorf("invalid data: %w", err)
+		}
+	}
+	// The keys are PascalCase or camelCase depending on the client that saved the cipher
+	common := map[string]json.RawMessage{}
+	for key, value := range data {
+		switch k := strings.ToLower(key); k {
+		case "name", "notes", "fields", "passwordhistory":
+			common[k] = value
+			delete(data, key)
+		}
+	}
+	value := func(field string) []byte {
+		if column, ok := columns[field]; ok && r.has(column) {
+			return jsonValue(r.bytes(column))
+		}
+		return common[field]
+	}
+
+	cd.Name = text(value("name"))
+	if notes := text(value("notes")); notes != "" {
+		cd.Notes, _ = json.Marshal(notes)
+	}
+	cd.Fields = jsonArray(value("fields"))
+	cd.PasswordHistory = jsonArray(value("passwordhistory"))
+
+	var typed []byte
+	if column, ok := columns[object]; ok && r.has(column) {
+		typed = jsonValue(r.bytes(column))
+	} else if len(data) > 0 {
+		typed, _ = json.Marshal(data)
+	} else {
+		typed = []byte("{}")
+	}
+	switch object {
+	case "login":
+		cd.Login = typed
+	case "securenote":
+		cd.SecureNote = typed
+	case "card":
+		cd.Card = typed
+	case "identity":
+		cd.Identity = typed
+	}
+	return nil
+}
+
+// jsonValue gives the JSON of a column, the text that is not JSON (ie an encrypted string) becomes a JSON string
+func jsonValue(b []byte) []byte {
+	if json.Valid(b) {
+		return b
+	}
+	raw, _ := json.Marshal(string(b))
+	return raw
+}
+
+// text gives the string held by the JSON value
+func text(raw []byte) string {
+	var s string
+	if len(raw) == 0 || json.Unmarshal(raw, &s) != nil {
+		return ""
+	}
+	return s
+}
+
+// jsonArray keeps the JSON value if it is a non empty array
+func jsonArray(raw []byte) []byte {
+	var array []interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &array) != nil || len(array) == 0 {
+		return nil
+	}
+	return raw
+}
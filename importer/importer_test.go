@@ -0,0 +1,247 @@
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotwarden/models"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// source creates a SQLite database of the server with the statements
+func source(t *testing.T, statements []string, args map[int][]interface{}) string {
+	path := filepath.Join(t.TempDir(), "source.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, s := range statements {
+		if _, err := db.Exec(s, args[i]...); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	return path
+}
+
+func target(t *testing.T) *models.DB {
+	db, err := models.NewDB("sqlite3", filepath.Join(t.TempDir(), "gotwarden.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Db.Close() })
+	return db
+}
+
+func TestImportRubywarden(t *testing.T) {
+	path := source(t, []string{
+		`CREATE TABLE users (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, email TEXT, email_verified BOOLEAN,
+			premium BOOLEAN, name TEXT, password_hash TEXT, password_hint TEXT, key TEXT, private_key BLOB, public_key BLOB,
+			totp_secret TEXT, security_stamp TEXT, culture TEXT, kdf_type INTEGER, kdf_iterations INTEGER)`,
+		`CREATE TABLE devices (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, user_uuid TEXT, name TEXT,
+			push_token TEXT, type INTEGER, access_token TEXT, refresh_token TEXT, token_expires_at DATETIME)`,
+		`CREATE TABLE folders (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, user_uuid TEXT, name TEXT)`,
+		`CREATE TABLE ciphers (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, user_uuid TEXT, folder_uuid TEXT,
+			organization_uuid TEXT, type INTEGER, data TEXT, favorite BOOLEAN, attachments BLOB, name TEXT, notes TEXT,
+			fields TEXT, login TEXT, securenote TEXT, card TEXT, identity TEXT, password_history TEXT)`,
+		`CREATE TABLE attachments (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, cipher_uuid TEXT, url TEXT,
+			filename TEXT, size INTEGER, file BLOB)`,
+		`INSERT INTO users VALUES ('u1', '2019-01-02 03:04:05', '2019-01-02 03:04:05', 'Alice@Example.com', 1, 1, 'Alice',
+			'client-hash', 'hint', '0.key', X'01', X'02', 'JBSWY3DPEHPK3PXP', 'stamp', 'fr-FR', 0, 100000)`,
+		`INSERT INTO devices VALUES ('d1', NULL, NULL, 'u1', 'firefox', '', 3, 'access', 'refresh', NULL)`,
+		`INSERT INTO folders VALUES ('f1', NULL, '2019-01-02 03:04:05', 'u1', '2.folder|iv|mac')`,
+		// A cipher with its columns, another one with the data blob only
+		`INSERT INTO ciphers VALUES ('c1', NULL, '2019-01-02 03:04:05', 'u1', 'f1', NULL, 1, NULL, 1, NULL, '2.name|iv|mac',
+			'2.notes|iv|mac', '[{"Type":0,"Name":"2.f|iv|mac"}]', '{"Username":"2.u|iv|mac","Uris":[]}', NULL, NULL, NULL, NULL)`,
+		`INSERT INTO ciphers (uuid, user_uuid, type, data) VALUES ('c2', 'u1', 2, '{"Name":"2.note|iv|mac","Notes":null,"Type":0}')`,
+		`INSERT INTO attachments VALUES ('a1', NULL, NULL, 'c1', NULL, '2.file|iv|mac', 4, X'CAFEBABE')`,
+	}, nil)
+	db := target(t)
+	ctx := context.Background()
+
+	report, err := Import(ctx, db, Source{Kind: Rubywarden, Driver: "sqlite3", Connect: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != 1 || report.Devices != 1 || report.Folders != 1 || report.Ciphers != 2 || report.Attachments != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if warnings := strings.Join(report.Warnings, "\n"); !strings.Contains(warnings, "1 two-step") {
+		t.Errorf("missing warning about the two-step logins in %v", report.Warnings)
+	}
+
+	u, err := db.GetUserFromEmail(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.CheckPassword("client-hash") || u.Key != "0.key" || u.Culture != "fr-FR" || u.KdfIterations != 100000 || u.TotpSecret != "" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	ciphers, err := db.GetCiphersByUserUUID(ctx, "u1")
+	if err != nil || len(*ciphers) != 2 {
+		t.Fatalf("unexpected ciphers %v: %v", ciphers, err)
+	}
+	for _, cd := range *ciphers {
+		o := cd.Jsonify()
+		switch cd.UUID {
+		case "c1":
+			login, _ := json.Marshal(o.Login)
+			if o.Name != "2.name|iv|mac" || *o.Notes.(*interface{}) != "2.notes|iv|mac" || o.FolderUUID != "f1" ||
+				!o.Favorite || len(o.Fields) != 1 || string(login) != `{"Uris":[],"Username":"2.u|iv|mac"}` {
+				t.Errorf("unexpected cipher %+v", o)
+			}
+			if len(o.Attachments) != 1 || o.Attachments[0].Filename != "2.file|iv|mac" {
+				t.Errorf("unexpected attachments %+v", o.Attachments)
+			}
+		case "c2":
+			note, _ := json.Marshal(o.SecureNote)
+			if o.Name != "2.note|iv|mac" || cd.Notes != nil || string(note) != `{"Type":0}` {
+				t.Errorf("unexpected cipher %+v", o)
+			}
+		}
+	}
+
+	// The users are never imported twice
+	if _, err := Import(ctx, db, Source{Kind: Rubywarden, Driver: "sqlite3", Connect: path}); !errors.Is(err, ErrConflict) {
+		t.Errorf("the users are imported twice: %v", err)
+	}
+}
+
+func TestImportVaultwarden(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	hash := pbkdf2.Key([]byte("client-hash"), salt, 100, 32, sha256.New)
+	path := source(t, []string{
+		`CREATE TABLE users (uuid TEXT PRIMARY KEY, enabled BOOLEAN, created_at DATETIME, updated_at DATETIME, verified_at DATETIME,
+			email TEXT, name TEXT, password_hash BLOB, salt BLOB, password_iterations INTEGER, password_hint TEXT, akey TEXT,
+			private_key TEXT, public_key TEXT, totp_secret TEXT, security_stamp TEXT, equivalent_domains TEXT,
+			excluded_globals TEXT, client_kdf_type INTEGER, client_kdf_iter INTEGER, client_kdf_memory INTEGER,
+			client_kdf_parallelism INTEGER)`,
+		`CREATE TABLE twofactor (uuid TEXT PRIMARY KEY, user_uuid TEXT, atype INTEGER, enabled BOOLEAN, data TEXT, last_used INTEGER)`,
+		`CREATE TABLE devices (uuid TEXT, created_at DATETIME, updated_at DATETIME, user_uuid TEXT, name TEXT, atype INTEGER,
+			push_token TEXT, refresh_token TEXT, twofactor_remember TEXT, PRIMARY KEY (uuid, user_uuid))`,
+		`CREATE TABLE folders (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, user_uuid TEXT, name TEXT)`,
+		`CREATE TABLE folders_ciphers (cipher_uuid TEXT, folder_uuid TEXT)`,
+		`CREATE TABLE favorites (user_uuid TEXT, cipher_uuid TEXT)`,
+		`CREATE TABLE ciphers (uuid TEXT PRIMARY KEY, created_at DATETIME, updated_at DATETIME, user_uuid TEXT,
+			organization_uuid TEXT, key TEXT, atype INTEGER, name TEXT, notes TEXT, fields TEXT, data TEXT,
+			password_history TEXT, deleted_at DATETIME, reprompt INTEGER)`,
+		`CREATE TABLE attachments (id TEXT PRIMARY KEY, cipher_uuid TEXT, file_name TEXT, file_size INTEGER, akey TEXT)`,
+		`CREATE TABLE organizations (uuid TEXT PRIMARY KEY, name TEXT, billing_email TEXT, private_key TEXT, public_key TEXT)`,
+		`CREATE TABLE users_organizations (uuid TEXT PRIMARY KEY, user_uuid TEXT, org_uuid TEXT, access_all BOOLEAN, akey TEXT,
+			status INTEGER, atype INTEGER)`,
+		`CREATE TABLE collections (uuid TEXT PRIMARY KEY, org_uuid TEXT, name TEXT)`,
+		`CREATE TABLE users_collections (user_uuid TEXT, collection_uuid TEXT, read_only BOOLEAN, hide_passwords BOOLEAN)`,
+		`CREATE TABLE ciphers_collections (cipher_uuid TEXT, collection_uuid TEXT)`,
+		`CREATE TABLE sends (uuid TEXT PRIMARY KEY)`,
+		`INSERT INTO users VALUES ('u1', 1, '2023-01-02 03:04:05.123456', '2023-01-02 03:04:05.123456', '2023-01-02 03:04:05',
+			'bob@example.com', 'Bob', ?, ?, 100, NULL, '2.akey|iv|mac', '2.private|iv|mac', 'public', NULL, 'stamp',
+			'[["example.com","example.org"]]', '[]', 1, 3, 64, 4)`,
+		`INSERT INTO users VALUES ('u2', 0, NULL, NULL, NULL, 'carol@example.com', 'Carol', X'00', X'00', 100, NULL, '2.akey|iv|mac',
+			NULL, NULL, NULL, 'stamp', '[]', '[]', 0, 600000, NULL, NULL)`,
+		`INSERT INTO twofactor VALUES ('t1', 'u1', 0, 1, 'JBSWY3DPEHPK3PXP', 0)`,
+		`INSERT INTO twofactor VALUES ('t2', 'u1', 1, 1, '{}', 0)`,
+		`INSERT INTO devices VALUES ('d1', NULL, NULL, 'u1', 'android', 0, '', 'refresh', NULL)`,
+		`INSERT INTO devices VALUES ('d1', NULL, NULL, 'u2', 'android', 0, '', 'refresh2', NULL)`,
+		`INSERT INTO folders VALUES ('f1', NULL, NULL, 'u1', '2.folder|iv|mac')`,
+		`INSERT INTO folders_ciphers VALUES ('c1', 'f1')`,
+		`INSERT INTO folders_ciphers VALUES ('c2', 'f1')`,
+		`INSERT INTO favorites VALUES ('u1', 'c1')`,
+		`INSERT INTO ciphers VALUES ('c1', NULL, NULL, 'u1', NULL, '2.ckey|iv|mac', 1, '2.name|iv|mac', NULL,
+			'[{"name":"2.f|iv|mac","type":0}]', '{"name":"2.name|iv|mac","username":"2.u|iv|mac","uris":null}', NULL, NULL, 0)`,
+		`INSERT INTO ciphers VALUES ('c2', NULL, NULL, NULL, 'o1', NULL, 3, '2.card|iv|mac', '2.notes|iv|mac', NULL,
+			'{"Number":"2.n|iv|mac"}', '[{"password":"2.p|iv|mac"}]', '2023-02-01 00:00:00', 0)`,
+		`INSERT INTO ciphers VALUES ('c3', NULL, NULL, 'u1', NULL, NULL, 5, '2.ssh|iv|mac', NULL, NULL, '{}', NULL, NULL, 0)`,
+		`INSERT INTO attachments VALUES ('a1', 'c1', '2.file|iv|mac', 4, '2.akey|iv|mac')`,
+		`INSERT INTO organizations VALUES ('o1', 'Team', 'team@example.com', NULL, NULL)`,
+		`INSERT INTO users_organizations VALUES ('ou1', 'u1', 'o1', 0, '4.orgkey', 2, 0)`,
+		`INSERT INTO users_organizations VALUES ('ou2', 'u2', 'o1', 0, '4.orgkey', -1, 2)`,
+		`INSERT INTO collections VALUES ('col1', 'o1', '2.coll|iv|mac')`,
+		`INSERT INTO users_collections VALUES ('u1', 'col1', 1, 0)`,
+		`INSERT INTO ciphers_collections VALUES ('c2', 'col1')`,
+		`INSERT INTO sends VALUES ('s1')`,
+	}, map[int][]interface{}{14: {hash, salt}})
+	db := target(t)
+	ctx := context.Background()
+
+	// The files of the attachments are needed
+	if _, err := Import(ctx, db, Source{Kind: Vaultwarden, Driver: "sqlite3", Connect: path}); err == nil {
+		t.Fatal("the import without the attachments is accepted")
+	}
+	if users, _ := db.AllUsers(ctx); len(*users) != 0 {
+		t.Fatal("the failed import is not rolled back")
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "c1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c1", "a1"), []byte{1, 2, 3, 4}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Import(ctx, db, Source{Kind: Vaultwarden, Driver: "sqlite3", Connect: path, AttachmentsDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != 2 || report.Devices != 1 || report.Folders != 1 || report.Ciphers != 2 || report.Attachments != 1 ||
+		report.Organizations != 1 || report.Members != 2 || report.Collections != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	warnings := strings.Join(report.Warnings, "\n")
+	for _, w := range []string{"2 two-step", "1 placements", "device d1", "revoked", "cipher c3", "1 sends"} {
+		if !strings.Contains(warnings, w) {
+			t.Errorf("missing warning %q in %v", w, report.Warnings)
+		}
+	}
+
+	bob, err := db.GetUserFromEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bob.CheckPassword("client-hash") || bob.CheckPassword("other-hash") {
+		t.Error("the master password of vaultwarden is not checked")
+	}
+	if bob.Kdf != models.KdfArgon2id || bob.KdfIterations != 3 || bob.KdfMemory != 64 || bob.KdfParallelism != 4 ||
+		bob.TotpSecret != "" || !bob.EmailVerified || bob.Key != "2.akey|iv|mac" ||
+		string(bob.EquivalentDomains) != `[["example.com","example.org"]]` {
+		t.Errorf("unexpected user %+v", bob)
+	}
+	if carol, err := db.GetUserFromEmail(ctx, "carol@example.com"); err != nil || !carol.Disabled || carol.KdfIterations != 600000 {
+		t.Errorf("unexpected user %+v: %v", carol, err)
+	}
+
+	ciphers, err := db.GetCiphersByUserUUID(ctx, "u1")
+	if err != nil || len(*ciphers) != 2 {
+		t.Fatalf("unexpected ciphers %v: %v", ciphers, err)
+	}
+	for _, cd := range *ciphers {
+		o := cd.Jsonify()
+		switch cd.UUID {
+		case "c1":
+			login, _ := json.Marshal(o.Login)
+			if o.FolderUUID != "f1" || !o.Favorite || *o.Key != "2.ckey|iv|mac" || len(o.Fields) != 1 ||
+				string(login) != `{"uris":null,"username":"2.u|iv|mac"}` {
+				t.Errorf("unexpected cipher %+v", o)
+			}
+			if len(o.Attachments) != 1 || o.Attachments[0].Key != "2.akey|iv|mac" || o.Attachments[0].Size != 4 {
+				t.Errorf("unexpected attachments %+v", o.Attachments)
+			}
+		case "c2":
+			if o.OrganizationUUID != "o1" || o.DeletedDate == nil || len(o.PasswordHistory) != 1 ||
+				len(o.CollectionUUIDs) != 1 || o.CollectionUUIDs[0] != "col1" {
+				t.Errorf("unexpected cipher %+v", o)
+			}
+		}
+	}
+	if ou, err := db.GetOrganizationUser(ctx, "o1", "u2"); err != nil || ou.Status != models.OrganizationUserInvited || ou.Key != "" {
+		t.Errorf("unexpected revoked member %+v: %v", ou, err)
+	}
+}
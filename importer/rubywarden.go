@@ -0,0 +1,169 @@
+package importer
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"gotwarden/models"
+)
+
+// rubywardenCiphers are the columns of the content of the ciphers, the oldest schemas only have the data blob
+var rubywardenCiphers = map[string]string{
+	"name":            "name",
+	"notes":           "notes",
+	"fields":          "fields",
+	"passwordhistory": "password_history",
+	"login":           "login",
+	"securenote":      "securenote",
+	"card":            "card",
+	"identity":        "identity",
+}
+
+// readRubywarden imports a rubywarden database: its users send the same master password hash to gotwarden,
+// which is kept as is
+func readRubywarden(ctx context.Context, r *run) error {
+	if err := r.checkUsers(ctx); err != nil {
+		return err
+	}
+
+	twoStep := 0
+	err := r.each(ctx, "users", func(row row) error {
+		u := &models.User{
+			UUID:          row.str("uuid"),
+			Email:         strings.ToLower(row.str("email")),
+			EmailVerified: row.bool("email_verified"),
+			Premium:       true,
+			Name:          row.str("name"),
+			PasswordHash:  row.str("password_hash"),
+			PasswordHint:  row.str("password_hint"),
+			Key:           row.str("key"),
+			Culture:       row.str("culture"),
+			PrivateKey:    row.bytes("private_key"),
+			PublicKey:     row.bytes("public_key"),
+			SecurityStamp: row.str("security_stamp"),
+			CreatedAt:     row.time("created_at"),
+			RevisionDate:  row.time("updated_at"),
+			Kdf:           row.int("kdf_type"),
+			KdfIterations: row.int("kdf_iterations"),
+		}
+		// The KDF settings came with the later versions, the former clients used 5000 iterations of PBKDF2
+		if !row.has("kdf_iterations") {
+			u.Kdf, u.KdfIterations = models.KdfPBKDF2, 5000
+		}
+		if u.Culture == "" {
+			u.Culture = "en-US"
+		}
+		// gotwarden has no two-step login
+		if row.str("totp_secret") != "" {
+			twoStep++
+		}
+		if err := r.insert(u); err != nil {
+			return err
+		}
+		r.users[u.UUID] = true
+		r.report.Users++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if twoStep > 0 {
+		r.warn("%d two-step logins not imported", twoStep)
+	}
+
+	err = r.each(ctx, "devices", func(row row) error {
+		if !r.users[row.str("user_uuid")] {
+			return nil
+		}
+		// The access tokens were signed by rubywarden, the clients get new ones with their refresh token
+		d := &models.Device{
+			UUID:           row.str("uuid"),
+			Name:           row.str("name"),
+			Type:           strconv.Itoa(row.int("type")),
+			PushToken:      row.str("push_token"),
+			RefreshToken:   row.str("refresh_token"),
+			TokenExpiresAt: time.Now(),
+			UserUUID:       row.str("user_uuid"),
+		}
+		if err := r.insert(d); err != nil {
+			return err
+		}
+		r.report.Devices++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "folders", func(row row) error {
+		f := &models.Folder{
+			UUID:     row.str("uuid"),
+			UserUUID: row.str("user_uuid"),
+			Name:     row.bytes("name"),
+			UpdateAt: row.time("updated_at"),
+		}
+		if !r.users[f.UserUUID] {
+			return nil
+		}
+		if err := r.insert(f); err != nil {
+			return err
+		}
+		r.folders[f.UUID] = f.UserUUID
+		r.report.Folders++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "ciphers", func(row row) error {
+		cd := &models.CipherData{
+			UUID:     row.str("uuid"),
+			UserUUID: row.str("user_uuid"),
+			Type:     row.int("type"),
+			Favorite: row.bool("favorite"),
+			UpdateAt: row.time("updated_at"),
+		}
+		if !r.users[cd.UserUUID] {
+			return nil
+		}
+		if owner, ok := r.folders[row.str("folder_uuid")]; ok && owner == cd.UserUUID {
+			cd.FolderUUID = row.str("folder_uuid")
+		}
+		if err := cipherData(cd, row, rubywardenCiphers); err != nil {
+			r.warn("cipher %s not imported: %v", cd.UUID, err)
+			return nil
+		}
+		if err := r.insert(cd); err != nil {
+			return err
+		}
+		r.ciphers[cd.UUID] = true
+		r.report.Ciphers++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The files are stored into the database
+	return r.each(ctx, "attachments", func(row row) error {
+		a := &models.AttachmentData{
+			UUID:       row.str("uuid"),
+			CipherUUID: row.str("cipher_uuid"),
+			Filename:   row.str("filename"),
+			Size:       row.int("size"),
+			File:       row.bytes("file"),
+			UpdateAt:   row.time("updated_at"),
+		}
+		if !r.ciphers[a.CipherUUID] {
+			return nil
+		}
+		if err := r.insert(a); err != nil {
+			return err
+		}
+		r.report.Attachments++
+		return nil
+	})
+}
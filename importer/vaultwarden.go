@@ -0,0 +1,350 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gotwarden/models"
+)
+
+// vaultwardenCiphers are the columns of the content of the ciphers, the properties of the type are into the data
+var vaultwardenCiphers = map[string]string{
+	"name":            "name",
+	"notes":           "notes",
+	"fields":          "fields",
+	"passwordhistory": "password_history",
+}
+
+// Statuses of the members of vaultwarden, the others are the same as gotwarden
+const vaultwardenRevoked = -1
+
+// vaultwardenLeftAside are the tables of features gotwarden does not have
+var vaultwardenLeftAside = []struct{ table, name string }{
+	{"sends", "sends"},
+	{"emergency_access", "emergency accesses"},
+	{"groups", "groups"},
+	{"org_policies", "organization policies"},
+}
+
+// readVaultwarden imports a vaultwarden database. Vaultwarden hashes again the master password hash sent by the
+// clients with PBKDF2, its hashes are kept in the format checked by models.User
+func readVaultwarden(ctx context.Context, r *run) error {
+	if err := r.checkUsers(ctx); err != nil {
+		return err
+	}
+
+	// gotwarden has no two-step login
+	if r.hasTable(ctx, "twofactor") {
+		enabled := 0
+		err := r.each(ctx, "twofactor", func(row row) error {
+			// The types from 1000 are the pending settings
+			if row.bool("enabled") && row.int("atype") < 1000 {
+				enabled++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if enabled > 0 {
+			r.warn("%d two-step logins not imported", enabled)
+		}
+	}
+
+	err := r.each(ctx, "users", func(row row) error {
+		u := &models.User{
+			UUID:              row.str("uuid"),
+			Email:             strings.ToLower(row.str("email")),
+			EmailVerified:     row.has("verified_at"),
+			Premium:           true,
+			Name:              row.str("name"),
+			PasswordHash:      models.ServerPasswordHash(row.int("password_iterations"), row.bytes("salt"), row.bytes("password_hash")),
+			PasswordHint:      row.str("password_hint"),
+			Key:               row.str("akey"),
+			Culture:           "en-US",
+			PrivateKey:        row.bytes("private_key"),
+			PublicKey:         row.bytes("public_key"),
+			SecurityStamp:     row.str("security_stamp"),
+			CreatedAt:         row.time("created_at"),
+			RevisionDate:      row.time("updated_at"),
+			Kdf:               row.int("client_kdf_type"),
+			KdfIterations:     row.int("client_kdf_iter"),
+			KdfMemory:         row.int("client_kdf_memory"),
+			KdfParallelism:    row.int("client_kdf_parallelism"),
+			Disabled:          row.has("enabled") && !row.bool("enabled"),
+			EquivalentDomains: jsonArray(row.bytes("equivalent_domains")),
+			ExcludedGlobals:   jsonArray(row.bytes("excluded_globals")),
+		}
+		if err := r.insert(u); err != nil {
+			return err
+		}
+		r.users[u.UUID] = true
+		r.report.Users++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// A device is identified by its uuid and its user, gotwarden only by its uuid
+	devices := map[string]bool{}
+	err = r.each(ctx, "devices", func(row row) error {
+		if !r.users[row.str("user_uuid")] {
+			return nil
+		}
+		if devices[row.str("uuid")] {
+			r.warn("device %s of several users only imported for the first one", row.str("uuid"))
+			return nil
+		}
+		// The access tokens were signed by vaultwarden, the clients get new ones with their refresh token
+		d := &models.Device{
+			UUID:           row.str("uuid"),
+			Name:           row.str("name"),
+			Type:           strconv.Itoa(row.int("atype")),
+			PushToken:      row.str("push_token"),
+			RefreshToken:   row.str("refresh_token"),
+			TokenExpiresAt: time.Now(),
+			UserUUID:       row.str("user_uuid"),
+		}
+		if err := r.insert(d); err != nil {
+			return err
+		}
+		devices[d.UUID] = true
+		r.report.Devices++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "folders", func(row row) error {
+		f := &models.Folder{
+			UUID:     row.str("uuid"),
+			UserUUID: row.str("user_uuid"),
+			Name:     row.bytes("name"),
+			UpdateAt: row.time("updated_at"),
+		}
+		if !r.users[f.UserUUID] {
+			return nil
+		}
+		if err := r.insert(f); err != nil {
+			return err
+		}
+		r.folders[f.UUID] = f.UserUUID
+		r.report.Folders++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "organizations", func(row row) error {
+		o := &models.Organization{
+			UUID:         row.str("uuid"),
+			Name:         row.str("name"),
+			BillingEmail: row.str("billing_email"),
+			UpdateAt:     time.Now(),
+		}
+		if err := r.insert(o); err != nil {
+			return err
+		}
+		r.orgs[o.UUID] = true
+		r.report.Organizations++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "users_organizations", func(row row) error {
+		ou := &models.OrganizationUser{
+			UUID:             row.str("uuid"),
+			OrganizationUUID: row.str("org_uuid"),
+			UserUUID:         row.str("user_uuid"),
+			Type:             row.int("atype"),
+			Status:           row.int("status"),
+			Key:              row.str("akey"),
+			AccessAll:        row.bool("access_all"),
+		}
+		if !r.users[ou.UserUUID] || !r.orgs[ou.OrganizationUUID] {
+			return nil
+		}
+		// Gotwarden cannot revoke, the member has to be confirmed again
+		if ou.Status <= vaultwardenRevoked {
+			r.warn("member %s revoked from the organization %s imported as invited", ou.UserUUID, ou.OrganizationUUID)
+			ou.Status, ou.Key = models.OrganizationUserInvited, ""
+		}
+		if err := r.insert(ou); err != nil {
+			return err
+		}
+		r.report.Members++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "collections", func(row row) error {
+		c := &models.Collection{
+			UUID:             row.str("uuid"),
+			OrganizationUUID: row.str("org_uuid"),
+			Name:             row.str("name"),
+		}
+		if !r.orgs[c.OrganizationUUID] {
+			return nil
+		}
+		if err := r.insert(c); err != nil {
+			return err
+		}
+		r.colls[c.UUID] = true
+		r.report.Collections++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = r.each(ctx, "users_collections", func(row row) error {
+		cu := &models.CollectionUser{
+			CollectionUUID: row.str("collection_uuid"),
+			UserUUID:       row.str("user_uuid"),
+			ReadOnly:       row.bool("read_only"),
+		}
+		if !r.colls[cu.CollectionUUID] || !r.users[cu.UserUUID] {
+			return nil
+		}
+		return r.insert(cu)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The folders and the favorites are by user in vaultwarden, a cipher of gotwarden has those of its owner
+	folders := map[string]string{}
+	placements := map[string]int{}
+	err = r.each(ctx, "folders_ciphers", func(row row) error {
+		folders[row.str("cipher_uuid")+"/"+r.folders[row.str("folder_uuid")]] = row.str("folder_uuid")
+		placements[row.str("cipher_uuid")]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	favorites := map[string]bool{}
+	if r.hasTable(ctx, "favorites") {
+		err = r.each(ctx, "favorites", func(row row) error {
+			favorites[row.str("cipher_uuid")+"/"+row.str("user_uuid")] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	lostPlacements := 0
+	err = r.each(ctx, "ciphers", func(row row) error {
+		cd := &models.CipherData{
+			UUID:             row.str("uuid"),
+			UserUUID:         row.str("user_uuid"),
+			OrganizationUUID: row.str("organization_uuid"),
+			Type:             row.int("atype"),
+			Key:              row.str("key"),
+			UpdateAt:         row.time("updated_at"),
+		}
+		if cd.OrganizationUUID != "" {
+			if !r.orgs[cd.OrganizationUUID] {
+				return nil
+			}
+			cd.UserUUID = ""
+		} else if !r.users[cd.UserUUID] {
+			return nil
+		} else {
+			cd.FolderUUID = folders[cd.UUID+"/"+cd.UserUUID]
+			// The oldest versions have the favorite into the cipher
+			cd.Favorite = favorites[cd.UUID+"/"+cd.UserUUID] || row.bool("favorite")
+		}
+		if row.has("deleted_at") {
+			deleted := row.time("deleted_at")
+			cd.DeletedAt = &deleted
+		}
+		if err := cipherData(cd, row, vaultwardenCiphers); err != nil {
+			r.warn("cipher %s not imported: %v", cd.UUID, err)
+			return nil
+		}
+		if err := r.insert(cd); err != nil {
+			return err
+		}
+		r.ciphers[cd.UUID] = true
+		r.report.Ciphers++
+		if cd.OrganizationUUID != "" {
+			lostPlacements += placements[cd.UUID]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if lostPlacements > 0 {
+		r.warn("%d placements of the ciphers of the organizations into the folders of their members not imported", lostPlacements)
+	}
+
+	err = r.each(ctx, "ciphers_collections", func(row row) error {
+		cc := &models.CollectionCipher{
+			CollectionUUID: row.str("collection_uuid"),
+			CipherUUID:     row.str("cipher_uuid"),
+		}
+		if !r.colls[cc.CollectionUUID] || !r.ciphers[cc.CipherUUID] {
+			return nil
+		}
+		return r.insert(cc)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The files are stored by vaultwarden into <attachments>/<cipher>/<id>
+	err = r.each(ctx, "attachments", func(row row) error {
+		a := &models.AttachmentData{
+			UUID:       row.str("id"),
+			CipherUUID: row.str("cipher_uuid"),
+			Filename:   row.str("file_name"),
+			Size:       row.int("file_size"),
+			Key:        row.str("akey"),
+			UpdateAt:   time.Now(),
+		}
+		if !r.ciphers[a.CipherUUID] {
+			return nil
+		}
+		if r.attDir == "" {
+			return fmt.Errorf("the directory of the attachments is needed to import the attachment %s", a.UUID)
+		}
+		file, err := ioutil.ReadFile(filepath.Join(r.attDir, a.CipherUUID, a.UUID))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("the file of the attachment %s is missing: %w", a.UUID, err)
+		} else if err != nil {
+			return err
+		}
+		a.File = file
+		if err := r.insert(a); err != nil {
+			return err
+		}
+		r.report.Attachments++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range vaultwardenLeftAside {
+		if n := r.count(ctx, t.table); n > 0 {
+			r.warn("%d %s not imported", n, t.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the log lines
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Redacted replaces the values of the secret fields
+const Redacted = "<redacted>"
+
+var (
+	mu           sync.Mutex
+	out          io.Writer = os.Stderr
+	formatter    logrus.Formatter
+	defaultLevel = logrus.InfoLevel
+	levels       = map[string]logrus.Level{}
+	loggers      = map[string]*logrus.Logger{}
+)
+
+func init() {
+	formatter, _ = newFormatter(FormatLogfmt)
+}
+
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case FormatJSON:
+		return redactor{&logrus.JSONFormatter{}}, nil
+	case FormatLogfmt:
+		return redactor{&logrus.TextFormatter{DisableColors: true, FullTimestamp: true, QuoteEmptyFields: true}}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (json or logfmt)", format)
+}
+
+// parseLevels reads the levels by module, ie "models=debug,notifications=warn"
+func parseLevels(value string) (map[string]logrus.Level, error) {
+	parsed := make(map[string]logrus.Level)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		module, name, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not module=level", item)
+		}
+		level, err := logrus.ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed[strings.TrimSpace(module)] = level
+	}
+	return parsed, nil
+}
+
+func parse(format, level, moduleLevels string) (logrus.Formatter, logrus.Level, map[string]logrus.Level, error) {
+	f, err := newFormatter(format)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	byModule, err := parseLevels(moduleLevels)
+	return f, lvl, byModule, err
+}
+
+// Check tells if the settings are valid
+func Check(format, level, moduleLevels string) error {
+	_, _, _, err := parse(format, level, moduleLevels)
+	return err
+}
+
+// Configure sets the format, the default level and the levels by module of all the loggers
+func Configure(w io.Writer, format, level, moduleLevels string) error {
+	f, lvl, byModule, err := parse(format, level, moduleLevels)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	out, formatter, defaultLevel, levels = w, f, lvl, byModule
+	for module, logger := range loggers {
+		configure(module, logger)
+	}
+	mu.Unlock()
+
+	// The messages of the libraries using the standard logger
+	log.SetFlags(0)
+	log.SetOutput(For("std").WriterLevel(logrus.InfoLevel))
+	return nil
+}
+
+func configure(module string, logger *logrus.Logger) {
+	logger.SetOutput(out)
+	logger.SetFormatter(formatter)
+	if level, ok := levels[module]; ok {
+		logger.SetLevel(level)
+	} else {
+		logger.SetLevel(defaultLevel)
+	}
+}
+
+// For gives the logger of the module, ie var logger = logging.For("models")
+func For(module string) *logrus.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	logger, ok := loggers[module]
+	if !ok {
+		logger = logrus.New()
+		configure(module, logger)
+		loggers[module] = logger
+	}
+	return logger.WithField("module", module)
+}
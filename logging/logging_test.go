@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// lines decodes the JSON log lines
+func lines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var decoded []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid JSON line %q: %s", line, err)
+		}
+		decoded = append(decoded, m)
+	}
+	out.Reset()
+	return decoded
+}
+
+func TestLevelsAndRedaction(t *testing.T) {
+	var out bytes.Buffer
+	models, handlers := For("test-models"), For("test-handlers")
+	if err := Configure(&out, FormatJSON, "warn", "test-models=debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(&out, FormatLogfmt, "info", "")
+
+	models.Debug("shown")
+	handlers.Info("hidden")
+	handlers.WithFields(logrus.Fields{"masterPasswordHash": "hash", "refresh_token": "token", "Key": "2.key", "user_id": "alice"}).Warn("redacted")
+
+	logged := lines(t, &out)
+	if len(logged) != 2 || logged[0]["msg"] != "shown" || logged[0]["module"] != "test-models" {
+		t.Fatalf("unexpected lines %v", logged)
+	}
+	for _, field := range []string{"masterPasswordHash", "refresh_token", "Key"} {
+		if logged[1][field] != Redacted {
+			t.Errorf("%s is not redacted: %v", field, logged[1])
+		}
+	}
+	if logged[1]["user_id"] != "alice" {
+		t.Errorf("user_id is redacted: %v", logged[1])
+	}
+
+	for _, invalid := range [][]string{{"xml", "info", ""}, {"json", "loud", ""}, {"json", "info", "models"}, {"json", "info", "models=loud"}} {
+		if err := Check(invalid[0], invalid[1], invalid[2]); err == nil {
+			t.Errorf("%v has been accepted", invalid)
+		}
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	redacted := RedactJSON([]byte(`{"email":"a@example.com","masterPasswordHash":"hash","keys":{"encryptedPrivateKey":"2.pk","publicKey":"pub"},"ciphers":[{"login":{"password":"2.p"}}]}`))
+	for _, secret := range []string{"hash", "2.pk", "2.p\""} {
+		if strings.Contains(redacted, secret) {
+			t.Errorf("%s is not redacted: %s", secret, redacted)
+		}
+	}
+	if !strings.Contains(redacted, "a@example.com") || !strings.Contains(redacted, `"publicKey":"pub"`) || !strings.Contains(redacted, `"password":"<redacted>"`) {
+		t.Errorf("unexpected redaction: %s", redacted)
+	}
+	if RedactJSON([]byte("password=secret")) != "<not json>" {
+		t.Error("a non JSON body is logged")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	if err := Configure(&out, FormatJSON, "info", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(&out, FormatLogfmt, "info", "")
+
+	module := For("test-handlers")
+	r := gin.New()
+	r.Use(Middleware(For("test-http"), func(c *gin.Context) logrus.Fields {
+		return logrus.Fields{"user_id": c.GetString("user")}
+	}))
+	r.GET("/items/:id", func(c *gin.Context) {
+		c.Set("user", "alice")
+		WithRequest(module, c).Info("handled")
+		c.Status(http.StatusNotFound)
+	})
+
+	for _, sent := range []string{"", "proxy-id.1", "invalid id\n"} {
+		req := httptest.NewRequest("GET", "/items/42?access_token=secret", nil)
+		if sent != "" {
+			req.Header.Set(RequestIDHeader, sent)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		id := w.Header().Get(RequestIDHeader)
+		if id == "" || (sent == "proxy-id.1" && id != sent) || (sent != "proxy-id.1" && id == sent) {
+			t.Errorf("%q: unexpected request id %q", sent, id)
+		}
+		logged := lines(t, &out)
+		if len(logged) != 2 {
+			t.Fatalf("unexpected lines %v", logged)
+		}
+		for _, line := range logged {
+			if line["request_id"] != id || line["user_id"] != "alice" {
+				t.Errorf("the request is not identified: %v", line)
+			}
+		}
+		access := logged[1]
+		if access["route"] != "/items/:id" || access["path"] != "/items/42" || access["status"] != float64(404) || access["level"] != "warning" {
+			t.Errorf("unexpected access log %v", access)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// secretFields are the names of the credentials, normalized (lower case, without _ and -)
+var secretFields = map[string]bool{
+	"password":              true,
+	"masterpasswordhash":    true,
+	"newmasterpasswordhash": true,
+	"key":                   true,
+	"privatekey":            true,
+	"encryptedprivatekey":   true,
+	"secret":                true,
+	"secretphrase":          true,
+	"totpsecret":            true,
+	"authorization":         true,
+	"cookie":                true,
+	"setcookie":             true,
+}
+
+// Secret tells if the field holds a credential (the known ones, and any *password, *token or *secret)
+func Secret(name string) bool {
+	n := strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(name))
+	return secretFields[n] || strings.HasSuffix(n, "password") || strings.HasSuffix(n, "token") || strings.HasSuffix(n, "secret")
+}
+
+// redactor hides the secret fields of the log lines
+type redactor struct {
+	logrus.Formatter
+}
+
+func (r redactor) Format(e *logrus.Entry) ([]byte, error) {
+	for k := range e.Data {
+		if Secret(k) {
+			e.Data[k] = Redacted
+		}
+	}
+	return r.Formatter.Format(e)
+}
+
+// RedactJSON hides the secret fields of a JSON document (a placeholder is given if it is not JSON)
+func RedactJSON(data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "<not json>"
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(redact(v))
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func redact(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			if Secret(k) {
+				value[k] = Redacted
+			} else {
+				value[k] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redact(value[i])
+		}
+	}
+	return v
+}
+
+// RedactValues hides the secret fields of a form or a query string
+func RedactValues(values url.Values) string {
+	redacted := make(url.Values, len(values))
+	for k, vv := range values {
+		if Secret(k) {
+			vv = []string{Redacted}
+		}
+		redacted[k] = vv
+	}
+	return redacted.Encode()
+}
+
+// RedactHeader hides the credentials of the headers
+func RedactHeader(header http.Header) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for k, vv := range header {
+		if Secret(k) {
+			redacted[k] = Redacted
+		} else {
+			redacted[k] = strings.Join(vv, ", ")
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader carries the id of the request (the one of the proxy is kept if valid)
+const RequestIDHeader = "X-Request-Id"
+
+const (
+	requestIDKey = "logging.requestID"
+	identityKey  = "logging.identity"
+)
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Identity gives the fields of the user authenticated by the request (ie from the JWT)
+type Identity func(c *gin.Context) logrus.Fields
+
+// Middleware gives an id to the request and logs it once done with the user, the status and the latency
+func Middleware(logger *logrus.Entry, identity Identity) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Set(requestIDKey, id)
+		c.Set(identityKey, identity)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := WithRequest(logger, c).WithFields(logrus.Fields{
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"route":      c.FullPath(),
+			"status":     status,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":  c.ClientIP(),
+			"size":       c.Writer.Size(),
+		})
+		switch {
+		case status >= 500:
+			entry.Error("Request failed")
+		case status >= 400:
+			entry.Warn("Request refused")
+		default:
+			entry.Info("Request served")
+		}
+	}
+}
+
+// RequestID gives the id of the request (empty outside of the middleware)
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// WithRequest adds the id of the request and the user to the logger of the module
+func WithRequest(logger *logrus.Entry, c *gin.Context) *logrus.Entry {
+	id := RequestID(c)
+	if id == "" {
+		return logger
+	}
+	entry := logger.WithField("request_id", id)
+	if identity, ok := c.Get(identityKey); ok {
+		if fields := identity.(Identity)(c); len(fields) > 0 {
+			entry = entry.WithFields(fields)
+		}
+	}
+	return entry
+}
@@ -2,67 +2,151 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"io"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
-	"time"
+	"text/tabwriter"
 
 	"gotwarden/handlers"
+	"gotwarden/logging"
+	"gotwarden/models"
 	"gotwarden/util"
-	"gotwarden/version"
 
+	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
+var logger = logging.For("main")
+
+// stdout receives the output of the commands
+var stdout io.Writer = os.Stdout
+
 func init() {
-	log.Print("Try to load .env ...")
 	if err := godotenv.Load(); err != nil {
-		log.Print("No .env file found")
+		logger.Debug("No .env file found")
 	}
 }
 
+// command is a subcommand of the binary, ie "gotwarden user list"
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+// commands are the subcommands of gotwarden (the server is run if none is given)
+var commands = map[string]command{
+	"serve":   {"Run the server (default)", serve},
+	"user":    {"Manage the users (list, disable, enable, delete, invite)", group("user", userCommands)},
+	"device":  {"Manage the devices (list, revoke)", group("device", deviceCommands)},
+	"stats":   {"Count the users, devices and vault items", stats},
+	"config":  {"Check the configuration (check)", group("config", configCommands)},
+	"db":      {"Manage the database (copy)", group("db", dbCommands)},
+	"backup":  {"Archive the database and the attachments", backupCreate},
+	"restore": {"Verify an archive then restore it (the server must be stopped)", backupRestore},
+	"import":  {"Import the users and their vaults from rubywarden or vaultwarden", importServer},
+	"version": {"Print the version", printVersion},
+}
+
 func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, "gotwarden:", err)
+		}
+		os.Exit(1)
+	}
+}
 
-	wardenCtx, err := handlers.Init(util.InitConfig())
-	if err != nil {
-		log.Fatalf("Impossible to load the context: %s", err)
+// run dispatches the arguments to the command
+func run(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printCommands(stdout, "gotwarden", commands)
+		return nil
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		printCommands(os.Stderr, "gotwarden", commands)
+		return fmt.Errorf("unknown command %q", name)
 	}
+	return cmd.run(args)
+}
 
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", wardenCtx.Port),
-		Handler: wardenCtx.Router(),
+// group dispatches the arguments to the subcommands of the command, ie "user list"
+func group(name string, subcommands map[string]command) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			printCommands(os.Stderr, "gotwarden "+name, subcommands)
+			return fmt.Errorf("%s: a command is needed", name)
+		}
+		sub, ok := subcommands[args[0]]
+		if !ok {
+			printCommands(os.Stderr, "gotwarden "+name, subcommands)
+			return fmt.Errorf("%s: unknown command %q", name, args[0])
+		}
+		return sub.run(args[1:])
 	}
+}
 
-	log.Printf("Starting on port %s Gotwarden server version %s (commit %s) built at %s", wardenCtx.Port, version.Release, version.Commit, version.BuildTime)
+// printCommands lists the commands and their summary
+func printCommands(w io.Writer, prefix string, cmds map[string]command) {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	// Initializing the server in a goroutine so that
-	// it won't block the graceful shutdown handling below
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
-
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 3 seconds.
-	quit := make(chan os.Signal)
-	// kill (no param) default send syscall.SIGTERM
-	// kill -2 is syscall.SIGINT
-	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
-
-	// The context is used to inform the server it has 3 seconds to finish
-	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", prefix)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, cmds[name].summary)
+	}
+	tw.Flush()
+}
+
+// newFlags gives the flags of the command, the usage shows its arguments
+func newFlags(name, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gotwarden %s [flags] %s\n", name, arguments)
+		flags.PrintDefaults()
 	}
+	return flags
+}
+
+// loadConfig reads and checks the config (env variables over WARDEN_CONFIG), then sets up the logs
+func loadConfig() (*util.Config, error) {
+	conf, err := util.InitConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	if err := logging.Configure(os.Stderr, conf.Log.Format, conf.Log.Level, conf.Log.Levels); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	if err := conf.Validate(gin.Mode() == gin.ReleaseMode); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return conf, nil
+}
+
+// openDatastore opens the database of the config, shared with a running server
+func openDatastore(conf *util.Config) (models.Datastore, error) {
+	if conf.Db.GetType() == util.MemoryDbType {
+		return nil, errors.New("the memory database only lives into the server, it cannot be managed from the command line")
+	}
+	return handlers.NewDatastore(conf.Db)
+}
 
-	log.Println("Server exiting")
+// commandContext is cancelled by SIGINT or SIGTERM
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 }
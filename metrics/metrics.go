@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the names of the metrics
+const Namespace = "gotwarden"
+
+// Results of the logins
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+)
+
+// Registry contains the metrics of the server, the Go runtime and the process
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Requests counts the HTTP requests by route and status
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+
+	// RequestDuration is the latency of the HTTP requests by route and status
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// Logins counts the logins by result
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "logins_total",
+		Help:      "Logins by result (success, failure).",
+	}, []string{"result"})
+
+	// Registrations counts the new accounts
+	Registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "registrations_total",
+		Help:      "Accounts registered.",
+	})
+
+	// Items counts the ciphers, folders and attachments created or deleted
+	Items = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "items_total",
+		Help:      "Ciphers, folders and attachments created or deleted.",
+	}, []string{"type", "action"})
+
+	// Backups counts the scheduled backups by result
+	Backups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "backups_total",
+		Help:      "Scheduled backups by result (success, failure).",
+	}, []string{"result"})
+
+	// BackupLastSuccess is the time of the last scheduled backup which succeeded
+	BackupLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "backup_last_success_timestamp_seconds",
+		Help:      "Time of the last scheduled backup which succeeded.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		Requests, RequestDuration, Logins, Registrations, Items, Backups, BackupLastSuccess,
+	)
+	// The series exist before the first event
+	for _, result := range []string{LoginSuccess, LoginFailure} {
+		Logins.WithLabelValues(result)
+	}
+	Backups.WithLabelValues("success")
+	Backups.WithLabelValues("failure")
+	for _, item := range []string{"cipher", "folder", "attachment"} {
+		Items.WithLabelValues(item, "created")
+		Items.WithLabelValues(item, "deleted")
+	}
+}
+
+// Middleware measures the requests, labelled by the route pattern to bound the number of series
+func Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	Requests.WithLabelValues(c.Request.Method, route, status).Inc()
+	RequestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
+
+// Handler exposes the metrics, a bearer token is required if not empty
+func Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,7 +1,7 @@
 package models
 
 import (
-	"log"
+	"context"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
@@ -12,9 +12,10 @@ type AttachmentData struct {
 	UUID       string    `db:"uuid"`
 	CipherUUID string    `db:"cipher_uuid"`
 	Filename   string    `db:"filename"`
-	Size       int       `dv:"size"`
+	Size       int       `db:"size"`
 	File       []byte    `db:"file"`
 	UpdateAt   time.Time `db:"update_at"`
+	Key        string    `db:"attachment_key"`
 }
 
 // AttachmentObject is the struct to manage internally the Attachment (ie Response)
@@ -25,46 +26,44 @@ type AttachmentObject struct {
 	Size         int
 	SizeName     string
 	File         []byte
+	Key          string `json:",omitempty"`
 	RevisionDate string
 	Object       string
 }
 
 // AllAttachments gets all the Attachments for this user
-func (db *DB) AllAttachments() (*[]AttachmentData, error) {
+func (db *DB) AllAttachments(ctx context.Context) (*[]AttachmentData, error) {
 	var attachments []AttachmentData
-	_, err := db.Select(&attachments, "SELECT * FROM attachments")
+	_, err := db.executor(ctx).Select(&attachments, "SELECT * FROM attachments")
 
 	return &attachments, err
 }
 
 // GetAttachmentsByCypherUUID gets all the Attachments for this cipher
-func (db *DB) GetAttachmentsByCypherUUID(uuid string) (*[]AttachmentData, error) {
+func (db *DB) GetAttachmentsByCypherUUID(ctx context.Context, uuid string) (*[]AttachmentData, error) {
 	var attachments []AttachmentData
-	_, err := db.Select(&attachments, "SELECT * FROM Attachments WHERE cypher_uuid=?", uuid)
+	_, err := db.executor(ctx).Select(&attachments, "SELECT * FROM attachments WHERE cipher_uuid=?", uuid)
 
 	return &attachments, err
 }
 
 // GetAttachment gets Attachment data from database
-func (db *DB) GetAttachment(uuid string) *AttachmentData {
-	obj, err := db.DbMap.Get(AttachmentData{}, uuid)
-
+func (db *DB) GetAttachment(ctx context.Context, uuid string) (*AttachmentData, error) {
+	obj, err := db.get(ctx, AttachmentData{}, uuid)
 	if err != nil {
-		log.Printf("Failed to get the Attachment %s", uuid)
-		return nil
+		return nil, err
 	}
-	a := obj.(*AttachmentData)
-	return a
+	return obj.(*AttachmentData), nil
 }
 
 // AddAttachment saves a new f
-func (db *DB) AddAttachment(a *AttachmentData) error {
-	return db.Insert(a)
+func (db *DB) AddAttachment(ctx context.Context, a *AttachmentData) error {
+	return db.executor(ctx).Insert(a)
 }
 
 // DeleteAttachment deletes f provided
-func (db *DB) DeleteAttachment(a *AttachmentData) error {
-	_, err := db.Delete(a)
+func (db *DB) DeleteAttachment(ctx context.Context, a *AttachmentData) error {
+	_, err := db.executor(ctx).Delete(a)
 	return err
 }
 
@@ -74,6 +73,7 @@ func (a *AttachmentData) Jsonify() *AttachmentObject {
 		UUID:         a.UUID,
 		Filename:     a.Filename,
 		File:         a.File,
+		Key:          a.Key,
 		Size:         a.Size,
 		SizeName:     humanize.Bytes(uint64(a.Size)),
 		RevisionDate: a.UpdateAt.Format(time.RFC3339),
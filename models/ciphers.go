@@ -1,11 +1,20 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"gotwarden/util"
-	"log"
 	"time"
 )
 
+var (
+	// ErrCipherNotFound is returned when a cipher doesn't exist or the user cannot see it
+	ErrCipherNotFound = fmt.Errorf("cipher %w", ErrNotFound)
+	// ErrCipherForbidden is returned when the user can see the cipher but not modify it
+	ErrCipherForbidden = errors.New("cipher not modifiable")
+)
+
 // CipherData contains the data to store for a cipher
 type CipherData struct {
 	UUID             string           `db:"uuid"`
@@ -24,7 +33,12 @@ type CipherData struct {
 	SecureNote       []byte           `db:"securenote"`
 	PasswordHistory  []byte           `db:"passwordhistory"`
 	UpdateAt         time.Time        `db:"update_at"`
+	DeletedAt        *time.Time       `db:"deleted_at"`
+	Key              string           `db:"cipher_key"`
 	Attachments      []AttachmentData `db:"-"`
+	CollectionUUIDs  []string         `db:"-"`
+	// ReadOnly is set when the user reaches the cipher through read only collections only
+	ReadOnly bool `db:"-"`
 }
 
 // CipherObject is a components into Warden server
@@ -36,7 +50,9 @@ type CipherObject struct {
 	Type                int
 	Favorite            bool
 	Attachments         []AttachmentObject
+	CollectionUUIDs     []string `json:"CollectionIds"`
 	Name                string
+	Key                 *string `json:",omitempty"`
 	Totp                interface{}
 	Notes               interface{}
 	Fields              []interface{}
@@ -46,85 +62,262 @@ type CipherObject struct {
 	SecureNote          interface{}
 	PasswordHistory     []interface{}
 	RevisionDate        string
+	DeletedDate         *string
 	Edit                bool
 	Object              string
 }
 
 // AllCiphers gets all the ciphers for this user
-func (db *DB) AllCiphers() (*[]CipherData, error) {
+func (db *DB) AllCiphers(ctx context.Context) (*[]CipherData, error) {
 	var ciphers []CipherData
-	_, err := db.Select(&ciphers, "SELECT * FROM ciphers")
+	_, err := db.executor(ctx).Select(&ciphers, "SELECT * FROM ciphers")
 
 	return &ciphers, err
 }
 
 // GetCiphersByFolderUUID gets all the ciphers for this user
-func (db *DB) GetCiphersByFolderUUID(uuid string) (*[]CipherData, error) {
+func (db *DB) GetCiphersByFolderUUID(ctx context.Context, uuid string) (*[]CipherData, error) {
 	var ciphers []CipherData
-	_, err := db.Select(&ciphers, "SELECT * FROM ciphers WHERE folder_uuid=?", uuid)
+	_, err := db.executor(ctx).Select(&ciphers, "SELECT * FROM ciphers WHERE folder_uuid=?", uuid)
 
 	return &ciphers, err
 }
 
-// GetCiphersByUserUUID gets all the ciphers for this user
-func (db *DB) GetCiphersByUserUUID(uuid string) (*[]CipherData, error) {
+// accessibleCiphers selects the ciphers of the user and the ones shared with him by his organizations
+// (only the collections he can modify if write)
+func accessibleCiphers(write bool) string {
+	readOnly := ""
+	if write {
+		readOnly = " AND NOT uc.read_only"
+	}
+	return `SELECT uuid FROM ciphers WHERE user_uuid=:user
+	OR organization_uuid IN (SELECT organization_uuid FROM organizations_users WHERE user_uuid=:user AND status=:confirmed AND access_all)
+	OR uuid IN (SELECT cc.cipher_uuid FROM collections_ciphers cc
+		JOIN users_collections uc ON uc.collection_uuid=cc.collection_uuid AND uc.user_uuid=:user` + readOnly + `
+		JOIN collections c ON c.uuid=cc.collection_uuid
+		JOIN organizations_users ou ON ou.organization_uuid=c.organization_uuid AND ou.user_uuid=:user AND ou.status=:confirmed)`
+}
+
+// userCiphers selects the ciphers the user can see
+var userCiphers = accessibleCiphers(false)
+
+// CanAccessCipher tells if the user owns the cipher or has access to it through his organizations
+func (db *DB) CanAccessCipher(ctx context.Context, userUUID, cipherUUID string, write bool) (bool, error) {
+	count, err := db.executor(ctx).SelectInt("SELECT COUNT(*) FROM ciphers WHERE uuid=:cipher AND uuid IN ("+accessibleCiphers(write)+")",
+		map[string]interface{}{"user": userUUID, "cipher": cipherUUID, "confirmed": OrganizationUserConfirmed})
+	return count > 0, err
+}
+
+// GetCiphersByUserUUID gets all the ciphers for this user with their attachments, collections and write access (4 queries
+// whatever the size of the vault)
+func (db *DB) GetCiphersByUserUUID(ctx context.Context, uuid string) (*[]CipherData, error) {
+	params := map[string]interface{}{"user": uuid, "confirmed": OrganizationUserConfirmed}
+	ex := db.executor(ctx)
+
 	var ciphers []CipherData
-	_, err := db.Select(&ciphers, "SELECT * FROM ciphers WHERE user_uuid=?", uuid)
+	if _, err := ex.Select(&ciphers, "SELECT * FROM ciphers WHERE uuid IN ("+userCiphers+")", params); err != nil {
+		return &ciphers, err
+	}
+
+	index := make(map[string]*CipherData, len(ciphers))
+	for i := range ciphers {
+		index[ciphers[i].UUID] = &ciphers[i]
+	}
 
-	// Add attachments to cipher
-	for _, cipher := range ciphers {
-		attachments, err := db.GetAttachmentsByCypherUUID(uuid)
-		if err == nil {
-			cipher.Attachments = *attachments
+	// The content of the files is not needed to list the attachments
+	var attachments []AttachmentData
+	if _, err := ex.Select(&attachments, "SELECT uuid, cipher_uuid, filename, size, update_at, attachment_key FROM attachments WHERE cipher_uuid IN ("+userCiphers+")", params); err != nil {
+		return &ciphers, err
+	}
+	for _, a := range attachments {
+		if cd, ok := index[a.CipherUUID]; ok {
+			cd.Attachments = append(cd.Attachments, a)
 		}
 	}
 
-	return &ciphers, err
+	var links []CollectionCipher
+	if _, err := ex.Select(&links, "SELECT * FROM collections_ciphers WHERE cipher_uuid IN ("+userCiphers+")", params); err != nil {
+		return &ciphers, err
+	}
+	for _, l := range links {
+		if cd, ok := index[l.CipherUUID]; ok {
+			cd.CollectionUUIDs = append(cd.CollectionUUIDs, l.CollectionUUID)
+		}
+	}
+
+	var writable []string
+	if _, err := ex.Select(&writable, accessibleCiphers(true), params); err != nil {
+		return &ciphers, err
+	}
+	for i := range ciphers {
+		ciphers[i].ReadOnly = true
+	}
+	for _, uuid := range writable {
+		if cd, ok := index[uuid]; ok {
+			cd.ReadOnly = false
+		}
+	}
+
+	return &ciphers, nil
 }
 
 // GetCipher gets a specific cipher
-func (db *DB) GetCipher(uuid string) *CipherData {
-	obj, err := db.DbMap.Get(CipherData{}, uuid)
-
-	if obj == nil {
-		log.Printf("Get User error %s", err)
-		return nil
+func (db *DB) GetCipher(ctx context.Context, uuid string) (*CipherData, error) {
+	obj, err := db.get(ctx, CipherData{}, uuid)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrCipherNotFound
+		}
+		return nil, err
 	}
 
 	cd := obj.(*CipherData)
 
 	// Get all the attachment for this cipher
-	attachments, err := db.GetAttachmentsByCypherUUID(uuid)
-	if err == nil {
-		for _, attachment := range *attachments {
-			cd.Attachments = append(cd.Attachments, attachment)
-		}
+	attachments, err := db.GetAttachmentsByCypherUUID(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	cd.Attachments = *attachments
+
+	var links []CollectionCipher
+	if _, err := db.executor(ctx).Select(&links, "SELECT * FROM collections_ciphers WHERE cipher_uuid=?", uuid); err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		cd.CollectionUUIDs = append(cd.CollectionUUIDs, l.CollectionUUID)
 	}
-	return cd
+	return cd, nil
 }
 
 // AddCipher saves a new cipher
-func (db *DB) AddCipher(cipher *CipherData) error {
-	return db.Insert(cipher)
+func (db *DB) AddCipher(ctx context.Context, cipher *CipherData) error {
+	return db.executor(ctx).Insert(cipher)
 }
 
 // SaveCipher updates existing cipher
-func (db *DB) SaveCipher(cipher *CipherData) error {
-	_, err := db.Update(cipher)
+func (db *DB) SaveCipher(ctx context.Context, cipher *CipherData) error {
+	_, err := db.executor(ctx).Update(cipher)
 	return err
 }
 
-// DeleteCipher deletes cipher provided
-func (db *DB) DeleteCipher(cipher *CipherData) error {
-	// Delete first all the attachment
-	attachments, err := db.GetAttachmentsByCypherUUID(cipher.UUID)
-	if err == nil {
-		for _, a := range *attachments {
-			db.DeleteAttachment(&a)
+// DeleteCipher deletes cipher provided with its attachments
+func (db *DB) DeleteCipher(ctx context.Context, cipher *CipherData) error {
+	return db.transaction(ctx, func(tx *DB) error {
+		return tx.deleteCipher(ctx, cipher.UUID)
+	})
+}
+
+// deleteCipher deletes the cipher, its attachments and its links to the collections
+func (db *DB) deleteCipher(ctx context.Context, uuid string) error {
+	for _, query := range []string{
+		"DELETE FROM attachments WHERE cipher_uuid=?",
+		"DELETE FROM collections_ciphers WHERE cipher_uuid=?",
+		"DELETE FROM ciphers WHERE uuid=?",
+	} {
+		if _, err := db.executor(ctx).Exec(query, uuid); err != nil {
+			return err
 		}
 	}
-	_, err = db.Delete(cipher)
-	return err
+	return nil
+}
+
+// updateCiphers applies the change to each cipher in one transaction (nothing done if the user cannot modify one of them,
+// or doesn't own it when ownerOnly)
+func (db *DB) updateCiphers(ctx context.Context, userUUID string, uuids []string, ownerOnly bool, apply func(tx *DB, uuid string) error) error {
+	query := "SELECT COUNT(*) FROM ciphers WHERE uuid=:cipher AND uuid IN (" + accessibleCiphers(true) + ")"
+	if ownerOnly {
+		query = "SELECT COUNT(*) FROM ciphers WHERE uuid=:cipher AND user_uuid=:user"
+	}
+
+	return db.transaction(ctx, func(tx *DB) error {
+		ex := tx.executor(ctx)
+		for _, uuid := range uuids {
+			params := map[string]interface{}{"user": userUUID, "cipher": uuid, "confirmed": OrganizationUserConfirmed}
+			count, err := ex.SelectInt(query, params)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				if visible, _ := ex.SelectInt("SELECT COUNT(*) FROM ciphers WHERE uuid=:cipher AND uuid IN ("+userCiphers+")", params); visible > 0 {
+					return ErrCipherForbidden
+				}
+				return ErrCipherNotFound
+			}
+			if err := apply(tx, uuid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MoveCiphers moves the ciphers of the user into the folder (none if empty)
+func (db *DB) MoveCiphers(ctx context.Context, userUUID string, uuids []string, folderUUID string) error {
+	now := time.Now().UTC()
+	return db.updateCiphers(ctx, userUUID, uuids, true, func(tx *DB, uuid string) error {
+		_, err := tx.executor(ctx).Exec("UPDATE ciphers SET folder_uuid=?, update_at=? WHERE uuid=?", folderUUID, now, uuid)
+		return err
+	})
+}
+
+// SoftDeleteCiphers moves the ciphers into the trash
+func (db *DB) SoftDeleteCiphers(ctx context.Context, userUUID string, uuids []string) error {
+	now := time.Now().UTC()
+	return db.updateCiphers(ctx, userUUID, uuids, false, func(tx *DB, uuid string) error {
+		_, err := tx.executor(ctx).Exec("UPDATE ciphers SET deleted_at=?, update_at=? WHERE uuid=?", now, now, uuid)
+		return err
+	})
+}
+
+// RestoreCiphers gets the ciphers out of the trash
+func (db *DB) RestoreCiphers(ctx context.Context, userUUID string, uuids []string) error {
+	now := time.Now().UTC()
+	return db.updateCiphers(ctx, userUUID, uuids, false, func(tx *DB, uuid string) error {
+		_, err := tx.executor(ctx).Exec("UPDATE ciphers SET deleted_at=NULL, update_at=? WHERE uuid=?", now, uuid)
+		return err
+	})
+}
+
+// DeleteCiphers deletes definitely the ciphers with their attachments
+func (db *DB) DeleteCiphers(ctx context.Context, userUUID string, uuids []string) error {
+	return db.updateCiphers(ctx, userUUID, uuids, false, func(tx *DB, uuid string) error {
+		return tx.deleteCipher(ctx, uuid)
+	})
+}
+
+// ShareCiphers saves the ciphers of the user (encrypted with the key of their organization) into the collections
+func (db *DB) ShareCiphers(ctx context.Context, userUUID string, ciphers []*CipherData, collectionUUIDs []string) error {
+	index := make(map[string]*CipherData, len(ciphers))
+	uuids := make([]string, 0, len(ciphers))
+	for _, cd := range ciphers {
+		index[cd.UUID] = cd
+		uuids = append(uuids, cd.UUID)
+	}
+
+	return db.updateCiphers(ctx, userUUID, uuids, true, func(tx *DB, uuid string) error {
+		ex := tx.executor(ctx)
+		if _, err := ex.Update(index[uuid]); err != nil {
+			return err
+		}
+		if _, err := ex.Exec("DELETE FROM collections_ciphers WHERE cipher_uuid=?", uuid); err != nil {
+			return err
+		}
+		for _, collectionUUID := range collectionUUIDs {
+			if err := ex.Insert(&CollectionCipher{CollectionUUID: collectionUUID, CipherUUID: uuid}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// collectionUUIDs never provides null to the clients
+func collectionUUIDs(uuids []string) []string {
+	if uuids == nil {
+		return []string{}
+	}
+	return uuids
 }
 
 // Jsonify provides a Struct to send back as Json
@@ -134,6 +327,15 @@ func (cd *CipherData) Jsonify() *CipherObject {
 	for _, a := range cd.Attachments {
 		ao = append(ao, *a.Jsonify())
 	}
+	var deletedDate *string
+	if cd.DeletedAt != nil {
+		d := cd.DeletedAt.Format(time.RFC3339)
+		deletedDate = &d
+	}
+	var key *string
+	if cd.Key != "" {
+		key = &cd.Key
+	}
 	return &CipherObject{
 		UUID:                cd.UUID,
 		FolderUUID:          cd.FolderUUID,
@@ -144,14 +346,17 @@ func (cd *CipherData) Jsonify() *CipherObject {
 		Fields:              util.UnmarshalArray(cd.Fields),
 		PasswordHistory:     util.UnmarshalArray(cd.PasswordHistory),
 		RevisionDate:        cd.UpdateAt.Format(time.RFC3339),
+		DeletedDate:         deletedDate,
 		Attachments:         ao,
+		CollectionUUIDs:     collectionUUIDs(cd.CollectionUUIDs),
 		OrganizationUseTotp: false,
 		Name:                cd.Name,
+		Key:                 key,
 		Notes:               util.UnmarshalObject(cd.Notes),
 		Card:                util.UnmarshalObject(cd.Card),
 		Identity:            util.UnmarshalObject(cd.Identity),
 		SecureNote:          util.UnmarshalObject(cd.SecureNote),
-		Edit:                true,
+		Edit:                !cd.ReadOnly,
 		Object:              "cipher",
 	}
 }
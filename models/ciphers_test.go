@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryCounter counts the queries traced by gorp
+type queryCounter struct {
+	count int
+}
+
+func (q *queryCounter) Printf(format string, v ...interface{}) {
+	q.count++
+}
+
+// newVault creates a database with a user owning size ciphers (one attachment every 10 ciphers)
+func newVault(tb testing.TB, size int) (*DB, string) {
+	db, err := NewDB("sqlite3", filepath.Join(tb.TempDir(), "test.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	u := NewUser("Bench", "bench@example.com", "hash", "", "key", 0, 100000)
+	if err := db.AddUser(context.Background(), u); err != nil {
+		tb.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < size; i++ {
+		cd := &CipherData{
+			UUID:     fmt.Sprintf("cipher-%05d", i),
+			UserUUID: u.UUID,
+			Type:     1,
+			Name:     fmt.Sprintf("2.name%d", i),
+			Login:    []byte(`{"Username":"2.user","Password":"2.password"}`),
+			UpdateAt: time.Now(),
+		}
+		if err := tx.Insert(cd); err != nil {
+			tb.Fatal(err)
+		}
+		if i%10 == 0 {
+			a := &AttachmentData{
+				UUID:       fmt.Sprintf("attachment-%05d", i),
+				CipherUUID: cd.UUID,
+				Filename:   "2.file",
+				Size:       1024,
+				File:       []byte(strings.Repeat("x", 1024)),
+				UpdateAt:   time.Now(),
+			}
+			if err := tx.Insert(a); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+	return db, u.UUID
+}
+
+func TestGetCiphersByUserUUIDLoadsAttachments(t *testing.T) {
+	db, userUUID := newVault(t, 100)
+
+	ciphers, err := db.GetCiphersByUserUUID(context.Background(), userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ciphers) != 100 {
+		t.Fatalf("got %d ciphers, want 100", len(*ciphers))
+	}
+
+	attachments := 0
+	for _, cd := range *ciphers {
+		for _, a := range cd.Attachments {
+			if a.CipherUUID != cd.UUID || a.Size != 1024 || a.File != nil {
+				t.Errorf("unexpected attachment %+v for cipher %s", a, cd.UUID)
+			}
+			attachments++
+		}
+	}
+	if attachments != 10 {
+		t.Errorf("got %d attachments, want 10", attachments)
+	}
+}
+
+func TestGetCiphersByUserUUIDQueryCount(t *testing.T) {
+	counts := make(map[int]int)
+	for _, size := range []int{10, 1000} {
+		db, userUUID := newVault(t, size)
+
+		counter := &queryCounter{}
+		db.TraceOn("", counter)
+		if _, err := db.GetCiphersByUserUUID(context.Background(), userUUID); err != nil {
+			t.Fatal(err)
+		}
+		db.TraceOff()
+		counts[size] = counter.count
+	}
+	if counts[10] != counts[1000] {
+		t.Errorf("the number of queries depends on the size of the vault: %v", counts)
+	}
+}
+
+func BenchmarkGetCiphersByUserUUID(b *testing.B) {
+	db, userUUID := newVault(b, 10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ciphers, err := db.GetCiphersByUserUUID(context.Background(), userUUID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := range *ciphers {
+			(*ciphers)[j].Jsonify()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+)
+
+// Collection groups ciphers of an organization
+type Collection struct {
+	UUID             string `db:"uuid"`
+	OrganizationUUID string `db:"organization_uuid"`
+	Name             string `db:"name"`
+}
+
+// CollectionObject is the struct sent back to the clients
+type CollectionObject struct {
+	UUID             string `json:"Id"`
+	OrganizationUUID string `json:"OrganizationId"`
+	Name             string
+	ReadOnly         bool
+	Object           string
+}
+
+// CollectionCipher links a cipher to a collection
+type CollectionCipher struct {
+	CollectionUUID string `db:"collection_uuid"`
+	CipherUUID     string `db:"cipher_uuid"`
+}
+
+// CollectionUser gives access to a collection to a member of the organization
+type CollectionUser struct {
+	CollectionUUID string `db:"collection_uuid"`
+	UserUUID       string `db:"user_uuid"`
+	ReadOnly       bool   `db:"read_only"`
+}
+
+// GetCollection gets a collection
+func (db *DB) GetCollection(ctx context.Context, uuid string) (*Collection, error) {
+	obj, err := db.get(ctx, Collection{}, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*Collection), nil
+}
+
+// GetCollectionsByUserUUID gets the collections the user has access to
+func (db *DB) GetCollectionsByUserUUID(ctx context.Context, uuid string) (*[]CollectionObject, error) {
+	var rows []struct {
+		UUID             string `db:"uuid"`
+		OrganizationUUID string `db:"organization_uuid"`
+		Name             string `db:"name"`
+		ReadOnly         bool   `db:"read_only"`
+	}
+	_, err := db.executor(ctx).Select(&rows, `SELECT c.uuid, c.organization_uuid, c.name,
+		(NOT ou.access_all AND COALESCE(uc.read_only, FALSE)) AS read_only FROM collections c
+		JOIN organizations_users ou ON ou.organization_uuid=c.organization_uuid AND ou.user_uuid=? AND ou.status=?
+		LEFT JOIN users_collections uc ON uc.collection_uuid=c.uuid AND uc.user_uuid=ou.user_uuid
+		WHERE ou.access_all OR uc.user_uuid IS NOT NULL
+		ORDER BY c.name`, uuid, OrganizationUserConfirmed)
+
+	collections := []CollectionObject{}
+	for _, row := range rows {
+		collections = append(collections, CollectionObject{
+			UUID:             row.UUID,
+			OrganizationUUID: row.OrganizationUUID,
+			Name:             row.Name,
+			ReadOnly:         row.ReadOnly,
+			Object:           "collection",
+		})
+	}
+	return &collections, err
+}
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyTable is a table copied by CopyDatabase, in the order of its references
+type copyTable struct {
+	name string
+	row  interface{}
+	// keys are the columns of the primary key, the rows are read by pages in their order
+	keys  []string
+	keyOf func(row interface{}) []string
+	// maxBatch bounds the rows of a batch holding large blobs (0 if none)
+	maxBatch int
+}
+
+var copyTables = []copyTable{
+	{"users", User{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*User).UUID} }, 0},
+	{"invitations", Invitation{}, []string{"email"}, func(r interface{}) []string { return []string{r.(*Invitation).Email} }, 0},
+	{"devices", Device{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*Device).UUID} }, 0},
+	{"folders", Folder{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*Folder).UUID} }, 0},
+	{"organizations", Organization{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*Organization).UUID} }, 0},
+	{"organizations_users", OrganizationUser{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*OrganizationUser).UUID} }, 0},
+	{"collections", Collection{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*Collection).UUID} }, 0},
+	{"users_collections", CollectionUser{}, []string{"collection_uuid", "user_uuid"}, func(r interface{}) []string {
+		cu := r.(*CollectionUser)
+		return []string{cu.CollectionUUID, cu.UserUUID}
+	}, 0},
+	{"ciphers", CipherData{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*CipherData).UUID} }, 0},
+	{"collections_ciphers", CollectionCipher{}, []string{"collection_uuid", "cipher_uuid"}, func(r interface{}) []string {
+		cc := r.(*CollectionCipher)
+		return []string{cc.CollectionUUID, cc.CipherUUID}
+	}, 0},
+	{"attachments", AttachmentData{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*AttachmentData).UUID} }, 20},
+	{"events", Event{}, []string{"uuid"}, func(r interface{}) []string { return []string{r.(*Event).UUID} }, 0},
+}
+
+// CopyTables are the tables copied by CopyDatabase, in order
+func CopyTables() []string {
+	names := make([]string, len(copyTables))
+	for i, t := range copyTables {
+		names[i] = t.name
+	}
+	return names
+}
+
+// ErrTargetNotEmpty is returned when the copy would mix its rows with those of the target
+var ErrTargetNotEmpty = errors.New("the target database is not empty")
+
+// copyProgressTable records into the target the last row copied of each table, so that an interrupted copy resumes
+const copyProgressTable = "copy_progress"
+
+// CopyDatabase copies every table of the source into the empty target (both at the schema version of this binary),
+// by batches each committed with its progress: a copy interrupted resumes after its last batch. The source must not
+// change meanwhile, progress is called after each batch
+func CopyDatabase(ctx context.Context, from, to *DB, batch int, progress func(table string, copied int)) error {
+	if batch < 1 {
+		return errors.New("the batch size must be positive")
+	}
+	for _, db := range []*DB{from, to} {
+		version, err := db.GetSchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		if version != SchemaVersion() {
+			return fmt.Errorf("the schema version %d is not the one of this binary (%d)", version, SchemaVersion())
+		}
+	}
+
+	if _, err := to.executor(ctx).Exec("CREATE TABLE IF NOT EXISTS " + copyProgressTable +
+		" (table_name varchar(64) not null primary key, last_key text not null, copied integer not null, done integer not null)"); err != nil {
+		return err
+	}
+	var states []struct {
+		Table   string `db:"table_name"`
+		LastKey string `db:"last_key"`
+		Copied  int    `db:"copied"`
+		Done    int    `db:"done"`
+	}
+	if _, err := to.executor(ctx).Select(&states, "SELECT * FROM "+copyProgressTable); err != nil {
+		return err
+	}
+	if len(states) == 0 {
+		for _, t := range copyTables {
+			count, err := to.executor(ctx).SelectInt("SELECT COUNT(*) FROM " + t.name)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return fmt.Errorf("%w (%d rows into %s)", ErrTargetNotEmpty, count, t.name)
+			}
+		}
+	}
+
+	for _, t := range copyTables {
+		var lastKey []string
+		copied, done, started := 0, false, false
+		for _, s := range states {
+			if s.Table == t.name {
+				if err := json.Unmarshal([]byte(s.LastKey), &lastKey); err != nil {
+					return fmt.Errorf("invalid progress of %s: %w", t.name, err)
+				}
+				copied, done, started = s.Copied, s.Done == 1, true
+			}
+		}
+		if done {
+			progress(t.name, copied)
+			continue
+		}
+
+		size := batch
+		if t.maxBatch > 0 && t.maxBatch < size {
+			size = t.maxBatch
+		}
+		for {
+			rows, err := from.page(ctx, t, lastKey, size)
+			if err != nil {
+				return fmt.Errorf("read of %s failed: %w", t.name, err)
+			}
+			if len(rows) > 0 {
+				lastKey = t.keyOf(rows[len(rows)-1])
+			}
+			copied += len(rows)
+			finished := len(rows) < size
+			err = to.transaction(ctx, func(tx *DB) error {
+				if len(rows) > 0 {
+					if err := tx.executor(ctx).Insert(rows...); err != nil {
+						return err
+					}
+				}
+				return tx.saveCopyProgress(ctx, t.name, lastKey, copied, finished, started)
+			})
+			if err != nil {
+				return fmt.Errorf("copy of %s failed: %w", t.name, err)
+			}
+			started = true
+			progress(t.name, copied)
+			if finished {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// saveCopyProgress records the last row copied of the table
+func (db *DB) saveCopyProgress(ctx context.Context, table string, lastKey []string, copied int, done, started bool) error {
+	key, err := json.Marshal(lastKey)
+	if err != nil {
+		return err
+	}
+	finished := 0
+	if done {
+		finished = 1
+	}
+	if started {
+		_, err = db.executor(ctx).Exec("UPDATE "+copyProgressTable+" SET last_key=?, copied=?, done=? WHERE table_name=?",
+			string(key), copied, finished, table)
+	} else {
+		_, err = db.executor(ctx).Exec("INSERT INTO "+copyProgressTable+" (table_name, last_key, copied, done) VALUES (?, ?, ?, ?)",
+			table, string(key), copied, finished)
+	}
+	return err
+}
+
+// FinishCopy removes the progress of the copy from the target, once verified
+func (db *DB) FinishCopy(ctx context.Context) error {
+	_, err := db.executor(ctx).Exec("DROP TABLE IF EXISTS " + copyProgressTable)
+	return err
+}
+
+// page reads the rows of the table following the key (from the first one if nil), in the order of the key
+func (db *DB) page(ctx context.Context, t copyTable, after []string, size int) ([]interface{}, error) {
+	query := "SELECT * FROM " + t.name
+	var args []interface{}
+	if after != nil {
+		// (a, b) > (x, y) written as a > x OR (a = x AND b > y), understood by every database
+		var conditions []string
+		for i := range t.keys {
+			var terms []string
+			for j := 0; j < i; j++ {
+				terms = append(terms, t.keys[j]+"=?")
+				args = append(args, after[j])
+			}
+			terms = append(terms, t.keys[i]+">?")
+			args = append(args, after[i])
+			conditions = append(conditions, "("+strings.Join(terms, " AND ")+")")
+		}
+		query += " WHERE " + strings.Join(conditions, " OR ")
+	}
+	query += " ORDER BY " + strings.Join(t.keys, ", ") + " LIMIT " + strconv.Itoa(size)
+	return db.executor(ctx).Select(t.row, query, args...)
+}
+
+// TableChecksum is the number of rows of a table and a digest of their content, independent of their order
+type TableChecksum struct {
+	Table    string
+	Rows     int
+	Checksum string
+}
+
+// Checksums reads every table copied and gives their checksums. The times are compared to the microsecond
+// (the precision of PostgreSQL), an empty blob is the same as NULL
+func (db *DB) Checksums(ctx context.Context, batch int) ([]TableChecksum, error) {
+	var sums []TableChecksum
+	for _, t := range copyTables {
+		size := batch
+		if t.maxBatch > 0 && t.maxBatch < size {
+			size = t.maxBatch
+		}
+		var digest [sha256.Size]byte
+		count := 0
+		var after []string
+		for {
+			rows, err := db.page(ctx, t, after, size)
+			if err != nil {
+				return nil, fmt.Errorf("read of %s failed: %w", t.name, err)
+			}
+			for _, row := range rows {
+				h := rowDigest(row)
+				for i := range digest {
+					digest[i] ^= h[i]
+				}
+			}
+			count += len(rows)
+			if len(rows) < size {
+				break
+			}
+			after = t.keyOf(rows[len(rows)-1])
+		}
+		sums = append(sums, TableChecksum{Table: t.name, Rows: count, Checksum: hex.EncodeToString(digest[:])})
+	}
+	return sums, nil
+}
+
+// rowDigest hashes the columns of the record, each one prefixed by its length
+func rowDigest(row interface{}) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(b []byte) {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+		h.Write(size[:])
+		h.Write(b)
+	}
+	v := reflect.Indirect(reflect.ValueOf(row))
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("db"); tag == "-" {
+			continue
+		}
+		switch f := v.Field(i).Interface().(type) {
+		case time.Time:
+			write([]byte(f.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)))
+		case *time.Time:
+			if f == nil {
+				write(nil)
+			} else {
+				write([]byte(f.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)))
+			}
+		case []byte:
+			write(f)
+		case string:
+			write([]byte(f))
+		default:
+			write([]byte(fmt.Sprint(f)))
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
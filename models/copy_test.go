@@ -0,0 +1,214 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	for query, expected := range map[string]string{
+		"SELECT * FROM users":                                   "SELECT * FROM users",
+		"SELECT * FROM users WHERE uuid=? AND email=?":          "SELECT * FROM users WHERE uuid=$1 AND email=$2",
+		"UPDATE ciphers SET name='?' WHERE uuid=?":              "UPDATE ciphers SET name='?' WHERE uuid=$1",
+		`SELECT "a?b" FROM t WHERE x IN (?,?,?)`:                `SELECT "a?b" FROM t WHERE x IN ($1,$2,$3)`,
+		"SELECT * FROM ciphers WHERE uuid=:cipher AND user=:id": "SELECT * FROM ciphers WHERE uuid=:cipher AND user=:id",
+	} {
+		if actual := rebind(query); actual != expected {
+			t.Errorf("%s: expected %s, got %s", query, expected, actual)
+		}
+	}
+}
+
+func TestCopyDatabase(t *testing.T) {
+	ctx := context.Background()
+	source, err := NewDB("sqlite3", filepath.Join(t.TempDir(), "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newSharedVault(t, source)
+	deleted := time.Now().Add(-time.Hour)
+	for i := 0; i < 7; i++ {
+		seed(t, source,
+			&CipherData{UUID: fmt.Sprintf("cipher-%d", i), UserUUID: v.member, Type: 2, Name: "2.note", Notes: []byte("2.notes"), UpdateAt: time.Now(), DeletedAt: &deleted},
+			&Folder{UUID: fmt.Sprintf("folder-%d", i), UserUUID: v.member, Name: []byte("2.folder"), UpdateAt: time.Now()},
+			&Event{UUID: fmt.Sprintf("event-%d", i), Type: EventUserLoggedIn, UserUUID: v.member, Date: time.Now()},
+		)
+	}
+	if err := source.AddInvitation(ctx, &Invitation{Email: "new@example.com", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := NewDB("sqlite3", filepath.Join(t.TempDir(), "target.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupted in the middle of the ciphers
+	interrupted, cancel := context.WithCancel(ctx)
+	err = CopyDatabase(interrupted, source, target, 3, func(table string, copied int) {
+		if table == "ciphers" {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("the copy has not been interrupted: %v", err)
+	}
+	if count, _ := target.SelectInt("SELECT COUNT(*) FROM ciphers"); count != 3 {
+		t.Errorf("expected the first batch of ciphers, got %d", count)
+	}
+
+	copied := map[string]int{}
+	if err := CopyDatabase(ctx, source, target, 3, func(table string, n int) { copied[table] = n }); err != nil {
+		t.Fatal(err)
+	}
+	if copied["users"] != 3 || copied["ciphers"] != 10 || copied["users_collections"] != 2 || copied["events"] != 7 {
+		t.Errorf("unexpected copy %v", copied)
+	}
+
+	sourceSums, err := source.Checksums(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetSums, err := target.Checksums(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sourceSums) != fmt.Sprint(targetSums) {
+		t.Errorf("the copy differs:\n%v\n%v", sourceSums, targetSums)
+	}
+	if err := target.FinishCopy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ciphers, err := target.GetCiphersByUserUUID(ctx, v.member); err != nil || len(*ciphers) != 10 {
+		t.Errorf("the copied vault cannot be read: %v", err)
+	}
+
+	// The copy is never mixed with existing rows
+	if err := CopyDatabase(ctx, source, target, 3, func(string, int) {}); !errors.Is(err, ErrTargetNotEmpty) {
+		t.Errorf("the copy into a database not empty is accepted: %v", err)
+	}
+
+	// A change is detected
+	if err := target.DeleteFolder(ctx, &Folder{UUID: "folder-1", UserUUID: v.member}); err != nil {
+		t.Fatal(err)
+	}
+	changed, _ := target.Checksums(ctx, 100)
+	for i := range changed {
+		if (changed[i].Checksum != sourceSums[i].Checksum) != (changed[i].Table == "folders") {
+			t.Errorf("%s: unexpected checksum %v", changed[i].Table, changed[i])
+		}
+	}
+}
+
+func TestCopyTablesCoverSchema(t *testing.T) {
+	db, err := NewDB("sqlite3", filepath.Join(t.TempDir(), "schema.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	if _, err := db.Select(&tables, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name<>'schema_version' ORDER BY name"); err != nil {
+		t.Fatal(err)
+	}
+	copied := map[string]bool{}
+	for _, name := range CopyTables() {
+		copied[name] = true
+	}
+	for _, name := range tables {
+		if !copied[name] {
+			t.Errorf("the table %s is not copied", name)
+		}
+	}
+	if len(tables) != len(copied) {
+		t.Errorf("expected the tables %v, copied %v", tables, CopyTables())
+	}
+}
+
+// openPostgres opens the PostgreSQL database of WARDEN_TEST_POSTGRES (postgres://... or key=value settings),
+// whose tables are dropped first: it must be a database dedicated to the tests
+func openPostgres(t *testing.T) *DB {
+	dsn := os.Getenv("WARDEN_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("WARDEN_TEST_POSTGRES is not set")
+	}
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tables := append(CopyTables(), "schema_version", copyProgressTable)
+	if _, err := conn.Exec("DROP TABLE IF EXISTS " + strings.Join(tables, ", ") + " CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Db.Close() })
+	return db
+}
+
+// copyAndVerify copies the database and compares the checksums of the source and the target
+func copyAndVerify(t *testing.T, from, to *DB) {
+	t.Helper()
+	ctx := context.Background()
+	if err := CopyDatabase(ctx, from, to, 3, func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	sourceSums, err := from.Checksums(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetSums, err := to.Checksums(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sourceSums) != fmt.Sprint(targetSums) {
+		t.Errorf("the copy differs:\n%v\n%v", sourceSums, targetSums)
+	}
+	if err := to.FinishCopy(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyDatabasePostgres(t *testing.T) {
+	postgres := openPostgres(t)
+	ctx := context.Background()
+	source, err := NewDB("sqlite3", filepath.Join(t.TempDir(), "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newSharedVault(t, source)
+	deleted := time.Now().Add(-time.Hour)
+	for i := 0; i < 7; i++ {
+		seed(t, source,
+			&CipherData{UUID: fmt.Sprintf("cipher-%d", i), UserUUID: v.member, Type: 2, Name: "2.note", Notes: []byte("2.notes"), UpdateAt: time.Now(), DeletedAt: &deleted},
+			&AttachmentData{UUID: fmt.Sprintf("attachment-%d", i), CipherUUID: v.writable, Filename: "2.file", Size: i, File: make([]byte, i), UpdateAt: time.Now()},
+			&Event{UUID: fmt.Sprintf("event-%d", i), Type: EventUserLoggedIn, UserUUID: v.member, Date: time.Now()},
+		)
+	}
+
+	// SQLite to PostgreSQL, then back to a new SQLite database
+	copyAndVerify(t, source, postgres)
+	if ciphers, err := postgres.GetCiphersByUserUUID(ctx, v.member); err != nil || len(*ciphers) != 10 {
+		t.Errorf("the vault copied into PostgreSQL cannot be read: %v", err)
+	}
+	target, err := NewDB("sqlite3", filepath.Join(t.TempDir(), "target.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyAndVerify(t, postgres, target)
+
+	sourceSums, _ := source.Checksums(ctx, 100)
+	targetSums, _ := target.Checksums(ctx, 100)
+	if fmt.Sprint(sourceSums) != fmt.Sprint(targetSums) {
+		t.Errorf("the round trip differs:\n%v\n%v", sourceSums, targetSums)
+	}
+}
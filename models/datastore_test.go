@@ -0,0 +1,547 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// store is a Datastore able to load fixtures (like gorp)
+type store interface {
+	Datastore
+	Insert(list ...interface{}) error
+}
+
+// forEachStore runs the test against every implementation of the Datastore
+func forEachStore(t *testing.T, test func(t *testing.T, db store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := NewDB("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryDB())
+	})
+}
+
+func seed(t *testing.T, db store, rows ...interface{}) {
+	t.Helper()
+	if err := db.Insert(rows...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cipherUUIDs lists the sorted uuids of the ciphers (or the error)
+func cipherUUIDs(ciphers *[]CipherData, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	uuids := []string{}
+	for _, cd := range *ciphers {
+		uuids = append(uuids, cd.UUID)
+	}
+	sort.Strings(uuids)
+	return fmt.Sprint(uuids)
+}
+
+// sharedVault is a user owning a cipher, and a member of an organization with a collection writable and a read only one
+type sharedVault struct {
+	owner, member, stranger string
+	readOnly, writable      string
+}
+
+func newSharedVault(t *testing.T, db store) sharedVault {
+	ctx := context.Background()
+	v := sharedVault{owner: "owner", member: "member", stranger: "stranger", readOnly: "cipher-ro", writable: "cipher-rw"}
+	for _, uuid := range []string{v.owner, v.member, v.stranger} {
+		u := NewUser(uuid, uuid+"@example.com", "hash", "", "key", 0, 100000)
+		u.UUID = uuid
+		if err := db.AddUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC()
+	seed(t, db,
+		&Organization{UUID: "org", Name: "Org", UpdateAt: now},
+		&OrganizationUser{UUID: "ou-owner", OrganizationUUID: "org", UserUUID: v.owner, Type: OrganizationUserOwner, Status: OrganizationUserConfirmed, AccessAll: true},
+		&OrganizationUser{UUID: "ou-member", OrganizationUUID: "org", UserUUID: v.member, Type: OrganizationUserUser, Status: OrganizationUserConfirmed},
+		&Collection{UUID: "col-ro", OrganizationUUID: "org", Name: "b"},
+		&Collection{UUID: "col-rw", OrganizationUUID: "org", Name: "a"},
+		&CollectionUser{CollectionUUID: "col-ro", UserUUID: v.member, ReadOnly: true},
+		&CollectionUser{CollectionUUID: "col-rw", UserUUID: v.member},
+		&CipherData{UUID: "cipher-own", UserUUID: v.member, Type: 1, Name: "2.own", UpdateAt: now},
+		&CipherData{UUID: v.readOnly, UserUUID: v.owner, OrganizationUUID: "org", Type: 1, Name: "2.ro", UpdateAt: now},
+		&CipherData{UUID: v.writable, UserUUID: v.owner, OrganizationUUID: "org", Type: 1, Name: "2.rw", UpdateAt: now},
+		&CollectionCipher{CollectionUUID: "col-ro", CipherUUID: v.readOnly},
+		&CollectionCipher{CollectionUUID: "col-rw", CipherUUID: v.writable},
+		&AttachmentData{UUID: "attachment", CipherUUID: v.writable, Filename: "2.file", Size: 3, File: []byte("abc"), UpdateAt: now},
+	)
+	return v
+}
+
+func TestDatastoreNotFound(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		checks := map[string]func() error{
+			"GetUser":             func() error { _, err := db.GetUser(ctx, "unknown"); return err },
+			"GetUserFromEmail":    func() error { _, err := db.GetUserFromEmail(ctx, "unknown@example.com"); return err },
+			"GetInvitation":       func() error { _, err := db.GetInvitation(ctx, "unknown@example.com"); return err },
+			"GetDevice":           func() error { _, err := db.GetDevice(ctx, "unknown"); return err },
+			"GetDeviceFromToken":  func() error { _, err := db.GetDeviceFromToken(ctx, "unknown"); return err },
+			"GetFolder":           func() error { _, err := db.GetFolder(ctx, "unknown"); return err },
+			"GetCipher":           func() error { _, err := db.GetCipher(ctx, "unknown"); return err },
+			"GetCollection":       func() error { _, err := db.GetCollection(ctx, "unknown"); return err },
+			"GetAttachment":       func() error { _, err := db.GetAttachment(ctx, "unknown"); return err },
+			"GetOrganizationUser": func() error { _, err := db.GetOrganizationUser(ctx, "unknown", "unknown"); return err },
+		}
+		for name, check := range checks {
+			if err := check(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: expected ErrNotFound, got %v", name, err)
+			}
+		}
+		if _, err := db.GetCipher(ctx, "unknown"); err != ErrCipherNotFound {
+			t.Errorf("GetCipher: expected ErrCipherNotFound, got %v", err)
+		}
+	})
+}
+
+func TestDatastoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		u := NewUser("Alice", "alice@example.com", "hash", "", "key", 0, 100000)
+		if err := db.AddUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddUser(ctx, u); err == nil {
+			t.Error("a user has been added twice")
+		}
+
+		u.Name = "Alice B."
+		u.TotpSecret = "secret"
+		if err := db.SaveUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.GetUser(ctx, u.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "Alice B." || !got.TwoFactorEnabled || got.Object != "profile" {
+			t.Errorf("unexpected user %+v", got)
+		}
+		if got, err = db.GetUserFromEmail(ctx, "alice@example.com"); err != nil || got.UUID != u.UUID {
+			t.Errorf("GetUserFromEmail: %v %v", got, err)
+		}
+
+		before := got.RevisionDate
+		time.Sleep(time.Millisecond)
+		if err := db.TouchUser(ctx, u.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = db.GetUser(ctx, u.UUID); !got.RevisionDate.After(before) {
+			t.Error("the revision date has not been updated")
+		}
+
+		// The returned user is a copy
+		got.Name = "changed"
+		if again, _ := db.GetUser(ctx, u.UUID); again.Name != "Alice B." {
+			t.Error("the stored user has been modified without SaveUser")
+		}
+
+		users, err := db.AllUsers(ctx)
+		if err != nil || len(*users) != 1 {
+			t.Errorf("AllUsers: %v %v", users, err)
+		}
+	})
+}
+
+func TestDatastoreTouchOrganizationUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		v := newSharedVault(t, db)
+		seed(t, db, &OrganizationUser{UUID: "ou-stranger", OrganizationUUID: "org", UserUUID: v.stranger, Type: OrganizationUserUser, Status: OrganizationUserInvited})
+
+		before := make(map[string]time.Time)
+		for _, uuid := range []string{v.owner, v.member, v.stranger} {
+			u, _ := db.GetUser(ctx, uuid)
+			before[uuid] = u.RevisionDate
+		}
+		time.Sleep(time.Millisecond)
+		if err := db.TouchOrganizationUsers(ctx, "org"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the confirmed members get the changes of the organization
+		for uuid, touched := range map[string]bool{v.owner: true, v.member: true, v.stranger: false} {
+			if u, _ := db.GetUser(ctx, uuid); u.RevisionDate.After(before[uuid]) != touched {
+				t.Errorf("%s: revision date updated %t, expected %t", uuid, !touched, touched)
+			}
+		}
+	})
+}
+
+func TestDatastoreDeleteUserCascades(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		v := newSharedVault(t, db)
+		seed(t, db,
+			&Device{UUID: "device", UserUUID: v.owner, AccessToken: "token"},
+			&Folder{UUID: "folder", UserUUID: v.owner, Name: []byte("2.folder")},
+			&CipherData{UUID: "cipher-owner", UserUUID: v.owner, FolderUUID: "folder", Type: 1, Name: "2.personal", UpdateAt: time.Now()},
+			&AttachmentData{UUID: "attachment-owner", CipherUUID: "cipher-owner", Filename: "2.file", Size: 3, File: []byte("abc"), UpdateAt: time.Now()},
+		)
+
+		owner, err := db.GetUser(ctx, v.owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteUser(ctx, owner); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.GetUser(ctx, v.owner); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the user still exists: %v", err)
+		}
+		if _, err := db.GetDeviceFromToken(ctx, "token"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the device still exists: %v", err)
+		}
+		if _, err := db.GetFolder(ctx, "folder"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the folder still exists: %v", err)
+		}
+		if _, err := db.GetCipher(ctx, "cipher-owner"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the cipher still exists: %v", err)
+		}
+		if _, err := db.GetAttachment(ctx, "attachment-owner"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the attachment still exists: %v", err)
+		}
+		if _, err := db.GetOrganizationUser(ctx, "org", v.owner); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the membership still exists: %v", err)
+		}
+		if storage, _ := db.GetStorageByUser(ctx); storage[v.owner] != 0 {
+			t.Errorf("the storage of the user is %d", storage[v.owner])
+		}
+
+		// The data of the other users are kept, with the ciphers shared by the user
+		if got := cipherUUIDs(db.GetCiphersByUserUUID(ctx, v.member)); got != "[cipher-own cipher-ro cipher-rw]" {
+			t.Errorf("unexpected ciphers of the member %v", got)
+		}
+		if cd, err := db.GetCipher(ctx, v.writable); err != nil || cd.UserUUID != "" || len(cd.Attachments) != 1 {
+			t.Errorf("the cipher shared is not kept without owner: %+v (%v)", cd, err)
+		}
+	})
+}
+
+func TestDatastoreCipherAccess(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		v := newSharedVault(t, db)
+
+		if got := cipherUUIDs(db.GetCiphersByUserUUID(ctx, v.member)); got != "[cipher-own cipher-ro cipher-rw]" {
+			t.Errorf("unexpected ciphers of the member %v", got)
+		}
+		if got := cipherUUIDs(db.GetCiphersByUserUUID(ctx, v.stranger)); got != "[]" {
+			t.Errorf("unexpected ciphers of the stranger %v", got)
+		}
+
+		for _, c := range []struct {
+			user, cipher string
+			write, want  bool
+		}{
+			{v.member, v.readOnly, false, true},
+			{v.member, v.readOnly, true, false},
+			{v.member, v.writable, true, true},
+			{v.owner, v.readOnly, true, true},
+			{v.stranger, v.writable, false, false},
+		} {
+			if got, err := db.CanAccessCipher(ctx, c.user, c.cipher, c.write); err != nil || got != c.want {
+				t.Errorf("CanAccessCipher(%s, %s, %t) = %t %v", c.user, c.cipher, c.write, got, err)
+			}
+		}
+
+		ciphers, _ := db.GetCiphersByUserUUID(ctx, v.member)
+		for _, cd := range *ciphers {
+			// Only the ciphers of the read only collections cannot be edited
+			if cd.ReadOnly != (cd.UUID == v.readOnly) || cd.Jsonify().Edit == cd.ReadOnly {
+				t.Errorf("%s: unexpected read only %t", cd.UUID, cd.ReadOnly)
+			}
+			if cd.UUID != v.writable {
+				continue
+			}
+			if len(cd.Attachments) != 1 || cd.Attachments[0].File != nil {
+				t.Errorf("the attachment is expected without its content %+v", cd.Attachments)
+			}
+			if fmt.Sprint(cd.CollectionUUIDs) != "[col-rw]" {
+				t.Errorf("unexpected collections %v", cd.CollectionUUIDs)
+			}
+		}
+		cd, err := db.GetCipher(ctx, v.writable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cd.Attachments) != 1 || string(cd.Attachments[0].File) != "abc" {
+			t.Errorf("the attachment is expected with its content %+v", cd.Attachments)
+		}
+
+		collections, err := db.GetCollectionsByUserUUID(ctx, v.member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(*collections); got != "[{col-rw org a false collection} {col-ro org b true collection}]" {
+			t.Errorf("unexpected collections %s", got)
+		}
+		if collections, _ = db.GetCollectionsByUserUUID(ctx, v.owner); len(*collections) != 2 || (*collections)[1].ReadOnly {
+			t.Errorf("the owner accesses all the collections %v", *collections)
+		}
+	})
+}
+
+func TestDatastoreBulkCiphers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		v := newSharedVault(t, db)
+
+		if err := db.SoftDeleteCiphers(ctx, v.member, []string{v.writable, v.readOnly}); err != ErrCipherForbidden {
+			t.Errorf("expected ErrCipherForbidden, got %v", err)
+		}
+		// Nothing is done when one of the ciphers fails
+		if cd, _ := db.GetCipher(ctx, v.writable); cd.DeletedAt != nil {
+			t.Error("the writable cipher has been deleted")
+		}
+		if err := db.DeleteCiphers(ctx, v.stranger, []string{v.writable}); err != ErrCipherNotFound {
+			t.Errorf("expected ErrCipherNotFound, got %v", err)
+		}
+		if err := db.MoveCiphers(ctx, v.member, []string{v.writable}, ""); err != ErrCipherForbidden {
+			t.Errorf("only the owner moves a cipher, got %v", err)
+		}
+
+		if err := db.SoftDeleteCiphers(ctx, v.member, []string{v.writable, "cipher-own"}); err != nil {
+			t.Fatal(err)
+		}
+		if cd, _ := db.GetCipher(ctx, v.writable); cd.DeletedAt == nil {
+			t.Error("the cipher is not into the trash")
+		}
+		if err := db.RestoreCiphers(ctx, v.member, []string{v.writable}); err != nil {
+			t.Fatal(err)
+		}
+		if cd, _ := db.GetCipher(ctx, v.writable); cd.DeletedAt != nil {
+			t.Error("the cipher has not been restored")
+		}
+
+		if err := db.DeleteCiphers(ctx, v.member, []string{v.writable}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetAttachment(ctx, "attachment"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the attachment of the deleted cipher still exists: %v", err)
+		}
+
+		own, _ := db.GetCipher(ctx, "cipher-own")
+		own.OrganizationUUID = "org"
+		own.Name = "2.shared"
+		if err := db.ShareCiphers(ctx, v.member, []*CipherData{own}, []string{"col-rw"}); err != nil {
+			t.Fatal(err)
+		}
+		cd, _ := db.GetCipher(ctx, "cipher-own")
+		if cd.OrganizationUUID != "org" || cd.Name != "2.shared" || fmt.Sprint(cd.CollectionUUIDs) != "[col-rw]" {
+			t.Errorf("the cipher has not been shared %+v", cd)
+		}
+	})
+}
+
+func TestDatastoreFolders(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		v := newSharedVault(t, db)
+		f := &Folder{UUID: "folder", UserUUID: v.member, Name: []byte("2.folder"), UpdateAt: time.Now().UTC()}
+		if err := db.AddFolder(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MoveCiphers(ctx, v.member, []string{"cipher-own"}, f.UUID); err != nil {
+			t.Fatal(err)
+		}
+		if got := cipherUUIDs(db.GetCiphersByFolderUUID(ctx, f.UUID)); got != "[cipher-own]" {
+			t.Errorf("unexpected ciphers of the folder %v", got)
+		}
+
+		f.Name = []byte("2.renamed")
+		if err := db.SaveFolder(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		if folders, err := db.GetFoldersByUserUUID(ctx, v.member); err != nil || len(*folders) != 1 || string((*folders)[0].Name) != "2.renamed" {
+			t.Errorf("GetFoldersByUserUUID: %v %v", folders, err)
+		}
+
+		if err := db.DeleteFolder(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		cd, err := db.GetCipher(ctx, "cipher-own")
+		if err != nil || cd.FolderUUID != "" {
+			t.Errorf("the cipher should be kept out of the folder: %+v %v", cd, err)
+		}
+	})
+}
+
+func TestDatastoreWithTx(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		failure := errors.New("failure")
+
+		err := db.WithTx(ctx, func(tx Datastore) error {
+			if err := tx.AddInvitation(ctx, &Invitation{Email: "bob@example.com", CreatedAt: time.Now().UTC()}); err != nil {
+				return err
+			}
+			return tx.WithTx(ctx, func(tx Datastore) error {
+				if _, err := tx.GetInvitation(ctx, "bob@example.com"); err != nil {
+					t.Errorf("the invitation is not visible into the transaction: %s", err)
+				}
+				return failure
+			})
+		})
+		if err != failure {
+			t.Fatalf("expected the error of the unit of work, got %v", err)
+		}
+		if _, err := db.GetInvitation(ctx, "bob@example.com"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("the invitation should have been rolled back, got %v", err)
+		}
+
+		err = db.WithTx(ctx, func(tx Datastore) error {
+			return tx.AddInvitation(ctx, &Invitation{Email: "bob@example.com", CreatedAt: time.Now().UTC()})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetInvitation(ctx, "bob@example.com"); err != nil {
+			t.Fatalf("the invitation should have been committed, got %v", err)
+		}
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := db.AllUsers(cancelled); !errors.Is(err, context.Canceled) {
+			t.Errorf("the query should have been cancelled, got %v", err)
+		}
+	})
+}
+
+func TestDatastoreEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < EventsPageSize+5; i++ {
+			e := &Event{UUID: fmt.Sprintf("event-%03d", i), Type: EventCipherUpdated, UserUUID: "user", CipherUUID: "cipher", Date: start.Add(time.Duration(i/2) * time.Minute)}
+			if i%10 == 0 {
+				e.Type, e.UserUUID, e.ActingUserUUID = EventCipherDeleted, "other", "user"
+			}
+			if err := db.AddEvent(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		filter := &EventFilter{UserUUID: "user", Start: start, End: start.Add(24 * time.Hour)}
+
+		var all []string
+		for {
+			events, token, err := db.GetEvents(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range *events {
+				all = append(all, e.UUID)
+			}
+			if token == "" {
+				break
+			}
+			filter.ContinuationToken = token
+		}
+		if len(all) != EventsPageSize+5 || all[0] != fmt.Sprintf("event-%03d", EventsPageSize+4) || all[len(all)-1] != "event-000" {
+			t.Errorf("unexpected pages of %d events from %s to %s", len(all), all[0], all[len(all)-1])
+		}
+
+		filter = &EventFilter{Types: []int{EventCipherDeleted}, Start: start, End: start.Add(time.Minute)}
+		if events, _, err := db.GetEvents(ctx, filter); err != nil || len(*events) != 1 || (*events)[0].UUID != "event-000" {
+			t.Errorf("unexpected filtered events %v %v", events, err)
+		}
+	})
+}
+
+func TestDatastoreEventsPageBoundaries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		add := func(i int) {
+			e := &Event{UUID: fmt.Sprintf("event-%03d", i), Type: EventCipherUpdated, UserUUID: "user", Date: start.Add(time.Duration(i) * time.Second)}
+			if err := db.AddEvent(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		filter := &EventFilter{UserUUID: "user", Start: start, End: start.Add(time.Hour)}
+
+		// A full page is the last one
+		for i := 0; i < EventsPageSize; i++ {
+			add(i)
+		}
+		if events, token, err := db.GetEvents(ctx, filter); err != nil || len(*events) != EventsPageSize || token != "" {
+			t.Fatalf("a full page: %d events, token %q, %v", len(*events), token, err)
+		}
+
+		// One more event is on a second page
+		add(EventsPageSize)
+		events, token, err := db.GetEvents(ctx, filter)
+		if err != nil || len(*events) != EventsPageSize || token == "" {
+			t.Fatalf("first page: %d events, token %q, %v", len(*events), token, err)
+		}
+		filter.ContinuationToken = token
+		events, token, err = db.GetEvents(ctx, filter)
+		if err != nil || len(*events) != 1 || (*events)[0].UUID != "event-000" || token != "" {
+			t.Fatalf("second page: %v, token %q, %v", events, token, err)
+		}
+
+		for _, tampered := range []string{"not base64!", "bm8gc2VwYXJhdG9y", "bm90IGEgZGF0ZXxldmVudA"} {
+			filter.ContinuationToken = tampered
+			if _, _, err := db.GetEvents(ctx, filter); !errors.Is(err, ErrInvalidContinuationToken) {
+				t.Errorf("%s: the tampered token is accepted: %v", tampered, err)
+			}
+		}
+	})
+}
+
+func TestDatastoreSchemaVersion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		if version, err := db.GetSchemaVersion(context.Background()); err != nil || version != SchemaVersion() {
+			t.Errorf("unexpected schema version %d %v", version, err)
+		}
+	})
+}
+
+func TestDatastoreProbes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		if err := db.Ping(context.Background()); err != nil {
+			t.Errorf("ping failed: %s", err)
+		}
+		if err := db.CheckWritable(context.Background()); err != nil {
+			t.Errorf("the store is not writable: %s", err)
+		}
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.CheckWritable(cancelled); err == nil {
+			t.Error("the probe ignores the context")
+		}
+	})
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := NewDB("sqlite3", path); err != nil {
+		t.Fatal(err)
+	}
+	readOnly, err := NewDB("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readOnly.Ping(context.Background()); err != nil {
+		t.Errorf("ping failed: %s", err)
+	}
+	if err := readOnly.CheckWritable(context.Background()); err == nil {
+		t.Error("the read-only database is writable")
+	}
+}
@@ -4,68 +4,214 @@ import (
 
 	// Database drivers
 
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"gotwarden/logging"
 
+	"github.com/go-gorp/gorp/v3"
 	// SQLite3 drivers
 	_ "github.com/mattn/go-sqlite3"
-	"gopkg.in/gorp.v1"
 )
 
-// Datastore functions to manage User
+// ErrNotFound is returned when the record doesn't exist
+var ErrNotFound = errors.New("record not found")
+
+var logger = logging.For("models")
+
+// Datastore functions to manage the data (the queries are cancelled with the context)
 type Datastore interface {
-	AllUsers() (*[]User, error)
-	AddUser(user *User) error
-	GetUserFromEmail(email string) (*User, error)
-	GetUser(uuid string) *User
-	SaveUser(u *User) error
-	AllDevices() (*[]Device, error)
-	GetDevice(uuid string) *Device
-	GetDeviceFromToken(token string) (*Device, error)
-	AddDevice(device *Device) error
-	SaveDevice(device *Device) error
-	GetFolder(uuid string) *Folder
-	GetFoldersByUserUUID(uuid string) (*[]Folder, error)
-	AllFolders() (*[]Folder, error)
-	AddFolder(f *Folder) error
-	SaveFolder(f *Folder) error
-	DeleteFolder(f *Folder) error
-	AllCiphers() (*[]CipherData, error)
-	AddCipher(cipher *CipherData) error
-	GetCiphersByUserUUID(uuid string) (*[]CipherData, error)
-	GetCiphersByFolderUUID(uuid string) (*[]CipherData, error)
-	SaveCipher(cipher *CipherData) error
-	DeleteCipher(cipher *CipherData) error
-	GetCipher(uuid string) *CipherData
-	GetAttachment(uuid string) *AttachmentData
-	AddAttachment(a *AttachmentData) error
-	DeleteAttachment(f *AttachmentData) error
+	// WithTx runs fn into a transaction, rolled back if fn fails
+	WithTx(ctx context.Context, fn func(Datastore) error) error
+	AllUsers(ctx context.Context) (*[]User, error)
+	AddUser(ctx context.Context, user *User) error
+	GetUserFromEmail(ctx context.Context, email string) (*User, error)
+	GetUser(ctx context.Context, uuid string) (*User, error)
+	SaveUser(ctx context.Context, u *User) error
+	TouchUser(ctx context.Context, uuid string) error
+	TouchOrganizationUsers(ctx context.Context, orgUUID string) error
+	DeleteUser(ctx context.Context, u *User) error
+	GetStorageByUser(ctx context.Context) (map[string]int64, error)
+	GetInvitation(ctx context.Context, email string) (*Invitation, error)
+	AddInvitation(ctx context.Context, i *Invitation) error
+	DeleteInvitation(ctx context.Context, i *Invitation) error
+	AllDevices(ctx context.Context) (*[]Device, error)
+	GetDevice(ctx context.Context, uuid string) (*Device, error)
+	GetDeviceFromToken(ctx context.Context, token string) (*Device, error)
+	AddDevice(ctx context.Context, device *Device) error
+	SaveDevice(ctx context.Context, device *Device) error
+	GetDevicesByUserUUID(ctx context.Context, uuid string) (*[]Device, error)
+	GetFolder(ctx context.Context, uuid string) (*Folder, error)
+	GetFoldersByUserUUID(ctx context.Context, uuid string) (*[]Folder, error)
+	AllFolders(ctx context.Context) (*[]Folder, error)
+	AddFolder(ctx context.Context, f *Folder) error
+	SaveFolder(ctx context.Context, f *Folder) error
+	DeleteFolder(ctx context.Context, f *Folder) error
+	AllCiphers(ctx context.Context) (*[]CipherData, error)
+	AddCipher(ctx context.Context, cipher *CipherData) error
+	GetCiphersByUserUUID(ctx context.Context, uuid string) (*[]CipherData, error)
+	GetCiphersByFolderUUID(ctx context.Context, uuid string) (*[]CipherData, error)
+	SaveCipher(ctx context.Context, cipher *CipherData) error
+	DeleteCipher(ctx context.Context, cipher *CipherData) error
+	GetCipher(ctx context.Context, uuid string) (*CipherData, error)
+	CanAccessCipher(ctx context.Context, userUUID, cipherUUID string, write bool) (bool, error)
+	MoveCiphers(ctx context.Context, userUUID string, uuids []string, folderUUID string) error
+	SoftDeleteCiphers(ctx context.Context, userUUID string, uuids []string) error
+	RestoreCiphers(ctx context.Context, userUUID string, uuids []string) error
+	DeleteCiphers(ctx context.Context, userUUID string, uuids []string) error
+	ShareCiphers(ctx context.Context, userUUID string, ciphers []*CipherData, collectionUUIDs []string) error
+	GetCollection(ctx context.Context, uuid string) (*Collection, error)
+	GetCollectionsByUserUUID(ctx context.Context, uuid string) (*[]CollectionObject, error)
+	GetAttachment(ctx context.Context, uuid string) (*AttachmentData, error)
+	AddAttachment(ctx context.Context, a *AttachmentData) error
+	DeleteAttachment(ctx context.Context, f *AttachmentData) error
+	AddEvent(ctx context.Context, e *Event) error
+	GetEvents(ctx context.Context, filter *EventFilter) (*[]Event, string, error)
+	GetOrganizationUser(ctx context.Context, orgUUID, userUUID string) (*OrganizationUser, error)
+	AllOrganizations(ctx context.Context) (*[]Organization, error)
+	AllOrganizationUsers(ctx context.Context) (*[]OrganizationUser, error)
+	GetOrganizationUsers(ctx context.Context, orgUUID string) (*[]OrganizationUser, error)
+	GetSchemaVersion(ctx context.Context) (int, error)
+	Ping(ctx context.Context) error
+	CheckWritable(ctx context.Context) error
 }
 
 // DB injector
 type DB struct {
 	*gorp.DbMap
+	// tx is the transaction of the unit of work (nil outside WithTx)
+	tx *gorp.Transaction
 }
 
 // NewDB create a new DB for the dataSource provided
 func NewDB(typeDb, connectDb string) (*DB, error) {
-	db, err := sql.Open(typeDb, connectDb)
+	dialect, err := dialectFor(typeDb)
 	if err != nil {
-		log.Fatalf("Failed to open database of type %s using string connection %s", typeDb, connectDb)
 		return nil, err
 	}
+	db, err := sql.Open(typeDb, connectDb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s database: %w", typeDb, err)
+	}
 
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
+	dbmap := &gorp.DbMap{Db: db, Dialect: dialect}
 
 	dbmap.AddTableWithName(User{}, "users").SetKeys(false, "UUID")
 	dbmap.AddTableWithName(Device{}, "devices").SetKeys(false, "UUID")
 	dbmap.AddTableWithName(Folder{}, "folders").SetKeys(false, "UUID")
 	dbmap.AddTableWithName(CipherData{}, "ciphers").SetKeys(false, "UUID")
 	dbmap.AddTableWithName(AttachmentData{}, "attachments").SetKeys(false, "UUID")
+	dbmap.AddTableWithName(Event{}, "events").SetKeys(false, "UUID")
+	dbmap.AddTableWithName(Organization{}, "organizations").SetKeys(false, "UUID")
+	dbmap.AddTableWithName(OrganizationUser{}, "organizations_users").SetKeys(false, "UUID")
+	dbmap.AddTableWithName(Invitation{}, "invitations").SetKeys(false, "Email")
+	dbmap.AddTableWithName(Collection{}, "collections").SetKeys(false, "UUID")
+	dbmap.AddTableWithName(CollectionCipher{}, "collections_ciphers").SetKeys(false, "CollectionUUID", "CipherUUID")
+	dbmap.AddTableWithName(CollectionUser{}, "users_collections").SetKeys(false, "CollectionUUID", "UserUUID")
 
 	err = dbmap.CreateTablesIfNotExists()
 	if err != nil {
-		log.Fatalf("Database init failed with error %s", err)
+		return nil, fmt.Errorf("database init failed: %w", err)
+	}
+
+	d := &DB{DbMap: dbmap}
+	if err = d.migrate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// executor runs the queries into the transaction if any, cancelled with the context (and traced into its span)
+func (db *DB) executor(ctx context.Context) gorp.SqlExecutor {
+	if db.tx != nil {
+		return traced(ctx, db.DbMap, rebound(db.DbMap, db.tx.WithContext(ctx)))
+	}
+	return traced(ctx, db.DbMap, rebound(db.DbMap, db.DbMap.WithContext(ctx)))
+}
+
+// WithTx runs fn into a transaction (the one already opened if nested)
+func (db *DB) WithTx(ctx context.Context, fn func(Datastore) error) error {
+	return db.transaction(ctx, func(tx *DB) error {
+		return fn(tx)
+	})
+}
+
+// ImportRecords inserts the records given by fn into a single transaction, nothing is inserted if it fails
+func (db *DB) ImportRecords(ctx context.Context, fn func(insert func(records ...interface{}) error) error) error {
+	return db.transaction(ctx, func(tx *DB) error {
+		return fn(func(records ...interface{}) error {
+			return tx.executor(ctx).Insert(records...)
+		})
+	})
+}
+
+// errProbe rolls back the transaction of CheckWritable
+var errProbe = errors.New("probe")
+
+// Ping checks the connection to the database
+func (db *DB) Ping(ctx context.Context) error {
+	return db.Db.PingContext(ctx)
+}
+
+// CheckWritable checks the attachments (stored into the database) can be written, nothing is changed
+func (db *DB) CheckWritable(ctx context.Context) error {
+	err := db.transaction(ctx, func(tx *DB) error {
+		if _, err := tx.executor(ctx).Exec("UPDATE attachments SET size = size WHERE 1 = 0"); err != nil {
+			return err
+		}
+		return errProbe
+	})
+	if err == errProbe {
+		return nil
+	}
+	return err
+}
+
+// transaction runs fn into a transaction, committed if it succeeds and rolled back otherwise
+func (db *DB) transaction(ctx context.Context, fn func(tx *DB) error) (err error) {
+	if db.tx != nil {
+		return fn(db)
+	}
+
+	// The transaction is rolled back by database/sql if the context is cancelled
+	tx, err := db.DbMap.WithContext(ctx).(*gorp.DbMap).Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = fn(&DB{DbMap: db.DbMap, tx: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// get gets the record by its keys (ErrNotFound if it doesn't exist)
+func (db *DB) get(ctx context.Context, i interface{}, keys ...interface{}) (interface{}, error) {
+	obj, err := db.executor(ctx).Get(i, keys...)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, ErrNotFound
+	}
+	return obj, nil
+}
+
+// selectOne selects the single record of the query (ErrNotFound if there is none)
+func (db *DB) selectOne(ctx context.Context, holder interface{}, query string, args ...interface{}) error {
+	err := db.executor(ctx).SelectOne(holder, query, args...)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
 	}
-	return &DB{dbmap}, nil
+	return err
 }
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestGetNotFound(t *testing.T) {
+	db, _ := newVault(t, 0)
+	ctx := context.Background()
+
+	if _, err := db.GetUser(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetUserFromEmail(ctx, "unknown@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUserFromEmail: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetCipher(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetCipher: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetFolder(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFolder: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetOrganizationUser(ctx, "unknown", "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetOrganizationUser: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestWithTxRollback(t *testing.T) {
+	db, userUUID := newVault(t, 0)
+	ctx := context.Background()
+	failure := errors.New("failure")
+
+	err := db.WithTx(ctx, func(tx Datastore) error {
+		if err := tx.AddFolder(ctx, &Folder{UUID: "folder", UserUUID: userUUID, Name: []byte("2.folder"), UpdateAt: time.Now()}); err != nil {
+			return err
+		}
+		// Nested units of work join the transaction
+		return tx.WithTx(ctx, func(tx Datastore) error {
+			if _, err := tx.GetFolder(ctx, "folder"); err != nil {
+				t.Errorf("the folder is not visible into the transaction: %s", err)
+			}
+			return failure
+		})
+	})
+	if err != failure {
+		t.Fatalf("expected the error of the unit of work, got %v", err)
+	}
+	if _, err := db.GetFolder(ctx, "folder"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("the folder should have been rolled back, got %v", err)
+	}
+}
+
+func TestDeleteFolderKeepsCiphers(t *testing.T) {
+	db, userUUID := newVault(t, 3)
+	ctx := context.Background()
+
+	f := &Folder{UUID: "folder", UserUUID: userUUID, Name: []byte("2.folder"), UpdateAt: time.Now()}
+	if err := db.AddFolder(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MoveCiphers(ctx, userUUID, []string{"cipher-00000", "cipher-00001"}, f.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteFolder(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphers, err := db.GetCiphersByFolderUUID(ctx, f.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ciphers) != 0 {
+		t.Fatalf("%d ciphers still reference the deleted folder", len(*ciphers))
+	}
+	all, err := db.GetCiphersByUserUUID(ctx, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*all) != 3 {
+		t.Fatalf("expected 3 ciphers, got %d", len(*all))
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	db, userUUID := newVault(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.GetCiphersByUserUUID(ctx, userUUID); !errors.Is(err, context.Canceled) {
+		t.Errorf("the query should have been cancelled, got %v", err)
+	}
+	if err := db.DeleteCiphers(ctx, userUUID, []string{"cipher-00000"}); err == nil {
+		t.Errorf("the transaction should have been cancelled")
+	}
+	if _, err := db.GetCipher(context.Background(), "cipher-00000"); err != nil {
+		t.Errorf("the cipher should not have been deleted: %s", err)
+	}
+}
+
+func TestQuerySpans(t *testing.T) {
+	db, userUUID := newVault(t, 0)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	// Without a request, nothing is traced
+	if _, err := db.GetUserFromEmail(context.Background(), "bench@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Ended()) != 0 {
+		t.Fatalf("unexpected spans %v", recorder.Ended())
+	}
+
+	ctx, request := otel.Tracer("test").Start(context.Background(), "request")
+	if _, err := db.GetUserFromEmail(ctx, "bench@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	err := db.WithTx(ctx, func(tx Datastore) error {
+		return tx.AddFolder(ctx, &Folder{UUID: "folder", UserUUID: userUUID, Name: []byte("2.folder"), UpdateAt: time.Now()})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 || spans[0].Name() != "SELECT users" || spans[1].Name() != "INSERT folders" {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	for _, span := range spans[:2] {
+		if span.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the request", span.Name())
+		}
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), "bench@example.com") {
+				t.Errorf("%s records the arguments: %v", span.Name(), span.Attributes())
+			}
+		}
+	}
+}
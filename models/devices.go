@@ -1,11 +1,12 @@
 package models
 
 import (
+	"context"
 	"encoding/base64"
-	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
 // Device which access to GotWarden server
@@ -22,41 +23,49 @@ type Device struct {
 }
 
 // AllDevices get all the devices
-func (db *DB) AllDevices() (*[]Device, error) {
+func (db *DB) AllDevices(ctx context.Context) (*[]Device, error) {
 	dd := []Device{}
 
-	_, err := db.Select(&dd, "SELECT * FROM devices")
+	_, err := db.executor(ctx).Select(&dd, "SELECT * FROM devices")
 
 	return &dd, err
 }
 
-// GetDevice get device for specific uuid identifier
-func (db *DB) GetDevice(uuid string) *Device {
-	obj, err := db.DbMap.Get(Device{}, uuid)
+// GetDevicesByUserUUID gets all the devices of the user
+func (db *DB) GetDevicesByUserUUID(ctx context.Context, uuid string) (*[]Device, error) {
+	dd := []Device{}
+
+	_, err := db.executor(ctx).Select(&dd, "SELECT * FROM devices WHERE user_uuid=?", uuid)
 
-	if obj == nil {
-		log.Printf("Get Device error %s", err)
-		return nil
+	return &dd, err
+}
+
+// GetDevice get device for specific uuid identifier
+func (db *DB) GetDevice(ctx context.Context, uuid string) (*Device, error) {
+	obj, err := db.get(ctx, Device{}, uuid)
+	if err != nil {
+		return nil, err
 	}
-	return obj.(*Device)
+	return obj.(*Device), nil
 }
 
 // GetDeviceFromToken get device for specific token
-func (db *DB) GetDeviceFromToken(token string) (*Device, error) {
+func (db *DB) GetDeviceFromToken(ctx context.Context, token string) (*Device, error) {
 	d := Device{}
-	err := db.DbMap.SelectOne(&d, "SELECT FROM * WHERE access_token=?", token)
-
-	return &d, err
+	if err := db.selectOne(ctx, &d, "SELECT * FROM devices WHERE access_token=?", token); err != nil {
+		return nil, err
+	}
+	return &d, nil
 }
 
 // AddDevice persiste an object Device
-func (db *DB) AddDevice(device *Device) error {
-	return db.Insert(device)
+func (db *DB) AddDevice(ctx context.Context, device *Device) error {
+	return db.executor(ctx).Insert(device)
 }
 
 // SaveDevice updates uuid device with the value into device provided
-func (db *DB) SaveDevice(device *Device) error {
-	_, err := db.Update(device)
+func (db *DB) SaveDevice(ctx context.Context, device *Device) error {
+	_, err := db.executor(ctx).Update(device)
 	return err
 }
 
@@ -64,7 +73,7 @@ func (db *DB) SaveDevice(device *Device) error {
 
 // NewDevice creates a new Device and persistes it
 func NewDevice(deviceIdentifier, deviceName, deviceType, userID string) *Device {
-	log.Printf("NewDevice : %s %s %s %s", deviceIdentifier, deviceName, deviceType, userID)
+	logger.WithFields(logrus.Fields{"device_identifier": deviceIdentifier, "device_type": deviceType, "user_id": userID}).Debug("New device")
 	return &Device{
 		UUID:         deviceIdentifier,
 		Name:         deviceName,
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-gorp/gorp/v3"
+	// PostgreSQL driver
+	_ "github.com/lib/pq"
+)
+
+// dialectFor gives the gorp dialect of the driver
+func dialectFor(typeDb string) (gorp.Dialect, error) {
+	switch typeDb {
+	case "sqlite3":
+		return gorp.SqliteDialect{}, nil
+	case "postgres":
+		return gorp.PostgresDialect{}, nil
+	}
+	return nil, fmt.Errorf("unsupported database %q", typeDb)
+}
+
+// rebind turns the ? placeholders of the query into the numbered ones of PostgreSQL ($1, $2...),
+// the quoted strings and identifiers are left as is
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// reboundExecutor rebinds the queries written with ? for PostgreSQL, the statements generated by gorp already
+// use the placeholders of the dialect
+type reboundExecutor struct {
+	gorp.SqlExecutor
+}
+
+// rebound wraps the executor if the dialect numbers its placeholders
+func rebound(dbmap *gorp.DbMap, e gorp.SqlExecutor) gorp.SqlExecutor {
+	if _, ok := dbmap.Dialect.(gorp.PostgresDialect); !ok {
+		return e
+	}
+	return reboundExecutor{e}
+}
+
+func (e reboundExecutor) WithContext(ctx context.Context) gorp.SqlExecutor {
+	return reboundExecutor{e.SqlExecutor.WithContext(ctx)}
+}
+
+func (e reboundExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.SqlExecutor.Exec(rebind(query), args...)
+}
+
+func (e reboundExecutor) Select(i interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	return e.SqlExecutor.Select(i, rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectInt(query string, args ...interface{}) (int64, error) {
+	return e.SqlExecutor.SelectInt(rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectNullInt(query string, args ...interface{}) (sql.NullInt64, error) {
+	return e.SqlExecutor.SelectNullInt(rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectFloat(query string, args ...interface{}) (float64, error) {
+	return e.SqlExecutor.SelectFloat(rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectNullFloat(query string, args ...interface{}) (sql.NullFloat64, error) {
+	return e.SqlExecutor.SelectNullFloat(rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectStr(query string, args ...interface{}) (string, error) {
+	return e.SqlExecutor.SelectStr(rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectNullStr(query string, args ...interface{}) (sql.NullString, error) {
+	return e.SqlExecutor.SelectNullStr(rebind(query), args...)
+}
+
+func (e reboundExecutor) SelectOne(holder interface{}, query string, args ...interface{}) error {
+	return e.SqlExecutor.SelectOne(holder, rebind(query), args...)
+}
+
+func (e reboundExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return e.SqlExecutor.Query(rebind(query), args...)
+}
+
+func (e reboundExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return e.SqlExecutor.QueryRow(rebind(query), args...)
+}
@@ -1,12 +1,112 @@
 package models
 
-// Domains don't what is it
+import (
+	_ "embed" // global domains dataset
+	"encoding/json"
+	"strings"
+)
+
+// globalDomainsJSON is the dataset of the Bitwarden global equivalent domains
+//
+//go:embed global_domains.json
+var globalDomainsJSON []byte
+
+// globalDomains is the dataset loaded at startup
+var globalDomains = loadGlobalDomains()
+
+// GlobalDomains is a group of domains known as equivalent for everybody
+type GlobalDomains struct {
+	Type     int      `json:"Type"`
+	Domains  []string `json:"Domains"`
+	Excluded bool     `json:"Excluded"`
+}
+
+// Domains are the settings of the equivalent domains used by the clients to match the URIs
 type Domains struct {
-	EquivalentDomains       []byte `json:"EquivalentDomains"`
-	GlobalEquivalentDomains []struct {
-		Type     int      `json:"Type"`
-		Domains  []string `json:"Domains"`
-		Excluded bool     `json:"Excluded"`
-	} `json:"GlobalEquivalentDomains"`
-	Object string `json:"Object"`
+	EquivalentDomains       [][]string      `json:"EquivalentDomains"`
+	GlobalEquivalentDomains []GlobalDomains `json:"GlobalEquivalentDomains"`
+	Object                  string          `json:"Object"`
+}
+
+func loadGlobalDomains() []GlobalDomains {
+	var gd []GlobalDomains
+	if err := json.Unmarshal(globalDomainsJSON, &gd); err != nil {
+		logger.WithError(err).Fatal("Invalid global domains dataset")
+	}
+	return gd
+}
+
+// IsGlobalDomainsType tells if the type is a group of the global domains dataset
+func IsGlobalDomainsType(t int) bool {
+	for _, gd := range globalDomains {
+		if gd.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDomains provides the equivalent domains of the user and the global ones (flagged if excluded by the user)
+func (u *User) GetDomains() *Domains {
+	equivalent := [][]string{}
+	if len(u.EquivalentDomains) > 0 {
+		if err := json.Unmarshal(u.EquivalentDomains, &equivalent); err != nil {
+			logger.WithError(err).WithField("user_id", u.UUID).Error("Invalid equivalent domains")
+		}
+	}
+
+	excluded := make(map[int]bool)
+	for _, t := range u.GetExcludedGlobals() {
+		excluded[t] = true
+	}
+
+	globals := make([]GlobalDomains, len(globalDomains))
+	for i, gd := range globalDomains {
+		globals[i] = gd
+		globals[i].Excluded = excluded[gd.Type]
+	}
+
+	return &Domains{
+		EquivalentDomains:       equivalent,
+		GlobalEquivalentDomains: globals,
+		Object:                  "domains",
+	}
+}
+
+// GetExcludedGlobals provides the types of the global groups excluded by the user
+func (u *User) GetExcludedGlobals() []int {
+	excluded := []int{}
+	if len(u.ExcludedGlobals) > 0 {
+		if err := json.Unmarshal(u.ExcludedGlobals, &excluded); err != nil {
+			logger.WithError(err).WithField("user_id", u.UUID).Error("Invalid excluded global domains")
+		}
+	}
+	return excluded
+}
+
+// SetDomains updates the settings of the user (domains are normalized, unknown global types ignored)
+func (u *User) SetDomains(equivalent [][]string, excludedGlobals []int) {
+	groups := [][]string{}
+	for _, group := range equivalent {
+		domains := []string{}
+		for _, d := range group {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d != "" {
+				domains = append(domains, d)
+			}
+		}
+		if len(domains) > 0 {
+			groups = append(groups, domains)
+		}
+	}
+
+	excluded := []int{}
+	for _, t := range excludedGlobals {
+		if IsGlobalDomainsType(t) {
+			excluded = append(excluded, t)
+		}
+	}
+
+	u.EquivalentDomains, _ = json.Marshal(groups)
+	u.ExcludedGlobals, _ = json.Marshal(excluded)
 }
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSetDomains(t *testing.T) {
+	u := &User{UUID: "user"}
+	u.SetDomains([][]string{{" Example.com ", "", "example.org"}, {" "}}, []int{1, 3, 99999})
+
+	d := u.GetDomains()
+	if !reflect.DeepEqual(d.EquivalentDomains, [][]string{{"example.com", "example.org"}}) {
+		t.Errorf("unexpected equivalent domains %v", d.EquivalentDomains)
+	}
+	if !reflect.DeepEqual(u.GetExcludedGlobals(), []int{1, 3}) {
+		t.Errorf("unexpected excluded globals %v", u.GetExcludedGlobals())
+	}
+	if len(d.GlobalEquivalentDomains) != len(globalDomains) || d.Object != "domains" {
+		t.Fatalf("unexpected global domains %v", d)
+	}
+	for _, gd := range d.GlobalEquivalentDomains {
+		if gd.Excluded != (gd.Type == 1 || gd.Type == 3) {
+			t.Errorf("group %d excluded: %t", gd.Type, gd.Excluded)
+		}
+	}
+	// The dataset is not altered by the settings of a user
+	for _, gd := range globalDomains {
+		if gd.Excluded {
+			t.Errorf("group %d of the dataset excluded", gd.Type)
+		}
+	}
+
+	empty := (&User{}).GetDomains()
+	if empty.EquivalentDomains == nil || len(empty.EquivalentDomains) != 0 {
+		t.Errorf("unexpected equivalent domains without settings %v", empty.EquivalentDomains)
+	}
+}
+
+func TestDatastoreDomains(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db store) {
+		ctx := context.Background()
+		u := &User{UUID: "user", Email: "user@example.com"}
+		if err := db.Insert(u); err != nil {
+			t.Fatal(err)
+		}
+
+		u.SetDomains([][]string{{"example.com", "example.org"}}, []int{2})
+		if err := db.SaveUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := db.GetUser(ctx, u.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(saved.GetDomains(), u.GetDomains()) || !reflect.DeepEqual(saved.GetExcludedGlobals(), []int{2}) {
+			t.Errorf("the settings are not saved: %v", saved.GetDomains())
+		}
+
+		// Nothing excluded anymore
+		saved.SetDomains(nil, nil)
+		if err := db.SaveUser(ctx, saved); err != nil {
+			t.Fatal(err)
+		}
+		if saved, _ = db.GetUser(ctx, u.UUID); len(saved.GetExcludedGlobals()) != 0 || len(saved.GetDomains().EquivalentDomains) != 0 {
+			t.Errorf("the settings are not cleared: %v", saved.GetDomains())
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types as defined by Bitwarden (EventType enum)
+const (
+	EventUserLoggedIn            = 1000
+	EventUserChangedPassword     = 1001
+	EventUserFailedLogIn         = 1005
+	EventUserClientExportedVault = 1007
+	EventCipherCreated           = 1100
+	EventCipherUpdated           = 1101
+	EventCipherDeleted           = 1102
+	EventCipherAttachmentCreated = 1103
+	EventCipherAttachmentDeleted = 1104
+	EventCipherClientViewed      = 1107
+	EventCipherShared            = 1105
+	EventCipherClientCopied      = 1111
+	EventCipherSoftDeleted       = 1115
+	EventCipherRestored          = 1116
+)
+
+// Event types specific to gotwarden (no Bitwarden equivalent)
+const (
+	EventFolderCreated = 1910
+	EventFolderUpdated = 1911
+	EventFolderDeleted = 1912
+	EventDeviceAdded   = 1920
+
+	EventAdminLoggedIn         = 1950
+	EventAdminFailedLogIn      = 1951
+	EventAdminUserDisabled     = 1952
+	EventAdminUserEnabled      = 1953
+	EventAdminUserDeauthorized = 1954
+	EventAdminUserDeleted      = 1955
+	EventAdminUserInvited      = 1956
+	EventAdminSMTPTested       = 1957
+)
+
+// AdminEventTypes are the events recorded for the actions of the admins
+var AdminEventTypes = []int{
+	EventAdminLoggedIn,
+	EventAdminFailedLogIn,
+	EventAdminUserDisabled,
+	EventAdminUserEnabled,
+	EventAdminUserDeauthorized,
+	EventAdminUserDeleted,
+	EventAdminUserInvited,
+	EventAdminSMTPTested,
+}
+
+// EventsPageSize is the maximum number of events sent back at once
+const EventsPageSize = 100
+
+// eventsDefaultPeriod is the period covered when no start date is provided
+const eventsDefaultPeriod = 30 * 24 * time.Hour
+
+// ErrInvalidContinuationToken is returned when the paging token cannot be decoded
+var ErrInvalidContinuationToken = errors.New("invalid continuation token")
+
+// Event is an audit record of an action made on the server. The admins are not users, their actions only have
+// the user they apply to as target
+type Event struct {
+	UUID             string    `db:"uuid"`
+	Type             int       `db:"type"`
+	UserUUID         string    `db:"user_uuid"`
+	ActingUserUUID   string    `db:"acting_user_uuid"`
+	TargetUserUUID   string    `db:"target_user_uuid"`
+	OrganizationUUID string    `db:"organization_uuid"`
+	CipherUUID       string    `db:"cipher_uuid"`
+	FolderUUID       string    `db:"folder_uuid"`
+	DeviceUUID       string    `db:"device_uuid"`
+	DeviceType       int       `db:"device_type"`
+	IPAddress        string    `db:"ip_address"`
+	Date             time.Time `db:"date"`
+}
+
+// EventObject is the event as expected by the Bitwarden clients
+type EventObject struct {
+	Type           int
+	UserID         *string `json:"UserId"`
+	OrganizationID *string `json:"OrganizationId"`
+	CipherID       *string `json:"CipherId"`
+	FolderID       *string `json:"FolderId"`
+	ActingUserID   *string `json:"ActingUserId"`
+	Date           string
+	DeviceType     *int
+	IPAddress      *string `json:"IpAddress"`
+	Object         string
+}
+
+// EventFilter selects a page of events
+type EventFilter struct {
+	UserUUID          string
+	OrganizationUUID  string
+	CipherUUID        string
+	Types             []int
+	Start             time.Time
+	End               time.Time
+	ContinuationToken string
+}
+
+// AddEvent persists an event
+func (db *DB) AddEvent(ctx context.Context, e *Event) error {
+	return db.executor(ctx).Insert(e)
+}
+
+// GetEvents gets a page of events (most recent first) and the token to get the next page
+func (db *DB) GetEvents(ctx context.Context, filter *EventFilter) (*[]Event, string, error) {
+	var events []Event
+
+	query := []string{"date >= ?", "date < ?"}
+	args := []interface{}{filter.Start.UTC(), filter.End.UTC()}
+
+	if filter.UserUUID != "" {
+		query = append(query, "(user_uuid=? OR acting_user_uuid=?)")
+		args = append(args, filter.UserUUID, filter.UserUUID)
+	}
+	if filter.OrganizationUUID != "" {
+		query = append(query, "organization_uuid=?")
+		args = append(args, filter.OrganizationUUID)
+	}
+	if filter.CipherUUID != "" {
+		query = append(query, "cipher_uuid=?")
+		args = append(args, filter.CipherUUID)
+	}
+	if len(filter.Types) > 0 {
+		placeholders := make([]string, len(filter.Types))
+		for i, t := range filter.Types {
+			placeholders[i] = "?"
+			args = append(args, t)
+		}
+		query = append(query, "type IN ("+strings.Join(placeholders, ",")+")")
+	}
+	if filter.ContinuationToken != "" {
+		date, uuid, err := decodeContinuationToken(filter.ContinuationToken)
+		if err != nil {
+			return nil, "", err
+		}
+		query = append(query, "(date < ? OR (date = ? AND uuid < ?))")
+		args = append(args, date, date, uuid)
+	}
+
+	// Ask one more event to know if there is a next page
+	_, err := db.executor(ctx).Select(&events,
+		"SELECT * FROM events WHERE "+strings.Join(query, " AND ")+" ORDER BY date DESC, uuid DESC LIMIT "+strconv.Itoa(EventsPageSize+1),
+		args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := ""
+	if len(events) > EventsPageSize {
+		events = events[:EventsPageSize]
+		last := events[len(events)-1]
+		token = encodeContinuationToken(last.Date, last.UUID)
+	}
+	return &events, token, nil
+}
+
+// NewEventFilter creates a filter for the period provided (default is the last 30 days)
+func NewEventFilter(start, end, token string) (*EventFilter, error) {
+	filter := &EventFilter{
+		End:               time.Now().UTC(),
+		ContinuationToken: token,
+	}
+	if end != "" {
+		t, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			return nil, err
+		}
+		filter.End = t
+	}
+	filter.Start = filter.End.Add(-eventsDefaultPeriod)
+	if start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, err
+		}
+		filter.Start = t
+	}
+	return filter, nil
+}
+
+func encodeContinuationToken(date time.Time, uuid string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(date.UTC().Format(time.RFC3339Nano) + "|" + uuid))
+}
+
+func decodeContinuationToken(token string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidContinuationToken
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", ErrInvalidContinuationToken
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", ErrInvalidContinuationToken
+	}
+	return date.UTC(), parts[1], nil
+}
+
+// Jsonify creates object ready to send back
+func (e *Event) Jsonify() *EventObject {
+	eo := &EventObject{
+		Type:           e.Type,
+		UserID:         nullable(e.UserUUID),
+		OrganizationID: nullable(e.OrganizationUUID),
+		CipherID:       nullable(e.CipherUUID),
+		FolderID:       nullable(e.FolderUUID),
+		ActingUserID:   nullable(e.ActingUserUUID),
+		Date:           e.Date.Format(time.RFC3339Nano),
+		IPAddress:      nullable(e.IPAddress),
+		Object:         "event",
+	}
+	if e.DeviceUUID != "" {
+		eo.DeviceType = &e.DeviceType
+	}
+	return eo
+}
+
+// nullable sends back nil for empty string (ie null into json)
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -1,7 +1,7 @@
 package models
 
 import (
-	"log"
+	"context"
 	"time"
 )
 
@@ -15,59 +15,51 @@ type Folder struct {
 }
 
 // AllFolders gets all the folders for this user
-func (db *DB) AllFolders() (*[]Folder, error) {
+func (db *DB) AllFolders(ctx context.Context) (*[]Folder, error) {
 	var folders []Folder
-	_, err := db.Select(&folders, "SELECT * FROM folders")
+	_, err := db.executor(ctx).Select(&folders, "SELECT * FROM folders")
 
 	return &folders, err
 }
 
 // GetFoldersByUserUUID gets all the folders for this user
-func (db *DB) GetFoldersByUserUUID(uuid string) (*[]Folder, error) {
+func (db *DB) GetFoldersByUserUUID(ctx context.Context, uuid string) (*[]Folder, error) {
 	var folders []Folder
-	_, err := db.Select(&folders, "SELECT * FROM folders WHERE user_uuid=?", uuid)
+	_, err := db.executor(ctx).Select(&folders, "SELECT * FROM folders WHERE user_uuid=?", uuid)
 
 	return &folders, err
 }
 
 // GetFolder gets folder data from database
-func (db *DB) GetFolder(uuid string) *Folder {
-	obj, err := db.DbMap.Get(Folder{}, uuid)
-
+func (db *DB) GetFolder(ctx context.Context, uuid string) (*Folder, error) {
+	obj, err := db.get(ctx, Folder{}, uuid)
 	if err != nil {
-		log.Printf("Failed to get the folder %s", uuid)
-		return nil
+		return nil, err
 	}
-	f := obj.(*Folder)
-	return f
+	return obj.(*Folder), nil
 }
 
 // AddFolder saves a new f
-func (db *DB) AddFolder(f *Folder) error {
-	return db.Insert(f)
+func (db *DB) AddFolder(ctx context.Context, f *Folder) error {
+	return db.executor(ctx).Insert(f)
 }
 
 // SaveFolder updates existing f
-func (db *DB) SaveFolder(f *Folder) error {
-	_, err := db.Update(f)
+func (db *DB) SaveFolder(ctx context.Context, f *Folder) error {
+	_, err := db.executor(ctx).Update(f)
 	return err
 }
 
-// DeleteFolder deletes f provided
-func (db *DB) DeleteFolder(f *Folder) error {
-
-	// Remove all the reference into the ciphers
-	ciphers, err := db.GetCiphersByFolderUUID(f.UUID)
-	if err != nil {
-		log.Printf("Impossible to get ciphers for this uuid and to deference it")
+// DeleteFolder deletes f provided (its ciphers are kept out of any folder)
+func (db *DB) DeleteFolder(ctx context.Context, f *Folder) error {
+	return db.transaction(ctx, func(tx *DB) error {
+		// Remove all the reference into the ciphers
+		if _, err := tx.executor(ctx).Exec("UPDATE ciphers SET folder_uuid='' WHERE folder_uuid=?", f.UUID); err != nil {
+			return err
+		}
+		_, err := tx.executor(ctx).Delete(f)
 		return err
-	}
-	for _, cipher := range *ciphers {
-		cipher.FolderUUID = ""
-		db.SaveCipher(&cipher)
-	}
-	_, err = db.Delete(f)
-	return err
+	})
 }
 
 // Jsonify creates object ready to send back
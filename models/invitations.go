@@ -0,0 +1,32 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Invitation allows an email to register when signups are closed
+type Invitation struct {
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// GetInvitation gets the invitation sent to this email
+func (db *DB) GetInvitation(ctx context.Context, email string) (*Invitation, error) {
+	obj, err := db.get(ctx, Invitation{}, email)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*Invitation), nil
+}
+
+// AddInvitation persists a new invitation
+func (db *DB) AddInvitation(ctx context.Context, i *Invitation) error {
+	return db.executor(ctx).Insert(i)
+}
+
+// DeleteInvitation deletes the invitation (ie once used)
+func (db *DB) DeleteInvitation(ctx context.Context, i *Invitation) error {
+	_, err := db.executor(ctx).Delete(i)
+	return err
+}
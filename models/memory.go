@@ -0,0 +1,1002 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB is a Datastore keeping the data in memory (lost when the process stops), for the tests and the ephemeral instances
+type MemoryDB struct {
+	mu   *sync.RWMutex
+	data *memoryData
+	// tx is true into a unit of work (the lock is already held)
+	tx bool
+}
+
+// memoryData are the tables of the store
+type memoryData struct {
+	users             *table[User]
+	devices           *table[Device]
+	folders           *table[Folder]
+	ciphers           *table[CipherData]
+	attachments       *table[AttachmentData]
+	events            *table[Event]
+	organizations     *table[Organization]
+	organizationUsers *table[OrganizationUser]
+	invitations       *table[Invitation]
+	collections       *table[Collection]
+	collectionCiphers *table[CollectionCipher]
+	collectionUsers   *table[CollectionUser]
+}
+
+// row is a record with its insertion sequence
+type row[V any] struct {
+	seq   int64
+	value V
+}
+
+// table keeps the records by primary key, listed in their insertion order (like the rowid of SQLite)
+type table[V any] struct {
+	rows map[string]row[V]
+	seq  int64
+}
+
+func newTable[V any]() *table[V] {
+	return &table[V]{rows: make(map[string]row[V])}
+}
+
+func (t *table[V]) get(key string) (V, bool) {
+	r, ok := t.rows[key]
+	return r.value, ok
+}
+
+// insert adds the record (error if the key already exists, like a primary key constraint)
+func (t *table[V]) insert(key string, v V) error {
+	if _, ok := t.rows[key]; ok {
+		return fmt.Errorf("duplicate key %q", key)
+	}
+	t.seq++
+	t.rows[key] = row[V]{seq: t.seq, value: v}
+	return nil
+}
+
+// update replaces the record if it exists
+func (t *table[V]) update(key string, v V) {
+	if r, ok := t.rows[key]; ok {
+		r.value = v
+		t.rows[key] = r
+	}
+}
+
+func (t *table[V]) delete(key string) {
+	delete(t.rows, key)
+}
+
+// list provides the records matching keep (all if nil) in their insertion order
+func (t *table[V]) list(keep func(v *V) bool) []V {
+	rows := make([]row[V], 0, len(t.rows))
+	for _, r := range t.rows {
+		if keep == nil || keep(&r.value) {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].seq < rows[j].seq })
+
+	values := make([]V, len(rows))
+	for i, r := range rows {
+		values[i] = r.value
+	}
+	return values
+}
+
+// deleteWhere deletes the records matching the condition
+func (t *table[V]) deleteWhere(match func(v *V) bool) {
+	for key, r := range t.rows {
+		if match(&r.value) {
+			delete(t.rows, key)
+		}
+	}
+}
+
+func (t *table[V]) clone() *table[V] {
+	c := &table[V]{rows: make(map[string]row[V], len(t.rows)), seq: t.seq}
+	for key, r := range t.rows {
+		c.rows[key] = r
+	}
+	return c
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		users:             d.users.clone(),
+		devices:           d.devices.clone(),
+		folders:           d.folders.clone(),
+		ciphers:           d.ciphers.clone(),
+		attachments:       d.attachments.clone(),
+		events:            d.events.clone(),
+		organizations:     d.organizations.clone(),
+		organizationUsers: d.organizationUsers.clone(),
+		invitations:       d.invitations.clone(),
+		collections:       d.collections.clone(),
+		collectionCiphers: d.collectionCiphers.clone(),
+		collectionUsers:   d.collectionUsers.clone(),
+	}
+}
+
+// NewMemoryDB creates an empty in-memory store
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		mu: &sync.RWMutex{},
+		data: &memoryData{
+			users:             newTable[User](),
+			devices:           newTable[Device](),
+			folders:           newTable[Folder](),
+			ciphers:           newTable[CipherData](),
+			attachments:       newTable[AttachmentData](),
+			events:            newTable[Event](),
+			organizations:     newTable[Organization](),
+			organizationUsers: newTable[OrganizationUser](),
+			invitations:       newTable[Invitation](),
+			collections:       newTable[Collection](),
+			collectionCiphers: newTable[CollectionCipher](),
+			collectionUsers:   newTable[CollectionUser](),
+		},
+	}
+}
+
+func pairKey(a, b string) string {
+	return a + "|" + b
+}
+
+// read runs fn with the tables locked for reading
+func (m *MemoryDB) read(ctx context.Context, fn func(d *memoryData) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !m.tx {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+	}
+	return fn(m.data)
+}
+
+// write runs fn with the tables locked for writing (fn must not fail after a first change, use transaction otherwise)
+func (m *MemoryDB) write(ctx context.Context, fn func(d *memoryData) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !m.tx {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	return fn(m.data)
+}
+
+// transaction runs fn on a copy of the tables, kept only if fn succeeds (the one already opened if nested)
+func (m *MemoryDB) transaction(ctx context.Context, fn func(tx *MemoryDB) error) error {
+	if m.tx {
+		return fn(m)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &MemoryDB{mu: m.mu, data: m.data.clone(), tx: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// Like database/sql, the transaction is rolled back if the context is cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	*m.data = *tx.data
+	return nil
+}
+
+// WithTx runs fn into a transaction (the one already opened if nested)
+func (m *MemoryDB) WithTx(ctx context.Context, fn func(Datastore) error) error {
+	return m.transaction(ctx, func(tx *MemoryDB) error {
+		return fn(tx)
+	})
+}
+
+// Insert adds the records whatever their type (like gorp, ie to load fixtures)
+func (m *MemoryDB) Insert(list ...interface{}) error {
+	return m.transaction(context.Background(), func(tx *MemoryDB) error {
+		d := tx.data
+		for _, i := range list {
+			var err error
+			switch r := i.(type) {
+			case *User:
+				err = d.users.insert(r.UUID, storedUser(r))
+			case *Device:
+				err = d.devices.insert(r.UUID, *r)
+			case *Folder:
+				err = d.folders.insert(r.UUID, storedFolder(r))
+			case *CipherData:
+				err = d.ciphers.insert(r.UUID, storedCipher(r))
+			case *AttachmentData:
+				err = d.attachments.insert(r.UUID, *r)
+			case *Event:
+				err = d.events.insert(r.UUID, *r)
+			case *Organization:
+				err = d.organizations.insert(r.UUID, *r)
+			case *OrganizationUser:
+				err = d.organizationUsers.insert(r.UUID, *r)
+			case *Invitation:
+				err = d.invitations.insert(r.Email, *r)
+			case *Collection:
+				err = d.collections.insert(r.UUID, *r)
+			case *CollectionCipher:
+				err = d.collectionCiphers.insert(pairKey(r.CollectionUUID, r.CipherUUID), *r)
+			case *CollectionUser:
+				err = d.collectionUsers.insert(pairKey(r.CollectionUUID, r.UserUUID), *r)
+			default:
+				err = fmt.Errorf("no table for the type %T", i)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The fields which are not columns are not stored
+
+func storedUser(u *User) User {
+	s := *u
+	s.TwoFactorEnabled = false
+	s.Organizations = nil
+	s.Object = ""
+	return s
+}
+
+func storedFolder(f *Folder) Folder {
+	s := *f
+	s.Object = ""
+	return s
+}
+
+func storedCipher(cd *CipherData) CipherData {
+	s := *cd
+	s.Attachments = nil
+	s.CollectionUUIDs = nil
+	return s
+}
+
+// AllUsers get all the users
+func (m *MemoryDB) AllUsers(ctx context.Context) (*[]User, error) {
+	var uu []User
+	err := m.read(ctx, func(d *memoryData) error {
+		uu = d.users.list(nil)
+		return nil
+	})
+	return &uu, err
+}
+
+// AddUser persistes the User provided
+func (m *MemoryDB) AddUser(ctx context.Context, user *User) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.users.insert(user.UUID, storedUser(user))
+	})
+}
+
+// GetUserFromEmail get a user
+func (m *MemoryDB) GetUserFromEmail(ctx context.Context, email string) (*User, error) {
+	var u *User
+	err := m.read(ctx, func(d *memoryData) error {
+		uu := d.users.list(func(u *User) bool { return u.Email == email })
+		if len(uu) == 0 {
+			return ErrNotFound
+		}
+		u = &uu[0]
+		return nil
+	})
+	return u, err
+}
+
+// GetUser get a user
+func (m *MemoryDB) GetUser(ctx context.Context, uuid string) (*User, error) {
+	var u User
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if u, ok = d.users.get(uuid); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.Object = "profile"
+	u.TwoFactorEnabled = u.TotpSecret != ""
+	return &u, nil
+}
+
+// SaveUser updates uuid user with the value into user provided
+func (m *MemoryDB) SaveUser(ctx context.Context, u *User) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.users.update(u.UUID, storedUser(u))
+		return nil
+	})
+}
+
+// TouchUser updates the revision date of the user (ie its vault changed)
+func (m *MemoryDB) TouchUser(ctx context.Context, uuid string) error {
+	return m.write(ctx, func(d *memoryData) error {
+		if u, ok := d.users.get(uuid); ok {
+			u.RevisionDate = time.Now().UTC()
+			d.users.update(uuid, u)
+		}
+		return nil
+	})
+}
+
+// TouchOrganizationUsers updates the revision date of the confirmed members of the organization
+func (m *MemoryDB) TouchOrganizationUsers(ctx context.Context, orgUUID string) error {
+	return m.write(ctx, func(d *memoryData) error {
+		now := time.Now().UTC()
+		for _, ou := range d.organizationUsers.list(func(ou *OrganizationUser) bool {
+			return ou.OrganizationUUID == orgUUID && ou.Status == OrganizationUserConfirmed
+		}) {
+			if u, ok := d.users.get(ou.UserUUID); ok {
+				u.RevisionDate = now
+				d.users.update(u.UUID, u)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteUser deletes the user and all its data (devices, folders, ciphers and attachments). The ciphers the user
+// shared stay into their organization, without owner
+func (m *MemoryDB) DeleteUser(ctx context.Context, u *User) error {
+	return m.transaction(ctx, func(tx *MemoryDB) error {
+		d := tx.data
+		for _, cd := range d.ciphers.list(func(cd *CipherData) bool { return cd.UserUUID == u.UUID }) {
+			if cd.OrganizationUUID == "" {
+				d.deleteCipher(cd.UUID)
+				continue
+			}
+			cd.UserUUID, cd.FolderUUID = "", ""
+			d.ciphers.update(cd.UUID, cd)
+		}
+		d.folders.deleteWhere(func(f *Folder) bool { return f.UserUUID == u.UUID })
+		d.devices.deleteWhere(func(dev *Device) bool { return dev.UserUUID == u.UUID })
+		d.collectionUsers.deleteWhere(func(cu *CollectionUser) bool { return cu.UserUUID == u.UUID })
+		d.organizationUsers.deleteWhere(func(ou *OrganizationUser) bool { return ou.UserUUID == u.UUID })
+		d.users.delete(u.UUID)
+		return nil
+	})
+}
+
+// GetStorageByUser gets the size of the attachments stored for each user
+func (m *MemoryDB) GetStorageByUser(ctx context.Context) (map[string]int64, error) {
+	storage := make(map[string]int64)
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, a := range d.attachments.list(nil) {
+			if cd, ok := d.ciphers.get(a.CipherUUID); ok {
+				storage[cd.UserUUID] += int64(a.Size)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// GetInvitation gets the invitation sent to this email
+func (m *MemoryDB) GetInvitation(ctx context.Context, email string) (*Invitation, error) {
+	var i Invitation
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if i, ok = d.invitations.get(email); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// AddInvitation persists a new invitation
+func (m *MemoryDB) AddInvitation(ctx context.Context, i *Invitation) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.invitations.insert(i.Email, *i)
+	})
+}
+
+// DeleteInvitation deletes the invitation (ie once used)
+func (m *MemoryDB) DeleteInvitation(ctx context.Context, i *Invitation) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.invitations.delete(i.Email)
+		return nil
+	})
+}
+
+// AllDevices get all the devices
+func (m *MemoryDB) AllDevices(ctx context.Context) (*[]Device, error) {
+	var dd []Device
+	err := m.read(ctx, func(d *memoryData) error {
+		dd = d.devices.list(nil)
+		return nil
+	})
+	return &dd, err
+}
+
+// GetDevice get device for specific uuid identifier
+func (m *MemoryDB) GetDevice(ctx context.Context, uuid string) (*Device, error) {
+	var dev Device
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if dev, ok = d.devices.get(uuid); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// GetDeviceFromToken get device for specific token
+func (m *MemoryDB) GetDeviceFromToken(ctx context.Context, token string) (*Device, error) {
+	var dev *Device
+	err := m.read(ctx, func(d *memoryData) error {
+		dd := d.devices.list(func(dev *Device) bool { return dev.AccessToken == token })
+		if len(dd) == 0 {
+			return ErrNotFound
+		}
+		dev = &dd[0]
+		return nil
+	})
+	return dev, err
+}
+
+// AddDevice persiste an object Device
+func (m *MemoryDB) AddDevice(ctx context.Context, device *Device) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.devices.insert(device.UUID, *device)
+	})
+}
+
+// SaveDevice updates uuid device with the value into device provided
+func (m *MemoryDB) SaveDevice(ctx context.Context, device *Device) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.devices.update(device.UUID, *device)
+		return nil
+	})
+}
+
+// GetDevicesByUserUUID gets all the devices of the user
+func (m *MemoryDB) GetDevicesByUserUUID(ctx context.Context, uuid string) (*[]Device, error) {
+	var dd []Device
+	err := m.read(ctx, func(d *memoryData) error {
+		dd = d.devices.list(func(dev *Device) bool { return dev.UserUUID == uuid })
+		return nil
+	})
+	return &dd, err
+}
+
+// GetFolder gets folder data from database
+func (m *MemoryDB) GetFolder(ctx context.Context, uuid string) (*Folder, error) {
+	var f Folder
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if f, ok = d.folders.get(uuid); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetFoldersByUserUUID gets all the folders for this user
+func (m *MemoryDB) GetFoldersByUserUUID(ctx context.Context, uuid string) (*[]Folder, error) {
+	var folders []Folder
+	err := m.read(ctx, func(d *memoryData) error {
+		folders = d.folders.list(func(f *Folder) bool { return f.UserUUID == uuid })
+		return nil
+	})
+	return &folders, err
+}
+
+// AllFolders gets all the folders
+func (m *MemoryDB) AllFolders(ctx context.Context) (*[]Folder, error) {
+	var folders []Folder
+	err := m.read(ctx, func(d *memoryData) error {
+		folders = d.folders.list(nil)
+		return nil
+	})
+	return &folders, err
+}
+
+// AddFolder saves a new f
+func (m *MemoryDB) AddFolder(ctx context.Context, f *Folder) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.folders.insert(f.UUID, storedFolder(f))
+	})
+}
+
+// SaveFolder updates existing f
+func (m *MemoryDB) SaveFolder(ctx context.Context, f *Folder) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.folders.update(f.UUID, storedFolder(f))
+		return nil
+	})
+}
+
+// DeleteFolder deletes f provided (its ciphers are kept out of any folder)
+func (m *MemoryDB) DeleteFolder(ctx context.Context, f *Folder) error {
+	return m.write(ctx, func(d *memoryData) error {
+		for _, cd := range d.ciphers.list(func(cd *CipherData) bool { return cd.FolderUUID == f.UUID }) {
+			cd.FolderUUID = ""
+			d.ciphers.update(cd.UUID, cd)
+		}
+		d.folders.delete(f.UUID)
+		return nil
+	})
+}
+
+// AllCiphers gets all the ciphers
+func (m *MemoryDB) AllCiphers(ctx context.Context) (*[]CipherData, error) {
+	var ciphers []CipherData
+	err := m.read(ctx, func(d *memoryData) error {
+		ciphers = d.ciphers.list(nil)
+		return nil
+	})
+	return &ciphers, err
+}
+
+// AddCipher saves a new cipher
+func (m *MemoryDB) AddCipher(ctx context.Context, cipher *CipherData) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.ciphers.insert(cipher.UUID, storedCipher(cipher))
+	})
+}
+
+// GetCiphersByUserUUID gets all the ciphers for this user with their attachments and collections
+func (m *MemoryDB) GetCiphersByUserUUID(ctx context.Context, uuid string) (*[]CipherData, error) {
+	var ciphers []CipherData
+	err := m.read(ctx, func(d *memoryData) error {
+		ciphers = d.ciphers.list(func(cd *CipherData) bool { return d.canAccessCipher(uuid, cd, false) })
+
+		index := make(map[string]*CipherData, len(ciphers))
+		for i := range ciphers {
+			index[ciphers[i].UUID] = &ciphers[i]
+		}
+		// The content of the files is not needed to list the attachments
+		for _, a := range d.attachments.list(nil) {
+			if cd, ok := index[a.CipherUUID]; ok {
+				a.File = nil
+				cd.Attachments = append(cd.Attachments, a)
+			}
+		}
+		for _, l := range d.collectionCiphers.list(nil) {
+			if cd, ok := index[l.CipherUUID]; ok {
+				cd.CollectionUUIDs = append(cd.CollectionUUIDs, l.CollectionUUID)
+			}
+		}
+		for i := range ciphers {
+			ciphers[i].ReadOnly = !d.canAccessCipher(uuid, &ciphers[i], true)
+		}
+		return nil
+	})
+	return &ciphers, err
+}
+
+// GetCiphersByFolderUUID gets all the ciphers of the folder
+func (m *MemoryDB) GetCiphersByFolderUUID(ctx context.Context, uuid string) (*[]CipherData, error) {
+	var ciphers []CipherData
+	err := m.read(ctx, func(d *memoryData) error {
+		ciphers = d.ciphers.list(func(cd *CipherData) bool { return cd.FolderUUID == uuid })
+		return nil
+	})
+	return &ciphers, err
+}
+
+// SaveCipher updates existing cipher
+func (m *MemoryDB) SaveCipher(ctx context.Context, cipher *CipherData) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.ciphers.update(cipher.UUID, storedCipher(cipher))
+		return nil
+	})
+}
+
+// DeleteCipher deletes cipher provided with its attachments
+func (m *MemoryDB) DeleteCipher(ctx context.Context, cipher *CipherData) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.deleteCipher(cipher.UUID)
+		return nil
+	})
+}
+
+// deleteCipher deletes the cipher, its attachments and its links to the collections
+func (d *memoryData) deleteCipher(uuid string) {
+	d.attachments.deleteWhere(func(a *AttachmentData) bool { return a.CipherUUID == uuid })
+	d.collectionCiphers.deleteWhere(func(l *CollectionCipher) bool { return l.CipherUUID == uuid })
+	d.ciphers.delete(uuid)
+}
+
+// GetCipher gets a specific cipher
+func (m *MemoryDB) GetCipher(ctx context.Context, uuid string) (*CipherData, error) {
+	var cd CipherData
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if cd, ok = d.ciphers.get(uuid); !ok {
+			return ErrCipherNotFound
+		}
+		cd.Attachments = d.attachments.list(func(a *AttachmentData) bool { return a.CipherUUID == uuid })
+		for _, l := range d.collectionCiphers.list(func(l *CollectionCipher) bool { return l.CipherUUID == uuid }) {
+			cd.CollectionUUIDs = append(cd.CollectionUUIDs, l.CollectionUUID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cd, nil
+}
+
+// confirmedMember gets the membership of the user if he is confirmed into the organization
+func (d *memoryData) confirmedMember(orgUUID, userUUID string) (OrganizationUser, bool) {
+	members := d.organizationUsers.list(func(ou *OrganizationUser) bool {
+		return ou.OrganizationUUID == orgUUID && ou.UserUUID == userUUID && ou.Status == OrganizationUserConfirmed
+	})
+	if len(members) == 0 {
+		return OrganizationUser{}, false
+	}
+	return members[0], true
+}
+
+// canAccessCipher tells if the user owns the cipher or has access to it through his organizations
+// (only the collections he can modify if write)
+func (d *memoryData) canAccessCipher(userUUID string, cd *CipherData, write bool) bool {
+	if cd.UserUUID == userUUID {
+		return true
+	}
+	if cd.OrganizationUUID != "" {
+		if ou, ok := d.confirmedMember(cd.OrganizationUUID, userUUID); ok && ou.AccessAll {
+			return true
+		}
+	}
+	for _, l := range d.collectionCiphers.list(func(l *CollectionCipher) bool { return l.CipherUUID == cd.UUID }) {
+		cu, ok := d.collectionUsers.get(pairKey(l.CollectionUUID, userUUID))
+		if !ok || (write && cu.ReadOnly) {
+			continue
+		}
+		c, ok := d.collections.get(l.CollectionUUID)
+		if !ok {
+			continue
+		}
+		if _, ok := d.confirmedMember(c.OrganizationUUID, userUUID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessCipher tells if the user owns the cipher or has access to it through his organizations
+func (m *MemoryDB) CanAccessCipher(ctx context.Context, userUUID, cipherUUID string, write bool) (bool, error) {
+	access := false
+	err := m.read(ctx, func(d *memoryData) error {
+		if cd, ok := d.ciphers.get(cipherUUID); ok {
+			access = d.canAccessCipher(userUUID, &cd, write)
+		}
+		return nil
+	})
+	return access, err
+}
+
+// updateCiphers applies the change to each cipher in one transaction (nothing done if the user cannot modify one of them,
+// or doesn't own it when ownerOnly)
+func (m *MemoryDB) updateCiphers(ctx context.Context, userUUID string, uuids []string, ownerOnly bool, apply func(d *memoryData, cd CipherData) error) error {
+	return m.transaction(ctx, func(tx *MemoryDB) error {
+		d := tx.data
+		for _, uuid := range uuids {
+			cd, ok := d.ciphers.get(uuid)
+			if !ok {
+				return ErrCipherNotFound
+			}
+			allowed := cd.UserUUID == userUUID
+			if !ownerOnly {
+				allowed = d.canAccessCipher(userUUID, &cd, true)
+			}
+			if !allowed {
+				if d.canAccessCipher(userUUID, &cd, false) {
+					return ErrCipherForbidden
+				}
+				return ErrCipherNotFound
+			}
+			if err := apply(d, cd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MoveCiphers moves the ciphers of the user into the folder (none if empty)
+func (m *MemoryDB) MoveCiphers(ctx context.Context, userUUID string, uuids []string, folderUUID string) error {
+	now := time.Now().UTC()
+	return m.updateCiphers(ctx, userUUID, uuids, true, func(d *memoryData, cd CipherData) error {
+		cd.FolderUUID = folderUUID
+		cd.UpdateAt = now
+		d.ciphers.update(cd.UUID, cd)
+		return nil
+	})
+}
+
+// SoftDeleteCiphers moves the ciphers into the trash
+func (m *MemoryDB) SoftDeleteCiphers(ctx context.Context, userUUID string, uuids []string) error {
+	now := time.Now().UTC()
+	return m.updateCiphers(ctx, userUUID, uuids, false, func(d *memoryData, cd CipherData) error {
+		deletedAt := now
+		cd.DeletedAt = &deletedAt
+		cd.UpdateAt = now
+		d.ciphers.update(cd.UUID, cd)
+		return nil
+	})
+}
+
+// RestoreCiphers gets the ciphers out of the trash
+func (m *MemoryDB) RestoreCiphers(ctx context.Context, userUUID string, uuids []string) error {
+	now := time.Now().UTC()
+	return m.updateCiphers(ctx, userUUID, uuids, false, func(d *memoryData, cd CipherData) error {
+		cd.DeletedAt = nil
+		cd.UpdateAt = now
+		d.ciphers.update(cd.UUID, cd)
+		return nil
+	})
+}
+
+// DeleteCiphers deletes definitely the ciphers with their attachments
+func (m *MemoryDB) DeleteCiphers(ctx context.Context, userUUID string, uuids []string) error {
+	return m.updateCiphers(ctx, userUUID, uuids, false, func(d *memoryData, cd CipherData) error {
+		d.deleteCipher(cd.UUID)
+		return nil
+	})
+}
+
+// ShareCiphers saves the ciphers of the user (encrypted with the key of their organization) into the collections
+func (m *MemoryDB) ShareCiphers(ctx context.Context, userUUID string, ciphers []*CipherData, collectionUUIDs []string) error {
+	index := make(map[string]*CipherData, len(ciphers))
+	uuids := make([]string, 0, len(ciphers))
+	for _, cd := range ciphers {
+		index[cd.UUID] = cd
+		uuids = append(uuids, cd.UUID)
+	}
+
+	return m.updateCiphers(ctx, userUUID, uuids, true, func(d *memoryData, cd CipherData) error {
+		d.ciphers.update(cd.UUID, storedCipher(index[cd.UUID]))
+		d.collectionCiphers.deleteWhere(func(l *CollectionCipher) bool { return l.CipherUUID == cd.UUID })
+		for _, collectionUUID := range collectionUUIDs {
+			l := CollectionCipher{CollectionUUID: collectionUUID, CipherUUID: cd.UUID}
+			if err := d.collectionCiphers.insert(pairKey(collectionUUID, cd.UUID), l); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetCollection gets a collection
+func (m *MemoryDB) GetCollection(ctx context.Context, uuid string) (*Collection, error) {
+	var c Collection
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if c, ok = d.collections.get(uuid); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetCollectionsByUserUUID gets the collections the user has access to
+func (m *MemoryDB) GetCollectionsByUserUUID(ctx context.Context, uuid string) (*[]CollectionObject, error) {
+	collections := []CollectionObject{}
+	err := m.read(ctx, func(d *memoryData) error {
+		for _, c := range d.collections.list(nil) {
+			ou, ok := d.confirmedMember(c.OrganizationUUID, uuid)
+			if !ok {
+				continue
+			}
+			readOnly := false
+			if !ou.AccessAll {
+				cu, ok := d.collectionUsers.get(pairKey(c.UUID, uuid))
+				if !ok {
+					continue
+				}
+				readOnly = cu.ReadOnly
+			}
+			collections = append(collections, CollectionObject{
+				UUID:             c.UUID,
+				OrganizationUUID: c.OrganizationUUID,
+				Name:             c.Name,
+				ReadOnly:         readOnly,
+				Object:           "collection",
+			})
+		}
+		return nil
+	})
+	sort.SliceStable(collections, func(i, j int) bool { return collections[i].Name < collections[j].Name })
+	return &collections, err
+}
+
+// GetAttachment gets Attachment data from database
+func (m *MemoryDB) GetAttachment(ctx context.Context, uuid string) (*AttachmentData, error) {
+	var a AttachmentData
+	err := m.read(ctx, func(d *memoryData) error {
+		var ok bool
+		if a, ok = d.attachments.get(uuid); !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AddAttachment saves a new f
+func (m *MemoryDB) AddAttachment(ctx context.Context, a *AttachmentData) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.attachments.insert(a.UUID, *a)
+	})
+}
+
+// DeleteAttachment deletes f provided
+func (m *MemoryDB) DeleteAttachment(ctx context.Context, a *AttachmentData) error {
+	return m.write(ctx, func(d *memoryData) error {
+		d.attachments.delete(a.UUID)
+		return nil
+	})
+}
+
+// AddEvent persists an event
+func (m *MemoryDB) AddEvent(ctx context.Context, e *Event) error {
+	return m.write(ctx, func(d *memoryData) error {
+		return d.events.insert(e.UUID, *e)
+	})
+}
+
+// GetEvents gets a page of events (most recent first) and the token to get the next page
+func (m *MemoryDB) GetEvents(ctx context.Context, filter *EventFilter) (*[]Event, string, error) {
+	var afterDate time.Time
+	var afterUUID string
+	if filter.ContinuationToken != "" {
+		var err error
+		if afterDate, afterUUID, err = decodeContinuationToken(filter.ContinuationToken); err != nil {
+			return nil, "", err
+		}
+	}
+	types := make(map[int]bool, len(filter.Types))
+	for _, t := range filter.Types {
+		types[t] = true
+	}
+
+	var events []Event
+	err := m.read(ctx, func(d *memoryData) error {
+		events = d.events.list(func(e *Event) bool {
+			switch {
+			case e.Date.Before(filter.Start) || !e.Date.Before(filter.End):
+				return false
+			case filter.UserUUID != "" && e.UserUUID != filter.UserUUID && e.ActingUserUUID != filter.UserUUID:
+				return false
+			case filter.OrganizationUUID != "" && e.OrganizationUUID != filter.OrganizationUUID:
+				return false
+			case filter.CipherUUID != "" && e.CipherUUID != filter.CipherUUID:
+				return false
+			case len(types) > 0 && !types[e.Type]:
+				return false
+			case filter.ContinuationToken != "":
+				return e.Date.Before(afterDate) || (e.Date.Equal(afterDate) && e.UUID < afterUUID)
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Date.Equal(events[j].Date) {
+			return events[i].Date.After(events[j].Date)
+		}
+		return strings.Compare(events[i].UUID, events[j].UUID) > 0
+	})
+
+	token := ""
+	if len(events) > EventsPageSize {
+		events = events[:EventsPageSize]
+		last := events[len(events)-1]
+		token = encodeContinuationToken(last.Date, last.UUID)
+	}
+	return &events, token, nil
+}
+
+// GetOrganizationUser gets the membership of a user into an organization
+func (m *MemoryDB) GetOrganizationUser(ctx context.Context, orgUUID, userUUID string) (*OrganizationUser, error) {
+	var ou *OrganizationUser
+	err := m.read(ctx, func(d *memoryData) error {
+		ous := d.organizationUsers.list(func(ou *OrganizationUser) bool {
+			return ou.OrganizationUUID == orgUUID && ou.UserUUID == userUUID
+		})
+		if len(ous) == 0 {
+			return ErrNotFound
+		}
+		ou = &ous[0]
+		return nil
+	})
+	return ou, err
+}
+
+// AllOrganizations gets all the organizations
+func (m *MemoryDB) AllOrganizations(ctx context.Context) (*[]Organization, error) {
+	var orgs []Organization
+	err := m.read(ctx, func(d *memoryData) error {
+		orgs = d.organizations.list(nil)
+		return nil
+	})
+	sort.SliceStable(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return &orgs, err
+}
+
+// AllOrganizationUsers gets all the memberships
+func (m *MemoryDB) AllOrganizationUsers(ctx context.Context) (*[]OrganizationUser, error) {
+	var ous []OrganizationUser
+	err := m.read(ctx, func(d *memoryData) error {
+		ous = d.organizationUsers.list(nil)
+		return nil
+	})
+	return &ous, err
+}
+
+// GetOrganizationUsers gets the memberships of an organization
+func (m *MemoryDB) GetOrganizationUsers(ctx context.Context, orgUUID string) (*[]OrganizationUser, error) {
+	var ous []OrganizationUser
+	err := m.read(ctx, func(d *memoryData) error {
+		ous = d.organizationUsers.list(func(ou *OrganizationUser) bool { return ou.OrganizationUUID == orgUUID })
+		return nil
+	})
+	return &ous, err
+}
+
+// GetSchemaVersion is always the version expected by this binary (nothing to migrate in memory)
+func (m *MemoryDB) GetSchemaVersion(ctx context.Context) (int, error) {
+	return SchemaVersion(), ctx.Err()
+}
+
+// Ping only fails if the context is done
+func (m *MemoryDB) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// CheckWritable only fails if the context is done
+func (m *MemoryDB) CheckWritable(ctx context.Context) error {
+	return ctx.Err()
+}
+
+var _ Datastore = (*MemoryDB)(nil)
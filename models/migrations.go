@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// migration upgrades the schema of a database created by a previous version
+type migration struct {
+	description string
+	up          func(db *DB) error
+}
+
+// migrations are applied in order, never remove or reorder them
+var migrations = []migration{
+	{"add users.disabled", func(db *DB) error {
+		return db.addColumn("users", "disabled", "integer not null default 0")
+	}},
+	{"add users.equivalent_domains and users.excluded_globals", func(db *DB) error {
+		if err := db.addColumn("users", "equivalent_domains", "blob"); err != nil {
+			return err
+		}
+		return db.addColumn("users", "excluded_globals", "blob")
+	}},
+	{"add users.revision_date", func(db *DB) error {
+		if err := db.addColumn("users", "revision_date", "datetime not null default '1970-01-01 00:00:00+00:00'"); err != nil {
+			return err
+		}
+		_, err := db.executor(context.Background()).Exec("UPDATE users SET revision_date=?", time.Now().UTC())
+		return err
+	}},
+	{"add ciphers.deleted_at", func(db *DB) error {
+		return db.addColumn("ciphers", "deleted_at", "datetime")
+	}},
+	{"add users.kdf_memory, users.kdf_parallelism, ciphers.cipher_key and attachments.attachment_key", func(db *DB) error {
+		for _, c := range []struct{ table, column, definition string }{
+			{"users", "kdf_memory", "integer not null default 0"},
+			{"users", "kdf_parallelism", "integer not null default 0"},
+			{"ciphers", "cipher_key", "text not null default ''"},
+			{"attachments", "attachment_key", "text not null default ''"},
+		} {
+			if err := db.addColumn(c.table, c.column, c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"add events.target_user_uuid", func(db *DB) error {
+		return db.addColumn("events", "target_user_uuid", "text not null default ''")
+	}},
+	{"fix the type of the cipher shared events", func(db *DB) error {
+		// 1108 is a client event the clients are not allowed to send, those events were recorded by /ciphers/share
+		_, err := db.executor(context.Background()).Exec("UPDATE events SET type=? WHERE type=?", EventCipherShared, 1108)
+		return err
+	}},
+}
+
+// SchemaVersion is the version of the schema expected by this binary
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// GetSchemaVersion gets the version of the schema into the database
+func (db *DB) GetSchemaVersion(ctx context.Context) (int, error) {
+	version, err := db.executor(ctx).SelectInt("SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	return int(version), err
+}
+
+// migrate applies the migrations not yet applied to the database
+func (db *DB) migrate() error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version integer not null)"); err != nil {
+		return err
+	}
+
+	current, err := db.GetSchemaVersion(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		logger.WithFields(logrus.Fields{"version": i + 1, "description": migrations[i].description}).Info("Apply migration")
+		if err := migrations[i].up(db); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", i+1, migrations[i].description, err)
+		}
+		if _, err := db.executor(context.Background()).Exec("INSERT INTO schema_version (version) VALUES (?)", i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table (nothing done if the table has already been created with it)
+func (db *DB) addColumn(table, column, definition string) error {
+	if _, err := db.Exec(fmt.Sprintf("SELECT %s FROM %s LIMIT 1", column, table)); err == nil {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
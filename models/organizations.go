@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Organization member types as defined by Bitwarden
+const (
+	OrganizationUserOwner   = 0
+	OrganizationUserAdmin   = 1
+	OrganizationUserUser    = 2
+	OrganizationUserManager = 3
+)
+
+// Organization member statuses as defined by Bitwarden
+const (
+	OrganizationUserInvited   = 0
+	OrganizationUserAccepted  = 1
+	OrganizationUserConfirmed = 2
+)
+
+// Organization shares ciphers between several users
+type Organization struct {
+	UUID         string    `db:"uuid"`
+	Name         string    `db:"name"`
+	BillingEmail string    `db:"billing_email"`
+	UpdateAt     time.Time `db:"update_at"`
+}
+
+// OrganizationUser is the membership of a user into an organization
+type OrganizationUser struct {
+	UUID             string `db:"uuid"`
+	OrganizationUUID string `db:"organization_uuid"`
+	UserUUID         string `db:"user_uuid"`
+	Type             int    `db:"type"`
+	Status           int    `db:"status"`
+	Key              string `db:"key_org"`
+	AccessAll        bool   `db:"access_all"`
+}
+
+// AllOrganizations gets all the organizations
+func (db *DB) AllOrganizations(ctx context.Context) (*[]Organization, error) {
+	var orgs []Organization
+	_, err := db.executor(ctx).Select(&orgs, "SELECT * FROM organizations ORDER BY name")
+
+	return &orgs, err
+}
+
+// AllOrganizationUsers gets all the memberships
+func (db *DB) AllOrganizationUsers(ctx context.Context) (*[]OrganizationUser, error) {
+	var ous []OrganizationUser
+	_, err := db.executor(ctx).Select(&ous, "SELECT * FROM organizations_users")
+
+	return &ous, err
+}
+
+// GetOrganizationUsers gets the memberships of an organization
+func (db *DB) GetOrganizationUsers(ctx context.Context, orgUUID string) (*[]OrganizationUser, error) {
+	var ous []OrganizationUser
+	_, err := db.executor(ctx).Select(&ous, "SELECT * FROM organizations_users WHERE organization_uuid=?", orgUUID)
+
+	return &ous, err
+}
+
+// GetOrganizationUser gets the membership of a user into an organization
+func (db *DB) GetOrganizationUser(ctx context.Context, orgUUID, userUUID string) (*OrganizationUser, error) {
+	ou := OrganizationUser{}
+
+	if err := db.selectOne(ctx, &ou, "SELECT * FROM organizations_users WHERE organization_uuid=? AND user_uuid=?", orgUUID, userUUID); err != nil {
+		return nil, err
+	}
+	return &ou, nil
+}
+
+// IsAdmin tells if the member can manage the organization
+func (ou *OrganizationUser) IsAdmin() bool {
+	return ou.Type == OrganizationUserOwner || ou.Type == OrganizationUserAdmin
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-gorp/gorp/v3"
+)
+
+// ErrNotSQLite is returned by the snapshots of the other databases
+var ErrNotSQLite = errors.New("only the SQLite databases can be snapshotted")
+
+// Snapshot writes a consistent copy of the SQLite database to the path (which must not exist),
+// the server can keep writing to the database meanwhile
+func (db *DB) Snapshot(ctx context.Context, path string) error {
+	if _, ok := db.Dialect.(gorp.SqliteDialect); !ok {
+		return ErrNotSQLite
+	}
+	_, err := db.Db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// CheckSnapshot checks the integrity of the SQLite file (opened read-only) and gets its schema version
+func CheckSnapshot(ctx context.Context, path string) (int, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return 0, fmt.Errorf("not a SQLite database: %w", err)
+	}
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("the database is corrupted: %s", strings.Join(problems, "; "))
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("not a gotwarden database: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-gorp/gorp/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("gotwarden/models")
+
+// statementTable finds the table of a statement (the first one after FROM, INTO or UPDATE)
+var statementTable = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE)\s+"?(\w+)`)
+
+// tracedExecutor records the queries as child spans of the request, named by the statement (never with the arguments)
+type tracedExecutor struct {
+	gorp.SqlExecutor
+	ctx   context.Context
+	dbmap *gorp.DbMap
+}
+
+// traced wraps the executor when the context is traced (the background jobs are not)
+func traced(ctx context.Context, dbmap *gorp.DbMap, e gorp.SqlExecutor) gorp.SqlExecutor {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return e
+	}
+	return tracedExecutor{SqlExecutor: e, ctx: ctx, dbmap: dbmap}
+}
+
+// dbSystem names the database of the dialect
+func dbSystem(dialect gorp.Dialect) attribute.KeyValue {
+	switch dialect.(type) {
+	case gorp.PostgresDialect:
+		return semconv.DBSystemPostgreSQL
+	case gorp.SqliteDialect:
+		return semconv.DBSystemSqlite
+	}
+	return semconv.DBSystemOtherSQL
+}
+
+func (e tracedExecutor) start(operation, table, statement string) trace.Span {
+	name := operation
+	if table != "" {
+		name += " " + table
+	}
+	_, span := tracer.Start(e.ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(dbSystem(e.dbmap.Dialect), semconv.DBOperationKey.String(operation)),
+	)
+	if table != "" {
+		span.SetAttributes(semconv.DBSQLTableKey.String(table))
+	}
+	if statement != "" {
+		span.SetAttributes(semconv.DBStatementKey.String(statement))
+	}
+	return span
+}
+
+// query starts the span of a SQL statement
+func (e tracedExecutor) query(query string) trace.Span {
+	statement := strings.TrimSpace(query)
+	operation := strings.ToUpper(strings.SplitN(statement, " ", 2)[0])
+	var table string
+	if m := statementTable.FindStringSubmatch(statement); m != nil {
+		table = m[1]
+	}
+	return e.start(operation, table, statement)
+}
+
+// mapped starts the span of a statement generated by gorp for the table of the record
+func (e tracedExecutor) mapped(operation string, record interface{}) trace.Span {
+	var table string
+	t := reflect.TypeOf(record)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != nil {
+		if m, err := e.dbmap.TableFor(t, false); err == nil {
+			table = m.TableName
+		}
+	}
+	return e.start(operation, table, "")
+}
+
+func end(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (e tracedExecutor) WithContext(ctx context.Context) gorp.SqlExecutor {
+	return traced(ctx, e.dbmap, e.SqlExecutor.WithContext(ctx))
+}
+
+func (e tracedExecutor) Get(i interface{}, keys ...interface{}) (obj interface{}, err error) {
+	span := e.mapped("SELECT", i)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Get(i, keys...)
+}
+
+func (e tracedExecutor) Insert(list ...interface{}) (err error) {
+	var first interface{}
+	if len(list) > 0 {
+		first = list[0]
+	}
+	span := e.mapped("INSERT", first)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Insert(list...)
+}
+
+func (e tracedExecutor) Update(list ...interface{}) (n int64, err error) {
+	var first interface{}
+	if len(list) > 0 {
+		first = list[0]
+	}
+	span := e.mapped("UPDATE", first)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Update(list...)
+}
+
+func (e tracedExecutor) Delete(list ...interface{}) (n int64, err error) {
+	var first interface{}
+	if len(list) > 0 {
+		first = list[0]
+	}
+	span := e.mapped("DELETE", first)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Delete(list...)
+}
+
+func (e tracedExecutor) Exec(query string, args ...interface{}) (res sql.Result, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Exec(query, args...)
+}
+
+func (e tracedExecutor) Select(i interface{}, query string, args ...interface{}) (list []interface{}, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Select(i, query, args...)
+}
+
+func (e tracedExecutor) SelectInt(query string, args ...interface{}) (n int64, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectInt(query, args...)
+}
+
+func (e tracedExecutor) SelectNullInt(query string, args ...interface{}) (n sql.NullInt64, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectNullInt(query, args...)
+}
+
+func (e tracedExecutor) SelectFloat(query string, args ...interface{}) (f float64, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectFloat(query, args...)
+}
+
+func (e tracedExecutor) SelectNullFloat(query string, args ...interface{}) (f sql.NullFloat64, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectNullFloat(query, args...)
+}
+
+func (e tracedExecutor) SelectStr(query string, args ...interface{}) (s string, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectStr(query, args...)
+}
+
+func (e tracedExecutor) SelectNullStr(query string, args ...interface{}) (s sql.NullString, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectNullStr(query, args...)
+}
+
+func (e tracedExecutor) SelectOne(holder interface{}, query string, args ...interface{}) (err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.SelectOne(holder, query, args...)
+}
+
+func (e tracedExecutor) Query(query string, args ...interface{}) (rows *sql.Rows, err error) {
+	span := e.query(query)
+	defer func() { end(span, err) }()
+	return e.SqlExecutor.Query(query, args...)
+}
+
+func (e tracedExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	span := e.query(query)
+	defer span.End()
+	return e.SqlExecutor.QueryRow(query, args...)
+}
@@ -1,82 +1,194 @@
 package models
 
 import (
-	"log"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 // User data structure
 type User struct {
-	UUID             string    `db:"uuid"`
-	Email            string    `db:"email"`
-	EmailVerified    bool      `db:"email_verified"`
-	Premium          bool      `db:"premium"`
-	Name             string    `db:"name"`
-	PasswordHash     string    `db:"password_hash" json:"-"`
-	PasswordHint     string    `db:"password_hint" json:"MasterPasswordHint"`
-	Key              string    `db:"key_pass"`
-	Culture          string    `db:"culture"`
-	TwoFactorEnabled bool      `db:"-"`
-	PrivateKey       []byte    `db:"private_key"`
-	PublicKey        []byte    `db:"public_key" json:"-"`
-	TotpSecret       string    `db:"totp_secret" json:"-"`
-	SecurityStamp    string    `db:"security_stamp"`
-	CreatedAt        time.Time `db:"created_at" json:"-"`
-	Kdf              int       `db:"kdf"`
-	KdfIterations    int       `db:"kdf_iterations" binding:"required"`
-	Organizations    []string  `db:"-"`
-	Object           string    `db:"-"`
+	UUID              string    `db:"uuid"`
+	Email             string    `db:"email"`
+	EmailVerified     bool      `db:"email_verified"`
+	Premium           bool      `db:"premium"`
+	Name              string    `db:"name"`
+	PasswordHash      string    `db:"password_hash" json:"-"`
+	PasswordHint      string    `db:"password_hint" json:"MasterPasswordHint"`
+	Key               string    `db:"key_pass"`
+	Culture           string    `db:"culture"`
+	TwoFactorEnabled  bool      `db:"-"`
+	PrivateKey        []byte    `db:"private_key"`
+	PublicKey         []byte    `db:"public_key" json:"-"`
+	TotpSecret        string    `db:"totp_secret" json:"-"`
+	SecurityStamp     string    `db:"security_stamp"`
+	CreatedAt         time.Time `db:"created_at" json:"-"`
+	Kdf               int       `db:"kdf"`
+	KdfIterations     int       `db:"kdf_iterations" binding:"required"`
+	KdfMemory         int       `db:"kdf_memory" json:"-"`
+	KdfParallelism    int       `db:"kdf_parallelism" json:"-"`
+	Disabled          bool      `db:"disabled" json:"-"`
+	EquivalentDomains []byte    `db:"equivalent_domains" json:"-"`
+	ExcludedGlobals   []byte    `db:"excluded_globals" json:"-"`
+	RevisionDate      time.Time `db:"revision_date" json:"-"`
+	Organizations     []string  `db:"-"`
+	Object            string    `db:"-"`
 }
 
 // AllUsers get all the users
-func (db *DB) AllUsers() (*[]User, error) {
+func (db *DB) AllUsers(ctx context.Context) (*[]User, error) {
 	uu := []User{}
 
-	_, err := db.Select(&uu, "SELECT * FROM users")
+	_, err := db.executor(ctx).Select(&uu, "SELECT * FROM users")
 
 	return &uu, err
 }
 
 // GetUser get a user
-func (db *DB) GetUser(uuid string) *User {
-	obj, err := db.DbMap.Get(User{}, uuid)
-
-	if obj == nil {
-		log.Printf("Get User error %s", err)
-		return nil
+func (db *DB) GetUser(ctx context.Context, uuid string) (*User, error) {
+	obj, err := db.get(ctx, User{}, uuid)
+	if err != nil {
+		return nil, err
 	}
 	u := obj.(*User)
 	// Add some fields
 	u.Object = "profile"
 	u.TwoFactorEnabled = u.TotpSecret != ""
-	return u
+	return u, nil
 }
 
 // SaveUser updates uuid user with the value into user provided
-func (db *DB) SaveUser(u *User) error {
-	_, err := db.Update(u)
+func (db *DB) SaveUser(ctx context.Context, u *User) error {
+	_, err := db.executor(ctx).Update(u)
 	return err
 }
 
+// DeleteUser deletes the user and all its data (devices, folders, ciphers and attachments). The ciphers the user
+// shared stay into their organization, without owner
+func (db *DB) DeleteUser(ctx context.Context, u *User) error {
+	const personal = "user_uuid=? AND (organization_uuid IS NULL OR organization_uuid='')"
+	queries := []string{
+		"DELETE FROM attachments WHERE cipher_uuid IN (SELECT uuid FROM ciphers WHERE " + personal + ")",
+		"DELETE FROM collections_ciphers WHERE cipher_uuid IN (SELECT uuid FROM ciphers WHERE " + personal + ")",
+		"DELETE FROM ciphers WHERE " + personal,
+		"UPDATE ciphers SET user_uuid='', folder_uuid='' WHERE user_uuid=?",
+		"DELETE FROM folders WHERE user_uuid=?",
+		"DELETE FROM devices WHERE user_uuid=?",
+		"DELETE FROM users_collections WHERE user_uuid=?",
+		"DELETE FROM organizations_users WHERE user_uuid=?",
+	}
+	return db.transaction(ctx, func(tx *DB) error {
+		for _, query := range queries {
+			if _, err := tx.executor(ctx).Exec(query, u.UUID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.executor(ctx).Delete(u)
+		return err
+	})
+}
+
+// GetStorageByUser gets the size of the attachments stored for each user
+func (db *DB) GetStorageByUser(ctx context.Context) (map[string]int64, error) {
+	var rows []struct {
+		UserUUID string `db:"user_uuid"`
+		Size     int64  `db:"size"`
+	}
+	_, err := db.executor(ctx).Select(&rows, "SELECT c.user_uuid AS user_uuid, SUM(a.size) AS size FROM attachments a JOIN ciphers c ON a.cipher_uuid=c.uuid GROUP BY c.user_uuid")
+	if err != nil {
+		return nil, err
+	}
+
+	storage := make(map[string]int64)
+	for _, row := range rows {
+		storage[row.UserUUID] = row.Size
+	}
+	return storage, nil
+}
+
+// TouchUser updates the revision date of the user (ie its vault changed)
+func (db *DB) TouchUser(ctx context.Context, uuid string) error {
+	_, err := db.executor(ctx).Exec("UPDATE users SET revision_date=? WHERE uuid=?", time.Now().UTC(), uuid)
+	return err
+}
+
+// TouchOrganizationUsers updates the revision date of the confirmed members of the organization (ie a cipher or a
+// collection of the organization changed)
+func (db *DB) TouchOrganizationUsers(ctx context.Context, orgUUID string) error {
+	_, err := db.executor(ctx).Exec("UPDATE users SET revision_date=? WHERE uuid IN "+
+		"(SELECT user_uuid FROM organizations_users WHERE organization_uuid=? AND status=?)",
+		time.Now().UTC(), orgUUID, OrganizationUserConfirmed)
+	return err
+}
+
+// SyncETag identifies the state of the vault of the user for the sync
+func (u *User) SyncETag(excludeDomains bool) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s|%t", u.UUID, u.RevisionDate.UnixNano(), u.SecurityStamp, excludeDomains)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
 // GetUserFromEmail get a user
-func (db *DB) GetUserFromEmail(email string) (*User, error) {
+func (db *DB) GetUserFromEmail(ctx context.Context, email string) (*User, error) {
 	u := User{}
 
-	err := db.SelectOne(&u, "SELECT * FROM users WHERE email=?", email)
-	log.Printf("GetUserFromEmail : %s", err)
-	return &u, err
+	if err := db.selectOne(ctx, &u, "SELECT * FROM users WHERE email=?", email); err != nil {
+		return nil, err
+	}
+	return &u, nil
 }
 
 // AddUser persistes the User provided
-func (db *DB) AddUser(user *User) error {
-	return db.Insert(user)
+func (db *DB) AddUser(ctx context.Context, user *User) error {
+	return db.executor(ctx).Insert(user)
+}
+
+// Key derivation functions of the master password, as defined by Bitwarden
+const (
+	KdfPBKDF2   = 0
+	KdfArgon2id = 1
+)
+
+// serverHashPrefix marks the password hashes imported from the servers hashing the master password hash
+// again, ie vaultwarden: pbkdf2-sha256$<iterations>$<base64 salt>$<base64 hash>
+const serverHashPrefix = "pbkdf2-sha256$"
+
+// ServerPasswordHash gives the hash of a server hashing the master password hash with PBKDF2-SHA256
+func ServerPasswordHash(iterations int, salt, hash []byte) string {
+	return fmt.Sprintf("%s%d$%s$%s", serverHashPrefix, iterations,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash))
 }
 
 // CheckPassword checks if password is valid
 func (u *User) CheckPassword(password string) bool {
-	return u.PasswordHash == password
+	if !strings.HasPrefix(u.PasswordHash, serverHashPrefix) {
+		return u.PasswordHash == password
+	}
+	parts := strings.Split(strings.TrimPrefix(u.PasswordHash, serverHashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2.Key([]byte(password), salt, iterations, len(hash), sha256.New), hash) == 1
 }
 
 // NewUser declares a new user
@@ -91,6 +203,9 @@ func NewUser(name, email, masterPasswordHash, masterPasswordHint, key string, kd
 		PasswordHash:  masterPasswordHash,
 		PasswordHint:  masterPasswordHint,
 		Key:           key,
+		SecurityStamp: uuid.New().String(),
+		CreatedAt:     time.Now(),
+		RevisionDate:  time.Now(),
 		Kdf:           kdf,
 		KdfIterations: kdfIterations,
 	}
@@ -0,0 +1,178 @@
+package notifications
+
+import (
+	"gotwarden/logging"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var logger = logging.For("notifications")
+
+// Update types as defined by Bitwarden
+const (
+	SyncCipherUpdate = 0
+	SyncCipherCreate = 1
+	SyncLoginDelete  = 2
+	SyncFolderDelete = 3
+	SyncCiphers      = 4
+	SyncVault        = 5
+	SyncOrgKeys      = 6
+	SyncFolderCreate = 7
+	SyncFolderUpdate = 8
+	SyncCipherDelete = 9
+	SyncSettings     = 10
+	LogOut           = 11
+)
+
+const (
+	// pingPeriod keeps the connection alive (the SignalR clients give up after 30s without message)
+	pingPeriod = 15 * time.Second
+	// writeWait is the time allowed to write a message
+	writeWait = 10 * time.Second
+	// handshakeWait is the time allowed to the client to send the handshake
+	handshakeWait = 10 * time.Second
+	// sendBuffer is the number of messages queued for a slow client before dropping them
+	sendBuffer = 16
+)
+
+// Hub keeps the websockets of the connected devices and pushes them the updates of the vaults
+type Hub struct {
+	mu       sync.RWMutex
+	conns    map[string]map[*conn]struct{}
+	upgrader websocket.Upgrader
+}
+
+// conn is the websocket of a device
+type conn struct {
+	ws       *websocket.Conn
+	protocol protocol
+	send     chan interface{}
+}
+
+// NewHub creates a hub without connection
+func NewHub() *Hub {
+	return &Hub{
+		conns: make(map[string]map[*conn]struct{}),
+		upgrader: websocket.Upgrader{
+			// The clients are authenticated by their access token
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// Serve upgrades the request to a websocket and keeps it for the user until it is closed
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, userUUID string) error {
+	ws, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(handshakeWait))
+	p, err := handshake(ws)
+	if err != nil {
+		logger.WithError(err).WithField("user_id", userUUID).Warn("Notifications handshake failed")
+		return nil
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	c := &conn{ws: ws, protocol: p, send: make(chan interface{}, sendBuffer)}
+	h.add(userUUID, c)
+	defer h.remove(userUUID, c)
+
+	done := make(chan struct{})
+	go c.writeLoop(done)
+
+	// The messages of the clients (pings, completions) are not used
+	for {
+		if _, _, err := ws.NextReader(); err != nil {
+			close(done)
+			return nil
+		}
+	}
+}
+
+// Send pushes an update to all the connected devices of the user (but the one at the origin of the update)
+func (h *Hub) Send(userUUID string, updateType int, contextID string, payload map[string]interface{}) {
+	var ctxID interface{}
+	if contextID != "" {
+		ctxID = contextID
+	}
+	message := map[string]interface{}{
+		"ContextId": ctxID,
+		"Type":      updateType,
+		"Payload":   payload,
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.conns[userUUID] {
+		select {
+		case c.send <- message:
+		default:
+			logger.WithField("user_id", userUUID).Warn("Notification dropped for a slow device")
+		}
+	}
+}
+
+// Connected gives the number of websockets opened by the user
+func (h *Hub) Connected(userUUID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns[userUUID])
+}
+
+// Connections gives the number of websockets opened by all the users
+func (h *Hub) Connections() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, conns := range h.conns {
+		n += len(conns)
+	}
+	return n
+}
+
+func (h *Hub) add(userUUID string, c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[userUUID] == nil {
+		h.conns[userUUID] = make(map[*conn]struct{})
+	}
+	h.conns[userUUID][c] = struct{}{}
+}
+
+func (h *Hub) remove(userUUID string, c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns[userUUID], c)
+	if len(h.conns[userUUID]) == 0 {
+		delete(h.conns, userUUID)
+	}
+}
+
+// writeLoop sends the updates and the pings until the connection is closed
+func (c *conn) writeLoop(done chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		var frame []byte
+		select {
+		case <-done:
+			return
+		case message := <-c.send:
+			frame = c.protocol.invocation("ReceiveMessage", message)
+		case <-ticker.C:
+			frame = c.protocol.ping()
+		}
+		c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.ws.WriteMessage(c.protocol.messageType(), frame); err != nil {
+			c.ws.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordSeparator ends the JSON messages of SignalR
+const recordSeparator = 0x1e
+
+// SignalR message types
+const (
+	invocationMessage = 1
+	pingMessage       = 6
+)
+
+// protocol encodes the messages sent to the clients (json or messagepack)
+type protocol interface {
+	invocation(target string, argument interface{}) []byte
+	ping() []byte
+	messageType() int
+}
+
+// handshake reads the protocol requested by the client and accepts it
+func handshake(ws *websocket.Conn) (protocol, error) {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.IndexByte(data, recordSeparator)
+	if end < 0 {
+		return nil, errors.New("handshake without record separator")
+	}
+
+	var request struct {
+		Protocol string `json:"protocol"`
+		Version  int    `json:"version"`
+	}
+	if err := json.Unmarshal(data[:end], &request); err != nil {
+		return nil, err
+	}
+
+	var p protocol
+	switch request.Protocol {
+	case "json":
+		p = jsonProtocol{}
+	case "messagepack":
+		p = messagePackProtocol{}
+	default:
+		ws.WriteMessage(websocket.TextMessage, append([]byte(`{"error":"Unsupported protocol"}`), recordSeparator))
+		return nil, fmt.Errorf("unsupported protocol %q", request.Protocol)
+	}
+	// The handshake response is always JSON
+	return p, ws.WriteMessage(websocket.TextMessage, []byte{'{', '}', recordSeparator})
+}
+
+// jsonProtocol is the text protocol of SignalR
+type jsonProtocol struct{}
+
+func (jsonProtocol) invocation(target string, argument interface{}) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":      invocationMessage,
+		"target":    target,
+		"arguments": []interface{}{argument},
+	})
+	return append(data, recordSeparator)
+}
+
+func (jsonProtocol) ping() []byte {
+	return []byte{'{', '"', 't', 'y', 'p', 'e', '"', ':', '6', '}', recordSeparator}
+}
+
+func (jsonProtocol) messageType() int {
+	return websocket.TextMessage
+}
+
+// messagePackProtocol is the binary protocol of SignalR (used by the Bitwarden clients)
+type messagePackProtocol struct{}
+
+func (messagePackProtocol) invocation(target string, argument interface{}) []byte {
+	// [type, headers, invocationId, target, arguments]
+	return frame([]interface{}{invocationMessage, map[string]interface{}{}, nil, target, []interface{}{argument}})
+}
+
+func (messagePackProtocol) ping() []byte {
+	return frame([]interface{}{pingMessage})
+}
+
+func (messagePackProtocol) messageType() int {
+	return websocket.BinaryMessage
+}
+
+// frame prefixes the encoded message with its length (varint)
+func frame(message interface{}) []byte {
+	var body bytes.Buffer
+	encodeMessagePack(&body, message)
+
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(body.Len()))
+	return append(prefix[:n], body.Bytes()...)
+}
+
+// encodeMessagePack writes the value with the subset of MessagePack needed by the notifications
+func encodeMessagePack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		encodeInt(buf, int64(v))
+	case int64:
+		encodeInt(buf, v)
+	case string:
+		encodeString(buf, v)
+	case time.Time:
+		encodeString(buf, v.UTC().Format(time.RFC3339Nano))
+	case []string:
+		encodeArrayHeader(buf, len(v))
+		for _, s := range v {
+			encodeString(buf, s)
+		}
+	case []interface{}:
+		encodeArrayHeader(buf, len(v))
+		for _, item := range v {
+			encodeMessagePack(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		switch n := len(v); {
+		case n < 16:
+			buf.WriteByte(0x80 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xde)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdf)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for _, k := range keys {
+			encodeString(buf, k)
+			encodeMessagePack(buf, v[k])
+		}
+	default:
+		// Unexpected types are sent as their text representation
+		encodeString(buf, fmt.Sprint(v))
+	}
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func encodeArrayHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xdc)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdd)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
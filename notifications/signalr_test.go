@@ -0,0 +1,86 @@
+package notifications
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessagePackFrames(t *testing.T) {
+	p := messagePackProtocol{}
+
+	if got, want := p.ping(), []byte{0x02, 0x91, 0x06}; !bytes.Equal(got, want) {
+		t.Errorf("ping: got % x, want % x", got, want)
+	}
+
+	message := map[string]interface{}{
+		"ContextId": nil,
+		"Type":      SyncCiphers,
+		"Payload": map[string]interface{}{
+			"UserId": "user",
+			"Date":   time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+	}
+	want := []byte{
+		0x55, // length of the message (85)
+		0x95, // [type, headers, invocationId, target, arguments]
+		0x01, // invocation
+		0x80, // no header
+		0xc0, // no invocation id
+		0xae, 'R', 'e', 'c', 'e', 'i', 'v', 'e', 'M', 'e', 's', 's', 'a', 'g', 'e',
+		0x91, // one argument
+		0x83, // the keys are sorted
+		0xa9, 'C', 'o', 'n', 't', 'e', 'x', 't', 'I', 'd', 0xc0,
+		0xa7, 'P', 'a', 'y', 'l', 'o', 'a', 'd', 0x82,
+		0xa4, 'D', 'a', 't', 'e', 0xb4, '2', '0', '2', '2', '-', '0', '1', '-', '0', '2', 'T', '0', '3', ':', '0', '4', ':', '0', '5', 'Z',
+		0xa6, 'U', 's', 'e', 'r', 'I', 'd', 0xa4, 'u', 's', 'e', 'r',
+		0xa4, 'T', 'y', 'p', 'e', 0x04,
+	}
+	if got := p.invocation("ReceiveMessage", message); !bytes.Equal(got, want) {
+		t.Errorf("invocation:\ngot  % x\nwant % x", got, want)
+	}
+}
+
+func TestMessagePackValues(t *testing.T) {
+	long := strings.Repeat("a", 32)
+	for _, c := range []struct {
+		value interface{}
+		want  []byte
+	}{
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 0x80}},
+		{-1, []byte{0xff}},
+		{-32, []byte{0xe0}},
+		{int64(-33), []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xdf}},
+		{"", []byte{0xa0}},
+		{long, append([]byte{0xd9, 32}, long...)},
+		{[]string{"a", "b"}, []byte{0x92, 0xa1, 'a', 0xa1, 'b'}},
+		{[]interface{}{}, []byte{0x90}},
+		{map[string]interface{}{}, []byte{0x80}},
+	} {
+		var buf bytes.Buffer
+		encodeMessagePack(&buf, c.value)
+		if !bytes.Equal(buf.Bytes(), c.want) {
+			t.Errorf("%#v: got % x, want % x", c.value, buf.Bytes(), c.want)
+		}
+	}
+
+	// The length prefix is a varint: 2 bytes from 128 (202 here)
+	if got := frame(strings.Repeat("a", 200)); !bytes.Equal(got[:4], []byte{0xca, 0x01, 0xd9, 200}) || len(got) != 2+2+200 {
+		t.Errorf("long frame: got % x", got[:4])
+	}
+}
+
+func TestJSONFrames(t *testing.T) {
+	p := jsonProtocol{}
+	if got := string(p.ping()); got != "{\"type\":6}\x1e" {
+		t.Errorf("ping: got %q", got)
+	}
+	got := string(p.invocation("ReceiveMessage", map[string]interface{}{"Type": SyncCiphers}))
+	if want := "{\"arguments\":[{\"Type\":4}],\"target\":\"ReceiveMessage\",\"type\":1}\x1e"; got != want {
+		t.Errorf("invocation: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gotwarden/backup"
+	"gotwarden/handlers"
+	"gotwarden/metrics"
+	"gotwarden/models"
+	"gotwarden/tracing"
+	"gotwarden/util"
+	"gotwarden/version"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serve runs the server until SIGINT or SIGTERM
+func serve(args []string) error {
+	flags := newFlags("serve", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	logger.WithField("settings", conf.Dump()).Info("Effective configuration")
+
+	shutdownTracing, err := tracing.Setup(conf.Tracing, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	wardenCtx, err := handlers.Init(conf)
+	if err != nil {
+		return fmt.Errorf("impossible to load the context: %w", err)
+	}
+
+	// The backups run into the server, the memory database is refused by the validation
+	backupCtx, stopBackups := context.WithCancel(context.Background())
+	defer stopBackups()
+	if conf.Backup.Interval > 0 {
+		db, ok := wardenCtx.Db.(*models.DB)
+		if !ok {
+			return errors.New("the scheduled backups need a SQLite or PostgreSQL database")
+		}
+		logger.WithFields(logrus.Fields{"dir": conf.Backup.Dir, "interval": conf.Backup.Interval.String()}).Info("Scheduling the backups")
+		go backup.Schedule(backupCtx, db, conf.Db, conf.Backup)
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", wardenCtx.Port),
+		Handler: wardenCtx.Router(),
+	}
+
+	serve := srv.ListenAndServe
+	var redirect *http.Server
+	if conf.TLS.Enabled() {
+		certs, err := util.NewCertReloader(conf.TLS.CertFile, conf.TLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("impossible to load the TLS certificate: %w", err)
+		}
+		if srv.TLSConfig, err = conf.TLS.ServerConfig(certs); err != nil {
+			return fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+
+		// The certificate is reloaded when the files change or on SIGHUP,
+		// the open connections keep the previous one
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		defer stopWatch()
+		go certs.Watch(watchCtx, 30*time.Second)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certs.Reload(); err != nil {
+					logger.WithError(err).Error("Cannot reload the TLS certificate")
+					continue
+				}
+				logger.WithField("file", conf.TLS.CertFile).Info("TLS certificate reloaded")
+			}
+		}()
+
+		if conf.TLS.RedirectPort != "" {
+			redirect = &http.Server{
+				Addr:    fmt.Sprintf(":%s", conf.TLS.RedirectPort),
+				Handler: util.RedirectHandler(wardenCtx.Port),
+			}
+			logger.WithField("port", conf.TLS.RedirectPort).Info("Redirecting HTTP to HTTPS")
+			go func() {
+				if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					logger.WithError(err).Fatal("Cannot listen")
+				}
+			}()
+		}
+	}
+
+	// The metrics are served on their own port, ie not exposed to the Internet
+	var metricsSrv *http.Server
+	if conf.MetricsPort != "" {
+		metricsSrv = &http.Server{
+			Addr:    fmt.Sprintf(":%s", conf.MetricsPort),
+			Handler: metrics.Handler(conf.MetricsToken),
+		}
+		logger.WithField("port", conf.MetricsPort).Info("Serving the metrics")
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Fatal("Cannot listen")
+			}
+		}()
+	}
+
+	logger.WithFields(logrus.Fields{
+		"port":       wardenCtx.Port,
+		"tls":        conf.TLS.Enabled(),
+		"tracing":    conf.Tracing.Exporter,
+		"version":    version.Release,
+		"commit":     version.Commit,
+		"build_time": version.BuildTime,
+	}).Info("Starting the Gotwarden server")
+
+	// Initializing the server in a goroutine so that
+	// it won't block the graceful shutdown handling below
+	go func() {
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Fatal("Cannot listen")
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shutdown the server with
+	// a timeout of 3 seconds.
+	quit := make(chan os.Signal, 1)
+	// kill (no param) default send syscall.SIGTERM
+	// kill -2 is syscall.SIGINT
+	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	logger.Info("Shutting down the server")
+	stopBackups()
+
+	// The readiness probe fails while the load balancer stops sending requests
+	wardenCtx.Drain()
+	if conf.ShutdownDelay > 0 {
+		logger.WithField("delay", conf.ShutdownDelay.String()).Info("Draining")
+		time.Sleep(conf.ShutdownDelay)
+	}
+
+	// The context is used to inform the server it has 3 seconds to finish
+	// the request it is currently handling
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if metricsSrv != nil {
+		metricsSrv.Shutdown(ctx)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+	// The spans of the last requests are flushed
+	if err := shutdownTracing(ctx); err != nil {
+		logger.WithError(err).Error("Cannot flush the spans")
+	}
+
+	logger.Info("Server exiting")
+	return nil
+}
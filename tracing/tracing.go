@@ -0,0 +1,177 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"gotwarden/logging"
+	"gotwarden/version"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName names the server into the traces
+const ServiceName = "gotwarden"
+
+// Exporters of the spans
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+var logger = logging.For("tracing")
+
+var tracer = otel.Tracer("gotwarden/http")
+
+// Config chooses where the spans are exported and how many requests are traced
+type Config struct {
+	Exporter string
+	// Endpoint is the base URL of the OTLP/HTTP collector (the spans are posted to /v1/traces)
+	Endpoint string
+	// Headers are sent to the collector, ie "x-api-key=secret,x-tenant=gotwarden"
+	Headers string
+	// SampleRatio is the part of the requests traced (when the caller hasn't decided)
+	SampleRatio float64
+}
+
+// Enabled tells if the spans are exported
+func (conf Config) Enabled() bool {
+	return conf.Exporter != ExporterNone && conf.Exporter != ""
+}
+
+// Check reports the invalid settings
+func (conf Config) Check() error {
+	switch conf.Exporter {
+	case ExporterNone, ExporterStdout, "":
+	case ExporterOTLP:
+		if u, err := url.Parse(conf.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q is not an http(s) URL", conf.Endpoint)
+		}
+		if _, err := parseHeaders(conf.Headers); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown exporter %q", conf.Exporter)
+	}
+	if conf.SampleRatio < 0 || conf.SampleRatio > 1 {
+		return fmt.Errorf("the sample ratio %v is not between 0 and 1", conf.SampleRatio)
+	}
+	return nil
+}
+
+// parseHeaders reads the list "key=value,..." (the values can be URL encoded)
+func parseHeaders(list string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.New("the headers must be a list of key=value")
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of the header %s", kv[0])
+		}
+		headers[strings.TrimSpace(kv[0])] = value
+	}
+	return headers, nil
+}
+
+// Setup installs the tracer provider and the W3C propagators, the shutdown flushes the spans left
+func Setup(conf Config, stdout io.Writer) (func(context.Context) error, error) {
+	if err := conf.Check(); err != nil {
+		return nil, err
+	}
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.WithError(err).Error("Cannot export the spans")
+	}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case ExporterOTLP:
+		headers, _ := parseHeaders(conf.Headers)
+		exporter, err = newOTLPExporter(context.Background(), conf.Endpoint, headers)
+	case ExporterStdout:
+		exporter, err = newStdoutExporter(stdout)
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(ServiceName),
+		semconv.ServiceVersionKey.String(version.Release),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Middleware traces the request into a server span, child of the caller's one (traceparent header) if any
+func Middleware(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+	// The path is not used as name (nor the query as attribute): it can carry ids and tokens
+	route := c.FullPath()
+	name := c.Request.Method + " " + route
+	if route == "" {
+		name = c.Request.Method + " unmatched"
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(c.Request.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.HTTPSchemeKey.String(scheme),
+			semconv.HTTPFlavorKey.String(fmt.Sprintf("%d.%d", c.Request.ProtoMajor, c.Request.ProtoMinor)),
+			semconv.HTTPUserAgentKey.String(c.Request.UserAgent()),
+			semconv.HTTPClientIPKey.String(c.ClientIP()),
+		),
+	)
+	defer span.End()
+	if id := logging.RequestID(c); id != "" {
+		span.SetAttributes(attribute.String("http.request_id", id))
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if size := c.Writer.Size(); size >= 0 {
+		span.SetAttributes(semconv.HTTPResponseContentLengthKey.Int(size))
+	}
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	if len(c.Errors) > 0 {
+		span.RecordError(c.Errors.Last())
+	}
+}
@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestCheck(t *testing.T) {
+	valid := []Config{
+		{Exporter: ExporterNone},
+		{Exporter: ExporterStdout, SampleRatio: 0.5},
+		{Exporter: ExporterOTLP, Endpoint: "http://collector:4318", Headers: "x-api-key=a%3Db, x-tenant=gotwarden", SampleRatio: 1},
+	}
+	for _, conf := range valid {
+		if err := conf.Check(); err != nil {
+			t.Errorf("%+v: %s", conf, err)
+		}
+	}
+	invalid := []Config{
+		{Exporter: "jaeger"},
+		{Exporter: ExporterOTLP, Endpoint: "collector:4318"},
+		{Exporter: ExporterOTLP, Endpoint: "http://collector:4318", Headers: "x-api-key"},
+		{Exporter: ExporterStdout, SampleRatio: 2},
+	}
+	for _, conf := range invalid {
+		if err := conf.Check(); err == nil {
+			t.Errorf("%+v has been accepted", conf)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	var handled trace.SpanContext
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/api/ciphers/:id", func(c *gin.Context) {
+		handled = trace.SpanContextFromContext(c.Request.Context())
+		c.Status(http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest("GET", "/api/ciphers/42?access_token=secret", nil)
+	req.Header.Set("traceparent", traceparent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	span := spans[0]
+	if span.Name() != "GET /api/ciphers/:id" || span.SpanKind() != trace.SpanKindServer || span.Status().Code != codes.Error {
+		t.Errorf("unexpected span %s %s %v", span.Name(), span.SpanKind(), span.Status())
+	}
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("the trace of the caller is not continued: %v", span.SpanContext())
+	}
+	if handled.SpanID() != span.SpanContext().SpanID() {
+		t.Error("the handler doesn't get the span of the request")
+	}
+	for _, attr := range span.Attributes() {
+		if strings.Contains(attr.Value.Emit(), "secret") || strings.Contains(attr.Value.Emit(), "42") {
+			t.Errorf("the path is recorded: %v", attr)
+		}
+	}
+	if spans[1].Name() != "GET unmatched" || spans[1].Parent().IsValid() {
+		t.Errorf("unexpected span %s", spans[1].Name())
+	}
+}
+
+// exportOne exports a span with an event and an error
+func exportOne(t *testing.T, exporter sdktrace.SpanExporter) {
+	t.Helper()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ctx, parent := provider.Tracer("gotwarden/http").Start(context.Background(), "GET /api/sync")
+	_, child := provider.Tracer("gotwarden/models").Start(ctx, "SELECT ciphers", trace.WithSpanKind(trace.SpanKindClient))
+	child.AddEvent("retried")
+	child.SetStatus(codes.Error, "database is locked")
+	child.End()
+	parent.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var received []*coltracepb.ExportTraceServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/otlp/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("x-api-key") != "key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, &req)
+	}))
+	defer collector.Close()
+
+	exporter, err := newOTLPExporter(context.Background(), collector.URL+"/otlp/", map[string]string{"x-api-key": "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportOne(t, exporter)
+
+	if len(received) != 2 {
+		t.Fatalf("expected an export by span, got %d", len(received))
+	}
+	scope := received[0].ResourceSpans[0].ScopeSpans[0]
+	child := scope.Spans[0]
+	if scope.Scope.Name != "gotwarden/models" || child.Name != "SELECT ciphers" || child.Kind != tracepb.Span_SPAN_KIND_CLIENT {
+		t.Errorf("unexpected span %v", scope)
+	}
+	if child.Status.Code != tracepb.Status_STATUS_CODE_ERROR || child.Status.Message != "database is locked" || len(child.Events) != 1 {
+		t.Errorf("unexpected status %v", child)
+	}
+	parent := received[1].ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if !bytes.Equal(child.ParentSpanId, parent.SpanId) || !bytes.Equal(child.TraceId, parent.TraceId) {
+		t.Errorf("the spans are not linked: %v %v", child, parent)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	exporter, err = newOTLPExporter(context.Background(), failing.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exporter.ExportSpans(context.Background(), tracetest.SpanStubs{{Name: "span"}}.Snapshots())
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("the failure of the collector is not reported: %v", err)
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var out bytes.Buffer
+	exporter, err := newStdoutExporter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportOne(t, exporter)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line by span: %s", out.String())
+	}
+	var span struct {
+		Name                   string
+		InstrumentationLibrary struct{ Name string }
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &span); err != nil || span.InstrumentationLibrary.Name != "gotwarden/models" || span.Name != "SELECT ciphers" {
+		t.Errorf("unexpected line %s (%v)", lines[0], err)
+	}
+}
@@ -1,8 +1,14 @@
 package util
 
 import (
+	"errors"
 	"fmt"
+	"gotwarden/logging"
+	"gotwarden/tracing"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +23,12 @@ type SqliteConfig struct {
 	DbFilePath string
 }
 
+// MemoryDbType keeps the data in memory (lost when the server stops)
+const MemoryDbType = "memory"
+
+// MemoryConfig is a Db config for the in-memory store (tests and ephemeral instances)
+type MemoryConfig struct{}
+
 // PostgresConfig is a Db config for PostgreSQL
 type PostgresConfig struct {
 	User     string
@@ -37,45 +49,205 @@ type Config struct {
 	AttachmentURL  string
 	IconURL        string
 	StaticFilePath string
+	Domain         string
+	AdminToken     string
+	SignupsAllowed bool
+	SMTP           SMTPConfig
+	WebVaultPath   string
+	IconTTL        time.Duration
+	IconMissTTL    time.Duration
+	RecordPath     string
+	TLS            TLSConfig
+	MetricsPort    string
+	MetricsToken   string
+	ShutdownDelay  time.Duration
+	Log            LogConfig
+	Tracing        tracing.Config
+	Backup         BackupConfig
+	// settings are the effective values of the variables (see Dump)
+	settings map[string]setting
+}
+
+// LogConfig contains the format and the levels of the logs
+type LogConfig struct {
+	Format string
+	Level  string
+	// Levels overrides the level by module, ie "models=debug,notifications=warn"
+	Levels string
+}
+
+// BackupConfig contains where the backups are written, how they are encrypted and kept
+type BackupConfig struct {
+	Dir string
+	// Keep is the number of archives kept (0 keeps them all)
+	Keep int
+	// Passphrase encrypts the archives (not encrypted if empty)
+	Passphrase string
+	// Interval schedules the backups into the server (disabled if 0)
+	Interval time.Duration
+}
+
+// SMTPConfig contains the SMTP server used to send emails
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
 }
 
-// InitConfig initialize a new Config object
-func InitConfig() *Config {
-	typeDb := getEnv("DB_TYPE", "sqlite")
+// DefaultSecretPhrase is the secret used when none is configured (never use it in production)
+const DefaultSecretPhrase = "This a secret ... sshhhshh"
+
+// InitConfig initialize a new Config object from the env variables, layered over the config file of WARDEN_CONFIG
+func InitConfig() (*Config, error) {
+	l, err := newLoader(os.Getenv(ConfigFileEnv))
+	if err != nil {
+		return nil, err
+	}
 
 	config := &Config{
-		Port:           getEnv("PORT", "3000"),
-		Validity:       time.Hour,
-		RefeshValidity: time.Hour + 30*time.Minute,
-		IdentityURL:    getEnv("WARDEN_IDENTITY_URL", "/identity"),
-		AttachmentURL:  getEnv("WARDEN_ATTACHMENT_URL", "/attachments"),
-		IconURL:        getEnv("WARDEN_ICONS_URL", "/icons"),
-		SecretPhrase:   getEnv("WARDEN_SECRET_PHRASE", "This a secret ... sshhhshh"),
-		StaticFilePath: getEnv("WARDEN_STATIC_PATH", "./fixtures/assets"),
-	}
-	if typeDb == "postgres" {
-		// Postgres
+		Port:           l.get("PORT", "3000"),
+		Validity:       l.duration("WARDEN_TOKEN_VALIDITY", time.Hour),
+		RefeshValidity: l.duration("WARDEN_REFRESH_VALIDITY", time.Hour+30*time.Minute),
+		IdentityURL:    l.get("WARDEN_IDENTITY_URL", "/identity"),
+		AttachmentURL:  l.get("WARDEN_ATTACHMENT_URL", "/attachments"),
+		IconURL:        l.get("WARDEN_ICONS_URL", "/icons"),
+		SecretPhrase:   l.secret("WARDEN_SECRET_PHRASE", DefaultSecretPhrase),
+		StaticFilePath: l.get("WARDEN_STATIC_PATH", "./fixtures/assets"),
+		Domain:         l.get("WARDEN_DOMAIN", "http://localhost:3000"),
+		WebVaultPath:   l.get("WARDEN_WEB_VAULT", ""),
+		IconTTL:        l.duration("WARDEN_ICON_TTL", 30*24*time.Hour),
+		IconMissTTL:    l.duration("WARDEN_ICON_MISS_TTL", 3*24*time.Hour),
+		AdminToken:     l.secret("WARDEN_ADMIN_TOKEN", ""),
+		SignupsAllowed: l.bool("WARDEN_SIGNUPS_ALLOWED", true),
+		RecordPath:     l.get("WARDEN_RECORD_PATH", ""),
+		MetricsPort:    l.get("WARDEN_METRICS_PORT", ""),
+		MetricsToken:   l.secret("WARDEN_METRICS_TOKEN", ""),
+		ShutdownDelay:  l.duration("WARDEN_SHUTDOWN_DELAY", 0),
+		Log: LogConfig{
+			Format: l.get("WARDEN_LOG_FORMAT", logging.FormatLogfmt),
+			Level:  l.get("WARDEN_LOG_LEVEL", "info"),
+			Levels: l.get("WARDEN_LOG_LEVELS", ""),
+		},
+		Tracing: tracing.Config{
+			Exporter:    l.get("WARDEN_TRACING_EXPORTER", tracing.ExporterNone),
+			Endpoint:    l.get("WARDEN_TRACING_ENDPOINT", "http://localhost:4318"),
+			Headers:     l.secret("WARDEN_TRACING_HEADERS", ""),
+			SampleRatio: l.float("WARDEN_TRACING_SAMPLE_RATIO", 1),
+		},
+		Backup: BackupConfig{
+			Dir:        l.get("WARDEN_BACKUP_DIR", "./backups"),
+			Keep:       l.int("WARDEN_BACKUP_KEEP", 7),
+			Passphrase: l.secret("WARDEN_BACKUP_PASSPHRASE", ""),
+			Interval:   l.duration("WARDEN_BACKUP_INTERVAL", 0),
+		},
+		SMTP: SMTPConfig{
+			Host:     l.get("SMTP_HOST", ""),
+			Port:     l.get("SMTP_PORT", "587"),
+			Username: l.get("SMTP_USERNAME", ""),
+			Password: l.secret("SMTP_PASSWORD", ""),
+			From:     l.get("SMTP_FROM", ""),
+		},
+		TLS: TLSConfig{
+			CertFile:      l.get("WARDEN_TLS_CERT", ""),
+			KeyFile:       l.get("WARDEN_TLS_KEY", ""),
+			MinVersion:    l.get("WARDEN_TLS_MIN_VERSION", "1.2"),
+			Ciphers:       splitList(l.get("WARDEN_TLS_CIPHERS", "")),
+			RedirectPort:  l.get("WARDEN_TLS_REDIRECT_PORT", ""),
+			AdminClientCA: l.get("WARDEN_TLS_ADMIN_CLIENT_CA", ""),
+		},
+	}
+	switch typeDb := l.get("DB_TYPE", "sqlite"); typeDb {
+	case "postgres":
 		config.Db = PostgresConfig{
-			User:     getEnv("DB_USER", ""),
-			Password: getEnv("DB_PASSWORD", ""),
-			Host:     getEnv("DB_HOST", "localhost"),
-			Name:     getEnv("DB_NAME", ""),
-			Port:     getEnv("DB_PORT", "5432"),
+			User:     l.get("DB_USER", ""),
+			Password: l.secret("DB_PASSWORD", ""),
+			Host:     l.get("DB_HOST", "localhost"),
+			Name:     l.get("DB_NAME", ""),
+			Port:     l.get("DB_PORT", "5432"),
 		}
+	case MemoryDbType:
+		config.Db = MemoryConfig{}
+	case "sqlite", "sqlite3":
+		config.Db = SqliteConfig{
+			DbFilePath: l.get("DB_FILEPATH", "./fixtures/test.db"),
+		}
+	default:
+		l.errs = append(l.errs, fmt.Errorf("DB_TYPE: unknown database type %q", typeDb))
 	}
 
-	// Default type is sqlite
-	config.Db = SqliteConfig{
-		DbFilePath: getEnv("DB_FILEPATH", "./fixtures/test.db"),
+	for _, key := range l.unknownKeys() {
+		l.errs = append(l.errs, fmt.Errorf("%s: unknown setting of the config file", key))
 	}
-	return config
+	config.settings = l.settings
+	return config, joinErrors(l.errs)
 }
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// Validate checks the settings are consistent (and safe in release mode)
+func (conf *Config) Validate(release bool) error {
+	var errs []error
+	switch {
+	case conf.SecretPhrase == "":
+		errs = append(errs, errors.New("WARDEN_SECRET_PHRASE: the secret cannot be empty"))
+	case conf.SecretPhrase == DefaultSecretPhrase && release:
+		errs = append(errs, errors.New("WARDEN_SECRET_PHRASE: the default secret cannot be used in release mode"))
+	case conf.SecretPhrase == DefaultSecretPhrase:
+		logger.Warn("The default WARDEN_SECRET_PHRASE is used, the tokens can be forged")
+	}
+	if port, err := strconv.Atoi(conf.Port); err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT: invalid port %q", conf.Port))
+	}
+	if conf.Validity <= 0 {
+		errs = append(errs, errors.New("WARDEN_TOKEN_VALIDITY: must be positive"))
+	}
+	if conf.RefeshValidity < conf.Validity {
+		errs = append(errs, errors.New("WARDEN_REFRESH_VALIDITY: cannot be shorter than WARDEN_TOKEN_VALIDITY"))
 	}
-	return fallback
+	if u, err := url.Parse(conf.Domain); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("WARDEN_DOMAIN: %q is not an http(s) URL", conf.Domain))
+	}
+	if conf.ShutdownDelay < 0 {
+		errs = append(errs, errors.New("WARDEN_SHUTDOWN_DELAY: cannot be negative"))
+	}
+	if err := logging.Check(conf.Log.Format, conf.Log.Level, conf.Log.Levels); err != nil {
+		errs = append(errs, fmt.Errorf("WARDEN_LOG_FORMAT, WARDEN_LOG_LEVEL, WARDEN_LOG_LEVELS: %w", err))
+	}
+	if err := conf.Tracing.Check(); err != nil {
+		errs = append(errs, fmt.Errorf("WARDEN_TRACING_EXPORTER, WARDEN_TRACING_ENDPOINT, WARDEN_TRACING_HEADERS, WARDEN_TRACING_SAMPLE_RATIO: %w", err))
+	}
+	if conf.Backup.Keep < 0 {
+		errs = append(errs, errors.New("WARDEN_BACKUP_KEEP: cannot be negative"))
+	}
+	switch {
+	case conf.Backup.Interval < 0:
+		errs = append(errs, errors.New("WARDEN_BACKUP_INTERVAL: cannot be negative"))
+	case conf.Backup.Interval > 0 && conf.Db != nil && conf.Db.GetType() == MemoryDbType:
+		errs = append(errs, errors.New("WARDEN_BACKUP_INTERVAL: the memory database cannot be backed up"))
+	}
+	if conf.SMTP.Host != "" && conf.SMTP.From == "" {
+		errs = append(errs, errors.New("SMTP_FROM: the sender is needed to send emails"))
+	}
+	if port, err := strconv.Atoi(conf.TLS.RedirectPort); conf.TLS.RedirectPort != "" && (err != nil || port <= 0 || port > 65535) {
+		errs = append(errs, fmt.Errorf("WARDEN_TLS_REDIRECT_PORT: invalid port %q", conf.TLS.RedirectPort))
+	}
+	errs = append(errs, conf.TLS.validate()...)
+	if port, err := strconv.Atoi(conf.MetricsPort); conf.MetricsPort != "" && (err != nil || port <= 0 || port > 65535 || conf.MetricsPort == conf.Port) {
+		errs = append(errs, fmt.Errorf("WARDEN_METRICS_PORT: invalid port %q", conf.MetricsPort))
+	}
+	return joinErrors(errs)
+}
+
+// joinErrors reports all the errors at once (nil if none)
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "\n"))
 }
 
 // GetConnect provide the Url for PostgreSQL
@@ -102,3 +274,13 @@ func (conf SqliteConfig) GetConnect() string {
 func (conf SqliteConfig) GetType() string {
 	return "sqlite3"
 }
+
+// GetConnect is empty for the in-memory store
+func (conf MemoryConfig) GetConnect() string {
+	return ""
+}
+
+// GetType for the in-memory store
+func (conf MemoryConfig) GetType() string {
+	return MemoryDbType
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigLayers(t *testing.T) {
+	secret := writeFile(t, "secret", "from docker\n")
+	for name, content := range map[string]string{
+		"config.yaml": "port: 4000\ntoken_validity: 2h\nwarden:\n  secret_phrase_file: " + secret + "\nsmtp:\n  host: mail.example.com\n  from: vault@example.com\n",
+		"config.toml": "port = 4000\ntoken_validity = \"2h\"\n[warden]\nsecret_phrase_file = \"" + secret + "\"\n[smtp]\nhost = \"mail.example.com\"\nfrom = \"vault@example.com\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(ConfigFileEnv, writeFile(t, name, content))
+			t.Setenv("SMTP_HOST", "smtp.example.com")
+			t.Setenv("WARDEN_REFRESH_VALIDITY", "3h")
+
+			conf, err := InitConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.Port != "4000" || conf.Validity != 2*time.Hour || conf.RefeshValidity != 3*time.Hour {
+				t.Errorf("the file is not read: %s %s %s", conf.Port, conf.Validity, conf.RefeshValidity)
+			}
+			if conf.SMTP.Host != "smtp.example.com" || conf.SMTP.From != "vault@example.com" {
+				t.Errorf("the env should override the file: %+v", conf.SMTP)
+			}
+			if conf.SecretPhrase != "from docker" {
+				t.Errorf("the secret file is not read: %q", conf.SecretPhrase)
+			}
+			if err := conf.Validate(true); err != nil {
+				t.Errorf("valid config refused: %s", err)
+			}
+
+			dump := conf.Dump()
+			if strings.Contains(dump, "from docker") || !strings.Contains(dump, "WARDEN_SECRET_PHRASE=<redacted>") {
+				t.Errorf("the secret is not redacted:\n%s", dump)
+			}
+			if !strings.Contains(dump, `SMTP_HOST="smtp.example.com" (env)`) || !strings.Contains(dump, `PORT="4000" (file)`) {
+				t.Errorf("unexpected dump:\n%s", dump)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	t.Setenv(ConfigFileEnv, writeFile(t, "config.yaml", "signups_allowd: false\nicon_ttl: forever\n"))
+	t.Setenv("SMTP_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	_, err := InitConfig()
+	if err == nil {
+		t.Fatal("the invalid config has been accepted")
+	}
+	for _, expected := range []string{"SIGNUPS_ALLOWD", "WARDEN_ICON_TTL", "SMTP_PASSWORD_FILE"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s is not reported: %s", expected, err)
+		}
+	}
+}
+
+func TestValidateDefaultSecret(t *testing.T) {
+	t.Setenv(ConfigFileEnv, "")
+	conf, err := InitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.SecretPhrase != DefaultSecretPhrase {
+		t.Skip("WARDEN_SECRET_PHRASE is set into the environment")
+	}
+	if err := conf.Validate(false); err != nil {
+		t.Errorf("the default secret is refused in debug mode: %s", err)
+	}
+	if err := conf.Validate(true); err == nil || !strings.Contains(err.Error(), "WARDEN_SECRET_PHRASE") {
+		t.Errorf("the default secret is accepted in release mode: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// ErrMailNotConfigured is returned when no SMTP server is set up
+var ErrMailNotConfigured = errors.New("SMTP server is not configured")
+
+// Configured tells if emails can be sent
+func (conf SMTPConfig) Configured() bool {
+	return conf.Host != "" && conf.From != ""
+}
+
+// SendMail sends a plain text email using the SMTP server configured
+func (conf SMTPConfig) SendMail(to, subject, body string) error {
+	if !conf.Configured() {
+		return ErrMailNotConfigured
+	}
+
+	var auth smtp.Auth
+	if conf.Username != "" {
+		auth = smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + conf.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"",
+		body,
+	}, "\r\n")
+
+	err := smtp.SendMail(net.JoinHostPort(conf.Host, conf.Port), auth, conf.From, []string{to}, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("failed to send email to %s: %s", to, err)
+	}
+	return nil
+}
@@ -1,18 +1,24 @@
 package util
 
 import (
+	"bytes"
 	"encoding/json"
+	"gotwarden/logging"
 	"io/ioutil"
-	"log"
+	"mime"
+	"net/url"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
+var logger = logging.For("util")
+
 func MarshalArray(array []interface{}) []byte {
 	if len(array) > 0 {
 		raw, err := json.Marshal(array)
 		if err != nil {
-			log.Printf("Marshal of struct failed")
+			logger.WithError(err).Error("Marshal of struct failed")
 		}
 		return raw
 	}
@@ -25,7 +31,7 @@ func MarshalObject(v interface{}) []byte {
 	} else {
 		raw, err := json.Marshal(v)
 		if err != nil {
-			log.Printf("Marshal of struct failed")
+			logger.WithError(err).Error("Marshal of struct failed")
 		}
 		return raw
 	}
@@ -38,7 +44,7 @@ func UnmarshalArray(object []byte) []interface{} {
 		var raw []interface{}
 		err := json.Unmarshal(object, &raw)
 		if err != nil {
-			log.Printf("Unmarshal of object failed")
+			logger.WithError(err).Error("Unmarshal of object failed")
 		}
 		return raw
 	}
@@ -51,20 +57,43 @@ func UnmarshalObject(object []byte) *interface{} {
 		var raw interface{}
 		err := json.Unmarshal(object, &raw)
 		if err != nil {
-			log.Printf("Unmarshal of object failed")
+			logger.WithError(err).Error("Unmarshal of object failed")
 		}
 		return &raw
 	}
 }
 
+// Trace logs the request at debug level, the credentials of the headers and the body are redacted
 func Trace(c *gin.Context) {
-	log.Printf("Trace de la requête %s", c.Request.RequestURI)
-	body, err := ioutil.ReadAll(c.Request.Body)
+	entry := logging.WithRequest(logger, c)
+	if !entry.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
 
-	log.Printf("Header Request %s", c.Request.Header)
+	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
-		log.Printf("Read body error %s", err)
-	} else {
-		log.Printf("Body Request %s", body)
+		entry.WithError(err).Warn("Cannot read the body of the request")
+	}
+	// The body is still available to the handlers
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var redacted string
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch {
+	case len(body) == 0:
+	case mediaType == "application/json":
+		redacted = logging.RedactJSON(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		values, _ := url.ParseQuery(string(body))
+		redacted = logging.RedactValues(values)
+	default:
+		redacted = "<" + mediaType + ">"
 	}
+	entry.WithFields(logrus.Fields{
+		"method": c.Request.Method,
+		"path":   c.Request.URL.Path,
+		"query":  logging.RedactValues(c.Request.URL.Query()),
+		"header": logging.RedactHeader(c.Request.Header),
+		"body":   redacted,
+	}).Debug("Request trace")
 }
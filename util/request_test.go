@@ -0,0 +1,54 @@
+package util
+
+import (
+	"bytes"
+	"gotwarden/logging"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	if err := logging.Configure(&out, logging.FormatJSON, "info", "util=debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Configure(io.Discard, logging.FormatLogfmt, "info", "")
+
+	body := `{"email":"alice@example.com","masterPasswordHash":"c2VjcmV0","key":"2.key|iv|mac"}`
+	var received string
+	r := gin.New()
+	r.POST("/api/accounts/register", Trace, func(c *gin.Context) {
+		data, _ := io.ReadAll(c.Request.Body)
+		received = string(data)
+	})
+	req := httptest.NewRequest("POST", "/api/accounts/register?access_token=ey.token", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer ey.token")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if received != body {
+		t.Errorf("the body is consumed by the trace: %q", received)
+	}
+	logged := out.String()
+	for _, secret := range []string{"c2VjcmV0", "2.key", "ey.token"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("%s is logged: %s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "Request trace") || !strings.Contains(logged, "alice@example.com") {
+		t.Errorf("the request is not traced: %s", logged)
+	}
+
+	// Nothing is read above the debug level
+	out.Reset()
+	logging.Configure(&out, logging.FormatJSON, "info", "")
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/accounts/register", strings.NewReader(body)))
+	if out.Len() != 0 || received != body {
+		t.Errorf("the request is traced at info level: %s", out.String())
+	}
+}
@@ -0,0 +1,201 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFileEnv is the variable giving the path of the config file (YAML or TOML)
+const ConfigFileEnv = "WARDEN_CONFIG"
+
+// Sources of the settings
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+)
+
+// setting is the effective value of a variable and where it comes from
+type setting struct {
+	key    string
+	value  string
+	source string
+	secret bool
+}
+
+// loader reads the settings from the environment, then the config file, then the defaults
+type loader struct {
+	file     map[string]string
+	settings map[string]setting
+	errs     []error
+}
+
+func newLoader(path string) (*loader, error) {
+	l := &loader{file: map[string]string{}, settings: map[string]setting{}}
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		err = errors.New("the format must be YAML (.yaml, .yml) or TOML (.toml)")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	flatten("", tree, l.file)
+	return l, nil
+}
+
+// flatten names the keys of the file like the env variables (smtp: {host: x} -> SMTP_HOST)
+func flatten(prefix string, tree interface{}, keys map[string]string) {
+	switch node := tree.(type) {
+	case map[string]interface{}:
+		for k, v := range node {
+			flatten(prefix+strings.ToUpper(k)+"_", v, keys)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range node {
+			flatten(prefix+strings.ToUpper(fmt.Sprint(k))+"_", v, keys)
+		}
+	case nil:
+	default:
+		keys[strings.TrimSuffix(prefix, "_")] = fmt.Sprint(node)
+	}
+}
+
+// lookup finds the value of the variable (the prefix WARDEN_ is optional into the file)
+func (l *loader) lookup(key string) (string, string, bool) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, sourceEnv, true
+	}
+	for _, k := range []string{key, strings.TrimPrefix(key, "WARDEN_")} {
+		if value, ok := l.file[k]; ok {
+			return value, sourceFile, true
+		}
+	}
+	return "", "", false
+}
+
+func (l *loader) set(key, value, source string, secret bool) string {
+	l.settings[key] = setting{key: key, value: value, source: source, secret: secret}
+	return value
+}
+
+// get provides the value of the variable or the fallback
+func (l *loader) get(key, fallback string) string {
+	if value, source, ok := l.lookup(key); ok {
+		return l.set(key, value, source, false)
+	}
+	return l.set(key, fallback, sourceDefault, false)
+}
+
+// secret provides the value of the variable, or the content of the file of the variable KEY_FILE (ie Docker secrets)
+func (l *loader) secret(key, fallback string) string {
+	if value, source, ok := l.lookup(key); ok {
+		return l.set(key, value, source, true)
+	}
+	if path, source, ok := l.lookup(key + "_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s_FILE: %w", key, err))
+		}
+		return l.set(key, strings.TrimRight(string(data), "\r\n"), source+" "+path, true)
+	}
+	return l.set(key, fallback, sourceDefault, true)
+}
+
+func (l *loader) duration(key string, fallback time.Duration) time.Duration {
+	value := l.get(key, fallback.String())
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid duration %q", key, value))
+		return fallback
+	}
+	return d
+}
+
+func (l *loader) int(key string, fallback int) int {
+	value := l.get(key, strconv.Itoa(fallback))
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid integer %q", key, value))
+		return fallback
+	}
+	return i
+}
+
+func (l *loader) float(key string, fallback float64) float64 {
+	value := l.get(key, strconv.FormatFloat(fallback, 'g', -1, 64))
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid number %q", key, value))
+		return fallback
+	}
+	return f
+}
+
+func (l *loader) bool(key string, fallback bool) bool {
+	value := l.get(key, strconv.FormatBool(fallback))
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: invalid boolean %q", key, value))
+		return fallback
+	}
+	return b
+}
+
+// unknownKeys lists the keys of the file which are not settings (ie typos)
+func (l *loader) unknownKeys() []string {
+	var unknown []string
+	for k := range l.file {
+		name := strings.TrimSuffix(k, "_FILE")
+		if _, ok := l.settings[name]; ok {
+			continue
+		}
+		if _, ok := l.settings["WARDEN_"+name]; ok {
+			continue
+		}
+		unknown = append(unknown, k)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Dump lists the effective settings and where they come from, with the secrets redacted
+func (conf *Config) Dump() string {
+	keys := make([]string, 0, len(conf.settings))
+	for k := range conf.settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		s := conf.settings[k]
+		value := strconv.Quote(s.value)
+		if s.secret && s.value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(&b, "%s=%s (%s)\n", k, value, s.source)
+	}
+	return b.String()
+}
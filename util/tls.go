@@ -0,0 +1,214 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig contains the settings of the native HTTPS serving (disabled without certificate)
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion string
+	// Ciphers are the names of the TLS 1.2 cipher suites (empty for the Go defaults)
+	Ciphers []string
+	// RedirectPort is the port of the HTTP listener redirecting to HTTPS (empty to disable)
+	RedirectPort string
+	// AdminClientCA is the CA bundle of the client certificates required by /admin (empty to disable)
+	AdminClientCA string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Enabled tells if the server is served over HTTPS
+func (conf TLSConfig) Enabled() bool {
+	return conf.CertFile != ""
+}
+
+func (conf TLSConfig) validate() []error {
+	var errs []error
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		errs = append(errs, errors.New("WARDEN_TLS_CERT, WARDEN_TLS_KEY: both the certificate and the key are needed"))
+	}
+	if _, ok := tlsVersions[conf.MinVersion]; !ok {
+		errs = append(errs, fmt.Errorf("WARDEN_TLS_MIN_VERSION: %q is not 1.2 or 1.3", conf.MinVersion))
+	}
+	if _, err := cipherSuites(conf.Ciphers); err != nil {
+		errs = append(errs, fmt.Errorf("WARDEN_TLS_CIPHERS: %w", err))
+	}
+	if !conf.Enabled() && conf.RedirectPort != "" {
+		errs = append(errs, errors.New("WARDEN_TLS_REDIRECT_PORT: HTTPS is not enabled"))
+	}
+	if !conf.Enabled() && conf.AdminClientCA != "" {
+		errs = append(errs, errors.New("WARDEN_TLS_ADMIN_CLIENT_CA: HTTPS is not enabled"))
+	}
+	return errs
+}
+
+// cipherSuites finds the ids of the cipher suites, the insecure ones are refused
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ServerConfig builds the TLS config of the server, the certificate is provided by the reloader
+func (conf TLSConfig) ServerConfig(certs *CertReloader) (*tls.Config, error) {
+	ciphers, err := cipherSuites(conf.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tlsVersions[conf.MinVersion],
+		CipherSuites:   ciphers,
+		GetCertificate: certs.GetCertificate,
+	}
+	if conf.AdminClientCA != "" {
+		pem, err := os.ReadFile(conf.AdminClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found into %s", conf.AdminClientCA)
+		}
+		// the certificate is only required by /admin (see handlers.RequireClientCert)
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// CertReloader provides the certificate of the server, reloaded without dropping the connections
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate and its key
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified is the latest modification time of the certificate and the key
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// Reload reads the files again, the current certificate is kept if they are invalid
+func (r *CertReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate is the tls.Config hook used at each handshake
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate when the files change, until the context is done
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modTime, err := r.lastModified()
+		r.mu.RLock()
+		changed := err == nil && !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			logger.WithError(err).Error("Cannot reload the TLS certificate")
+			continue
+		}
+		logger.WithField("file", r.certFile).Info("TLS certificate reloaded")
+	}
+}
+
+// RedirectHandler redirects the HTTP requests to the HTTPS port
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = strings.Trim(req.Host, "[]")
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key into dir
+func writeCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, r *CertReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first.example.com")
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, r); name != "first.example.com" {
+		t.Fatalf("unexpected certificate %s", name)
+	}
+
+	// an invalid file keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("the invalid key has been loaded")
+	}
+	if name := commonName(t, r); name != "first.example.com" {
+		t.Errorf("the certificate has been lost: %s", name)
+	}
+
+	// the watcher picks the new files
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+	writeCert(t, dir, "second.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	for deadline := time.Now().Add(5 * time.Second); commonName(t, r) != "second.example.com"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the new certificate has not been reloaded")
+		}
+	}
+}
+
+func TestTLSValidate(t *testing.T) {
+	valid := TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.2", Ciphers: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}
+	if errs := valid.validate(); len(errs) != 0 {
+		t.Errorf("valid config refused: %v", errs)
+	}
+
+	invalid := TLSConfig{KeyFile: "key.pem", MinVersion: "1.0", Ciphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}, RedirectPort: "80", AdminClientCA: "ca.pem"}
+	msg := joinErrors(invalid.validate()).Error()
+	for _, expected := range []string{"WARDEN_TLS_KEY", "WARDEN_TLS_MIN_VERSION", "WARDEN_TLS_CIPHERS", "WARDEN_TLS_REDIRECT_PORT", "WARDEN_TLS_ADMIN_CLIENT_CA"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("%s is not reported: %s", expected, msg)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "vault.example.com")
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3", AdminClientCA: certFile}
+	config, err := conf.ServerConfig(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS13 || config.ClientAuth != tls.VerifyClientCertIfGiven || config.ClientCAs == nil {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	conf.AdminClientCA = keyFile
+	if _, err := conf.ServerConfig(r); err == nil {
+		t.Error("a key has been accepted as CA")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tc := range []struct{ port, host, expected string }{
+		{"443", "vault.example.com", "https://vault.example.com/api/sync?x=1"},
+		{"443", "vault.example.com:80", "https://vault.example.com/api/sync?x=1"},
+		{"8443", "vault.example.com:8080", "https://vault.example.com:8443/api/sync?x=1"},
+		{"443", "[::1]:80", "https://[::1]/api/sync?x=1"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tc.host+"/api/sync?x=1", nil)
+		w := httptest.NewRecorder()
+		RedirectHandler(tc.port).ServeHTTP(w, req)
+		if w.Code != 301 || w.Header().Get("Location") != tc.expected {
+			t.Errorf("%s: got %d %s", tc.host, w.Code, w.Header().Get("Location"))
+		}
+	}
+}